@@ -0,0 +1,216 @@
+package patrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errIncidentResolved = errors.New("Incident is already resolved")
+
+// acknowledgement records that someone is handling an ongoing incident, so
+// that it is neither notified again nor escalated. Acknowledgements and
+// reminders are saved in the history file (see saveNotificationState).
+type acknowledgement struct {
+	IncidentID string
+	By         string
+	At         time.Time
+}
+
+// reminderState tracks the notifications that were sent for the ongoing
+// incident of a check.
+type reminderState struct {
+	IncidentID string
+	NotifiedAt time.Time
+	Escalated  bool
+}
+
+// Interval at which incidents are checked for reminders, which is replaced
+// by tests
+var reminderInterval = 30 * time.Second
+
+// ongoingIncident returns the incident of a check that is not resolved yet.
+func (p *Patrol) ongoingIncident(group, name string) (incident, bool) {
+	incidents := incidentsFromTransitions(p.History.GetTransitions(group, name))
+	if len(incidents) == 0 || !incidents[len(incidents)-1].Ongoing() {
+		return incident{}, false
+	}
+	return incidents[len(incidents)-1], true
+}
+
+// acknowledge marks the ongoing incident of a check as handled by a user.
+func (p *Patrol) acknowledge(group, name, incidentID, user string) (incident, error) {
+	i, ok := p.ongoingIncident(group, name)
+	if !ok || (incidentID != "" && incidentID != i.ID) {
+		if _, err := p.getIncident(group, name, incidentID, true); err != nil {
+			return incident{}, err
+		}
+		return incident{}, fmt.Errorf("%w: %s/%s at %s", errIncidentResolved, group, name, incidentID)
+	}
+
+	p.ackMux.Lock()
+	if _, ok := p.acks[group]; !ok {
+		p.acks[group] = make(map[string]acknowledgement)
+	}
+	ack := acknowledgement{IncidentID: i.ID, By: user, At: time.Now()}
+	p.acks[group][name] = ack
+	p.ackMux.Unlock()
+	p.saveNotificationState(group, name)
+
+	i.Acknowledged = true
+	i.AcknowledgedBy = ack.By
+	i.AcknowledgedAt = ack.At
+	p.logger.Infof("%s acknowledged the incident of %s/%s", user, group, name)
+	return i, nil
+}
+
+// acknowledged returns the acknowledgement of an incident, if any.
+func (p *Patrol) acknowledged(group, name, incidentID string) (acknowledgement, bool) {
+	p.ackMux.Lock()
+	defer p.ackMux.Unlock()
+	ack, ok := p.acks[group][name]
+	return ack, ok && ack.IncidentID == incidentID
+}
+
+// failureNotified records that a failure of a check was notified, which
+// delays its next reminder.
+func (p *Patrol) failureNotified(group, name string) {
+	i, ok := p.ongoingIncident(group, name)
+	if !ok {
+		return
+	}
+	p.ackMux.Lock()
+	if _, ok := p.reminders[group]; !ok {
+		p.reminders[group] = make(map[string]*reminderState)
+	}
+	if state := p.reminders[group][name]; state != nil && state.IncidentID == i.ID {
+		state.NotifiedAt = time.Now()
+	} else {
+		p.reminders[group][name] = &reminderState{IncidentID: i.ID, NotifiedAt: time.Now()}
+	}
+	p.ackMux.Unlock()
+	p.saveNotificationState(group, name)
+}
+
+// sendReminders notifies failures again once they have not been notified
+// for the renotify interval, and escalates them once they have lasted for
+// the escalation delay. Acknowledged, paused, flapping and silenced
+// checks are skipped.
+func (p *Patrol) sendReminders() {
+	now := time.Now()
+	for _, c := range p.checkers {
+		i, ok := p.ongoingIncident(c.Group, c.Name)
+		if !ok || c.IsPaused() || p.IsFlapping(c.Group, c.Name) {
+			p.ackMux.Lock()
+			_, hadReminder := p.reminders[c.Group][c.Name]
+			delete(p.reminders[c.Group], c.Name)
+			p.ackMux.Unlock()
+			if hadReminder {
+				p.saveNotificationState(c.Group, c.Name)
+			}
+			continue
+		}
+		if _, ok := p.acknowledged(c.Group, c.Name, i.ID); ok {
+			continue
+		}
+		if _, ok := p.silenced(c.Group, c.Name); ok {
+			continue
+		}
+
+		p.ackMux.Lock()
+		if _, ok := p.reminders[c.Group]; !ok {
+			p.reminders[c.Group] = make(map[string]*reminderState)
+		}
+		state := p.reminders[c.Group][c.Name]
+		changed := state == nil || state.IncidentID != i.ID
+		if changed {
+			state = &reminderState{IncidentID: i.ID, NotifiedAt: i.StartedAt}
+			p.reminders[c.Group][c.Name] = state
+		}
+		escalate := p.escalateAfter > 0 && !state.Escalated && now.Sub(i.StartedAt) >= p.escalateAfter
+		if escalate {
+			state.Escalated = true
+		}
+		renotify := p.renotify > 0 && now.Sub(state.NotifiedAt) >= p.renotify
+		if renotify {
+			state.NotifiedAt = now
+		}
+		p.ackMux.Unlock()
+		if changed || escalate || renotify {
+			p.saveNotificationState(c.Group, c.Name)
+		}
+
+		if escalate {
+			p.remind("escalated", c.Group, c.Name)
+		}
+		if renotify {
+			p.remind("unhealthy", c.Group, c.Name)
+		}
+	}
+}
+
+// remind runs the handlers of an event of a check that is still failing.
+// Unlike notify, failures are never held for grouping.
+func (p *Patrol) remind(status, group, name string) {
+	p.logger.Infof("Sending %s reminder for %s/%s", status, group, name)
+	event := p.newEvent(status, group, name)
+	for _, n := range p.handlersFor(status, group, name) {
+		p.deliver(n, event)
+	}
+}
+
+func (p *Patrol) scheduleReminders() {
+	for {
+		select {
+		case <-time.After(reminderInterval):
+			p.sendReminders()
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// serveAcknowledge acknowledges the ongoing incident of a check, on behalf
+// of the user that sent the request.
+func (p *Patrol) serveAcknowledge(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	// Only authenticated requests reach this handler
+	user, _, _ := req.BasicAuth()
+	i, err := p.acknowledge(req.FormValue("group"), req.FormValue("check"), req.FormValue("incident"), user)
+	if errors.Is(err, errIncidentResolved) {
+		writeJSONError(res, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeJSONError(res, http.StatusNotFound, err)
+		return
+	}
+
+	if !redirectBack(res, req) {
+		writeJSON(res, http.StatusOK, i)
+	}
+}
+
+// serveAckPage asks for confirmation before acknowledging an incident, so
+// that links in notifications can be opened safely (i.e. by previews of
+// chat apps).
+func (p *Patrol) serveAckPage(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	i, err := p.getIncident(query.Get("group"), query.Get("check"), query.Get("incident"), true)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	p.executePage(res, "ack", struct {
+		Name     string
+		Incident incident
+	}{
+		Name:     p.name,
+		Incident: i,
+	})
+}
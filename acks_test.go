@@ -0,0 +1,328 @@
+package patrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestAcknowledge(t *testing.T) {
+	os.Remove("acks-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "acks-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var bodiesMux sync.Mutex
+	var bodies []string
+	var numEscalations int32
+	failureServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodiesMux.Lock()
+		bodies = append(bodies, string(body))
+		bodiesMux.Unlock()
+	}))
+	defer failureServer.Close()
+	escalationServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&numEscalations, 1)
+	}))
+	defer escalationServer.Close()
+	failureURL, _ := url.Parse(failureServer.URL)
+	escalationURL, _ := url.Parse(escalationServer.URL)
+
+	p, err := New(CreatePatrolOptions{
+		URL: "https://status.example.com",
+		Admin: &PatrolAdminOptions{
+			Username:   "admin",
+			Password:   "secret",
+			Responders: map[string]string{"alice": "hunter2"},
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+		Renotify:      50 * time.Millisecond,
+		EscalateAfter: 50 * time.Millisecond,
+		GlobalEventHandlers: EventHandlers{
+			"unhealthy": {{
+				Webhook: &webhookNotification{Method: "POST", URL: failureURL, Body: "{{ack.link}}"},
+			}},
+			"escalated": {{
+				Webhook: &webhookNotification{Method: "GET", URL: escalationURL},
+			}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	if _, err := historyFile.Append(history.Item{Group: "foo", Name: "bar", Type: "boolean", Status: "unhealthy"}); err != nil {
+		t.Error(err)
+		return
+	}
+	p.OnCheckerStatus("unhealthy", "foo", "bar")
+	incident, ok := p.ongoingIncident("foo", "bar")
+	if !ok {
+		t.Error(fmt.Errorf("Expected an ongoing incident"))
+		return
+	}
+
+	// Unacknowledged failures are notified again and escalated once
+	<-time.After(60 * time.Millisecond)
+	p.sendReminders()
+	p.sendReminders()
+	<-time.After(100 * time.Millisecond)
+	bodiesMux.Lock()
+	ackLink := "https://status.example.com/ack?" + url.Values{"group": {"foo"}, "check": {"bar"}, "incident": {incident.ID}}.Encode()
+	if len(bodies) != 2 || bodies[0] != ackLink {
+		t.Error(fmt.Errorf("Expected 2 failure notifications with ack links, got %q", bodies))
+		bodiesMux.Unlock()
+		return
+	}
+	bodiesMux.Unlock()
+	if n := atomic.LoadInt32(&numEscalations); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 escalation, got %d", n))
+		return
+	}
+
+	// The ack link asks responders for confirmation
+	res, err := http.Get(server.URL + strings.TrimPrefix(ackLink, "https://status.example.com"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Error(fmt.Errorf("Expected ack page to require a responder, got %d", res.StatusCode))
+		return
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+strings.TrimPrefix(ackLink, "https://status.example.com"), nil)
+	req.SetBasicAuth("alice", "hunter2")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	page, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(page), `action="/api/v1/incidents/ack"`) {
+		t.Error(fmt.Errorf("Wrong ack page (status %d): %s", res.StatusCode, page))
+		return
+	}
+
+	acknowledge := func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", server.URL+"/api/v1/incidents/ack", strings.NewReader(url.Values{
+			"group":    {"foo"},
+			"check":    {"bar"},
+			"incident": {incident.ID},
+		}.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("alice", "hunter2")
+		return http.DefaultClient.Do(req)
+	}
+	res, err = acknowledge()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var acked struct {
+		AcknowledgedBy string
+	}
+	json.NewDecoder(res.Body).Decode(&acked)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || acked.AcknowledgedBy != "alice" {
+		t.Error(fmt.Errorf("Failed to acknowledge incident (status %d): %#v", res.StatusCode, acked))
+		return
+	}
+
+	// Acknowledged failures are not notified again, but are still failing
+	<-time.After(60 * time.Millisecond)
+	p.sendReminders()
+	<-time.After(100 * time.Millisecond)
+	bodiesMux.Lock()
+	if len(bodies) != 2 {
+		t.Error(fmt.Errorf("Expected no reminders after acknowledging, got %q", bodies))
+		bodiesMux.Unlock()
+		return
+	}
+	bodiesMux.Unlock()
+	if incidents := p.getIncidents(true); len(incidents) != 1 || !incidents[0].Ongoing() || incidents[0].AcknowledgedBy != "alice" {
+		t.Error(fmt.Errorf("Wrong incidents: %#v", incidents))
+		return
+	}
+
+	// Who acknowledged an incident is only shown along with private data
+	if incidents := p.getIncidents(false); len(incidents) != 1 || !incidents[0].Acknowledged || incidents[0].AcknowledgedBy != "" {
+		t.Error(fmt.Errorf("Expected acknowledger to be hidden from public incidents: %#v", incidents))
+		return
+	}
+	for _, path := range []string{"/", "/api/v1/incidents", "/incident?group=foo&check=bar&incident=" + url.QueryEscape(incident.ID)} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		page, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || strings.Contains(string(page), "alice") || !strings.Contains(string(page), "cknowledged") {
+			t.Error(fmt.Errorf("Expected %s to show the acknowledgement without its responder (status %d): %s", path, res.StatusCode, page))
+			return
+		}
+	}
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.SetBasicAuth("alice", "hunter2")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	page, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(page), "Acknowledged by alice") {
+		t.Error(fmt.Errorf("Expected responders to see who acknowledged the incident: %s", page))
+		return
+	}
+
+	// Resolved incidents cannot be acknowledged
+	if _, err := historyFile.Append(history.Item{Group: "foo", Name: "bar", Type: "boolean", Status: "healthy"}); err != nil {
+		t.Error(err)
+		return
+	}
+	res, err = acknowledge()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Error(fmt.Errorf("Expected resolved incident to be rejected, got %d", res.StatusCode))
+		return
+	}
+}
+
+func TestNotificationStateRestart(t *testing.T) {
+	os.Remove("acks-restart-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "acks-restart-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var numEscalations int32
+	escalationServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&numEscalations, 1)
+	}))
+	defer escalationServer.Close()
+	escalationURL, _ := url.Parse(escalationServer.URL)
+
+	newPatrol := func(historyFile *history.File) (*Patrol, error) {
+		return New(CreatePatrolOptions{
+			Checkers: []*checker.Checker{
+				checker.New(&checker.Checker{Group: "foo", Name: "acked", Cmd: "true", History: historyFile, Interval: time.Minute}),
+				checker.New(&checker.Checker{Group: "foo", Name: "escalated", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			},
+			EscalateAfter: 50 * time.Millisecond,
+			GlobalEventHandlers: EventHandlers{
+				"escalated": {{
+					Webhook: &webhookNotification{Method: "GET", URL: escalationURL},
+				}},
+			},
+		}, historyFile)
+	}
+	p, err := newPatrol(historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"acked", "escalated"} {
+		if _, err := historyFile.Append(history.Item{Group: "foo", Name: name, Type: "boolean", Status: "unhealthy"}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if _, err := p.acknowledge("foo", "acked", "", "alice"); err != nil {
+		t.Error(err)
+		return
+	}
+	<-time.After(60 * time.Millisecond)
+	p.sendReminders()
+	p.setIssueState("foo", "escalated", &issueState{Issue: issueRef{ID: "7"}, Unhealthy: true})
+	p.flapMux.Lock()
+	p.flappingChecks["foo"] = map[string]bool{"acked": true}
+	p.flapMux.Unlock()
+	p.saveNotificationState("foo", "acked")
+	<-time.After(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&numEscalations); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 escalation before restarting, got %d", n))
+		return
+	}
+
+	// After a restart, the acknowledgement, escalation, flapping state and
+	// issue are remembered
+	historyFile.Close(context.Background())
+	historyFile, err = history.New(history.NewOptions{
+		File: "acks-restart-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+	p, err = newPatrol(historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	incident, _ := p.ongoingIncident("foo", "acked")
+	if ack, ok := p.acknowledged("foo", "acked", incident.ID); !ok || ack.By != "alice" {
+		t.Error(fmt.Errorf("Expected acknowledgement to be restored, got: %#v", ack))
+		return
+	}
+	if !p.IsFlapping("foo", "acked") {
+		t.Error(fmt.Errorf("Expected flapping state to be restored"))
+		return
+	}
+	if state := p.issues["foo"]["escalated"]; state == nil || state.Issue.ID != "7" || !state.Unhealthy {
+		t.Error(fmt.Errorf("Expected issue to be restored, got: %#v", state))
+		return
+	}
+	p.sendReminders()
+	<-time.After(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&numEscalations); n != 1 {
+		t.Error(fmt.Errorf("Expected no escalations after restarting, got %d", n-1))
+		return
+	}
+}
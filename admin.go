@@ -0,0 +1,146 @@
+package patrol
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+type adminStatus struct {
+	Checkers []checker.State
+	History  history.WriteStats
+
+	// Recent deliveries by notifier, and the deliveries that are being
+	// retried or have failed
+	Notifiers        []notifierStatus
+	DeliveryFailures []deliveryFailure
+
+	// Version of patrol, and the latest release if it is newer
+	Version string
+	Update  *Release `json:",omitempty"`
+}
+
+func (p *Patrol) getAdminStatus() adminStatus {
+	status := adminStatus{
+		Checkers: make([]checker.State, len(p.checkers)),
+		History:  p.History.Stats(),
+		Version:  Version,
+		Update:   p.getUpdate(),
+	}
+	for i, checker := range p.checkers {
+		status.Checkers[i] = checker.GetState()
+	}
+	status.Notifiers, status.DeliveryFailures = p.getDeliveryStatus()
+	sort.Slice(status.Checkers, func(i, j int) bool {
+		a, b := status.Checkers[i], status.Checkers[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Name < b.Name
+	})
+	return status
+}
+
+// serveAdminStatus lists the scheduling state of all checkers, along with
+// the state of the history file's writer.
+func (p *Patrol) serveAdminStatus(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, p.getAdminStatus())
+}
+
+type latencyBucket struct {
+	// Upper bound of the bucket, or zero for the last bucket
+	Le    time.Duration
+	Count int
+}
+
+type checkerStats struct {
+	Group    string
+	Name     string
+	Runs     int
+	Attempts int
+	Failures int
+	Skipped  int
+}
+
+type adminStats struct {
+	Goroutines int
+	HeapAlloc  uint64
+	NumGC      uint32
+
+	HistoryQueue   int
+	HistoryLatency []latencyBucket
+	Checkers       []checkerStats
+}
+
+// serveAdminStats reports internal metrics of the patrol process that are
+// useful when diagnosing performance problems.
+func (p *Patrol) serveAdminStats(res http.ResponseWriter, req *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	status := p.getAdminStatus()
+	stats := adminStats{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      mem.HeapAlloc,
+		NumGC:          mem.NumGC,
+		HistoryQueue:   status.History.Pending,
+		HistoryLatency: make([]latencyBucket, len(status.History.Latency)),
+		Checkers:       make([]checkerStats, len(status.Checkers)),
+	}
+	for i, count := range status.History.Latency {
+		stats.HistoryLatency[i].Count = count
+		if i < len(history.LatencyBuckets) {
+			stats.HistoryLatency[i].Le = history.LatencyBuckets[i]
+		}
+	}
+	for i, state := range status.Checkers {
+		stats.Checkers[i] = checkerStats{
+			Group:    state.Group,
+			Name:     state.Name,
+			Runs:     state.Runs,
+			Attempts: state.Attempts,
+			Failures: state.Failures,
+			Skipped:  state.Skipped,
+		}
+	}
+	writeJSON(res, http.StatusOK, stats)
+}
+
+// reportLink is a month that a report can be downloaded for.
+type reportLink struct {
+	Label string
+	From  string
+	To    string
+}
+
+func (p *Patrol) serveAdminPage(res http.ResponseWriter, req *http.Request) {
+	status := p.getAdminStatus()
+
+	// The current month, and the three months before it
+	var reports []reportLink
+	month := monthStart(time.Now())
+	for i := 0; i < 4; i++ {
+		reports = append(reports, reportLink{
+			Label: month.Format("January 2006"),
+			From:  month.Format("2006-01-02"),
+			To:    month.AddDate(0, 1, 0).Format("2006-01-02"),
+		})
+		month = month.AddDate(0, -1, 0)
+	}
+
+	data := struct {
+		Name    string
+		Reports []reportLink
+		adminStatus
+	}{
+		Name:        p.name,
+		Reports:     reports,
+		adminStatus: status,
+	}
+
+	p.executePage(res, "admin", data)
+}
@@ -0,0 +1,289 @@
+package patrol
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strings"
+
+	"github.com/NYTimes/gziphandler"
+)
+
+func (p *Patrol) newHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Streams cannot be compressed, since the gzip handler buffers
+	// writes until it has enough data to decide on an encoding
+	mux.HandleFunc("/api/v1/stream", p.serveStream)
+
+	mux.HandleFunc("/healthz", p.serveHealthz)
+	mux.HandleFunc("/healthz/", p.serveHealthz)
+
+	mux.Handle("/api/v1/status", gziphandler.GzipHandler(http.HandlerFunc(p.serveStatus)))
+	mux.Handle("/api/v1/transitions", gziphandler.GzipHandler(http.HandlerFunc(p.serveTransitions)))
+	mux.Handle("/api/v1/search", gziphandler.GzipHandler(http.HandlerFunc(p.serveSearch)))
+	mux.Handle("/api/v1/metrics/", gziphandler.GzipHandler(http.HandlerFunc(p.serveMetrics)))
+	mux.Handle("/api/v1/checks/results", gziphandler.GzipHandler(http.HandlerFunc(p.serveCheckResults)))
+	mux.Handle("/api/v1/environments/compare", gziphandler.GzipHandler(http.HandlerFunc(p.serveEnvironmentComparison)))
+	mux.Handle("/api/grafana", gziphandler.GzipHandler(http.HandlerFunc(p.serveGrafana)))
+	mux.Handle("/api/grafana/", gziphandler.GzipHandler(http.HandlerFunc(p.serveGrafana)))
+
+	mux.Handle("/api/v1/results", p.requireAdmin(http.HandlerFunc(p.serveResults)))
+	mux.Handle("/api/v1/checks/pause", p.requireAdmin(p.serveSetPaused(true)))
+	mux.Handle("/api/v1/checks/resume", p.requireAdmin(p.serveSetPaused(false)))
+	mux.Handle("/api/v1/checks/append", p.requireAdmin(http.HandlerFunc(p.serveAppend)))
+	mux.Handle("/api/v1/silences", p.requireAdmin(http.HandlerFunc(p.serveSilences)))
+	mux.Handle("/api/v1/admin/status", p.requireAdmin(gziphandler.GzipHandler(http.HandlerFunc(p.serveAdminStatus))))
+	mux.Handle("/api/v1/report", gziphandler.GzipHandler(http.HandlerFunc(p.serveReport)))
+	mux.Handle("/api/v1/incidents", gziphandler.GzipHandler(http.HandlerFunc(p.serveIncidents)))
+	mux.Handle("/api/v1/postmortems", p.requireAdmin(http.HandlerFunc(p.serveSetPostmortem)))
+	mux.Handle("/api/v1/comments", p.requireResponder(http.HandlerFunc(p.serveAddComment)))
+	mux.Handle("/api/v1/incidents/ack", p.requireResponder(http.HandlerFunc(p.serveAcknowledge)))
+	mux.Handle("/incidents.rss", gziphandler.GzipHandler(http.HandlerFunc(p.serveIncidentsFeed)))
+	mux.Handle("/check", gziphandler.GzipHandler(http.HandlerFunc(p.serveCheckPage)))
+	mux.Handle("/incidents", gziphandler.GzipHandler(http.HandlerFunc(p.serveIncidentsPage)))
+	mux.Handle("/calendar", gziphandler.GzipHandler(http.HandlerFunc(p.serveCalendarPage)))
+	mux.Handle("/incident", gziphandler.GzipHandler(http.HandlerFunc(p.serveIncidentPage)))
+	mux.Handle("/ack", p.requireResponder(gziphandler.GzipHandler(http.HandlerFunc(p.serveAckPage))))
+	mux.Handle("/admin", p.requireAdmin(gziphandler.GzipHandler(http.HandlerFunc(p.serveAdminPage))))
+	mux.Handle("/api/v1/admin/notifiers/test", p.requireAdmin(http.HandlerFunc(p.serveTestNotifiers)))
+	mux.Handle("/api/v1/admin/stats", p.requireAdmin(gziphandler.GzipHandler(http.HandlerFunc(p.serveAdminStats))))
+	if p.admin != nil && p.admin.Pprof {
+		mux.Handle("/debug/pprof/", p.requireAdmin(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", p.requireAdmin(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", p.requireAdmin(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", p.requireAdmin(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", p.requireAdmin(http.HandlerFunc(pprof.Trace)))
+	}
+
+	mux.Handle("/", gziphandler.GzipHandler(p))
+	return mux
+}
+
+// serveStream tails history items as they are written. Items are sent
+// as server-sent events if the client accepts 'text/event-stream' and
+// as newline-delimited JSON otherwise.
+func (p *Patrol) serveStream(res http.ResponseWriter, req *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	items, unsubscribe := p.History.Subscribe(req.URL.Query().Get("group"))
+	defer unsubscribe()
+	showPrivate := p.showPrivate(req)
+
+	useSSE := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	if useSSE {
+		res.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		res.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case item := <-items:
+			if !showPrivate && p.isPrivate(item.Group, item.Name) {
+				continue
+			}
+			data, err := json.Marshal(item)
+			if err != nil {
+				p.logger.Warnf("Failed to encode item for stream: %s", err)
+				continue
+			}
+
+			if useSSE {
+				_, err = res.Write([]byte("data: " + string(data) + "\n\n"))
+			} else {
+				_, err = res.Write(append(data, '\n'))
+			}
+			if err != nil {
+				p.logger.Debugf("Closing stream: %s", err)
+				return
+			}
+			flusher.Flush()
+
+		case <-req.Context().Done():
+			return
+
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(value)
+}
+
+func writeJSONError(res http.ResponseWriter, status int, err error) {
+	writeJSON(res, status, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// serveTransitions lists the status transitions of a single check, with
+// the most recent transition first.
+func (p *Patrol) serveTransitions(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	group, check := query.Get("group"), query.Get("check")
+	if group == "" || check == "" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Both 'group' and 'check' must be specified"))
+		return
+	}
+	if p.isPrivate(group, check) && !p.showPrivate(req) {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s/%s", errCheckerNotFound, group, check))
+		return
+	}
+
+	writeJSON(res, http.StatusOK, p.History.GetTransitions(group, check))
+}
+
+// requireAdmin only allows requests that carry the admin credentials. If
+// no admin credentials are configured, all requests are rejected.
+func (p *Patrol) requireAdmin(handler http.Handler) http.Handler {
+	return p.requireUser(false, handler)
+}
+
+// requireResponder allows requests that carry the credentials of the admin
+// or of one of the responders.
+func (p *Patrol) requireResponder(handler http.Handler) http.Handler {
+	return p.requireUser(true, handler)
+}
+
+func (p *Patrol) requireUser(allowResponders bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if p.admin == nil {
+			writeJSONError(res, http.StatusForbidden, fmt.Errorf("Admin access is not configured"))
+			return
+		}
+
+		if !p.isUser(req, allowResponders) {
+			res.Header().Set("WWW-Authenticate", `Basic realm="patrol", charset="UTF-8"`)
+			writeJSONError(res, http.StatusUnauthorized, fmt.Errorf("Invalid admin credentials"))
+			return
+		}
+
+		// Browsers send basic auth credentials along with requests from
+		// any site, so requests that change something must come from the
+		// status page itself
+		if !isSafeMethod(req.Method) && p.isCrossSite(req) {
+			writeJSONError(res, http.StatusForbidden, fmt.Errorf("Cross-site requests are not allowed"))
+			return
+		}
+
+		handler.ServeHTTP(res, req)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// isCrossSite returns whether a request was sent by a browser from another
+// site, i.e. by a form on another page. Requests must come from the host
+// that they were sent to, or from the public url of the status page.
+// Clients that are not browsers send neither header, and are allowed.
+func (p *Patrol) isCrossSite(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return true
+	}
+	if u.Host == req.Host {
+		return false
+	}
+	public, err := url.Parse(p.url)
+	return err != nil || u.Host != public.Host
+}
+
+// isUser returns whether a request carries the credentials of the admin,
+// or of one of the responders if they are allowed.
+func (p *Patrol) isUser(req *http.Request, allowResponders bool) bool {
+	if p.admin == nil {
+		return false
+	}
+	username, password, ok := req.BasicAuth()
+	return ok && (validCredentials(username, password, p.admin.Username, p.admin.Password) ||
+		(allowResponders && validCredentials(username, password, username, p.admin.Responders[username])))
+}
+
+// showPrivate returns whether private checks should be included in the
+// response to a request, which is only the case for the admin and
+// responders.
+func (p *Patrol) showPrivate(req *http.Request) bool {
+	return p.isUser(req, true)
+}
+
+// isPrivate returns whether a check is hidden from public pages.
+func (p *Patrol) isPrivate(group, name string) bool {
+	c := p.getChecker(group, name)
+	return c != nil && c.Private
+}
+
+// validCredentials compares credentials in constant time. Empty passwords
+// are never accepted, since they belong to users that do not exist.
+func validCredentials(username, password, expectedUsername, expectedPassword string) bool {
+	return expectedPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+}
+
+// redirectBack sends requests made by forms on the status page back to
+// the given page. It returns false if the request did not ask for a
+// redirect, so that an API response should be sent instead. Only paths
+// on the same host are followed, and backslashes are refused since
+// browsers treat them as slashes.
+func redirectBack(res http.ResponseWriter, req *http.Request) bool {
+	target := req.FormValue("redirect")
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return false
+	}
+	if u, err := url.Parse(target); err != nil || u.Scheme != "" || u.Host != "" {
+		return false
+	}
+	http.Redirect(res, req, target, http.StatusSeeOther)
+	return true
+}
+
+func (p *Patrol) serveSetPaused(paused bool) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+			return
+		}
+
+		group, check := req.FormValue("group"), req.FormValue("check")
+		if err := p.SetCheckerPaused(group, check, paused); errors.Is(err, errCheckerNotFound) {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeJSONError(res, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !redirectBack(res, req) {
+			writeJSON(res, http.StatusOK, map[string]interface{}{
+				"group":  group,
+				"check":  check,
+				"paused": paused,
+			})
+		}
+	})
+}
@@ -0,0 +1,1559 @@
+package patrol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestStream(t *testing.T) {
+	os.Remove("api-stream-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-stream-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/stream?group=foo")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	go func() {
+		<-time.After(100 * time.Millisecond)
+		for _, group := range []string{"bar", "foo"} {
+			historyFile.Append(history.Item{
+				Group: group,
+				Name:  "baz",
+				Type:  "boolean",
+			})
+		}
+	}()
+
+	line, err := bufio.NewReader(res.Body).ReadBytes('\n')
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var item history.Item
+	if err := json.Unmarshal(line, &item); err != nil {
+		t.Error(err)
+		return
+	}
+	if item.Group != "foo" || item.Name != "baz" {
+		t.Error(fmt.Errorf("Wrong item received from stream: %s", item))
+		return
+	}
+}
+
+func TestTransitionsAPI(t *testing.T) {
+	os.Remove("api-transitions-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-transitions-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, status := range []string{"healthy", "unhealthy"} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   "bar",
+			Type:   "metric",
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/transitions?group=foo&check=bar")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var transitions []history.Transition
+	if err := json.NewDecoder(res.Body).Decode(&transitions); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(transitions) != 2 || transitions[0].To != "unhealthy" {
+		t.Error(fmt.Errorf("Wrong transitions returned: %#v", transitions))
+		return
+	}
+}
+
+func TestPauseAPI(t *testing.T) {
+	os.Remove("api-pause-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-pause-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	form := url.Values{"group": {"foo"}, "check": {"bar"}}
+	if res, err := http.PostForm(server.URL+"/api/v1/checks/pause", form); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != http.StatusUnauthorized {
+		t.Error(fmt.Errorf("Expected unauthenticated pause to be rejected, got status %d", res.StatusCode))
+		return
+	}
+
+	if res, err := adminRequest("POST", server.URL+"/api/v1/checks/pause", form); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != http.StatusOK {
+		t.Error(fmt.Errorf("Failed to pause checker, got status %d", res.StatusCode))
+		return
+	}
+
+	if !p.getChecker("foo", "bar").IsPaused() {
+		t.Error(fmt.Errorf("Checker was not paused"))
+		return
+	}
+	if !historyFile.GetCheckState("foo", "bar").Paused {
+		t.Error(fmt.Errorf("Paused state was not persisted"))
+		return
+	}
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != 200 {
+		t.Error(fmt.Errorf("Status page returned non-200 status: %d", res.StatusCode))
+		return
+	}
+}
+
+func adminRequest(method, url string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	return http.DefaultClient.Do(req)
+}
+
+func TestAdminStatus(t *testing.T) {
+	os.Remove("api-admin-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-admin-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "slow",
+				Cmd:      "sleep 1",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p.checkers[0].Start(nil)
+	defer p.checkers[0].Close(context.Background())
+	<-time.After(100 * time.Millisecond)
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	res, err := adminRequest("GET", server.URL+"/api/v1/admin/status", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var status adminStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(status.Checkers) != 1 || !status.Checkers[0].Running || status.Checkers[0].Attempt != 1 {
+		t.Error(fmt.Errorf("Wrong checker state returned: %#v", status))
+		return
+	}
+
+	if res, err := adminRequest("GET", server.URL+"/admin", nil); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != 200 {
+		t.Error(fmt.Errorf("Admin page returned non-200 status: %d", res.StatusCode))
+		return
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	os.Remove("api-stats-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-stats-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	c := checker.New(&checker.Checker{
+		Group:    "foo",
+		Name:     "bar",
+		Cmd:      "true",
+		History:  historyFile,
+		Interval: 1 * time.Minute,
+	})
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+			Pprof:    true,
+		},
+		Checkers: []*checker.Checker{c},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.Start(nil)
+	defer c.Close(context.Background())
+	<-time.After(100 * time.Millisecond)
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	res, err := adminRequest("GET", server.URL+"/api/v1/admin/stats", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var stats adminStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Error(err)
+		return
+	}
+	if stats.Goroutines == 0 || len(stats.Checkers) != 1 || stats.Checkers[0].Runs != 1 {
+		t.Error(fmt.Errorf("Wrong stats returned: %#v", stats))
+		return
+	}
+
+	batches := 0
+	for _, bucket := range stats.HistoryLatency {
+		batches += bucket.Count
+	}
+	if batches == 0 {
+		t.Error(fmt.Errorf("Write latency was not recorded: %#v", stats.HistoryLatency))
+		return
+	}
+
+	if res, err := http.Get(server.URL + "/debug/pprof/"); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != http.StatusUnauthorized {
+		t.Error(fmt.Errorf("Expected unauthenticated pprof request to be rejected, got status %d", res.StatusCode))
+		return
+	}
+	if res, err := adminRequest("GET", server.URL+"/debug/pprof/", nil); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != 200 {
+		t.Error(fmt.Errorf("pprof index returned non-200 status: %d", res.StatusCode))
+		return
+	}
+}
+
+func TestAppendAPI(t *testing.T) {
+	os.Remove("api-append-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-append-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "jobs",
+				Name:     "Nightly backup",
+				Type:     "boolean",
+				External: true,
+				History:  historyFile,
+				Interval: 24 * time.Hour,
+			}),
+			checker.New(&checker.Checker{
+				Group:    "jobs",
+				Name:     "Scheduled",
+				Type:     "boolean",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	upstream := PatrolUpstreamOptions{URL: server.URL, Username: "admin", Password: "secret"}
+	result := AppendedResult{
+		Group:       "jobs",
+		Check:       "Nightly backup",
+		Status:      "unhealthy",
+		Error:       "pg_dump failed",
+		Output:      "connection refused",
+		Annotations: map[string]string{"host": "db-1"},
+	}
+	if err := AppendResult(upstream, result); err != nil {
+		t.Error(err)
+		return
+	}
+	item, ok := historyFile.GetLatestItem("jobs", "Nightly backup")
+	if !ok || item.Status != "unhealthy" || item.Error != "pg_dump failed" || string(item.Output) != "connection refused" || item.Annotations["host"] != "db-1" {
+		t.Error(fmt.Errorf("Appended result was not recorded: %s", item))
+		return
+	}
+
+	for _, test := range []struct {
+		upstream PatrolUpstreamOptions
+		result   AppendedResult
+		status   string
+	}{
+		{PatrolUpstreamOptions{URL: server.URL, Username: "admin", Password: "wrong"}, result, "401"},
+		{upstream, AppendedResult{Group: "jobs", Check: "Missing", Status: "healthy"}, "404"},
+		{upstream, AppendedResult{Group: "jobs", Check: "Scheduled", Status: "healthy"}, "409"},
+		{upstream, AppendedResult{Group: "jobs", Check: "Nightly backup", Status: "ok"}, "400"},
+	} {
+		if err := AppendResult(test.upstream, test.result); err == nil || !strings.Contains(err.Error(), "status "+test.status) {
+			t.Error(fmt.Errorf("Expected appending %#v to fail with status %s, got: %v", test.result, test.status, err))
+			return
+		}
+	}
+}
+
+func TestRegionResults(t *testing.T) {
+	os.Remove("api-upstream-test.db")
+	os.Remove("api-agent-test.db")
+	upstreamHistory, err := history.New(history.NewOptions{
+		File: "api-upstream-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer upstreamHistory.Close(context.Background())
+	agentHistory, err := history.New(history.NewOptions{
+		File: "api-agent-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer agentHistory.Close(context.Background())
+
+	c := checker.New(&checker.Checker{
+		Group:    "foo",
+		Name:     "bar",
+		Cmd:      "true",
+		History:  upstreamHistory,
+		Interval: 1 * time.Minute,
+		Region:   "us",
+		Quorum:   1,
+	})
+	upstream, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{c},
+	}, upstreamHistory)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(upstream.server.Handler)
+	defer server.Close()
+
+	agent, err := New(CreatePatrolOptions{
+		Region:      "eu",
+		RegionLabel: "Frankfurt",
+		Upstream: &PatrolUpstreamOptions{
+			URL:      server.URL,
+			Username: "admin",
+			Password: "secret",
+		},
+	}, agentHistory)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go agent.forwardResults()
+	defer close(agent.shutdown)
+	<-time.After(50 * time.Millisecond)
+
+	if _, err := agentHistory.Append(history.Item{
+		Group:    "foo",
+		Name:     "bar",
+		Type:     "boolean",
+		Status:   "unhealthy",
+		Duration: 250 * time.Millisecond,
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var item history.Item
+	for i := 0; i < 20 && item.Regions["eu"] == ""; i++ {
+		<-time.After(50 * time.Millisecond)
+		item = c.Check()
+	}
+	if item.Status != "unhealthy" || item.Regions["eu"] != "unhealthy" || item.Regions["us"] != "healthy" {
+		t.Error(fmt.Errorf("Forwarded result was not used for consensus: %s (regions: %v)", item, item.Regions))
+		return
+	}
+	if item.Region != "us" || item.RegionLatency["eu"] != 250*time.Millisecond {
+		t.Error(fmt.Errorf("Result was not tagged with regions: %s (latency: %v)", item, item.RegionLatency))
+		return
+	}
+
+	// The check page compares regions by their labels
+	if _, err := upstreamHistory.Append(item); err != nil {
+		t.Error(err)
+		return
+	}
+	res, err := http.Get(server.URL + "/check?group=foo&check=bar")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(body), "Frankfurt") || !strings.Contains(string(body), "unhealthy (250ms)") {
+		t.Error(fmt.Errorf("Regions are missing from the check page: %s", body))
+		return
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	os.Remove("api-healthz-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-healthz-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, group := range []string{"API", "Web App"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    group,
+			Name:     "up",
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{Checkers: checkers}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for group, status := range map[string]string{"API": "healthy", "Web App": "unhealthy"} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  group,
+			Name:   "up",
+			Type:   "boolean",
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	for path, status := range map[string]int{
+		"/healthz/API":       http.StatusOK,
+		"/healthz/Web%20App": http.StatusServiceUnavailable,
+		"/healthz":           http.StatusServiceUnavailable,
+		"/healthz/Unknown":   http.StatusNotFound,
+	} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Error(fmt.Errorf("Expected %s to return %d, got %d", path, status, res.StatusCode))
+			return
+		}
+	}
+}
+
+func TestStatusAPI(t *testing.T) {
+	os.Remove("api-status-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-status-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, group := range []string{"API", "Web"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    group,
+			Name:     "up",
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+			Severity: checker.SeverityCritical,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{Checkers: checkers}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for group, status := range map[string]string{"API": "unhealthy", "Web": "healthy"} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  group,
+			Name:   "up",
+			Type:   "boolean",
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/status")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+
+	var status overallStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Error(err)
+		return
+	}
+	if status.Status != statusMajorOutage || status.Groups["API"] != statusMajorOutage || status.Groups["Web"] != statusOperational || status.NumChecksDown != 1 {
+		t.Error(fmt.Errorf("Wrong status returned: %#v", status))
+		return
+	}
+}
+
+func TestPostmortemAPI(t *testing.T) {
+	os.Remove("api-postmortem-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-postmortem-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	for _, status := range []string{"healthy", "unhealthy", "healthy", "unhealthy"} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   "bar",
+			Type:   "boolean",
+			Dedupe: history.DedupeEveryRun,
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	res, err := http.Get(server.URL + "/api/v1/incidents")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var incidents []incident
+	err = json.NewDecoder(res.Body).Decode(&incidents)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(incidents) != 2 || !incidents[0].Ongoing() || incidents[1].Ongoing() {
+		t.Error(fmt.Errorf("Wrong incidents returned: %#v", incidents))
+		return
+	}
+
+	if res, err := adminRequest("POST", server.URL+"/api/v1/postmortems", url.Values{
+		"group":    {"foo"},
+		"check":    {"bar"},
+		"incident": {"2006-01-02T15:04:05Z"},
+		"markdown": {"# Nothing happened"},
+	}); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != 404 {
+		t.Error(fmt.Errorf("Expected unknown incident to return 404, got %d", res.StatusCode))
+		return
+	}
+
+	if res, err := adminRequest("POST", server.URL+"/api/v1/postmortems", url.Values{
+		"group":    {"foo"},
+		"check":    {"bar"},
+		"incident": {incidents[1].ID},
+		"markdown": {"# Root cause\n\nThe `bar` service ran out of <memory>."},
+	}); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != 200 {
+		t.Error(fmt.Errorf("Setting postmortem returned non-200 status: %d", res.StatusCode))
+		return
+	}
+
+	res, err = http.Get(server.URL + "/incident?" + url.Values{
+		"group":    {"foo"},
+		"check":    {"bar"},
+		"incident": {incidents[1].ID},
+	}.Encode())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(body), "Root cause</h2>") || !strings.Contains(string(body), "out of &lt;memory&gt;") {
+		t.Error(fmt.Errorf("Postmortem was not rendered on the incident page: %s", body))
+		return
+	}
+}
+
+func TestCommentsAPI(t *testing.T) {
+	os.Remove("api-comments-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-comments-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var numComments int32
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&numComments, 1)
+	}))
+	defer webhookServer.Close()
+	webhookURL, _ := url.Parse(webhookServer.URL)
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+			Responders: map[string]string{
+				"alice": "hunter2",
+			},
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+		GlobalEventHandlers: EventHandlers{
+			"comment": {{
+				Webhook: &webhookNotification{Method: "GET", URL: webhookURL},
+			}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	if _, err := historyFile.Append(history.Item{
+		Group:  "foo",
+		Name:   "bar",
+		Type:   "boolean",
+		Status: "unhealthy",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	incidents := p.getIncidents(true)
+	if len(incidents) != 1 {
+		t.Error(fmt.Errorf("Expected 1 incident, got %d", len(incidents)))
+		return
+	}
+
+	responderRequest := func(path, password string) (*http.Response, error) {
+		req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(url.Values{
+			"group":    {"foo"},
+			"check":    {"bar"},
+			"incident": {incidents[0].ID},
+			"body":     {"Investigating"},
+		}.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("alice", password)
+		return http.DefaultClient.Do(req)
+	}
+
+	for _, test := range []struct {
+		path     string
+		password string
+		status   int
+	}{
+		{"/api/v1/comments", "wrong", 401},
+		{"/api/v1/postmortems", "hunter2", 401},
+		{"/api/v1/comments", "hunter2", 200},
+	} {
+		res, err := responderRequest(test.path, test.password)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Error(fmt.Errorf("Expected %s to return %d, got %d", test.path, test.status, res.StatusCode))
+			return
+		}
+	}
+
+	comments := historyFile.GetComments("foo", "bar", incidents[0].StartedAt)
+	if len(comments) != 1 || comments[0].Author != "alice" || comments[0].Body != "Investigating" {
+		t.Error(fmt.Errorf("Wrong comments stored: %#v", comments))
+		return
+	}
+	<-time.After(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&numComments); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 comment notification, got %d", n))
+		return
+	}
+
+	res, err := http.Get(server.URL + "/incidents.rss")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	var feed rssFeed
+	if err := xml.NewDecoder(res.Body).Decode(&feed); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(feed.Channel.Items) != 2 || feed.Channel.Items[0].Description != "alice: Investigating" {
+		t.Error(fmt.Errorf("Wrong feed items returned: %#v", feed.Channel.Items))
+		return
+	}
+}
+
+func TestPrivateChecks(t *testing.T) {
+	os.Remove("api-private-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-private-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, name := range []string{"Homepage", "Disk diagnostics"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "Web",
+			Name:     name,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+			Private:  name == "Disk diagnostics",
+		}))
+	}
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: checkers,
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for name, status := range map[string]string{"Homepage": "healthy", "Disk diagnostics": "unhealthy"} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "Web",
+			Name:   name,
+			Type:   "boolean",
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	get := func(path string, asAdmin bool) (int, string, error) {
+		var res *http.Response
+		var err error
+		if asAdmin {
+			res, err = adminRequest("GET", server.URL+path, nil)
+		} else {
+			res, err = http.Get(server.URL + path)
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body), err
+	}
+
+	for _, test := range []struct {
+		path    string
+		asAdmin bool
+		status  int
+		private bool
+	}{
+		{"/", false, http.StatusOK, false},
+		{"/", true, http.StatusOK, true},
+		{"/api/v1/status", false, http.StatusOK, false},
+		{"/api/v1/status", true, http.StatusOK, true},
+		{"/healthz/Web", false, http.StatusOK, false},
+		{"/healthz/Web", true, http.StatusServiceUnavailable, true},
+		{"/check?group=Web&check=Disk+diagnostics", false, http.StatusNotFound, false},
+		{"/check?group=Web&check=Disk+diagnostics", true, http.StatusOK, true},
+		{"/api/v1/transitions?group=Web&check=Disk+diagnostics", false, http.StatusNotFound, false},
+		{"/api/v1/incidents", false, http.StatusOK, false},
+		{"/api/v1/incidents", true, http.StatusOK, true},
+		{"/api/v1/report", false, http.StatusOK, false},
+		{"/api/v1/report", true, http.StatusOK, true},
+		{"/admin", true, http.StatusOK, true},
+	} {
+		status, body, err := get(test.path, test.asAdmin)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != test.status {
+			t.Error(fmt.Errorf("Expected %s to return %d (as admin: %t), got %d", test.path, test.status, test.asAdmin, status))
+			return
+		}
+		// Error messages repeat the requested check, and the status API does
+		// not list checks
+		if status == http.StatusOK && test.path != "/api/v1/status" && strings.Contains(body, "Disk diagnostics") != test.private {
+			t.Error(fmt.Errorf("Expected private check to be included in %s: %t (as admin: %t), got: %s", test.path, test.private, test.asAdmin, body))
+			return
+		}
+		if test.path == "/api/v1/status" {
+			var overall overallStatus
+			if err := json.Unmarshal([]byte(body), &overall); err != nil {
+				t.Error(err)
+				return
+			}
+			if (overall.NumChecksDown == 1) != test.private {
+				t.Error(fmt.Errorf("Expected private check to be counted in status: %t (as admin: %t), got: %#v", test.private, test.asAdmin, overall))
+				return
+			}
+		}
+	}
+}
+
+func TestSearchAPI(t *testing.T) {
+	os.Remove("api-search-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-search-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, name := range []string{"Database", "Cache"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "API",
+			Name:     name,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+			Dedupe:   history.DedupeEveryRun,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{Checkers: checkers}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, item := range []history.Item{
+		{Name: "Database", Status: "unhealthy", Error: "Process exited with status 2", Output: []byte("dial tcp 10.0.0.5:5432: Connection refused\n")},
+		{Name: "Database", Status: "healthy", Output: []byte("ok\n")},
+		{Name: "Cache", Status: "unhealthy", Error: "Process exited with status 1", Output: []byte("connecting to redis\nconnection refused\n")},
+		{Name: "Cache", Status: "unhealthy", Error: "Process exited with status 1", Output: []byte("refused: connection reset\n")},
+	} {
+		item.Group = "API"
+		item.Type = "boolean"
+		item.Dedupe = history.DedupeEveryRun
+		if _, err := historyFile.Append(item); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	for _, test := range []struct {
+		query    string
+		status   int
+		excerpts []string
+	}{
+		{`q=%22connection+refused%22`, http.StatusOK, []string{"connection refused", "dial tcp 10.0.0.5:5432: Connection refused"}},
+		{`q=refused+connection`, http.StatusOK, []string{"refused: connection reset", "connection refused", "dial tcp 10.0.0.5:5432: Connection refused"}},
+		{`q=%22connection+refused%22&check=Database`, http.StatusOK, []string{"dial tcp 10.0.0.5:5432: Connection refused"}},
+		{`q=%22connection+refused%22&limit=1`, http.StatusOK, []string{"connection refused"}},
+		{`q=status+2`, http.StatusOK, []string{"Process exited with status 2"}},
+		{`q=timeout`, http.StatusOK, []string{}},
+		{`q=`, http.StatusBadRequest, nil},
+		{`q=refused&from=yesterday`, http.StatusBadRequest, nil},
+	} {
+		res, err := http.Get(server.URL + "/api/v1/search?" + test.query)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var results []searchResult
+		err = json.NewDecoder(res.Body).Decode(&results)
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Error(fmt.Errorf("Expected search for %s to return %d, got %d", test.query, test.status, res.StatusCode))
+			return
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var excerpts []string
+		for _, result := range results {
+			excerpts = append(excerpts, result.Excerpt)
+		}
+		if fmt.Sprintf("%q", excerpts) != fmt.Sprintf("%q", test.excerpts) {
+			t.Error(fmt.Errorf("Wrong results for %s: %#v", test.query, results))
+			return
+		}
+	}
+}
+
+func TestMetricsAPI(t *testing.T) {
+	os.Remove("api-metrics-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-metrics-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "Queue", Name: "depth", Type: "metric", MetricUnit: "jobs", Cmd: "echo 1", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "Queue", Name: "up", Type: "boolean", Cmd: "true", History: historyFile, Interval: time.Minute}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	from := time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, err := range historyFile.AppendBatch([]history.Item{
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 10, CreatedAt: from.Add(1 * time.Minute)},
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 20, CreatedAt: from.Add(2 * time.Minute)},
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 5, CreatedAt: from.Add(11 * time.Minute), Aggregate: &history.Aggregate{Period: history.PeriodHour, Count: 3, Min: 1, Max: 9}},
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 100, CreatedAt: from.Add(30 * time.Minute)},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	get := func(path string) (int, metricSeries, error) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			return 0, metricSeries{}, err
+		}
+		defer res.Body.Close()
+		var series metricSeries
+		json.NewDecoder(res.Body).Decode(&series)
+		return res.StatusCode, series, nil
+	}
+
+	query := "?from=2021-01-31T12:00:00Z&to=2021-01-31T12:20:00Z&step=10m"
+	for agg, values := range map[string][]float64{
+		"":    {15, 5},
+		"max": {20, 9},
+		"min": {10, 1},
+	} {
+		status, series, err := get("/api/v1/metrics/Queue/depth" + query + "&agg=" + agg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != http.StatusOK || series.Unit != "jobs" || len(series.Points) != 2 {
+			t.Error(fmt.Errorf("Wrong %s series (status %d): %#v", agg, status, series))
+			return
+		}
+		for i, point := range series.Points {
+			if !point.Time.Equal(from.Add(time.Duration(i)*10*time.Minute)) || point.Value != values[i] || point.Count != []int{2, 3}[i] {
+				t.Error(fmt.Errorf("Wrong %s point %d: %#v", agg, i, point))
+				return
+			}
+		}
+	}
+
+	for path, expected := range map[string]int{
+		"/api/v1/metrics/Queue/up":                  http.StatusBadRequest,
+		"/api/v1/metrics/Queue/missing":             http.StatusNotFound,
+		"/api/v1/metrics/Queue/depth?agg=sum":       http.StatusBadRequest,
+		"/api/v1/metrics/Queue/depth?step=1s":       http.StatusBadRequest,
+		"/api/v1/metrics/Queue/depth" + query + "x": http.StatusBadRequest,
+	} {
+		status, _, err := get(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != expected {
+			t.Error(fmt.Errorf("Expected %d for %s, got %d", expected, path, status))
+			return
+		}
+	}
+}
+
+func TestGrafanaAPI(t *testing.T) {
+	os.Remove("api-grafana-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-grafana-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "Queue", Name: "depth", Type: "metric", Cmd: "echo 1", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "Queue", Name: "up", Type: "boolean", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "Queue", Name: "secret", Type: "boolean", Cmd: "true", Private: true, History: historyFile, Interval: time.Minute}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	from := time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, err := range historyFile.AppendBatch([]history.Item{
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 10, CreatedAt: from.Add(1 * time.Minute)},
+		{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: 20, CreatedAt: from.Add(2 * time.Minute)},
+		{Group: "Queue", Name: "up", Type: "boolean", Dedupe: history.DedupeEveryRun, Status: "healthy", Duration: time.Second, CreatedAt: from.Add(1 * time.Minute)},
+		{Group: "Queue", Name: "up", Type: "boolean", Dedupe: history.DedupeEveryRun, Status: "unhealthy", Duration: 3 * time.Second, Error: "Timed out", CreatedAt: from.Add(2 * time.Minute)},
+		{Group: "Queue", Name: "up", Type: "boolean", Dedupe: history.DedupeEveryRun, Status: "healthy", Duration: time.Second, CreatedAt: from.Add(12 * time.Minute)},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	post := func(path, body string, out interface{}) (int, error) {
+		res, err := http.Post(server.URL+"/api/grafana"+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(out)
+		return res.StatusCode, nil
+	}
+
+	res, err := http.Get(server.URL + "/api/grafana/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Error(fmt.Errorf("Expected connection test to succeed, got status %d", res.StatusCode))
+		return
+	}
+
+	var targets []string
+	if _, err := post("/search", `{"target": "queue/"}`, &targets); err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(targets, ",") != "Queue/depth,Queue/depth:status,Queue/depth:duration,Queue/up:status,Queue/up:duration" {
+		t.Error(fmt.Errorf("Wrong targets: %#v", targets))
+		return
+	}
+
+	rangeJSON := `"range": {"from": "2021-01-31T12:00:00.000Z", "to": "2021-01-31T12:30:00.000Z"}`
+	var series []grafanaTimeseries
+	status, err := post("/query", `{`+rangeJSON+`, "intervalMs": 600000, "maxDataPoints": 100, "targets": [
+		{"target": "Queue/depth"}, {"target": "Queue/up:status"}, {"target": "Queue/up:duration"}
+	]}`, &series)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ms := float64(grafanaTime(from))
+	expected := []grafanaTimeseries{
+		{Target: "Queue/depth", Datapoints: [][2]float64{{15, ms}}},
+		{Target: "Queue/up:status", Datapoints: [][2]float64{{0, ms}, {0, ms + 600000}, {1, ms + 1200000}}},
+		{Target: "Queue/up:duration", Datapoints: [][2]float64{{2000, ms}, {1000, ms + 600000}}},
+	}
+	if status != http.StatusOK || fmt.Sprint(series) != fmt.Sprint(expected) {
+		t.Error(fmt.Errorf("Wrong series (status %d): %v", status, series))
+		return
+	}
+
+	var tables []grafanaTable
+	if _, err := post("/query", `{`+rangeJSON+`, "targets": [{"target": "Queue/up", "type": "table"}]}`, &tables); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(tables) != 1 || len(tables[0].Rows) != 3 || tables[0].Rows[1][1] != "unhealthy" || tables[0].Rows[1][4] != "Timed out" {
+		t.Error(fmt.Errorf("Wrong table: %#v", tables))
+		return
+	}
+
+	var annotations []grafanaAnnotation
+	if _, err := post("/annotations", `{`+rangeJSON+`, "annotation": {"name": "Incidents", "query": "Queue"}}`, &annotations); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(annotations) != 1 || annotations[0].Time != grafanaTime(from.Add(2*time.Minute)) || annotations[0].TimeEnd != grafanaTime(from.Add(12*time.Minute)) || annotations[0].Text != "Unhealthy for 10m0s" {
+		t.Error(fmt.Errorf("Wrong annotations: %#v", annotations))
+		return
+	}
+
+	for body, expected := range map[string]int{
+		`{` + rangeJSON + `, "targets": [{"target": "Queue/up"}]}`:                  http.StatusBadRequest,
+		`{` + rangeJSON + `, "targets": [{"target": "Queue/secret:status"}]}`:       http.StatusNotFound,
+		`{"range": {"from": "2021-01-31T12:20:00Z", "to": "2021-01-31T12:00:00Z"}}`: http.StatusBadRequest,
+		`{`: http.StatusBadRequest,
+	} {
+		var out interface{}
+		status, err := post("/query", body, &out)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != expected {
+			t.Error(fmt.Errorf("Expected %d for %s, got %d: %v", expected, body, status, out))
+			return
+		}
+	}
+}
+
+func TestCheckResultsAPI(t *testing.T) {
+	os.Remove("api-results-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-results-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "Queue", Name: "depth", Type: "metric", MetricUnit: "jobs", Cmd: "echo 1", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "Queue", Name: "secret", Type: "boolean", Cmd: "true", Private: true, History: historyFile, Interval: time.Minute}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	from := time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC)
+	var items []history.Item
+	for i := 0; i < 45; i++ {
+		items = append(items, history.Item{Group: "Queue", Name: "depth", Type: "metric", Status: "healthy", Metric: float64(i), CreatedAt: from.Add(time.Duration(i) * time.Minute)})
+	}
+	for _, err := range historyFile.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	type page struct {
+		Items []history.Item
+		Next  string
+	}
+	get := func(path string) (int, page, error) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			return 0, page{}, err
+		}
+		defer res.Body.Close()
+		var body page
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body, nil
+	}
+
+	// Pages follow each other until the oldest result
+	before := ""
+	for i, size := range []int{20, 20, 5} {
+		status, body, err := get("/api/v1/checks/results?group=Queue&check=depth&limit=20&before=" + url.QueryEscape(before))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != http.StatusOK || len(body.Items) != size {
+			t.Error(fmt.Errorf("Wrong page %d (status %d): %d results", i, status, len(body.Items)))
+			return
+		}
+		if body.Items[0].Metric != float64(44-20*i) {
+			t.Error(fmt.Errorf("Expected page %d to start at %d, got: %v", i, 44-20*i, body.Items[0].Metric))
+			return
+		}
+		if (body.Next == "") != (i == 2) {
+			t.Error(fmt.Errorf("Wrong next page after page %d: %q", i, body.Next))
+			return
+		}
+		before = body.Next
+	}
+
+	for path, expected := range map[string]int{
+		"/api/v1/checks/results?group=Queue":                         http.StatusBadRequest,
+		"/api/v1/checks/results?group=Queue&check=depth&limit=0":     http.StatusBadRequest,
+		"/api/v1/checks/results?group=Queue&check=depth&before=nope": http.StatusNotFound,
+		"/api/v1/checks/results?group=Queue&check=missing":           http.StatusNotFound,
+		"/api/v1/checks/results?group=Queue&check=secret":            http.StatusNotFound,
+	} {
+		status, _, err := get(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if status != expected {
+			t.Error(fmt.Errorf("Expected %d for %s, got %d", expected, path, status))
+			return
+		}
+	}
+
+	// The check page only renders rows when asked for older results
+	status, body, err := get("/api/v1/checks/results?group=Queue&check=depth&limit=20")
+	if err != nil || status != http.StatusOK {
+		t.Error(fmt.Errorf("Failed to get first page (status %d): %v", status, err))
+		return
+	}
+	res, err := http.Get(server.URL + "/check?group=Queue&check=depth&rows=1&before=" + url.QueryEscape(body.Next))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	html, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-Patrol-Next") == "" {
+		t.Error(fmt.Errorf("Wrong rows (status %d, next %q)", res.StatusCode, res.Header.Get("X-Patrol-Next")))
+		return
+	}
+	if strings.Count(string(html), "<tr") != 20 || strings.Contains(string(html), "<html") {
+		t.Error(fmt.Errorf("Expected 20 rows without the page, got: %s", html))
+		return
+	}
+}
+
+func TestCrossSiteRequests(t *testing.T) {
+	os.Remove("api-cross-site-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "api-cross-site-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		URL: "https://status.example.com",
+		Admin: &PatrolAdminOptions{
+			Username: "admin",
+			Password: "secret",
+		},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	request := func(path string, headers map[string]string) (int, error) {
+		req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(url.Values{"group": {"foo"}, "check": {"bar"}}.Encode()))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		for key, val := range headers {
+			req.Header.Set(key, val)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	// Forms on other sites cannot use the credentials that the browser
+	// remembers to change anything
+	for _, path := range []string{
+		"/api/v1/checks/pause",
+		"/api/v1/checks/resume",
+		"/api/v1/checks/append",
+		"/api/v1/silences",
+		"/api/v1/postmortems",
+		"/api/v1/comments",
+		"/api/v1/incidents/ack",
+		"/api/v1/admin/notifiers/test",
+	} {
+		for _, headers := range []map[string]string{
+			{"Sec-Fetch-Site": "cross-site"},
+			{"Sec-Fetch-Site": "same-site"},
+			{"Origin": "https://evil.example.com"},
+			{"Origin": "null"},
+		} {
+			if status, err := request(path, headers); err != nil {
+				t.Error(err)
+				return
+			} else if status != http.StatusForbidden {
+				t.Error(fmt.Errorf("Expected cross-site request to %s with %v to be rejected, got status %d", path, headers, status))
+				return
+			}
+		}
+	}
+	if p.getChecker("foo", "bar").IsPaused() {
+		t.Error(fmt.Errorf("Checker was paused by a cross-site request"))
+		return
+	}
+
+	// Requests from the status page itself, and from clients that are not
+	// browsers, are allowed
+	for _, headers := range []map[string]string{
+		{"Sec-Fetch-Site": "same-origin"},
+		{"Origin": server.URL},
+		{"Origin": "https://status.example.com"},
+		{},
+	} {
+		if status, err := request("/api/v1/checks/pause", headers); err != nil {
+			t.Error(err)
+			return
+		} else if status != http.StatusOK {
+			t.Error(fmt.Errorf("Expected request with %v to be allowed, got status %d", headers, status))
+			return
+		}
+	}
+}
+
+func TestRedirectBack(t *testing.T) {
+	for target, expected := range map[string]bool{
+		"":                     false,
+		"/":                    true,
+		"/?group=foo#bar":      true,
+		"status":               false,
+		"//evil.example":       false,
+		"/\\evil.example":      false,
+		"/%5Cevil.example":     true,
+		"https://evil.example": false,
+		"/%zz":                 false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/pause", strings.NewReader(url.Values{"redirect": {target}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		if redirected := redirectBack(res, req); redirected != expected {
+			t.Error(fmt.Errorf("Expected redirect to %q to be %v, got %v", target, expected, redirected))
+			return
+		}
+		if expected && res.Header().Get("Location") != target {
+			t.Error(fmt.Errorf("Wrong redirect for %q: %s", target, res.Header().Get("Location")))
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package patrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// AppendedResult is a result of an external check, which is reported to
+// patrol instead of patrol running the check.
+type AppendedResult struct {
+	Group       string            `json:"group"`
+	Check       string            `json:"check"`
+	Status      string            `json:"status"`
+	Metric      float64           `json:"metric,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Output      string            `json:"output,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// serveAppend records results of external checks, i.e. of cron jobs that
+// report their outcome with 'patrol append'.
+func (p *Patrol) serveAppend(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	var result AppendedResult
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1<<20)).Decode(&result); err != nil {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse result: %s", err))
+		return
+	}
+	c := p.getChecker(result.Group, result.Check)
+	if c == nil {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s/%s", errCheckerNotFound, result.Group, result.Check))
+		return
+	}
+
+	item, err := c.Record(history.Item{
+		Status:      result.Status,
+		Metric:      result.Metric,
+		Error:       result.Error,
+		Output:      []byte(result.Output),
+		Annotations: result.Annotations,
+	})
+	if errors.Is(err, checker.ErrInvalidResult) {
+		writeJSONError(res, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, checker.ErrNotExternal) || errors.Is(err, checker.ErrPaused) {
+		writeJSONError(res, http.StatusConflict, fmt.Errorf("%s: %s/%s", err, result.Group, result.Check))
+		return
+	} else if err != nil {
+		writeJSONError(res, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, item)
+}
+
+// AppendResult reports a result of an external check to a running patrol
+// instance, authenticating with its admin credentials.
+func AppendResult(upstream PatrolUpstreamOptions, result AppendedResult) error {
+	return callAPI(upstream, http.MethodPost, "/api/v1/checks/append", result, nil, "append result")
+}
+
+// callAPI sends a request to the API of a running patrol instance, with
+// 'body' encoded as JSON unless it is nil, and decodes the response into
+// 'out' unless it is nil. 'action' describes the request in errors.
+func callAPI(upstream PatrolUpstreamOptions, method, path string, body, out interface{}, action string) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(upstream.URL, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if upstream.Username != "" {
+		req.SetBasicAuth(upstream.Username, upstream.Password)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		if body.Error != "" {
+			return fmt.Errorf("Failed to %s (status %d): %s", action, res.StatusCode, body.Error)
+		}
+		return fmt.Errorf("Failed to %s (status %d)", action, res.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return fmt.Errorf("Failed to %s: %s", action, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package patrol
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Maximum number of results listed for a day of the calendar
+const maxCalendarResults = 100
+
+// calendarDay summarizes the checks of a service over a day. Days are in
+// UTC, so that they line up with the daily aggregates of metric checks.
+type calendarDay struct {
+	Date time.Time
+
+	// Worst status of the service's checks within the day, or empty if
+	// none of its checks were monitored on that day
+	Status string
+
+	// Number of results recorded on the day, and how many of them failed
+	Results  int
+	Failures int
+
+	// Number of incidents that overlap the day
+	Incidents int
+}
+
+func (day calendarDay) end() time.Time {
+	return day.Date.Add(24 * time.Hour)
+}
+
+// overlaps returns whether a period overlaps the day. Periods that start
+// and end at once overlap the day that they happen on.
+func (day calendarDay) overlaps(start, end time.Time) bool {
+	return start.Before(day.end()) && (end.After(day.Date) || !start.Before(day.Date))
+}
+
+// raise sets the status of the day to the given status, unless it already
+// has a worse one.
+func (day *calendarDay) raise(status string) {
+	if day.Status == "" || statusRanks[status] > statusRanks[day.Status] {
+		day.Status = status
+	}
+}
+
+// parseCalendarMonth parses a month ('2021-01'), which defaults to the
+// current month.
+func parseCalendarMonth(str string) (time.Time, error) {
+	if str == "" {
+		now := time.Now().UTC()
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	month, err := time.Parse("2006-01", str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid month '%s': must be formatted as YYYY-MM", str)
+	}
+	return month, nil
+}
+
+// groupVisible returns whether a service has checks that can be shown.
+func (p *Patrol) groupVisible(group string, includePrivate bool) bool {
+	for _, c := range p.checkers {
+		if c.Group == group && (includePrivate || !c.Private) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCalendar summarizes each day of a month for the checks of a service.
+// A day has the status of the service's most severe check that was down
+// on that day, either because of an incident or because some of its
+// results failed, which includes the failures counted by hourly and daily
+// aggregates. Private checks are only included if asked for.
+func (p *Patrol) getCalendar(group string, month time.Time, includePrivate bool) []calendarDay {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	days := make([]calendarDay, start.AddDate(0, 1, 0).Sub(start)/(24*time.Hour))
+	for i := range days {
+		days[i].Date = start.AddDate(0, 0, i)
+	}
+
+	now := time.Now()
+	for _, c := range p.checkers {
+		if c.Group != group || (c.Private && !includePrivate) {
+			continue
+		}
+		outage := outageStatus(c.Severity)
+		if p.groupStatusRules[group].weight(c.Name) == 0 || c.StatusPage != nil {
+			outage = statusOperational
+		}
+
+		// The check's first transition is its first result
+		transitions := p.History.GetTransitions(group, c.Name)
+		if len(transitions) == 0 {
+			continue
+		}
+		for i := range days {
+			if days[i].overlaps(transitions[len(transitions)-1].CreatedAt, now) {
+				days[i].raise(statusOperational)
+			}
+		}
+
+		for _, incident := range incidentsFromTransitions(transitions) {
+			end := incident.ResolvedAt
+			if incident.Ongoing() {
+				end = now
+			}
+			for i := range days {
+				if days[i].overlaps(incident.StartedAt, end) {
+					days[i].Incidents++
+					days[i].raise(outage)
+				}
+			}
+		}
+
+		p.History.EachItem(group, c.Name, func(item history.Item, _ func() history.Item) bool {
+			if item.SeenAt().Before(start) {
+				return false
+			}
+			addResults(days, item, outage)
+			return true
+		})
+	}
+	return days
+}
+
+// addResults counts the results that an item stands for on the days that
+// they were recorded on. Identical results that were collapsed into one
+// item (see DedupeIdentical) only keep when the first and the last of them
+// were recorded, so they are spread evenly over that time.
+func addResults(days []calendarDay, item history.Item, outage string) {
+	add := func(at time.Time, count, failures int) {
+		idx := int(at.Sub(days[0].Date) / (24 * time.Hour))
+		if at.Before(days[0].Date) || idx >= len(days) {
+			return
+		}
+		days[idx].Results += count
+		days[idx].Failures += failures
+		if failures > 0 {
+			days[idx].raise(outage)
+		}
+	}
+
+	count, failures := item.Results()
+	if item.LastSeen == nil || count < 2 {
+		add(item.CreatedAt, count, failures)
+		return
+	}
+
+	// Collapsed results are identical, so either all of them failed or
+	// none did
+	step := item.SeenAt().Sub(item.CreatedAt) / time.Duration(count-1)
+	for i := 0; i < count; i++ {
+		add(item.CreatedAt.Add(time.Duration(i)*step), 1, failures/count)
+	}
+}
+
+// getCalendarDay lists the incidents of a service that overlap a day, and
+// its results that were recorded on the day, most recent first. Items of
+// collapsed results are listed on each day that they span.
+func (p *Patrol) getCalendarDay(group string, day calendarDay, includePrivate bool) ([]incident, []history.Item) {
+	now := time.Now()
+	incidents := []incident{}
+	for _, i := range p.getIncidents(includePrivate) {
+		end := i.ResolvedAt
+		if i.Ongoing() {
+			end = now
+		}
+		if i.Group == group && day.overlaps(i.StartedAt, end) {
+			incidents = append(incidents, i)
+		}
+	}
+
+	items := []history.Item{}
+	for _, c := range p.checkers {
+		if c.Group != group || (c.Private && !includePrivate) {
+			continue
+		}
+		// Only the most recent results of each check can be listed, so
+		// only those are read back
+		numItems := 0
+		p.History.EachItem(group, c.Name, func(item history.Item, load func() history.Item) bool {
+			if day.overlaps(item.CreatedAt, item.SeenAt()) {
+				items = append(items, load())
+				numItems++
+			}
+			return numItems < maxCalendarResults
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].CreatedAt.After(items[j].CreatedAt)
+	})
+	if len(items) > maxCalendarResults {
+		items = items[:maxCalendarResults]
+	}
+	return incidents, items
+}
+
+// serveCalendarPage shows a month of a service as a calendar, in which each
+// day is colored by the worst status of the service on that day. Selecting
+// a day lists its incidents and results.
+func (p *Patrol) serveCalendarPage(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	group := query.Get("group")
+	includePrivate := p.showPrivate(req)
+	if !p.groupVisible(group, includePrivate) {
+		http.Error(res, fmt.Sprintf("No such service: %s", group), http.StatusNotFound)
+		return
+	}
+
+	var selected time.Time
+	if str := query.Get("day"); str != "" {
+		var err error
+		if selected, err = time.Parse("2006-01-02", str); err != nil {
+			http.Error(res, fmt.Sprintf("Invalid day '%s': must be formatted as YYYY-MM-DD", str), http.StatusBadRequest)
+			return
+		}
+	}
+	monthStr := query.Get("month")
+	if monthStr == "" && !selected.IsZero() {
+		monthStr = selected.Format("2006-01")
+	}
+	month, err := parseCalendarMonth(monthStr)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days := p.getCalendar(group, month, includePrivate)
+
+	// Weeks start on Monday, and are padded with days that have no date
+	var weeks [][]calendarDay
+	week := make([]calendarDay, (int(month.Weekday())+6)%7)
+	for _, day := range days {
+		week = append(week, day)
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = nil
+		}
+	}
+	if len(week) > 0 {
+		weeks = append(weeks, append(week, make([]calendarDay, 7-len(week))...))
+	}
+
+	var selectedDay *calendarDay
+	var incidents []incident
+	var items []history.Item
+	for i := range days {
+		if days[i].Date.Equal(selected) {
+			selectedDay = &days[i]
+			incidents, items = p.getCalendarDay(group, days[i], includePrivate)
+		}
+	}
+
+	p.executePage(res, "calendar", struct {
+		Name      string
+		Group     string
+		Month     time.Time
+		PrevMonth string
+		NextMonth string
+		Weeks     [][]calendarDay
+		Day       *calendarDay
+		Selected  string
+		Incidents []incident
+		Items     []history.Item
+	}{
+		Name:      p.name,
+		Group:     group,
+		Month:     month,
+		PrevMonth: month.AddDate(0, -1, 0).Format("2006-01"),
+		NextMonth: month.AddDate(0, 1, 0).Format("2006-01"),
+		Weeks:     weeks,
+		Day:       selectedDay,
+		Selected:  query.Get("day"),
+		Incidents: incidents,
+		Items:     items,
+	})
+}
@@ -0,0 +1,122 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestCalendar(t *testing.T) {
+	os.Remove("calendar-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "calendar-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "API", Name: "up", Type: "boolean", Cmd: "true", History: historyFile, Interval: time.Minute, Severity: checker.SeverityCritical}),
+			checker.New(&checker.Checker{Group: "API", Name: "latency", Type: "metric", Cmd: "echo 1", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API", Name: "ping", Type: "boolean", Cmd: "true", History: historyFile, Interval: 12 * time.Hour, Dedupe: history.DedupeIdentical}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	day := func(d, hour int) time.Time {
+		return time.Date(2021, 1, d, hour, 0, 0, 0, time.UTC)
+	}
+	for _, err := range historyFile.AppendBatch([]history.Item{
+		{Group: "API", Name: "up", Type: "boolean", Status: "healthy", CreatedAt: day(3, 10)},
+		{Group: "API", Name: "up", Type: "boolean", Status: "unhealthy", Error: "Connection refused", CreatedAt: day(5, 23)},
+		{Group: "API", Name: "up", Type: "boolean", Status: "healthy", CreatedAt: day(6, 1)},
+		{Group: "API", Name: "latency", Type: "metric", Status: "unhealthy", Metric: 2, CreatedAt: day(10, 0), Aggregate: &history.Aggregate{Period: history.PeriodDay, Count: 24, Failures: 2, Min: 1, Max: 3}},
+		{Group: "API", Name: "latency", Type: "metric", Status: "healthy", Metric: 1, CreatedAt: day(11, 0)},
+		// Collapsed into a single item that spans three days
+		{Group: "API", Name: "ping", Type: "boolean", Dedupe: history.DedupeIdentical, Status: "healthy", CreatedAt: day(20, 12)},
+		{Group: "API", Name: "ping", Type: "boolean", Dedupe: history.DedupeIdentical, Status: "healthy", CreatedAt: day(21, 0)},
+		{Group: "API", Name: "ping", Type: "boolean", Dedupe: history.DedupeIdentical, Status: "healthy", CreatedAt: day(21, 12)},
+		{Group: "API", Name: "ping", Type: "boolean", Dedupe: history.DedupeIdentical, Status: "healthy", CreatedAt: day(22, 0)},
+		{Group: "API", Name: "ping", Type: "boolean", Dedupe: history.DedupeIdentical, Status: "healthy", CreatedAt: day(22, 12)},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	days := p.getCalendar("API", day(1, 0), false)
+	if len(days) != 31 {
+		t.Error(fmt.Errorf("Expected 31 days, got %d", len(days)))
+		return
+	}
+	for d, expected := range map[int]calendarDay{
+		2:  {Status: ""},
+		3:  {Status: statusOperational, Results: 1},
+		5:  {Status: statusMajorOutage, Results: 1, Failures: 1, Incidents: 1},
+		6:  {Status: statusMajorOutage, Results: 1, Incidents: 1},
+		7:  {Status: statusOperational},
+		10: {Status: statusPartialOutage, Results: 24, Failures: 2, Incidents: 1},
+		11: {Status: statusOperational, Results: 1},
+		20: {Status: statusOperational, Results: 1},
+		21: {Status: statusOperational, Results: 2},
+		22: {Status: statusOperational, Results: 2},
+	} {
+		expected.Date = day(d, 0)
+		if days[d-1] != expected {
+			t.Error(fmt.Errorf("Wrong summary of January %d: %#v", d, days[d-1]))
+			return
+		}
+	}
+
+	incidents, items := p.getCalendarDay("API", days[4], false)
+	if len(incidents) != 1 || incidents[0].Name != "up" || len(items) != 1 || items[0].Error != "Connection refused" {
+		t.Error(fmt.Errorf("Wrong incidents or results of January 5: %#v, %#v", incidents, items))
+		return
+	}
+
+	_, items = p.getCalendarDay("API", days[21], false)
+	if len(items) != 1 || items[0].Name != "ping" || items[0].Count != 5 {
+		t.Error(fmt.Errorf("Expected collapsed results to be listed on January 22: %#v", items))
+		return
+	}
+
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+	for path, expected := range map[string]int{
+		"/calendar?group=API&day=2021-01-05": http.StatusOK,
+		"/calendar?group=API&month=2021-13":  http.StatusBadRequest,
+		"/calendar?group=Web":                http.StatusNotFound,
+	} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Error(fmt.Errorf("Expected %d for %s, got %d: %s", expected, path, res.StatusCode, body))
+			return
+		}
+		if expected == http.StatusOK && !strings.Contains(string(body), "Connection refused") {
+			t.Error(fmt.Errorf("Expected results of the day to be listed: %s", body))
+			return
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/karimsa/patrol"
+	"github.com/karimsa/patrol/internal/history"
 	"github.com/urfave/cli/v2"
 )
 
@@ -25,12 +35,30 @@ var cmdRun = &cli.Command{
 	Usage: "Run statuspage using given configuration file.",
 	Flags: []cli.Flag{
 		configFlag,
+		&cli.BoolFlag{
+			Name:  "simulate",
+			Usage: "Record simulated results instead of running checks, in a temporary data file. Notifications are still sent.",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
-		p, config, err := patrol.FromConfigFile(ctx.String("config"), nil)
+		// Simulated results must not end up in the real data file
+		var historyOptions *history.NewOptions
+		if ctx.Bool("simulate") {
+			dir, err := ioutil.TempDir("", "patrol-simulate")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			historyOptions = &history.NewOptions{File: filepath.Join(dir, "data.db")}
+		}
+
+		p, config, err := patrol.FromConfigFile(ctx.String("config"), historyOptions)
 		if err != nil {
 			return err
 		}
+		if ctx.Bool("simulate") {
+			p.Simulate()
+		}
 
 		cs, err := json.MarshalIndent(config, "", "\t")
 		if err != nil {
@@ -40,12 +68,12 @@ var cmdRun = &cli.Command{
 		log.Printf("Config: %s\n", cs)
 		p.Start()
 
+		// systemd stops services with SIGTERM
 		sigInt := make(chan os.Signal, 1)
-		signal.Notify(sigInt, os.Interrupt)
+		signal.Notify(sigInt, os.Interrupt, syscall.SIGTERM)
 		<-sigInt
 
-		p.Close()
-		return nil
+		return p.Close()
 	},
 }
 
@@ -78,8 +106,37 @@ var cmdCheckConfig = &cli.Command{
 			p.History.Compact()
 		}
 
-		p.Close()
-		return nil
+		return p.Close()
+	},
+}
+
+var cmdConfig = &cli.Command{
+	Name:  "config",
+	Usage: "Inspect a configuration file.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "print",
+			Usage: "Validate a configuration file and print it, without opening its data file.",
+			Flags: []cli.Flag{
+				configFlag,
+				&cli.BoolFlag{
+					Name:  "resolved",
+					Usage: "Print the configuration as patrol runs it, with generated checks, inherited options and defaults",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "Format to print the configuration in (yaml, json)",
+					Value: patrol.ConfigFormatYAML,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				data, err := ioutil.ReadFile(ctx.String("config"))
+				if err != nil {
+					return err
+				}
+				return patrol.WriteConfig(os.Stdout, data, ctx.Bool("resolved"), ctx.String("format"))
+			},
+		},
 	},
 }
 
@@ -158,19 +215,550 @@ var cmdList = &cli.Command{
 		}
 		fmt.Printf("-\n")
 
-		p.Close()
+		return p.Close()
+	},
+}
+
+var cmdReport = &cli.Command{
+	Name:  "report",
+	Usage: "Print the uptime, number of outages and mean time to recovery of each check.",
+	Flags: []cli.Flag{
+		configFlag,
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "Start of the report, as a date (YYYY-MM-DD) or an RFC3339 timestamp. Defaults to 30 days before the end.",
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "End of the report, as a date (YYYY-MM-DD) or an RFC3339 timestamp. Defaults to now.",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format (csv, json, pdf)",
+			Value: "csv",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		to := time.Now()
+		if ctx.String("to") != "" {
+			var err error
+			if to, err = patrol.ParseReportTime(ctx.String("to")); err != nil {
+				return err
+			}
+		}
+		from := to.AddDate(0, 0, -30)
+		if ctx.String("from") != "" {
+			var err error
+			if from, err = patrol.ParseReportTime(ctx.String("from")); err != nil {
+				return err
+			}
+		}
+
+		p, _, err := patrol.FromConfigFile(ctx.String("config"), nil)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		return p.WriteReport(os.Stdout, from, to, ctx.String("format"))
+	},
+}
+
+// apiFlags are the flags of commands that call the API of a running patrol
+// instance.
+func apiFlags(flags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "url",
+			Usage:   "URL of the patrol instance",
+			Value:   "http://localhost:8080",
+			EnvVars: []string{"PATROL_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "username",
+			Usage:   "Username of the admin",
+			EnvVars: []string{"PATROL_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "password",
+			Usage:   "Password of the admin",
+			EnvVars: []string{"PATROL_PASSWORD"},
+		},
+	}, flags...)
+}
+
+func apiOptions(ctx *cli.Context) patrol.PatrolUpstreamOptions {
+	return patrol.PatrolUpstreamOptions{
+		URL:      ctx.String("url"),
+		Username: ctx.String("username"),
+		Password: ctx.String("password"),
+	}
+}
+
+var cmdAppend = &cli.Command{
+	Name:  "append",
+	Usage: "Record a result of an external check in a running patrol instance.",
+	Flags: apiFlags(
+		&cli.StringFlag{
+			Name:     "group",
+			Usage:    "Name of the service",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "name",
+			Usage:    "Name of the check",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "status",
+			Usage:    "Status of the result (healthy, unhealthy)",
+			Required: true,
+		},
+		&cli.Float64Flag{
+			Name:  "metric",
+			Usage: "Value of the result, for metric checks",
+		},
+		&cli.StringFlag{
+			Name:  "error",
+			Usage: "Reason that the check failed",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Output to keep with the result, or '-' to read it from stdin",
+		},
+		&cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "Annotation of the result, as key=value",
+		},
+	),
+	Action: func(ctx *cli.Context) error {
+		output := ctx.String("output")
+		if output == "-" {
+			buf, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			output = string(buf)
+		}
+
+		var annotations map[string]string
+		for _, annotation := range ctx.StringSlice("annotation") {
+			parts := strings.SplitN(annotation, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid annotation '%s' (must be key=value)", annotation)
+			}
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[parts[0]] = parts[1]
+		}
+
+		return patrol.AppendResult(apiOptions(ctx), patrol.AppendedResult{
+			Group:       ctx.String("group"),
+			Check:       ctx.String("name"),
+			Status:      ctx.String("status"),
+			Metric:      ctx.Float64("metric"),
+			Error:       ctx.String("error"),
+			Output:      output,
+			Annotations: annotations,
+		})
+	},
+}
+
+var cmdSilence = &cli.Command{
+	Name:  "silence",
+	Usage: "Mute the notifications of checks in a running patrol instance, i.e. during maintenance.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "create",
+			Usage: "Silence the checks that match all of the given patterns.",
+			Flags: apiFlags(
+				&cli.StringFlag{
+					Name:  "group",
+					Usage: "Pattern of the services to silence (i.e. 'api-*')",
+				},
+				&cli.StringFlag{
+					Name:  "check",
+					Usage: "Pattern of the checks to silence",
+				},
+				&cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "Pattern of a tag that silenced checks must have (i.e. 'region:eu')",
+				},
+				&cli.DurationFlag{
+					Name:     "duration",
+					Usage:    "How long the silence lasts",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "start",
+					Usage: "Start of the silence, as an RFC3339 timestamp. Defaults to now.",
+				},
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "Why the checks are silenced",
+				},
+			),
+			Action: func(ctx *cli.Context) error {
+				req := patrol.SilenceRequest{
+					Group:    ctx.String("group"),
+					Check:    ctx.String("check"),
+					Tags:     ctx.StringSlice("tag"),
+					Duration: ctx.Duration("duration").String(),
+					Reason:   ctx.String("reason"),
+				}
+				if start := ctx.String("start"); start != "" {
+					startsAt, err := time.Parse(time.RFC3339, start)
+					if err != nil {
+						return fmt.Errorf("Invalid start '%s' (must be an RFC3339 timestamp)", start)
+					}
+					req.StartsAt = startsAt
+				}
+
+				silence, err := patrol.CreateSilence(apiOptions(ctx), req)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Created silence %s until %s, matching %d checks:\n", silence.ID, silence.EndsAt.Local().Format(time.RFC3339), len(silence.Checks))
+				for _, check := range silence.Checks {
+					fmt.Printf("\t%s\n", check)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List the silences that have not ended yet.",
+			Flags: apiFlags(),
+			Action: func(ctx *cli.Context) error {
+				silences, err := patrol.ListSilences(apiOptions(ctx))
+				if err != nil {
+					return err
+				}
+				for _, silence := range silences {
+					state := "scheduled"
+					if silence.Active {
+						state = "active"
+					}
+					var patterns []string
+					if silence.Group != "" {
+						patterns = append(patterns, "group="+silence.Group)
+					}
+					if silence.Check != "" {
+						patterns = append(patterns, "check="+silence.Check)
+					}
+					for _, tag := range silence.Tags {
+						patterns = append(patterns, "tag="+tag)
+					}
+					fmt.Printf(
+						"%s\t%s\t%s - %s\t%s\t%d checks\t%s\n",
+						silence.ID,
+						state,
+						silence.StartsAt.Local().Format(time.RFC3339),
+						silence.EndsAt.Local().Format(time.RFC3339),
+						strings.Join(patterns, ","),
+						len(silence.Checks),
+						silence.Reason,
+					)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "delete",
+			Usage:     "Delete silences, which ends them early or cancels them.",
+			ArgsUsage: "<silence-id>...",
+			Flags:     apiFlags(),
+			Action: func(ctx *cli.Context) error {
+				if ctx.NArg() == 0 {
+					return fmt.Errorf("The ID of a silence must be given")
+				}
+				for _, id := range ctx.Args().Slice() {
+					if err := patrol.DeleteSilence(apiOptions(ctx), id); err != nil {
+						return err
+					}
+					fmt.Printf("Deleted silence %s\n", id)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+var cmdNotify = &cli.Command{
+	Name:  "notify",
+	Usage: "Manage notifications.",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "test",
+			Usage:     "Send a test notification through a notifier, or through all notifiers.",
+			ArgsUsage: "[notifier-name]",
+			Flags: []cli.Flag{
+				configFlag,
+			},
+			Action: func(ctx *cli.Context) error {
+				p, _, err := patrol.FromConfigFile(ctx.String("config"), nil)
+				if err != nil {
+					return err
+				}
+				defer p.Close()
+
+				tests, err := p.TestNotifiers(ctx.Args().First())
+				if err != nil {
+					return err
+				}
+				numFailed := 0
+				for _, test := range tests {
+					on := test.Event
+					if test.Service != "" {
+						on += " of " + test.Service
+					}
+					if test.Error == "" {
+						fmt.Printf("ok\t%s (%s)\n", test.Notifier, on)
+					} else {
+						fmt.Printf("failed\t%s (%s): %s\n", test.Notifier, on, test.Error)
+						numFailed++
+					}
+				}
+				if numFailed > 0 {
+					return fmt.Errorf("%d of %d test notifications failed", numFailed, len(tests))
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// prompt asks for a value on stdin, and returns the default if the answer
+// is empty.
+func prompt(in *bufio.Reader, question, defaultValue string) string {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", question, defaultValue)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, _ := in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return defaultValue
+	}
+	return answer
+}
+
+// splitList splits a comma-separated answer into its values.
+func splitList(str string) []string {
+	var list []string
+	for _, value := range strings.Split(str, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+var cmdInit = &cli.Command{
+	Name:  "init",
+	Usage: "Generate a starter config file. Asks for the options that are not given as flags, if stdin is a terminal.",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:      "config",
+			Usage:     "Path to write the config file to",
+			Value:     "patrol.yml",
+			TakesFile: true,
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Name of the status page",
+			Value: "Statuspage",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "Port of the status page",
+			Value: 8080,
+		},
+		&cli.StringFlag{
+			Name:  "db",
+			Usage: "Path to the history file",
+			Value: "data.db",
+		},
+		&cli.StringSliceFlag{
+			Name:  "http",
+			Usage: "URL that must respond successfully",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tcp",
+			Usage: "Address (host:port) that must accept TCP connections",
+		},
+		&cli.StringSliceFlag{
+			Name:  "disk",
+			Usage: "Mount point whose usage is recorded",
+		},
+		&cli.StringFlag{
+			Name:  "notifier",
+			Usage: "Notifier for failures and recoveries (slack, discord, webhook)",
+		},
+		&cli.StringFlag{
+			Name:  "notifier-url",
+			Usage: "URL of the notifier's webhook",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Overwrite the config file if it exists",
+		},
+		&cli.BoolFlag{
+			Name:  "no-input",
+			Usage: "Do not ask for options, and use the defaults of those that are not given",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		path := ctx.String("config")
+		if _, err := os.Stat(path); err == nil && !ctx.Bool("force") {
+			return fmt.Errorf("%s already exists (use --force to overwrite it)", path)
+		}
+
+		opts := patrol.InitOptions{
+			Name:        ctx.String("name"),
+			Port:        ctx.Int("port"),
+			DB:          ctx.String("db"),
+			HTTP:        ctx.StringSlice("http"),
+			TCP:         ctx.StringSlice("tcp"),
+			Disks:       ctx.StringSlice("disk"),
+			Notifier:    ctx.String("notifier"),
+			NotifierURL: ctx.String("notifier-url"),
+		}
+		stat, err := os.Stdin.Stat()
+		if !ctx.Bool("no-input") && err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			in := bufio.NewReader(os.Stdin)
+			if !ctx.IsSet("name") {
+				opts.Name = prompt(in, "Name of the status page", opts.Name)
+			}
+			if !ctx.IsSet("port") {
+				port, err := strconv.Atoi(prompt(in, "Port of the status page", strconv.Itoa(opts.Port)))
+				if err != nil {
+					return fmt.Errorf("Invalid port: %s", err)
+				}
+				opts.Port = port
+			}
+			if !ctx.IsSet("db") {
+				opts.DB = prompt(in, "Path to the history file", opts.DB)
+			}
+			if !ctx.IsSet("http") && !ctx.IsSet("tcp") && !ctx.IsSet("disk") {
+				fmt.Println("Checks to generate, as comma-separated lists (leave all empty for examples):")
+				opts.HTTP = splitList(prompt(in, "  URLs that must respond", ""))
+				opts.TCP = splitList(prompt(in, "  Addresses (host:port) that must accept connections", ""))
+				opts.Disks = splitList(prompt(in, "  Mount points to record the usage of", ""))
+			}
+			if !ctx.IsSet("notifier") {
+				opts.Notifier = prompt(in, "Notifier (slack, discord, webhook or none)", "none")
+				if opts.Notifier == "none" {
+					opts.Notifier = ""
+				}
+			}
+			if opts.Notifier != "" && !ctx.IsSet("notifier-url") {
+				opts.NotifierURL = prompt(in, fmt.Sprintf("URL of the %s webhook", opts.Notifier), "")
+			}
+		}
+
+		data, err := patrol.GenerateConfig(opts)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s, start patrol with: patrol run --config %s\n", path, path)
+		return nil
+	},
+}
+
+// Client for looking up and downloading releases, which uses the proxy set
+// in the environment
+var releaseClient = &http.Client{Timeout: 5 * time.Minute}
+
+var cmdVersion = &cli.Command{
+	Name:  "version",
+	Usage: "Print the version of patrol.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "check-latest",
+			Usage: "Also check whether a newer release is available",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		fmt.Printf("patrol %s (%s, %s/%s)\n", patrol.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		if !ctx.Bool("check-latest") {
+			return nil
+		}
+
+		release, err := patrol.LatestRelease(releaseClient)
+		if err != nil {
+			return err
+		}
+		if patrol.IsNewerVersion(release.Version, patrol.Version) {
+			fmt.Printf("patrol %s is available, update with: patrol self-update\n%s\n", release.Version, release.URL)
+		} else if release.Version == patrol.Version {
+			fmt.Printf("patrol is up to date\n")
+		} else {
+			fmt.Printf("Latest release is %s\n", release.Version)
+		}
+		return nil
+	},
+}
+
+var cmdSelfUpdate = &cli.Command{
+	Name:  "self-update",
+	Usage: "Replace this binary with the latest release, once its signature is verified.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Install the latest release even if it is not newer, i.e. over development builds",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		release, err := patrol.LatestRelease(releaseClient)
+		if err != nil {
+			return err
+		}
+		if !ctx.Bool("force") && !patrol.IsNewerVersion(release.Version, patrol.Version) {
+			fmt.Printf("patrol %s is up to date (latest release is %s)\n", patrol.Version, release.Version)
+			return nil
+		}
+
+		path, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return err
+		}
+		fmt.Printf("Downloading patrol %s\n", release.Version)
+		binary, err := patrol.DownloadRelease(releaseClient, release, ctx.Bool("force"))
+		if err != nil {
+			return err
+		}
+		if err := patrol.ReplaceExecutable(path, binary); err != nil {
+			return fmt.Errorf("Failed to replace %s: %s", path, err)
+		}
+		fmt.Printf("Updated %s from %s to %s, restart patrol to use it\n", path, patrol.Version, release.Version)
 		return nil
 	},
 }
 
 func main() {
 	app := &cli.App{
-		Name:  "patrol",
-		Usage: "Host your own statuspages.",
+		Name:    "patrol",
+		Usage:   "Host your own statuspages.",
+		Version: patrol.Version,
 		Commands: []*cli.Command{
+			cmdInit,
 			cmdCheckConfig,
+			cmdConfig,
 			cmdRun,
 			cmdList,
+			cmdReport,
+			cmdAppend,
+			cmdSilence,
+			cmdNotify,
+			cmdVersion,
+			cmdSelfUpdate,
 		},
 		Authors: []*cli.Author{
 			&cli.Author{
@@ -1,8 +1,13 @@
 package patrol
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,31 +39,527 @@ func (cmd *checkCmd) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-type configRaw struct {
-	Name     string
-	Port     int
-	HTTPS    PatrolHttpsOptions `yaml:"https"`
-	DB       string             `yaml:"db"`
-	LogLevel string             `yaml:"logLevel"`
-	Compact  history.CompactOptions
-	Services map[string]struct {
-		Checks []struct {
-			Name       string
-			Interval   duration
-			Timeout    duration
-			Cmd        checkCmd
-			Type       string
-			MetricUnit string `yaml:"unit"`
+// pluginConfig holds the options of a check that uses a plugin, which can
+// be any YAML value. They are stored as JSON, since that is what plugins
+// receive.
+type pluginConfig []byte
+
+func (pc *pluginConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	value, err := jsonValue(value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	*pc = data
+	return nil
+}
+
+func (pc pluginConfig) MarshalYAML() (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(pc, &value)
+	return value, err
+}
+
+// jsonValue converts a value decoded from YAML into one that can be encoded
+// as JSON, since YAML maps can have keys that are not strings.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			str, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("Plugin config keys must be strings, got: %v", key)
+			}
+			converted, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			m[str] = converted
+		}
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, val := range v {
+			converted, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = converted
+		}
+		return list, nil
+	default:
+		return value, nil
+	}
+}
+
+type retentionConfig struct {
+	MaxEntries  int      `yaml:"maxEntries,omitempty"`
+	MaxAge      duration `yaml:"maxAge,omitempty"`
+	HourlyAfter duration `yaml:"hourlyAfter,omitempty"`
+	DailyAfter  duration `yaml:"dailyAfter,omitempty"`
+}
+
+// merge returns the retention with any values that are set in the
+// override replaced.
+func (r retentionConfig) merge(override retentionConfig) retentionConfig {
+	if override.MaxEntries != 0 {
+		r.MaxEntries = override.MaxEntries
+	}
+	if !override.MaxAge.isZero() {
+		r.MaxAge = override.MaxAge
+	}
+	if !override.HourlyAfter.isZero() {
+		r.HourlyAfter = override.HourlyAfter
+	}
+	if !override.DailyAfter.isZero() {
+		r.DailyAfter = override.DailyAfter
+	}
+	return r
+}
+
+// rawCheckConfig is a single check of a service.
+type rawCheckConfig struct {
+	Name       string                  `yaml:",omitempty"`
+	Interval   duration                `yaml:",omitempty"`
+	Timeout    duration                `yaml:",omitempty"`
+	Cmd        checkCmd                `yaml:",omitempty"`
+	Type       string                  `yaml:",omitempty"`
+	MetricUnit string                  `yaml:"unit,omitempty"`
+	Dedupe     string                  `yaml:",omitempty"`
+	Severity   string                  `yaml:",omitempty"`
+	Priority   string                  `yaml:",omitempty"`
+	Weight     *float64                `yaml:",omitempty"`
+	Public     *bool                   `yaml:",omitempty"`
+	Owner      string                  `yaml:",omitempty"`
+	RunbookURL string                  `yaml:"runbook_url,omitempty"`
+	Tags       []string                `yaml:",omitempty"`
+	DependsOn  []string                `yaml:"dependsOn,omitempty"`
+	Retention  retentionConfig         `yaml:",omitempty"`
+	Anomaly    *checker.AnomalyOptions `yaml:",omitempty"`
+	Forecast   *forecastConfig         `yaml:",omitempty"`
+	Samples    int                     `yaml:",omitempty"`
+	Quorum     int                     `yaml:",omitempty"`
+	Proxy      *checker.ProxyOptions   `yaml:",omitempty"`
+	TLS        *checker.TLSOptions     `yaml:"tls,omitempty"`
+	RunAs      *runAsConfig            `yaml:"runAs,omitempty"`
+	Limits     *limitsConfig           `yaml:",omitempty"`
+
+	AddressFamilies []string `yaml:"addressFamilies,omitempty"`
+
+	// Name of the plugin that runs the check instead of 'cmd'
+	Plugin string       `yaml:",omitempty"`
+	Config pluginConfig `yaml:",omitempty"`
+
+	// External checks are not run by patrol, their results are appended
+	// through the API (i.e. with 'patrol append')
+	External bool `yaml:",omitempty"`
+
+	// Pattern of the results that the check records when patrol runs with
+	// '--simulate', which overrides the top-level pattern
+	Simulate *checker.SimulationOptions `yaml:",omitempty"`
+
+	// Sources polled by checks of type snmp, rabbitmq, kafka, domain,
+	// ntp, content, logwatch, certificate, prometheus, cloudwatch and
+	// statuspage
+	SNMP        *checker.SNMPOptions        `yaml:"snmp,omitempty"`
+	RabbitMQ    *checker.RabbitMQOptions    `yaml:"rabbitmq,omitempty"`
+	Kafka       *checker.KafkaOptions       `yaml:",omitempty"`
+	Domain      *checker.DomainOptions      `yaml:",omitempty"`
+	NTP         *checker.NTPOptions         `yaml:"ntp,omitempty"`
+	Content     *checker.ContentOptions     `yaml:",omitempty"`
+	LogWatch    *checker.LogWatchOptions    `yaml:"logwatch,omitempty"`
+	Certificate *checker.CertificateOptions `yaml:",omitempty"`
+	Prometheus  *checker.PrometheusOptions  `yaml:",omitempty"`
+	CloudWatch  *cloudWatchConfig           `yaml:"cloudwatch,omitempty"`
+	StatusPage  *checker.StatusPageOptions  `yaml:"statuspage,omitempty"`
+}
+
+// domainsConfig is the 'domains' option of a service. It is either a list
+// of domains, or a map with the domains in 'names' and the options of the
+// generated checks.
+type domainsConfig struct {
+	Names []string `yaml:",omitempty"`
+
+	// Options of the certificate checks
+	MinDays             int      `yaml:"minDays,omitempty"`
+	CertificateInterval duration `yaml:"certificateInterval,omitempty"`
+
+	// Options of the reachability checks
+	Path     string   `yaml:",omitempty"`
+	Interval duration `yaml:",omitempty"`
+	Timeout  duration `yaml:",omitempty"`
+}
+
+// Domains can have a port, but no scheme or path
+var domainPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?$`)
+
+// Environments are used in URLs and the query of the comparison API
+var environmentPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func (d *domainsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var names []string
+	if err := unmarshal(&names); err == nil {
+		*d = domainsConfig{Names: names}
+		return nil
+	}
+
+	type rawDomainsConfig domainsConfig
+	return unmarshal((*rawDomainsConfig)(d))
+}
+
+// checks returns the checks that are generated for the domains: one that
+// fails once the domain's certificate is about to expire, and one that
+// fails when the domain cannot be reached over HTTPS.
+func (d domainsConfig) checks() ([]rawCheckConfig, error) {
+	path := d.Path
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "' \t\n") {
+		return nil, fmt.Errorf("Domain path must start with '/', and cannot contain quotes or spaces: %s", path)
+	}
+	certificateInterval := d.CertificateInterval
+	if certificateInterval.isZero() {
+		certificateInterval = duration(1 * time.Hour)
+	}
+
+	checks := make([]rawCheckConfig, 0, 2*len(d.Names))
+	for _, domain := range d.Names {
+		if !domainPattern.MatchString(domain) {
+			return nil, fmt.Errorf("Invalid domain '%s' (must be a host name, with an optional port)", domain)
 		}
+		checks = append(checks,
+			rawCheckConfig{
+				Name:     fmt.Sprintf("%s certificate", domain),
+				Type:     "certificate",
+				Interval: certificateInterval,
+				Certificate: &checker.CertificateOptions{
+					Host:    domain,
+					MinDays: d.MinDays,
+				},
+			},
+			rawCheckConfig{
+				Name:     fmt.Sprintf("%s is reachable", domain),
+				Interval: d.Interval,
+				Timeout:  d.Timeout,
+				Cmd:      checkCmd(fmt.Sprintf("curl -fsSL -o /dev/null 'https://%s%s'", domain, path)),
+			},
+		)
+	}
+	return checks, nil
+}
+
+// resolveDependencies returns the statuspage checks that a check of the
+// given group depends on, as 'service/check'. Dependencies are named by the
+// name of a statuspage check of the same service, or as 'service/check'.
+func resolveDependencies(group string, names []string, statusPages map[string]map[string]bool) ([]string, error) {
+	var resolved []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		target := group + "/" + name
+		if !statusPages[group][name] {
+			parts := strings.SplitN(name, "/", 2)
+			if len(parts) != 2 || !statusPages[parts[0]][parts[1]] {
+				return nil, fmt.Errorf("'%s' is not a statuspage check", name)
+			}
+			target = name
+		}
+		if !seen[target] {
+			seen[target] = true
+			resolved = append(resolved, target)
+		}
+	}
+	return resolved, nil
+}
 
-		OnFailure   []*singleNotificationConfig `yaml:"on_failure"`
-		OnRecovered []*singleNotificationConfig `yaml:"on_recovered"`
-		OnSuccess   []*singleNotificationConfig `yaml:"on_success"`
+// cloudWatchConfig is the 'cloudwatch' option of a check, whose period is
+// written like the other durations of the config (i.e. '5m').
+type cloudWatchConfig struct {
+	checker.CloudWatchOptions `yaml:",inline"`
+	Period                    duration `yaml:",omitempty"`
+}
+
+// validate checks the options, and fills in the defaults.
+func (c *cloudWatchConfig) validate() error {
+	c.CloudWatchOptions.Period = c.Period.duration()
+	err := c.CloudWatchOptions.Validate()
+	c.Period = duration(c.CloudWatchOptions.Period)
+	return err
+}
+
+func (c *cloudWatchConfig) options() *checker.CloudWatchOptions {
+	if c == nil {
+		return nil
 	}
+	opts := c.CloudWatchOptions
+	opts.Period = c.Period.duration()
+	return &opts
+}
 
-	OnFailure   []*singleNotificationConfig `yaml:"on_failure"`
-	OnRecovered []*singleNotificationConfig `yaml:"on_recovered"`
-	OnSuccess   []*singleNotificationConfig `yaml:"on_success"`
+// limitsConfig is the 'limits' option of a check.
+type limitsConfig struct {
+	CPU    duration `yaml:"cpu,omitempty"`
+	Memory size     `yaml:",omitempty"`
+	Output size     `yaml:",omitempty"`
+}
+
+// runAsConfig is the 'runAs' option of a check. It is either a user with an
+// optional group (i.e. 'nobody' or 'nobody:nogroup'), or a map with a
+// 'user' and a 'group'.
+type runAsConfig checker.RunAsOptions
+
+func (r *runAsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		parts := strings.SplitN(str, ":", 2)
+		*r = runAsConfig{User: parts[0]}
+		if len(parts) == 2 {
+			r.Group = parts[1]
+		}
+		return nil
+	}
+
+	var opts checker.RunAsOptions
+	if err := unmarshal(&opts); err != nil {
+		return err
+	}
+	*r = runAsConfig(opts)
+	return nil
+}
+
+// groupStatusConfig is the 'status' option of a service. It is either the
+// name of a rule ('all' or 'any'), or a map with a 'quorum' (i.e. '2/3' or
+// '50%') or a 'weighted' threshold.
+type groupStatusConfig struct {
+	Rule      string
+	Quorum    float64
+	Threshold float64
+}
+
+func (g *groupStatusConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rule string
+	if err := unmarshal(&rule); err == nil {
+		if rule != groupRuleAll && rule != groupRuleAny {
+			return fmt.Errorf("Service status must be 'all', 'any', or a map with a 'quorum' or 'weighted' key")
+		}
+		*g = groupStatusConfig{Rule: rule}
+		return nil
+	}
+
+	var raw struct {
+		Quorum   string
+		Weighted *float64
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if (raw.Quorum == "") == (raw.Weighted == nil) {
+		return fmt.Errorf("Service status must have exactly one of 'quorum' and 'weighted'")
+	}
+	if raw.Weighted != nil {
+		if *raw.Weighted <= 0 {
+			return fmt.Errorf("Weighted threshold of service status must be positive")
+		}
+		*g = groupStatusConfig{Rule: groupRuleWeighted, Threshold: *raw.Weighted}
+		return nil
+	}
+
+	quorum, err := parseFraction(raw.Quorum)
+	if err != nil {
+		return fmt.Errorf("Invalid quorum in service status: %s", err)
+	}
+	if quorum <= 0 || quorum > 1 {
+		return fmt.Errorf("Quorum of service status must be more than 0 and at most 1, got: %s", raw.Quorum)
+	}
+	*g = groupStatusConfig{Rule: groupRuleQuorum, Quorum: quorum}
+	return nil
+}
+
+func (g groupStatusConfig) MarshalYAML() (interface{}, error) {
+	switch g.Rule {
+	case groupRuleQuorum:
+		return map[string]string{"quorum": strconv.FormatFloat(g.Quorum, 'g', -1, 64)}, nil
+	case groupRuleWeighted:
+		return map[string]float64{"weighted": g.Threshold}, nil
+	default:
+		return g.Rule, nil
+	}
+}
+
+// parseFraction parses a fraction written as 'n/m', a percentage or a
+// decimal number.
+func parseFraction(str string) (float64, error) {
+	str = strings.TrimSpace(str)
+	if idx := strings.Index(str, "/"); idx >= 0 {
+		num, err := strconv.ParseFloat(strings.TrimSpace(str[:idx]), 64)
+		if err != nil {
+			return 0, err
+		}
+		den, err := strconv.ParseFloat(strings.TrimSpace(str[idx+1:]), 64)
+		if err != nil {
+			return 0, err
+		}
+		if den == 0 {
+			return 0, fmt.Errorf("Division by zero in '%s'", str)
+		}
+		return num / den, nil
+	}
+	if strings.HasSuffix(str, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(str, "%")), 64)
+		return percent / 100, err
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+func (r retentionConfig) retention() history.Retention {
+	return history.Retention{
+		MaxEntries:  r.MaxEntries,
+		MaxAge:      r.MaxAge.duration(),
+		HourlyAfter: r.HourlyAfter.duration(),
+		DailyAfter:  r.DailyAfter.duration(),
+	}
+}
+
+type forecastConfig struct {
+	Threshold *float64 `yaml:",omitempty"`
+	Horizon   duration `yaml:",omitempty"`
+	Window    int      `yaml:",omitempty"`
+}
+
+type configRaw struct {
+	Name     string                 `yaml:",omitempty"`
+	URL      string                 `yaml:"url,omitempty"`
+	Port     int                    `yaml:",omitempty"`
+	HTTPS    PatrolHttpsOptions     `yaml:"https,omitempty"`
+	Admin    PatrolAdminOptions     `yaml:"admin,omitempty"`
+	DB       string                 `yaml:"db,omitempty"`
+	LogLevel string                 `yaml:"logLevel,omitempty"`
+	Compact  history.CompactOptions `yaml:",omitempty"`
+
+	// Region that checks are run from, and the instance to forward
+	// results to when running as an agent
+	Region      string                `yaml:",omitempty"`
+	RegionLabel string                `yaml:"regionLabel,omitempty"`
+	Upstream    PatrolUpstreamOptions `yaml:",omitempty"`
+
+	// Proxy for checks, notifications and forwarding results
+	Proxy *checker.ProxyOptions `yaml:",omitempty"`
+
+	// Monthly reports, and the notifications sent once they are written
+	Reports  ReportOptions               `yaml:",omitempty"`
+	OnReport []*singleNotificationConfig `yaml:"on_report,omitempty"`
+
+	// Issue tracker that checks which stay unhealthy are filed in
+	Issues *struct {
+		OpenAfter  duration            `yaml:"openAfter,omitempty"`
+		CloseAfter duration            `yaml:"closeAfter,omitempty"`
+		Severities []checker.Severity  `yaml:",omitempty"`
+		GitHub     *GitHubIssueOptions `yaml:"github,omitempty"`
+		Jira       *JiraIssueOptions   `yaml:",omitempty"`
+	} `yaml:",omitempty"`
+
+	// Pattern of the results that checks record when patrol runs with
+	// '--simulate', unless they have their own
+	Simulate *checker.SimulationOptions `yaml:",omitempty"`
+
+	// Durability mode and flush interval for history writes
+	Durability    string   `yaml:"durability,omitempty"`
+	FsyncInterval duration `yaml:"fsyncInterval,omitempty"`
+
+	// Number of results per check to keep in memory
+	MaxItemsInMemory int `yaml:"maxItemsInMemory,omitempty"`
+
+	// Number of results to keep for checks without a retention
+	MaxEntries int `yaml:"maxEntries,omitempty"`
+
+	Flapping struct {
+		Transitions int      `yaml:",omitempty"`
+		Window      duration `yaml:",omitempty"`
+	} `yaml:",omitempty"`
+
+	// Failure notifications are grouped once this many checks fail within
+	// the window
+	Grouping struct {
+		Threshold int      `yaml:",omitempty"`
+		Window    duration `yaml:",omitempty"`
+	} `yaml:",omitempty"`
+
+	// Whether to look up new releases of patrol
+	CheckUpdates bool `yaml:"checkUpdates,omitempty"`
+
+	// Reminders for failures that are not acknowledged
+	Renotify      duration `yaml:",omitempty"`
+	EscalateAfter duration `yaml:"escalateAfter,omitempty"`
+
+	// Number of intervals after which the latest result of a check is
+	// stale, which defaults to 3. Zero disables stale results.
+	StaleAfter *int `yaml:"staleAfter,omitempty"`
+
+	// Maximum number of checks that run at once. Zero does not limit
+	// checks.
+	Concurrency int `yaml:",omitempty"`
+
+	// External programs that implement types of checks, by name
+	Plugins map[string]struct {
+		Path string   `yaml:",omitempty"`
+		Args []string `yaml:",omitempty"`
+	} `yaml:",omitempty"`
+
+	Services map[string]struct {
+		Checks []rawCheckConfig `yaml:",omitempty"`
+
+		// Domains that TLS certificate and reachability checks are
+		// generated for
+		Domains *domainsConfig `yaml:",omitempty"`
+
+		Retention retentionConfig   `yaml:",omitempty"`
+		Status    groupStatusConfig `yaml:",omitempty"`
+
+		// Whether the service's checks are shown on the public status page,
+		// which checks can override
+		Public *bool `yaml:",omitempty"`
+
+		// Tags of all of the service's checks, which checks can add to
+		Tags []string `yaml:",omitempty"`
+
+		// Statuspage checks of the providers that all of the service's
+		// checks depend on, which checks can add to
+		DependsOn []string `yaml:"dependsOn,omitempty"`
+
+		// Environment that the service runs in (i.e. 'prod'), and the
+		// service in another environment that runs the same checks, which
+		// it is compared to
+		Environment string `yaml:",omitempty"`
+		Mirrors     string `yaml:",omitempty"`
+
+		OnFailure   []*singleNotificationConfig `yaml:"on_failure,omitempty"`
+		OnRecovered []*singleNotificationConfig `yaml:"on_recovered,omitempty"`
+		OnSuccess   []*singleNotificationConfig `yaml:"on_success,omitempty"`
+		OnFlapping  []*singleNotificationConfig `yaml:"on_flapping,omitempty"`
+		OnDegraded  []*singleNotificationConfig `yaml:"on_degraded,omitempty"`
+		OnForecast  []*singleNotificationConfig `yaml:"on_forecast,omitempty"`
+		OnChange    []*singleNotificationConfig `yaml:"on_change,omitempty"`
+		OnComment   []*singleNotificationConfig `yaml:"on_comment,omitempty"`
+		OnEscalated []*singleNotificationConfig `yaml:"on_escalation,omitempty"`
+	} `yaml:",omitempty"`
+
+	OnFailure   []*singleNotificationConfig `yaml:"on_failure,omitempty"`
+	OnRecovered []*singleNotificationConfig `yaml:"on_recovered,omitempty"`
+	OnSuccess   []*singleNotificationConfig `yaml:"on_success,omitempty"`
+	OnFlapping  []*singleNotificationConfig `yaml:"on_flapping,omitempty"`
+	OnDegraded  []*singleNotificationConfig `yaml:"on_degraded,omitempty"`
+	OnForecast  []*singleNotificationConfig `yaml:"on_forecast,omitempty"`
+	OnChange    []*singleNotificationConfig `yaml:"on_change,omitempty"`
+	OnComment   []*singleNotificationConfig `yaml:"on_comment,omitempty"`
+	OnEscalated []*singleNotificationConfig `yaml:"on_escalation,omitempty"`
 }
 
 func FromConfigFile(filePath string, historyOptions *history.NewOptions) (*Patrol, configRaw, error) {
@@ -98,10 +599,20 @@ func FromConfig(data []byte, historyOptions *history.NewOptions) (patrol *Patrol
 		Port:               uint32(raw.Port),
 		LogLevel:           logLevel,
 		GroupEventHandlers: make(map[string]EventHandlers),
+		GroupStatusRules:   make(map[string]GroupStatusRule),
+		Simulations:        make(map[string]map[string]*checker.SimulationOptions),
+		Environments:       make(map[string]GroupEnvironment),
 		GlobalEventHandlers: EventHandlers{
 			"healthy":   raw.OnSuccess,
 			"recovered": raw.OnRecovered,
 			"unhealthy": raw.OnFailure,
+			"flapping":  raw.OnFlapping,
+			"degraded":  raw.OnDegraded,
+			"forecast":  raw.OnForecast,
+			"changed":   raw.OnChange,
+			"comment":   raw.OnComment,
+			"escalated": raw.OnEscalated,
+			"report":    raw.OnReport,
 		},
 	}
 
@@ -111,47 +622,507 @@ func FromConfig(data []byte, historyOptions *history.NewOptions) (patrol *Patrol
 		patrolOpts.History = *historyOptions
 	}
 	patrolOpts.History.Compact = raw.Compact
+	patrolOpts.History.Durability, err = history.ParseDurability(raw.Durability)
+	if err != nil {
+		return
+	}
+	raw.Durability = string(patrolOpts.History.Durability)
+	patrolOpts.History.FsyncInterval = raw.FsyncInterval.duration()
+	patrolOpts.History.MaxItemsInMemory = raw.MaxItemsInMemory
+	patrolOpts.History.MaxEntries = raw.MaxEntries
+	patrolOpts.History.Retention = make(map[string]map[string]history.Retention, len(raw.Services))
 	patrolOpts.History.LogLevel = logLevel
 
 	if raw.HTTPS.Cert != "" && raw.HTTPS.Key != "" {
 		patrolOpts.HTTPS = &raw.HTTPS
 	}
+	if raw.Admin.Username != "" || raw.Admin.Password != "" {
+		if raw.Admin.Username == "" || raw.Admin.Password == "" {
+			err = fmt.Errorf("Both 'username' and 'password' must be specified for admin")
+			return
+		}
+		for username, password := range raw.Admin.Responders {
+			if password == "" {
+				err = fmt.Errorf("A password must be specified for responder: %s", username)
+				return
+			}
+		}
+		patrolOpts.Admin = &raw.Admin
+	}
+	patrolOpts.Region = raw.Region
+	patrolOpts.RegionLabel = raw.RegionLabel
+	patrolOpts.Proxy = raw.Proxy
+	if raw.Reports.Dir != "" {
+		if info, statErr := os.Stat(raw.Reports.Dir); statErr != nil || !info.IsDir() {
+			err = fmt.Errorf("Reports directory does not exist: %s", raw.Reports.Dir)
+			return
+		}
+		patrolOpts.Reports = &raw.Reports
+	}
+	if raw.Issues != nil {
+		if raw.Issues.OpenAfter.isZero() {
+			raw.Issues.OpenAfter = duration(15 * time.Minute)
+		}
+		if raw.Issues.CloseAfter.isZero() {
+			raw.Issues.CloseAfter = raw.Issues.OpenAfter
+		}
+		patrolOpts.Issues = &IssueOptions{
+			OpenAfter:  raw.Issues.OpenAfter.duration(),
+			CloseAfter: raw.Issues.CloseAfter.duration(),
+			Severities: raw.Issues.Severities,
+			GitHub:     raw.Issues.GitHub,
+			Jira:       raw.Issues.Jira,
+		}
+		if err = patrolOpts.Issues.Validate(); err != nil {
+			return
+		}
+		for _, severity := range raw.Issues.Severities {
+			if _, err = checker.ParseSeverity(string(severity)); err != nil {
+				err = fmt.Errorf("Invalid severity for issues: %s", err)
+				return
+			}
+		}
+	}
+	if raw.Simulate != nil {
+		if err = raw.Simulate.Validate(); err != nil {
+			err = fmt.Errorf("Invalid simulate options: %s", err)
+			return
+		}
+	}
+	if raw.Upstream.URL != "" {
+		if raw.Region == "" {
+			err = fmt.Errorf("A 'region' must be specified to forward results upstream")
+			return
+		}
+		patrolOpts.Upstream = &raw.Upstream
+	}
+	for name, plugin := range raw.Plugins {
+		if plugin.Path == "" {
+			err = fmt.Errorf("Plugin '%s' is missing a path", name)
+			return
+		}
+	}
+	if raw.Flapping.Transitions != 0 || !raw.Flapping.Window.isZero() {
+		if raw.Flapping.Transitions <= 0 || raw.Flapping.Window.isZero() {
+			err = fmt.Errorf("Both 'transitions' and 'window' must be specified for flapping")
+			return
+		}
+		patrolOpts.Flapping = &FlappingOptions{
+			Transitions: raw.Flapping.Transitions,
+			Window:      raw.Flapping.Window.duration(),
+		}
+	}
 
-	// Just a random guess for size, estimating about 5 checks for
-	// each defined service
-	patrolOpts.Checkers = make([]*checker.Checker, 0, len(raw.Services)*5)
+	if raw.Grouping.Threshold != 0 || !raw.Grouping.Window.isZero() {
+		if raw.Grouping.Threshold < 2 || raw.Grouping.Window.isZero() {
+			err = fmt.Errorf("Both 'threshold' (at least 2) and 'window' must be specified for grouping")
+			return
+		}
+		patrolOpts.Grouping = &GroupingOptions{
+			Threshold: raw.Grouping.Threshold,
+			Window:    raw.Grouping.Window.duration(),
+		}
+	}
+	if raw.URL != "" {
+		if u, parseErr := url.Parse(raw.URL); parseErr != nil || u.Host == "" {
+			err = fmt.Errorf("Invalid url: '%s'", raw.URL)
+			return
+		}
+		patrolOpts.URL = raw.URL
+	}
+	patrolOpts.CheckUpdates = raw.CheckUpdates
+	patrolOpts.Renotify = raw.Renotify.duration()
+	patrolOpts.EscalateAfter = raw.EscalateAfter.duration()
 
-	historyFile, err := history.New(patrolOpts.History)
-	if err != nil {
+	patrolOpts.StaleAfter = 3
+	if raw.StaleAfter != nil {
+		if *raw.StaleAfter < 0 {
+			err = fmt.Errorf("'staleAfter' cannot be negative")
+			return
+		}
+		patrolOpts.StaleAfter = *raw.StaleAfter
+	}
+	raw.StaleAfter = &patrolOpts.StaleAfter
+	if raw.Concurrency < 0 {
+		err = fmt.Errorf("'concurrency' cannot be negative")
 		return
 	}
+	patrolOpts.Concurrency = raw.Concurrency
+
+	// Just a random guess for size, estimating about 5 checks for
+	// each defined service
+	patrolOpts.Checkers = make([]*checker.Checker, 0, len(raw.Services)*5)
 
 	if len(raw.Services) == 0 {
 		err = fmt.Errorf("Config file contains no services")
 		return
 	}
 	for group, groupConfig := range raw.Services {
+		if groupConfig.Environment == "" {
+			if groupConfig.Mirrors != "" {
+				err = fmt.Errorf("%s mirrors %s, but has no environment", group, groupConfig.Mirrors)
+				return
+			}
+			continue
+		}
+		if !environmentPattern.MatchString(groupConfig.Environment) {
+			err = fmt.Errorf("Invalid environment of %s: '%s' (environments can only contain letters, digits, dots, dashes and underscores)", group, groupConfig.Environment)
+			return
+		}
+		service := group
+		if groupConfig.Mirrors != "" {
+			mirrored, ok := raw.Services[groupConfig.Mirrors]
+			if !ok {
+				err = fmt.Errorf("%s mirrors %s, which does not exist", group, groupConfig.Mirrors)
+				return
+			}
+			if mirrored.Mirrors != "" {
+				err = fmt.Errorf("%s mirrors %s, which mirrors %s itself", group, groupConfig.Mirrors, mirrored.Mirrors)
+				return
+			}
+			if mirrored.Environment == "" || mirrored.Environment == groupConfig.Environment {
+				err = fmt.Errorf("%s mirrors %s, which must be in a different environment", group, groupConfig.Mirrors)
+				return
+			}
+			service = groupConfig.Mirrors
+		}
+		patrolOpts.Environments[group] = GroupEnvironment{
+			Name:    groupConfig.Environment,
+			Service: service,
+		}
+	}
+	// Checks of the status pages of providers, which other checks can
+	// depend on
+	statusPages := make(map[string]map[string]bool)
+	for group, groupConfig := range raw.Services {
+		for _, checkConfig := range groupConfig.Checks {
+			if checkConfig.StatusPage != nil {
+				if _, ok := statusPages[group]; !ok {
+					statusPages[group] = make(map[string]bool)
+				}
+				statusPages[group][checkConfig.Name] = true
+			}
+		}
+	}
+	for group, groupConfig := range raw.Services {
+		if groupConfig.Domains != nil {
+			generated, domainsErr := groupConfig.Domains.checks()
+			if domainsErr != nil {
+				err = fmt.Errorf("Invalid domains in %s: %s", group, domainsErr)
+				return
+			}
+			names := make(map[string]bool, len(groupConfig.Checks))
+			for _, checkConfig := range groupConfig.Checks {
+				names[checkConfig.Name] = true
+			}
+			for _, checkConfig := range generated {
+				if names[checkConfig.Name] {
+					err = fmt.Errorf("Check '%s' in %s is generated from its domains, and cannot be defined twice", checkConfig.Name, group)
+					return
+				}
+				names[checkConfig.Name] = true
+			}
+			groupConfig.Checks = append(groupConfig.Checks, generated...)
+		}
 		if groupConfig.Checks == nil || len(groupConfig.Checks) == 0 {
 			err = fmt.Errorf("Empty group '%s' defined in config", group)
 			return
 		}
+		statusRule := GroupStatusRule{
+			Rule:      groupConfig.Status.Rule,
+			Quorum:    groupConfig.Status.Quorum,
+			Threshold: groupConfig.Status.Threshold,
+			Weights:   make(map[string]float64),
+		}
 
 		for idx, checkConfig := range groupConfig.Checks {
 			if checkConfig.Type == "" {
 				checkConfig.Type = "boolean"
 			}
+			configType := checkConfig.Type
 			if checkConfig.Name == "" {
 				err = fmt.Errorf("%d-th check missing name in %s", idx, group)
 				return
 			}
-			if checkConfig.Cmd.isZero() {
+			// Checks of these types poll a source instead of running a cmd
+			sources := []struct {
+				name       string
+				configured bool
+				unit       string
+			}{
+				{"snmp", checkConfig.SNMP != nil, ""},
+				{"rabbitmq", checkConfig.RabbitMQ != nil, "messages"},
+				{"kafka", checkConfig.Kafka != nil, "messages"},
+				{"domain", checkConfig.Domain != nil, "days"},
+				{"ntp", checkConfig.NTP != nil, "ms"},
+				{"content", checkConfig.Content != nil, ""},
+				{"logwatch", checkConfig.LogWatch != nil, ""},
+				{"certificate", checkConfig.Certificate != nil, "days"},
+				{"prometheus", checkConfig.Prometheus != nil, ""},
+				{"cloudwatch", checkConfig.CloudWatch != nil, ""},
+				{"statuspage", checkConfig.StatusPage != nil, ""},
+			}
+			polled := false
+			for _, source := range sources {
+				if source.configured && checkConfig.Type != source.name {
+					err = fmt.Errorf("%d-th check in %s has %s options, but is not of type %s", idx, group, source.name, source.name)
+					return
+				}
+				if checkConfig.Type != source.name {
+					continue
+				}
+				if !source.configured {
+					err = fmt.Errorf("%d-th check in %s is of type %s but is missing %s options", idx, group, source.name, source.name)
+					return
+				}
+				if !checkConfig.Cmd.isZero() || checkConfig.Plugin != "" {
+					err = fmt.Errorf("%d-th check in %s is of type %s and cannot specify a cmd or plugin", idx, group, source.name)
+					return
+				}
+
+				var sourceErr error
+				switch source.name {
+				case "snmp":
+					// SNMP checks record the first value if it has a unit
+					sourceErr = checkConfig.SNMP.Validate()
+					checkConfig.Type = "boolean"
+					if checkConfig.MetricUnit != "" {
+						checkConfig.Type = "metric"
+					}
+				case "rabbitmq":
+					sourceErr = checkConfig.RabbitMQ.Validate()
+					checkConfig.Type = "metric"
+				case "kafka":
+					sourceErr = checkConfig.Kafka.Validate()
+					checkConfig.Type = "metric"
+				case "domain":
+					sourceErr = checkConfig.Domain.Validate()
+					checkConfig.Type = "metric"
+				case "ntp":
+					sourceErr = checkConfig.NTP.Validate()
+					checkConfig.Type = "metric"
+				case "content":
+					sourceErr = checkConfig.Content.Validate()
+					checkConfig.Type = "boolean"
+				case "certificate":
+					sourceErr = checkConfig.Certificate.Validate()
+					checkConfig.Type = "metric"
+				case "prometheus":
+					sourceErr = checkConfig.Prometheus.Validate()
+					checkConfig.Type = "metric"
+				case "cloudwatch":
+					sourceErr = checkConfig.CloudWatch.validate()
+					checkConfig.Type = "metric"
+				case "statuspage":
+					// Outages of providers are not outages of the
+					// service, unless a severity is given
+					sourceErr = checkConfig.StatusPage.Validate()
+					checkConfig.Type = "boolean"
+					if checkConfig.Severity == "" {
+						checkConfig.Severity = string(checker.SeverityInfo)
+					}
+				case "logwatch":
+					// Each run only sees new lines, so samples would be empty
+					sourceErr = checkConfig.LogWatch.Validate()
+					if sourceErr == nil && checkConfig.Samples > 1 {
+						sourceErr = fmt.Errorf("Multiple samples are not supported")
+					}
+					checkConfig.Type = "boolean"
+					if checkConfig.MetricUnit != "" {
+						checkConfig.Type = "metric"
+					}
+				}
+				if sourceErr != nil {
+					err = fmt.Errorf("%d-th check in %s has invalid %s options: %s", idx, group, source.name, sourceErr)
+					return
+				}
+				if checkConfig.Type == "metric" && checkConfig.MetricUnit == "" {
+					checkConfig.MetricUnit = source.unit
+				}
+				polled = true
+			}
+			if checkConfig.External {
+				if !checkConfig.Cmd.isZero() || checkConfig.Plugin != "" || polled {
+					err = fmt.Errorf("%d-th check in %s is external and cannot specify a cmd, plugin or source", idx, group)
+					return
+				}
+				if checkConfig.Samples > 1 || len(checkConfig.AddressFamilies) > 0 || checkConfig.Quorum > 0 {
+					err = fmt.Errorf("%d-th check in %s is external, so it cannot take samples, verify address families or use a quorum", idx, group)
+					return
+				}
+				polled = true
+			}
+			var plugin *checker.Plugin
+			if checkConfig.Plugin != "" {
+				pluginConfig, ok := raw.Plugins[checkConfig.Plugin]
+				if !ok {
+					err = fmt.Errorf("%d-th check in %s uses undefined plugin '%s'", idx, group, checkConfig.Plugin)
+					return
+				}
+				if !checkConfig.Cmd.isZero() {
+					err = fmt.Errorf("%d-th check in %s cannot specify both a cmd and a plugin", idx, group)
+					return
+				}
+				plugin = &checker.Plugin{
+					Name: checkConfig.Plugin,
+					Path: pluginConfig.Path,
+					Args: pluginConfig.Args,
+				}
+			} else if checkConfig.Cmd.isZero() && !polled {
 				err = fmt.Errorf("%d-th check missing cmd in %s", idx, group)
 				return
+			} else if checkConfig.Config != nil {
+				err = fmt.Errorf("%d-th check in %s has a config, but no plugin", idx, group)
+				return
 			}
 			if checkConfig.Type == "metric" && checkConfig.MetricUnit == "" {
 				err = fmt.Errorf("%d-th check is of type metric but is missing unit in %s", idx, group)
 				return
 			}
+			var limits *checker.LimitOptions
+			if checkConfig.Limits != nil {
+				if polled {
+					err = fmt.Errorf("%d-th check in %s does not run a cmd or plugin, so it cannot have limits", idx, group)
+					return
+				}
+				limits = &checker.LimitOptions{
+					CPU:    checkConfig.Limits.CPU.duration(),
+					Memory: int64(checkConfig.Limits.Memory),
+					Output: int64(checkConfig.Limits.Output),
+				}
+				if limitsErr := limits.Validate(); limitsErr != nil {
+					err = fmt.Errorf("%d-th check in %s has invalid limits: %s", idx, group, limitsErr)
+					return
+				}
+			}
+			var runAs *checker.RunAsOptions
+			if checkConfig.RunAs != nil {
+				if polled {
+					err = fmt.Errorf("%d-th check in %s does not run a cmd or plugin, so it cannot run as another user", idx, group)
+					return
+				}
+				runAs = (*checker.RunAsOptions)(checkConfig.RunAs)
+				if runAsErr := runAs.Validate(); runAsErr != nil {
+					err = fmt.Errorf("%d-th check in %s has invalid runAs: %s", idx, group, runAsErr)
+					return
+				}
+			}
+			if checkConfig.Anomaly != nil {
+				if checkConfig.Type != "metric" {
+					err = fmt.Errorf("%d-th check in %s has anomaly detection but is not of type metric", idx, group)
+					return
+				}
+				if checkConfig.Anomaly.Window < 2 || checkConfig.Anomaly.Deviations <= 0 {
+					err = fmt.Errorf("%d-th check in %s must specify a 'window' of at least 2 and positive 'deviations' for anomaly detection", idx, group)
+					return
+				}
+			}
+			if checkConfig.Samples < 0 || (checkConfig.Samples > 1 && checkConfig.Type != "metric") {
+				err = fmt.Errorf("%d-th check in %s can only take multiple samples if it is of type metric", idx, group)
+				return
+			}
+			if checkConfig.Quorum < 0 {
+				err = fmt.Errorf("%d-th check in %s has a negative quorum", idx, group)
+				return
+			}
+			for _, family := range checkConfig.AddressFamilies {
+				if !checker.ValidAddressFamily(family) {
+					err = fmt.Errorf("%d-th check in %s has invalid address family '%s' (must be 'ipv4' or 'ipv6')", idx, group, family)
+					return
+				}
+			}
+			if len(checkConfig.AddressFamilies) > 0 && checkConfig.Type != "boolean" {
+				err = fmt.Errorf("%d-th check in %s can only verify address families if it is of type boolean", idx, group)
+				return
+			}
+			tags := append(append([]string{}, groupConfig.Tags...), checkConfig.Tags...)
+			for _, tag := range tags {
+				if tag == "" || strings.ContainsAny(tag, " \t,") {
+					err = fmt.Errorf("%d-th check in %s has an invalid tag: '%s' (tags cannot be empty or contain spaces or commas)", idx, group, tag)
+					return
+				}
+			}
+			dependsOn, dependsErr := resolveDependencies(group, append(append([]string{}, groupConfig.DependsOn...), checkConfig.DependsOn...), statusPages)
+			if dependsErr != nil {
+				err = fmt.Errorf("%d-th check in %s has an invalid dependency: %s", idx, group, dependsErr)
+				return
+			}
+			if checkConfig.RunbookURL != "" {
+				if u, parseErr := url.Parse(checkConfig.RunbookURL); parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					err = fmt.Errorf("%d-th check in %s has an invalid runbook_url: '%s' (must be an http or https URL)", idx, group, checkConfig.RunbookURL)
+					return
+				}
+			}
+			simulation := checkConfig.Simulate
+			if simulation == nil && raw.Simulate != nil {
+				simulation = &checker.SimulationOptions{}
+				*simulation = *raw.Simulate
+			}
+			if simulation != nil {
+				if simErr := simulation.Validate(); simErr != nil {
+					err = fmt.Errorf("%d-th check in %s has invalid simulate options: %s", idx, group, simErr)
+					return
+				}
+				if _, ok := patrolOpts.Simulations[group]; !ok {
+					patrolOpts.Simulations[group] = make(map[string]*checker.SimulationOptions)
+				}
+				patrolOpts.Simulations[group][checkConfig.Name] = simulation
+			}
+			if checkConfig.TLS != nil {
+				if _, tlsErr := checkConfig.TLS.Config(); tlsErr != nil {
+					err = fmt.Errorf("%d-th check in %s has invalid tls options: %s", idx, group, tlsErr)
+					return
+				}
+			}
+			proxy := raw.Proxy
+			if checkConfig.Proxy != nil {
+				proxy = checkConfig.Proxy
+			}
+			var forecast *checker.ForecastOptions
+			if checkConfig.Forecast != nil {
+				if checkConfig.Type != "metric" {
+					err = fmt.Errorf("%d-th check in %s has forecasting but is not of type metric", idx, group)
+					return
+				}
+				if checkConfig.Forecast.Threshold == nil || checkConfig.Forecast.Horizon.isZero() {
+					err = fmt.Errorf("%d-th check in %s must specify a 'threshold' and 'horizon' for forecasting", idx, group)
+					return
+				}
+				forecast = &checker.ForecastOptions{
+					Threshold: *checkConfig.Forecast.Threshold,
+					Horizon:   checkConfig.Forecast.Horizon.duration(),
+					Window:    checkConfig.Forecast.Window,
+				}
+				if forecast.Window == 0 {
+					forecast.Window = 30
+				} else if forecast.Window < 2 {
+					err = fmt.Errorf("%d-th check in %s must use a forecasting 'window' of at least 2", idx, group)
+					return
+				}
+				checkConfig.Forecast.Window = forecast.Window
+			}
+			if checkConfig.Weight != nil {
+				if *checkConfig.Weight < 0 {
+					err = fmt.Errorf("%d-th check in %s has a negative weight", idx, group)
+					return
+				}
+				statusRule.Weights[checkConfig.Name] = *checkConfig.Weight
+			}
+			severity, severityErr := checker.ParseSeverity(checkConfig.Severity)
+			if severityErr != nil {
+				err = fmt.Errorf("%d-th check in %s has invalid severity: %s", idx, group, severityErr)
+				return
+			}
+			priority, priorityErr := checker.ParsePriority(checkConfig.Priority)
+			if priorityErr != nil {
+				err = fmt.Errorf("%d-th check in %s has invalid priority: %s", idx, group, priorityErr)
+				return
+			}
+			dedupe, dedupeErr := history.ParseDedupe(checkConfig.Dedupe)
+			if dedupeErr != nil {
+				err = fmt.Errorf("%d-th check in %s has invalid dedupe: %s", idx, group, dedupeErr)
+				return
+			}
 			if checkConfig.Interval.isZero() {
 				checkConfig.Interval = duration(60 * time.Second)
 			}
@@ -159,24 +1130,156 @@ func FromConfig(data []byte, historyOptions *history.NewOptions) (patrol *Patrol
 				checkConfig.Timeout = duration(3 * time.Minute)
 			}
 
-			groupConfig.Checks[idx] = checkConfig
-			patrolOpts.Checkers = append(patrolOpts.Checkers, checker.New(&checker.Checker{
+			retention := groupConfig.Retention.merge(checkConfig.Retention).retention()
+			if retention.MaxEntries < 0 || retention.MaxAge < 0 || retention.HourlyAfter < 0 || retention.DailyAfter < 0 {
+				err = fmt.Errorf("%d-th check in %s has a negative retention", idx, group)
+				return
+			}
+			if checkConfig.Type != "metric" {
+				// Downsampling that is set on the service only applies to
+				// its metric checks
+				if !checkConfig.Retention.HourlyAfter.isZero() || !checkConfig.Retention.DailyAfter.isZero() {
+					err = fmt.Errorf("%d-th check in %s is not a metric check, so its results cannot be downsampled", idx, group)
+					return
+				}
+				retention.HourlyAfter = 0
+				retention.DailyAfter = 0
+			}
+			if dedupe == history.DedupeIdentical && (retention.HourlyAfter > 0 || retention.DailyAfter > 0) {
+				err = fmt.Errorf("%d-th check in %s collapses identical results, so its results cannot be downsampled", idx, group)
+				return
+			}
+			if retention.HourlyAfter > 0 && retention.DailyAfter > 0 && retention.DailyAfter < retention.HourlyAfter {
+				err = fmt.Errorf("%d-th check in %s aggregates its results daily before hourly (dailyAfter must not be less than hourlyAfter)", idx, group)
+				return
+			}
+			if _, ok := patrolOpts.History.Retention[group]; !ok {
+				patrolOpts.History.Retention[group] = make(map[string]history.Retention, len(groupConfig.Checks))
+			}
+			patrolOpts.History.Retention[group][checkConfig.Name] = retention
+
+			public := true
+			if checkConfig.Public != nil {
+				public = *checkConfig.Public
+			} else if groupConfig.Public != nil {
+				public = *groupConfig.Public
+			}
+
+			// The check is stored with the options that it inherits, so
+			// that the config can be printed as it is resolved. Checks
+			// that poll a source keep the type of the source.
+			resolved := checkConfig
+			resolved.Type = configType
+			resolved.Public = &public
+			resolved.Proxy = proxy
+			resolved.Simulate = simulation
+			if len(tags) > 0 {
+				resolved.Tags = tags
+			}
+			resolved.DependsOn = dependsOn
+			resolved.Severity = string(severity)
+			resolved.Priority = string(priority)
+			resolved.Retention = retentionConfig{
+				MaxEntries:  retention.MaxEntries,
+				MaxAge:      duration(retention.MaxAge),
+				HourlyAfter: duration(retention.HourlyAfter),
+				DailyAfter:  duration(retention.DailyAfter),
+			}
+			groupConfig.Checks[idx] = resolved
+			patrolOpts.Checkers = append(patrolOpts.Checkers, &checker.Checker{
 				Group:      group,
 				Name:       checkConfig.Name,
 				Type:       checkConfig.Type,
 				Cmd:        checkConfig.Cmd.String(),
 				MetricUnit: checkConfig.MetricUnit,
+				Severity:   severity,
+				Priority:   priority,
+				Private:    !public,
+				Owner:      checkConfig.Owner,
+				RunbookURL: checkConfig.RunbookURL,
+				Tags:       tags,
+				DependsOn:  dependsOn,
+				Dedupe:     dedupe,
+				Retention:  retention,
+				Anomaly:    checkConfig.Anomaly,
+				Forecast:   forecast,
+				Samples:    checkConfig.Samples,
+				Region:     raw.Region,
+				Quorum:     checkConfig.Quorum,
+				Proxy:      proxy,
+				TLS:        checkConfig.TLS,
+				RunAs:      runAs,
+				Limits:     limits,
 				Interval:   checkConfig.Interval.duration(),
 				CmdTimeout: checkConfig.Timeout.duration(),
-				History:    historyFile,
-			}))
+
+				External:        checkConfig.External,
+				AddressFamilies: checkConfig.AddressFamilies,
+				Plugin:          plugin,
+				PluginConfig:    checkConfig.Config,
+				SNMP:            checkConfig.SNMP,
+				RabbitMQ:        checkConfig.RabbitMQ,
+				Kafka:           checkConfig.Kafka,
+				Domain:          checkConfig.Domain,
+				NTP:             checkConfig.NTP,
+				Content:         checkConfig.Content,
+				LogWatch:        checkConfig.LogWatch,
+				Certificate:     checkConfig.Certificate,
+				Prometheus:      checkConfig.Prometheus,
+				CloudWatch:      checkConfig.CloudWatch.options(),
+				StatusPage:      checkConfig.StatusPage,
+			})
 		}
 
+		totalWeight := 0.0
+		for _, checkConfig := range groupConfig.Checks {
+			totalWeight += statusRule.weight(checkConfig.Name)
+		}
+		if totalWeight == 0 {
+			err = fmt.Errorf("At least one check in %s must have a weight above 0", group)
+			return
+		}
+		if statusRule.Rule == groupRuleWeighted && statusRule.Threshold > totalWeight {
+			err = fmt.Errorf("Weighted status of %s has a threshold of %g, but its checks only weigh %g in total", group, statusRule.Threshold, totalWeight)
+			return
+		}
+		patrolOpts.GroupStatusRules[group] = statusRule
+
 		patrolOpts.GroupEventHandlers[group] = EventHandlers{
 			"healthy":   groupConfig.OnSuccess,
 			"recovered": groupConfig.OnRecovered,
 			"unhealthy": groupConfig.OnFailure,
+			"flapping":  groupConfig.OnFlapping,
+			"degraded":  groupConfig.OnDegraded,
+			"forecast":  groupConfig.OnForecast,
+			"changed":   groupConfig.OnChange,
+			"comment":   groupConfig.OnComment,
+			"escalated": groupConfig.OnEscalated,
+		}
+		if err = patrolOpts.GroupEventHandlers[group].validate(); err != nil {
+			return
+		}
+
+		// Generated checks replace the domains they were generated from
+		groupConfig.Domains = nil
+		if groupConfig.Status.Rule == "" {
+			groupConfig.Status.Rule = groupRuleAll
 		}
+		raw.Services[group] = groupConfig
+	}
+	if err = patrolOpts.GlobalEventHandlers.validate(); err != nil {
+		return
+	}
+
+	// The history file is opened once all checks are known, so that their
+	// retention is applied while reading the existing history
+	historyFile, err := history.New(patrolOpts.History)
+	if err != nil {
+		return
+	}
+	for _, c := range patrolOpts.Checkers {
+		c.History = historyFile
+		checker.New(c)
 	}
 
 	patrol, err = New(patrolOpts, historyFile)
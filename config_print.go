@@ -0,0 +1,171 @@
+package patrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/karimsa/patrol/internal/history"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats that a config can be written in
+const (
+	ConfigFormatYAML = "yaml"
+	ConfigFormatJSON = "json"
+)
+
+// Replaces secrets in configs that are written out
+const hiddenSecret = "(hidden)"
+
+// dryRunConfig loads a config with a temporary history file, so that the
+// config's own history file is not opened or created, and returns the
+// config as it was resolved.
+func dryRunConfig(data []byte) (configRaw, error) {
+	dir, err := ioutil.TempDir("", "patrol-config")
+	if err != nil {
+		return configRaw{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	p, raw, err := FromConfig(data, &history.NewOptions{File: filepath.Join(dir, "data.db")})
+	if err != nil {
+		return configRaw{}, err
+	}
+	return raw, p.Shutdown(context.Background())
+}
+
+// ValidateConfig checks that a config can be loaded, without opening or
+// creating its history file.
+func ValidateConfig(data []byte) error {
+	_, err := dryRunConfig(data)
+	return err
+}
+
+// WriteConfig validates a config like ValidateConfig, and writes it back
+// out as YAML or JSON. If resolved is set, the config is written the way
+// patrol runs it: checks that are generated from domains are listed, and
+// checks include the options that they inherit from their service or from
+// the top level, and the defaults of options that are not set. Secrets,
+// which are the fields of the config's types that are tagged with
+// 'secret', are hidden.
+func WriteConfig(out io.Writer, data []byte, resolved bool, format string) error {
+	if format != ConfigFormatYAML && format != ConfigFormatJSON {
+		return fmt.Errorf("Unrecognized config format: '%s' (must be yaml or json)", format)
+	}
+
+	var raw configRaw
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return err
+	}
+	resolvedRaw, err := dryRunConfig(data)
+	if err != nil {
+		return err
+	}
+	if resolved {
+		raw = resolvedRaw
+	}
+	redactSecrets(reflect.ValueOf(&raw))
+
+	// The config is encoded as YAML first, so that JSON uses the same keys
+	buf, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	if format == ConfigFormatYAML {
+		_, err = out.Write(buf)
+		return err
+	}
+
+	var value interface{}
+	if err := yaml.Unmarshal(buf, &value); err != nil {
+		return err
+	}
+	if value, err = jsonValue(value); err != nil {
+		return err
+	}
+	if buf, err = json.MarshalIndent(value, "", "\t"); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", buf)
+	return err
+}
+
+// redactSecrets replaces the values of the fields of a config that are
+// tagged with 'secret', in place. Fields tagged with 'secret:"url"' keep
+// the scheme and host of their URL, so that it is still clear where they
+// point to.
+func redactSecrets(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			redactSecrets(value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if mode := field.Tag.Get("secret"); mode != "" {
+				hideSecret(value.Field(i), mode)
+			} else {
+				redactSecrets(value.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			redactSecrets(value.Index(i))
+		}
+	case reflect.Map:
+		// Values of maps cannot be modified, so they are replaced
+		for _, key := range value.MapKeys() {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			elem.Set(value.MapIndex(key))
+			redactSecrets(elem)
+			value.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// hideSecret replaces the value of a secret field. Maps are replaced
+// instead of being modified, since they may be shared with other configs.
+func hideSecret(value reflect.Value, mode string) {
+	switch {
+	case value.Kind() == reflect.String && value.String() != "":
+		if mode == "url" {
+			value.SetString(hideURL(value.String()))
+		} else {
+			value.SetString(hiddenSecret)
+		}
+	case value.Kind() == reflect.Map && value.Type().Elem().Kind() == reflect.String && !value.IsNil():
+		hidden := reflect.MakeMap(value.Type())
+		for _, key := range value.MapKeys() {
+			hidden.SetMapIndex(key, reflect.ValueOf(hiddenSecret).Convert(value.Type().Elem()))
+		}
+		value.Set(hidden)
+	case value.Type() == reflect.TypeOf(&url.URL{}) && !value.IsNil():
+		u, _ := url.Parse(hideURL(value.Interface().(*url.URL).String()))
+		value.Set(reflect.ValueOf(u))
+	}
+}
+
+// hideURL hides the credentials, path and query of a URL, which is where
+// webhooks and proxies keep their secrets.
+func hideURL(str string) string {
+	u, err := url.Parse(str)
+	if err != nil || u.Host == "" {
+		return hiddenSecret
+	}
+	if u.User == nil && strings.Trim(u.Path, "/") == "" && u.RawQuery == "" {
+		return str
+	}
+	return u.Scheme + "://" + u.Host + "/" + hiddenSecret
+}
@@ -0,0 +1,289 @@
+package patrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Number of attempts after which a delivery has failed
+const maxDeliveryAttempts = 6
+
+// Delay before the first retry of a delivery, which doubles with each
+// attempt, and the interval at which deliveries are checked for retries.
+// Both are replaced by tests.
+var (
+	deliveryBackoff       = 30 * time.Second
+	deliveryRetryInterval = 10 * time.Second
+)
+
+// Maximum number of delivery failures that are listed by the admin status
+const maxListedDeliveryFailures = 50
+
+var lastDeliveryID uint64
+
+// newDeliveryID returns an ID that is unique across restarts.
+func newDeliveryID() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&lastDeliveryID, 1))
+}
+
+// deliver sends a notification through a notifier in the background. The
+// delivery is recorded in the history file before it is sent, so that it is
+// retried while the notifier is unreachable, even across restarts.
+func (p *Patrol) deliver(n *singleNotificationConfig, event notificationEvent) {
+	if n.Webhook == nil {
+		p.logger.Warnf("Could not send notification using empty notifier")
+		return
+	}
+	details, err := json.Marshal(event)
+	if err != nil {
+		p.logger.Warnf("Failed to encode notification for %s: %s", n.name(), err)
+		return
+	}
+
+	d := history.Delivery{
+		ID:        newDeliveryID(),
+		Notifier:  n.name(),
+		Event:     event.Status,
+		Group:     event.Group,
+		Name:      event.Check,
+		Details:   details,
+		Status:    history.DeliveryPending,
+		CreatedAt: time.Now(),
+	}
+	if err := p.History.SetDelivery(d); err != nil {
+		p.logger.Warnf("Failed to record delivery through %s: %s", d.Notifier, err)
+	}
+	p.goBackground(func() { p.attemptDelivery(n, d) })
+}
+
+// startDelivery marks a delivery as being sent, and returns false if it is
+// already being sent.
+func (p *Patrol) startDelivery(id string) bool {
+	p.deliveryMux.Lock()
+	defer p.deliveryMux.Unlock()
+	if p.sending == nil {
+		p.sending = make(map[string]bool)
+	}
+	if p.sending[id] {
+		return false
+	}
+	p.sending[id] = true
+	return true
+}
+
+func (p *Patrol) finishDelivery(id string) {
+	p.deliveryMux.Lock()
+	defer p.deliveryMux.Unlock()
+	delete(p.sending, id)
+}
+
+// deliveryDue returns true if a delivery is pending, or is being retried
+// and its next attempt is due.
+func deliveryDue(d history.Delivery, now time.Time) bool {
+	switch d.Status {
+	case history.DeliveryPending:
+		return true
+	case history.DeliveryRetrying:
+		return !d.NextAttemptAt.After(now)
+	default:
+		return false
+	}
+}
+
+// attemptDelivery renders the request of a delivery with the notifier's
+// current configuration and sends it once, and records whether it was
+// sent, will be retried, or has failed. The delivery is read again once
+// it is marked as being sent, since d may be stale if another attempt
+// finished in the meantime.
+func (p *Patrol) attemptDelivery(n *singleNotificationConfig, d history.Delivery) {
+	if !p.startDelivery(d.ID) {
+		return
+	}
+	defer p.finishDelivery(d.ID)
+	if latest, ok := p.History.GetDelivery(d.ID); ok {
+		if !deliveryDue(latest, time.Now()) {
+			return
+		}
+		d = latest
+	}
+
+	var event notificationEvent
+	if len(d.Details) == 0 || json.Unmarshal(d.Details, &event) != nil {
+		p.dropDelivery(d, "Delivery has no event to render its notification from")
+		return
+	}
+
+	d.Attempts++
+	retry, err := n.Webhook.send(event)
+	switch {
+	case err == nil:
+		d.Status = history.DeliverySent
+		d.Error = ""
+		d.NextAttemptAt = time.Time{}
+	case retry && d.Attempts < maxDeliveryAttempts:
+		d.Status = history.DeliveryRetrying
+		d.Error = err.Error()
+		d.NextAttemptAt = time.Now().Add(deliveryBackoff << (d.Attempts - 1))
+		p.logger.Warnf("Failed to send notification through %s (attempt %d), retrying at %s: %s", d.Notifier, d.Attempts, d.NextAttemptAt.Format(time.RFC3339), err)
+	default:
+		d.Status = history.DeliveryFailed
+		d.Error = err.Error()
+		d.NextAttemptAt = time.Time{}
+		p.logger.Warnf("Failed to send notification through %s after %d attempts: %s", d.Notifier, d.Attempts, err)
+	}
+
+	if err := p.History.SetDelivery(d); err != nil {
+		p.logger.Warnf("Failed to record delivery through %s: %s", d.Notifier, err)
+	}
+}
+
+// dropDelivery marks a delivery that cannot be sent anymore as failed.
+func (p *Patrol) dropDelivery(d history.Delivery, reason string) {
+	d.Status = history.DeliveryFailed
+	d.Error = reason
+	d.NextAttemptAt = time.Time{}
+	p.logger.Warnf("Dropped notification through %s: %s", d.Notifier, reason)
+	if err := p.History.SetDelivery(d); err != nil {
+		p.logger.Warnf("Failed to record delivery through %s: %s", d.Notifier, err)
+	}
+}
+
+// notifierFor returns the configured notifier with the given name, if any.
+// Since names are not unique, a notifier that handles the given event is
+// preferred.
+func (p *Patrol) notifierFor(name, event string) *singleNotificationConfig {
+	var found *singleNotificationConfig
+	for _, cn := range p.notifiers() {
+		if cn.notifier.Webhook == nil || cn.notifier.name() != name {
+			continue
+		}
+		if cn.event == event {
+			return cn.notifier
+		}
+		if found == nil {
+			found = cn.notifier
+		}
+	}
+	return found
+}
+
+// retryDeliveries sends the deliveries that are due for another attempt,
+// and those that were pending when patrol stopped. Requests are rendered
+// again through the notifier that has the same name, and deliveries of
+// notifiers that are no longer configured are dropped.
+func (p *Patrol) retryDeliveries() {
+	now := time.Now()
+	for _, d := range p.History.GetDeliveries() {
+		if !deliveryDue(d, now) {
+			continue
+		}
+		n := p.notifierFor(d.Notifier, d.Event)
+		if n == nil {
+			p.dropDelivery(d, fmt.Sprintf("Notifier %s is no longer configured", d.Notifier))
+			continue
+		}
+		p.attemptDelivery(n, d)
+	}
+}
+
+func (p *Patrol) scheduleDeliveryRetries() {
+	for {
+		select {
+		case <-time.After(deliveryRetryInterval):
+			p.retryDeliveries()
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// notifierStatus summarizes the recent deliveries of a notifier, and its
+// latest test.
+type notifierStatus struct {
+	Notifier   string
+	Sent       int
+	Retrying   int
+	Failed     int
+	LastSentAt time.Time
+	LastTest   *NotifierTest `json:",omitempty"`
+}
+
+// deliveryFailure is a delivery that is being retried or has failed. The
+// request of the delivery is left out, since it may include secrets.
+type deliveryFailure struct {
+	ID            string
+	Notifier      string
+	Event         string
+	Group         string
+	Name          string
+	Status        string
+	Attempts      int
+	Error         string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// getDeliveryStatus summarizes the recent deliveries of each notifier, and
+// lists the most recent delivery failures. Notifiers that are no longer
+// configured are listed while they have recent deliveries.
+func (p *Patrol) getDeliveryStatus() ([]notifierStatus, []deliveryFailure) {
+	byNotifier := make(map[string]*notifierStatus)
+	for _, cn := range p.notifiers() {
+		byNotifier[cn.notifier.name()] = &notifierStatus{Notifier: cn.notifier.name()}
+	}
+	failures := []deliveryFailure{}
+	for _, d := range p.History.GetDeliveries() {
+		status, ok := byNotifier[d.Notifier]
+		if !ok {
+			status = &notifierStatus{Notifier: d.Notifier}
+			byNotifier[d.Notifier] = status
+		}
+		switch d.Status {
+		case history.DeliveryPending:
+			continue
+		case history.DeliverySent:
+			status.Sent++
+			if d.UpdatedAt.After(status.LastSentAt) {
+				status.LastSentAt = d.UpdatedAt
+			}
+			continue
+		case history.DeliveryRetrying:
+			status.Retrying++
+		case history.DeliveryFailed:
+			status.Failed++
+		}
+		if len(failures) < maxListedDeliveryFailures {
+			failures = append(failures, deliveryFailure{
+				ID:            d.ID,
+				Notifier:      d.Notifier,
+				Event:         d.Event,
+				Group:         d.Group,
+				Name:          d.Name,
+				Status:        d.Status,
+				Attempts:      d.Attempts,
+				Error:         d.Error,
+				NextAttemptAt: d.NextAttemptAt,
+				CreatedAt:     d.CreatedAt,
+				UpdatedAt:     d.UpdatedAt,
+			})
+		}
+	}
+
+	notifiers := make([]notifierStatus, 0, len(byNotifier))
+	for _, status := range byNotifier {
+		if test, ok := p.lastNotifierTest(status.Notifier); ok {
+			status.LastTest = &test
+		}
+		notifiers = append(notifiers, *status)
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return notifiers[i].Notifier < notifiers[j].Notifier
+	})
+	return notifiers, failures
+}
@@ -0,0 +1,217 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestDeliveryRetries(t *testing.T) {
+	os.Remove("deliveries-test.db")
+	defer func(backoff time.Duration) { deliveryBackoff = backoff }(deliveryBackoff)
+	deliveryBackoff = 10 * time.Millisecond
+
+	// Slack is down until its webhook is rotated, the pager rejects all
+	// notifications, and teams is down until it is removed
+	slack := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slack.Close()
+	var numSlackRequests int32
+	var slackBody, slackAuth atomic.Value
+	rotatedSlack := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		slackBody.Store(string(body))
+		slackAuth.Store(req.Header.Get("Authorization"))
+		atomic.AddInt32(&numSlackRequests, 1)
+	}))
+	defer rotatedSlack.Close()
+	pager := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusNotFound)
+	}))
+	defer pager.Close()
+	teams := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer teams.Close()
+	slackURL, _ := url.Parse(slack.URL)
+	rotatedSlackURL, _ := url.Parse(rotatedSlack.URL)
+	pagerURL, _ := url.Parse(pager.URL)
+	teamsURL, _ := url.Parse(teams.URL)
+
+	open := func(handlers EventHandlers) (*Patrol, error) {
+		historyFile, err := history.New(history.NewOptions{File: "deliveries-test.db"})
+		if err != nil {
+			return nil, err
+		}
+		return New(CreatePatrolOptions{GlobalEventHandlers: handlers}, historyFile)
+	}
+	p, err := open(EventHandlers{
+		"unhealthy": {
+			{Name: "slack", Webhook: &webhookNotification{Method: "POST", URL: slackURL, Headers: map[string]string{"Authorization": "Bearer old"}, Body: "{{check.name}} is down"}},
+			{Name: "pager", Webhook: &webhookNotification{Method: "POST", URL: pagerURL}},
+			{Name: "teams", Webhook: &webhookNotification{Method: "POST", URL: teamsURL}},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p.notify("unhealthy", "foo", "bar")
+	<-time.After(100 * time.Millisecond)
+
+	notifiers, failures := p.getDeliveryStatus()
+	if len(notifiers) != 3 || notifiers[0].Notifier != "pager" || notifiers[0].Failed != 1 || notifiers[1].Notifier != "slack" || notifiers[1].Retrying != 1 || notifiers[2].Retrying != 1 {
+		t.Error(fmt.Errorf("Wrong notifier status: %#v", notifiers))
+		return
+	}
+	if len(failures) != 3 {
+		t.Error(fmt.Errorf("Expected 3 delivery failures, got %#v", failures))
+		return
+	}
+	for _, failure := range failures {
+		if failure.Group != "foo" || failure.Name != "bar" || failure.Event != "unhealthy" || failure.Error == "" {
+			t.Error(fmt.Errorf("Wrong delivery failure: %#v", failure))
+			return
+		}
+	}
+
+	// Requests are never stored, since they may include secrets
+	for _, d := range p.History.GetDeliveries() {
+		if strings.Contains(string(d.Details), "Bearer") || strings.Contains(string(d.Details), slack.URL) {
+			t.Error(fmt.Errorf("Expected request to be left out of delivery: %s", d.Details))
+			return
+		}
+	}
+
+	// Deliveries that are being retried survive restarts, and are sent
+	// with the notifier's current configuration
+	p.History.Close(context.Background())
+	p, err = open(EventHandlers{
+		"unhealthy": {
+			{Name: "slack", Webhook: &webhookNotification{Method: "POST", URL: rotatedSlackURL, Headers: map[string]string{"Authorization": "Bearer new"}, Body: "{{check.name}} is still down"}},
+			{Name: "pager", Webhook: &webhookNotification{Method: "POST", URL: pagerURL}},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer p.History.Close(context.Background())
+	for i := 0; i < 2; i++ {
+		<-time.After(50 * time.Millisecond)
+		p.retryDeliveries()
+	}
+
+	if n := atomic.LoadInt32(&numSlackRequests); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 request to the rotated slack webhook, got %d", n))
+		return
+	}
+	if body, auth := slackBody.Load(), slackAuth.Load(); body != "bar is still down" || auth != "Bearer new" {
+		t.Error(fmt.Errorf("Expected request to be rendered again, got %v (%v)", body, auth))
+		return
+	}
+	notifiers, failures = p.getDeliveryStatus()
+	if len(notifiers) != 3 || notifiers[1].Sent != 1 || notifiers[1].Retrying != 0 || notifiers[1].LastSentAt.IsZero() {
+		t.Error(fmt.Errorf("Wrong notifier status after retries: %#v", notifiers))
+		return
+	}
+
+	// Deliveries of notifiers that were removed are dropped
+	if len(failures) != 2 || failures[0].Notifier != "teams" || failures[0].Status != history.DeliveryFailed || !strings.Contains(failures[0].Error, "no longer configured") {
+		t.Error(fmt.Errorf("Wrong delivery failures after retries: %#v", failures))
+		return
+	}
+	if failures[1].Notifier != "pager" || failures[1].Status != history.DeliveryFailed || failures[1].Attempts != 1 {
+		t.Error(fmt.Errorf("Wrong delivery failures after retries: %#v", failures))
+		return
+	}
+
+	// Stale copies of deliveries that were sent in the meantime are not
+	// sent again
+	for _, d := range p.History.GetDeliveries() {
+		if d.Notifier != "slack" {
+			continue
+		}
+		d.Status = history.DeliveryRetrying
+		d.NextAttemptAt = time.Time{}
+		p.attemptDelivery(p.notifierFor(d.Notifier, d.Event), d)
+	}
+	if n := atomic.LoadInt32(&numSlackRequests); n != 1 {
+		t.Error(fmt.Errorf("Expected stale delivery to be skipped, got %d requests", n))
+		return
+	}
+}
+
+func TestShutdownWaitsForDeliveries(t *testing.T) {
+	os.Remove("deliveries-shutdown-test.db")
+	var numRequests int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&numRequests, 1)
+	}))
+	defer webhook.Close()
+	webhookURL, _ := url.Parse(webhook.URL)
+	slack := &singleNotificationConfig{Name: "slack", Webhook: &webhookNotification{Method: "POST", URL: webhookURL}}
+
+	historyFile, err := history.New(history.NewOptions{File: "deliveries-shutdown-test.db"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p, err := New(CreatePatrolOptions{
+		GlobalEventHandlers: EventHandlers{"unhealthy": {slack}},
+		Grouping:            &GroupingOptions{Threshold: 1, Window: time.Hour},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := historyFile.Append(history.Item{Group: "foo", Name: "bar", Type: "boolean", Status: "unhealthy"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// One notification is being sent, and another is held for grouping
+	p.deliver(slack, notificationEvent{Status: "unhealthy", Group: "foo", Check: "baz"})
+	if !p.holdFailure(notificationEvent{Status: "unhealthy", Group: "foo", Check: "bar"}, []*singleNotificationConfig{slack}) {
+		t.Error(fmt.Errorf("Expected failure to be held"))
+		return
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := atomic.LoadInt32(&numRequests); n != 2 {
+		t.Error(fmt.Errorf("Expected both notifications to be sent before shutting down, got %d", n))
+		return
+	}
+	historyFile, err = history.New(history.NewOptions{File: "deliveries-shutdown-test.db"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+	deliveries := historyFile.GetDeliveries()
+	if len(deliveries) != 2 {
+		t.Error(fmt.Errorf("Expected 2 deliveries, got %d", len(deliveries)))
+		return
+	}
+	for _, d := range deliveries {
+		if d.Status != history.DeliverySent {
+			t.Error(fmt.Errorf("Expected delivery to be recorded as sent, got: %s", d))
+			return
+		}
+	}
+}
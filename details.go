@@ -0,0 +1,233 @@
+package patrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Number of results shown on the check page, and loaded at once when
+// older results are asked for
+const maxDetailItems = 20
+
+// Limits on the number of results returned by a page of the results API
+const (
+	defaultResultsPage = 50
+	maxResultsPage     = 500
+)
+
+var errResultNotFound = errors.New("No such result")
+
+// regionSummary compares the results of a check across regions, over all
+// of the check's retained results.
+type regionSummary struct {
+	Region string
+	Label  string
+
+	// Status in the latest result that included the region
+	Status string
+
+	NumResults int
+	NumFailed  int
+	MinLatency time.Duration
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+
+	// AvgLatency as a percentage of the slowest region's average, to draw
+	// bars with
+	RelativeLatency int
+}
+
+// getRegionSummaries summarizes the results of a check in each region.
+func (p *Patrol) getRegionSummaries(group, name string) []regionSummary {
+	summaries := make(map[string]*regionSummary)
+	var totalLatency = make(map[string]time.Duration)
+	p.History.EachItem(group, name, func(item history.Item, _ func() history.Item) bool {
+		for region, status := range item.Regions {
+			summary, ok := summaries[region]
+			if !ok {
+				summary = &regionSummary{
+					Region: region,
+					Label:  p.getRegionLabel(region),
+					Status: status,
+				}
+				summaries[region] = summary
+			}
+
+			summary.NumResults++
+			if status == "unhealthy" {
+				summary.NumFailed++
+			}
+			latency := item.RegionLatency[region]
+			totalLatency[region] += latency
+			if summary.NumResults == 1 || latency < summary.MinLatency {
+				summary.MinLatency = latency
+			}
+			if latency > summary.MaxLatency {
+				summary.MaxLatency = latency
+			}
+		}
+		return true
+	})
+
+	list := make([]regionSummary, 0, len(summaries))
+	var slowest time.Duration
+	for region, summary := range summaries {
+		summary.AvgLatency = totalLatency[region] / time.Duration(summary.NumResults)
+		if summary.AvgLatency > slowest {
+			slowest = summary.AvgLatency
+		}
+		list = append(list, *summary)
+	}
+	for i := range list {
+		if slowest > 0 {
+			list[i].RelativeLatency = int(100 * list[i].AvgLatency / slowest)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Label < list[j].Label
+	})
+	return list
+}
+
+// encodeCursor turns the cursor of the next page of results into the
+// 'before' parameter of the page. Cursors that are nil are empty.
+func encodeCursor(cursor *history.Cursor) string {
+	if cursor == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", cursor.CreatedAt.UnixNano(), cursor.ID)
+}
+
+func decodeCursor(before string) (*history.Cursor, error) {
+	parts := strings.SplitN(before, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: %s", errResultNotFound, before)
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errResultNotFound, before)
+	}
+	return &history.Cursor{ID: parts[1], CreatedAt: time.Unix(0, nanos)}, nil
+}
+
+// resultsPage returns up to 'limit' results of a check, starting after the
+// result that 'before' points at (or with the most recent result if it is
+// empty), along with the 'before' of the next page. It is empty once there
+// are no older results. Pages still follow each other once the result
+// that 'before' points at is downsampled.
+func (p *Patrol) resultsPage(group, name, before string, limit int) ([]history.Item, string, error) {
+	var after *history.Cursor
+	if before != "" {
+		cursor, err := decodeCursor(before)
+		if err != nil {
+			return nil, "", err
+		}
+		after = cursor
+	}
+	items, next := p.History.GetItemsPage(group, name, after, limit)
+	return items, encodeCursor(next), nil
+}
+
+// serveCheckPage shows the recent results of a single check, and compares
+// its status and latency across the regions that it is run from. Older
+// results are shown a page at a time: 'before' skips to the results after
+// the one it points at, and 'rows' only renders the rows of the results,
+// which the page loads when asked for older results.
+func (p *Patrol) serveCheckPage(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	group, name := query.Get("group"), query.Get("check")
+	c := p.getChecker(group, name)
+	if c == nil || (c.Private && !p.showPrivate(req)) {
+		http.Error(res, fmt.Sprintf("%s: %s/%s", errCheckerNotFound, group, name), http.StatusNotFound)
+		return
+	}
+
+	regions := p.getRegionSummaries(group, name)
+	items, next, err := p.resultsPage(group, name, query.Get("before"), maxDetailItems)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Name       string
+		Group      string
+		Check      string
+		Owner      string
+		RunbookURL string
+		Items      []history.Item
+		Regions    []regionSummary
+
+		// IDs of the results that the current and the next page start
+		// after
+		Before string
+		Next   string
+	}{
+		Name:    p.name,
+		Group:   group,
+		Check:   name,
+		Items:   items,
+		Regions: regions,
+		Before:  query.Get("before"),
+		Next:    next,
+	}
+
+	// Owners and runbooks are internal, like private checks
+	if p.showPrivate(req) {
+		data.Owner = c.Owner
+		data.RunbookURL = c.RunbookURL
+	}
+	if query.Get("rows") != "" {
+		res.Header().Set("X-Patrol-Next", next)
+		p.executePage(res, "checkRows", data)
+		return
+	}
+	p.executePage(res, "check", data)
+}
+
+// serveCheckResults returns the results of a check a page at a time, with
+// the most recent first. 'before' points at the result that the page
+// starts after, which is returned as 'Next' along with each page.
+func (p *Patrol) serveCheckResults(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	group, name := query.Get("group"), query.Get("check")
+	if group == "" || name == "" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Both 'group' and 'check' must be specified"))
+		return
+	}
+	c := p.getChecker(group, name)
+	if c == nil || (c.Private && !p.showPrivate(req)) {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s/%s", errCheckerNotFound, group, name))
+		return
+	}
+
+	limit := defaultResultsPage
+	if str := query.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Invalid limit: %s", str))
+			return
+		}
+		limit = n
+	}
+	if limit > maxResultsPage {
+		limit = maxResultsPage
+	}
+
+	items, next, err := p.resultsPage(group, name, query.Get("before"), limit)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"Items": items,
+		"Next":  next,
+	})
+}
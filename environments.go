@@ -0,0 +1,157 @@
+package patrol
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GroupEnvironment is the environment that a service runs in, along with
+// the name that its checks are compared by across environments. Services
+// that run the same checks in several environments share the same name.
+type GroupEnvironment struct {
+	Name    string
+	Service string
+}
+
+// EnvironmentResult is the latest result of a check in one environment.
+type EnvironmentResult struct {
+	Group string
+
+	// One of 'healthy', 'unhealthy', 'pending' or 'stale'. Recovered
+	// checks are healthy.
+	Status    string
+	Error     string    `json:",omitempty"`
+	UpdatedAt time.Time `json:",omitempty"`
+}
+
+// EnvironmentComparison holds the results of a check in each of the
+// environments that it runs in.
+type EnvironmentComparison struct {
+	Service      string
+	Check        string
+	Environments map[string]EnvironmentResult
+
+	// Whether the check is healthy in some environments but not in others
+	Differs bool
+}
+
+// getEnvironments returns the names of all environments that services run
+// in, sorted by name.
+func (p *Patrol) getEnvironments() []string {
+	seen := make(map[string]bool, len(p.environments))
+	names := []string{}
+	for _, env := range p.environments {
+		if !seen[env.Name] {
+			seen[env.Name] = true
+			names = append(names, env.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compareEnvironments returns the checks that run in at least two of the
+// given environments, along with their latest result in each of them.
+func (p *Patrol) compareEnvironments(environments []string, includePrivate bool) []EnvironmentComparison {
+	compared := make(map[string]bool, len(environments))
+	for _, env := range environments {
+		compared[env] = true
+	}
+
+	byCheck := make(map[[2]string]*EnvironmentComparison)
+	for _, c := range p.checkers {
+		env, ok := p.environments[c.Group]
+		if !ok || !compared[env.Name] || (c.Private && !includePrivate) {
+			continue
+		}
+		key := [2]string{env.Service, c.Name}
+		if _, ok := byCheck[key]; !ok {
+			byCheck[key] = &EnvironmentComparison{
+				Service:      env.Service,
+				Check:        c.Name,
+				Environments: make(map[string]EnvironmentResult),
+			}
+		}
+
+		result := EnvironmentResult{Group: c.Group, Status: "pending"}
+		if item, ok := p.History.GetLatestItem(c.Group, c.Name); ok {
+			result.UpdatedAt = item.SeenAt()
+			if p.isStale(item) {
+				result.Status = "stale"
+			} else if item.Status == "unhealthy" {
+				result.Status = "unhealthy"
+				result.Error = item.Error
+			} else {
+				result.Status = "healthy"
+			}
+		}
+		byCheck[key].Environments[env.Name] = result
+	}
+
+	list := make([]EnvironmentComparison, 0, len(byCheck))
+	for _, comparison := range byCheck {
+		if len(comparison.Environments) < 2 {
+			continue
+		}
+		healthy, unhealthy := false, false
+		for _, result := range comparison.Environments {
+			healthy = healthy || result.Status == "healthy"
+			unhealthy = unhealthy || result.Status == "unhealthy"
+		}
+		comparison.Differs = healthy && unhealthy
+		list = append(list, *comparison)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Service != list[j].Service {
+			return list[i].Service < list[j].Service
+		}
+		return list[i].Check < list[j].Check
+	})
+	return list
+}
+
+// serveEnvironmentComparison compares the checks that run in several
+// environments. The compared environments default to all of them, and
+// 'healthy' and 'failing' only keep the checks that are healthy or failing
+// in the given environment (i.e. '?healthy=staging&failing=prod').
+func (p *Patrol) serveEnvironmentComparison(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	known := p.getEnvironments()
+	isKnown := func(env string) bool {
+		for _, name := range known {
+			if name == env {
+				return true
+			}
+		}
+		return false
+	}
+
+	environments := known
+	if str := query.Get("environments"); str != "" {
+		environments = strings.Split(str, ",")
+	}
+	for _, env := range append(append([]string{}, environments...), query.Get("healthy"), query.Get("failing")) {
+		if env != "" && !isKnown(env) {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Unknown environment: '%s'", env))
+			return
+		}
+	}
+
+	list := []EnvironmentComparison{}
+	for _, comparison := range p.compareEnvironments(environments, p.showPrivate(req)) {
+		if env := query.Get("healthy"); env != "" && comparison.Environments[env].Status != "healthy" {
+			continue
+		}
+		if env := query.Get("failing"); env != "" && comparison.Environments[env].Status != "unhealthy" {
+			continue
+		}
+		list = append(list, comparison)
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"Environments": environments,
+		"Checks":       list,
+	})
+}
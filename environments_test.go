@@ -0,0 +1,137 @@
+package patrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestEnvironmentComparison(t *testing.T) {
+	os.Remove("environments-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "environments-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "API", Name: "Login", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API", Name: "Search", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API", Name: "Billing", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API (staging)", Name: "Login", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API (staging)", Name: "Search", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API (staging)", Name: "Billing", Cmd: "true", Private: true, History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "Docs", Name: "Homepage", Cmd: "true", History: historyFile, Interval: time.Minute}),
+		},
+		Environments: map[string]GroupEnvironment{
+			"API":           {Name: "prod", Service: "API"},
+			"API (staging)": {Name: "staging", Service: "API"},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	for _, item := range []history.Item{
+		{Group: "API", Name: "Login", Type: "boolean", Status: "unhealthy", Error: "Connection refused"},
+		{Group: "API", Name: "Search", Type: "boolean", Status: "healthy"},
+		{Group: "API", Name: "Billing", Type: "boolean", Status: "unhealthy"},
+		{Group: "API (staging)", Name: "Login", Type: "boolean", Status: "healthy"},
+		{Group: "API (staging)", Name: "Search", Type: "boolean", Status: "healthy"},
+		{Group: "API (staging)", Name: "Billing", Type: "boolean", Status: "healthy"},
+		{Group: "Docs", Name: "Homepage", Type: "boolean", Status: "healthy"},
+	} {
+		if _, err := historyFile.Append(item); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	compare := func(query string) (int, []EnvironmentComparison, error) {
+		res, err := http.Get(server.URL + "/api/v1/environments/compare" + query)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer res.Body.Close()
+		var body struct {
+			Environments []string
+			Checks       []EnvironmentComparison
+		}
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&body)
+		}
+		return res.StatusCode, body.Checks, err
+	}
+
+	// Billing is private in staging, so it only runs in a single
+	// environment for the public
+	_, checks, err := compare("")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(checks) != 2 || checks[0].Check != "Login" || checks[1].Check != "Search" {
+		t.Error(fmt.Errorf("Expected Login and Search to be compared, got: %#v", checks))
+		return
+	}
+	login := checks[0]
+	if !login.Differs || login.Environments["prod"].Status != "unhealthy" || login.Environments["prod"].Error != "Connection refused" || login.Environments["staging"].Group != "API (staging)" {
+		t.Error(fmt.Errorf("Wrong comparison of Login: %#v", login))
+		return
+	}
+	if checks[1].Differs {
+		t.Error(fmt.Errorf("Expected Search to be healthy in both environments: %#v", checks[1]))
+		return
+	}
+
+	_, checks, err = compare("?healthy=staging&failing=prod")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(checks) != 1 || checks[0].Check != "Login" {
+		t.Error(fmt.Errorf("Expected only Login to fail in prod, got: %#v", checks))
+		return
+	}
+
+	for _, query := range []string{"?failing=qa", "?environments=prod,qa"} {
+		if status, _, _ := compare(query); status != http.StatusBadRequest {
+			t.Error(fmt.Errorf("Expected %s to be rejected, got status %d", query, status))
+			return
+		}
+	}
+
+	// The status page only shows the services of the chosen environment
+	res, err := http.Get(server.URL + "/?env=staging")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	page, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(page), "API (staging)") || strings.Contains(string(page), "Docs") || strings.Contains(string(page), "group=API&amp;") {
+		t.Error(fmt.Errorf("Expected only the staging services to be shown:\n%s", page))
+		return
+	}
+}
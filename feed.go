@@ -0,0 +1,92 @@
+package patrol
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// maxFeedItems limits the RSS feed to the most recent updates
+const maxFeedItems = 50
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+
+	createdAt time.Time
+}
+
+// serveIncidentsFeed serves the start and end of each incident, and the
+// comments that were posted on it, as an RSS feed.
+func (p *Patrol) serveIncidentsFeed(res http.ResponseWriter, req *http.Request) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	baseURL := scheme + "://" + req.Host
+
+	var items []rssItem
+	addItem := func(i incident, title, description string, createdAt time.Time) {
+		link := baseURL + "/incident?" + url.Values{
+			"group":    {i.Group},
+			"check":    {i.Name},
+			"incident": {i.ID},
+		}.Encode()
+		items = append(items, rssItem{
+			Title:       title,
+			Link:        link,
+			Description: description,
+			GUID:        link + "#" + createdAt.UTC().Format(time.RFC3339Nano),
+			PubDate:     createdAt.Format(time.RFC1123Z),
+			createdAt:   createdAt,
+		})
+	}
+	for _, i := range p.getIncidents(p.showPrivate(req)) {
+		addItem(i, fmt.Sprintf("%s / %s is down", i.Group, i.Name), "", i.StartedAt)
+		for _, c := range i.Comments {
+			addItem(i, fmt.Sprintf("Update on %s / %s", i.Group, i.Name), fmt.Sprintf("%s: %s", c.Author, c.Body), c.CreatedAt)
+		}
+		if !i.Ongoing() {
+			addItem(i, fmt.Sprintf("%s / %s has recovered", i.Group, i.Name), "", i.ResolvedAt)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].createdAt.After(items[j].createdAt)
+	})
+	if len(items) > maxFeedItems {
+		items = items[:maxFeedItems]
+	}
+
+	res.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	res.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(res).Encode(rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       p.name + " incidents",
+			Link:        baseURL + "/incidents",
+			Description: "Incidents and updates from " + p.name,
+			Items:       items,
+		},
+	}); err != nil {
+		p.logger.Warnf("Failed to write RSS feed: %s", err)
+	}
+}
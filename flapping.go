@@ -0,0 +1,62 @@
+package patrol
+
+import (
+	"time"
+)
+
+// Options for detecting checks that keep changing between healthy and
+// unhealthy. A check is flapping once it has changed status more than
+// 'Transitions' times within the last 'Window'.
+type FlappingOptions struct {
+	Transitions int
+	Window      time.Duration
+}
+
+// isFlapping decides whether a check is flapping, based on the
+// transitions recorded in the history file.
+func (p *Patrol) isFlapping(group, name string) bool {
+	if p.flapping == nil {
+		return false
+	}
+
+	since := time.Now().Add(-p.flapping.Window)
+	numTransitions := 0
+	for _, t := range p.History.GetTransitions(group, name) {
+		if t.CreatedAt.Before(since) {
+			break
+		}
+		// The first result of a check is not a change in status
+		if t.From != "" {
+			numTransitions++
+		}
+	}
+	return numTransitions > p.flapping.Transitions
+}
+
+// updateFlapping refreshes the flapping state of a check, and returns
+// whether the check was flapping before and after the update.
+func (p *Patrol) updateFlapping(group, name string) (wasFlapping, flapping bool) {
+	flapping = p.isFlapping(group, name)
+
+	p.flapMux.Lock()
+	defer p.flapMux.Unlock()
+
+	wasFlapping = p.flappingChecks[group][name]
+	if flapping {
+		if _, ok := p.flappingChecks[group]; !ok {
+			p.flappingChecks[group] = make(map[string]bool)
+		}
+		p.flappingChecks[group][name] = true
+	} else if wasFlapping {
+		delete(p.flappingChecks[group], name)
+	}
+	return
+}
+
+// IsFlapping returns true if the given check was flapping as of its
+// latest result.
+func (p *Patrol) IsFlapping(group, name string) bool {
+	p.flapMux.Lock()
+	defer p.flapMux.Unlock()
+	return p.flappingChecks[group][name]
+}
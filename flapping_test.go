@@ -0,0 +1,82 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestFlapping(t *testing.T) {
+	os.Remove("flapping-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "flapping-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var numFailures, numFlapping int32
+	webhook := func(counter *int32) []*singleNotificationConfig {
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(counter, 1)
+		}))
+		t.Cleanup(server.Close)
+		u, _ := url.Parse(server.URL)
+		return []*singleNotificationConfig{{
+			Webhook: &webhookNotification{Method: "GET", URL: u},
+		}}
+	}
+
+	p, err := New(CreatePatrolOptions{
+		Flapping: &FlappingOptions{
+			Transitions: 2,
+			Window:      1 * time.Hour,
+		},
+		GlobalEventHandlers: EventHandlers{
+			"unhealthy": webhook(&numFailures),
+			"flapping":  webhook(&numFlapping),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, status := range []string{"healthy", "unhealthy", "healthy", "unhealthy", "healthy", "unhealthy"} {
+		item, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   "bar",
+			Type:   "boolean",
+			Status: status,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p.OnCheckerStatus(item.Status, item.Group, item.Name)
+	}
+	<-time.After(100 * time.Millisecond)
+
+	if !p.IsFlapping("foo", "bar") {
+		t.Error(fmt.Errorf("Check was not marked as flapping"))
+		return
+	}
+	if n := atomic.LoadInt32(&numFailures); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 failure notification before flapping, got %d", n))
+		return
+	}
+	if n := atomic.LoadInt32(&numFlapping); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 flapping notification, got %d", n))
+		return
+	}
+}
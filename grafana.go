@@ -0,0 +1,331 @@
+package patrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Suffixes of Grafana targets that chart the status or the duration of a
+// check, rather than the values of a metric check
+const (
+	grafanaStatusSuffix   = ":status"
+	grafanaDurationSuffix = ":duration"
+)
+
+// grafanaRange is the time range of a dashboard.
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaQuery is the body of a query of the simple JSON data source.
+type grafanaQuery struct {
+	Range         grafanaRange `json:"range"`
+	IntervalMs    int64        `json:"intervalMs"`
+	MaxDataPoints int          `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+}
+
+type grafanaTimeseries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Time       int64       `json:"time"`
+	TimeEnd    int64       `json:"timeEnd"`
+	Tags       []string    `json:"tags"`
+}
+
+func grafanaTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// grafanaTargets lists the targets that can be charted: the values of
+// metric checks, and the status and duration of all checks.
+func (p *Patrol) grafanaTargets(includePrivate bool) []string {
+	targets := []string{}
+	for _, c := range p.checkers {
+		if c.Private && !includePrivate {
+			continue
+		}
+		name := c.Group + "/" + c.Name
+		if c.Type == "metric" {
+			targets = append(targets, name)
+		}
+		targets = append(targets, name+grafanaStatusSuffix, name+grafanaDurationSuffix)
+	}
+	return targets
+}
+
+// grafanaChecker finds the check that a target belongs to, along with the
+// suffix of the target.
+func (p *Patrol) grafanaChecker(target string, includePrivate bool) (*checker.Checker, string) {
+	suffix := ""
+	for _, s := range []string{grafanaStatusSuffix, grafanaDurationSuffix} {
+		if strings.HasSuffix(target, s) {
+			target, suffix = strings.TrimSuffix(target, s), s
+			break
+		}
+	}
+	for _, c := range p.checkers {
+		if c.Group+"/"+c.Name == target && (!c.Private || includePrivate) {
+			return c, suffix
+		}
+	}
+	return nil, ""
+}
+
+// grafanaSeries charts a target. Durations are charted in milliseconds.
+func (p *Patrol) grafanaSeries(c *checker.Checker, suffix string, from, to time.Time, step time.Duration) ([]metricPoint, error) {
+	switch suffix {
+	case grafanaStatusSuffix:
+		return p.grafanaStatusPoints(c, from, to, step), nil
+	case grafanaDurationSuffix:
+		return p.getSeries(c.Group, c.Name, from, to, step, aggAvg, func(item history.Item) (float64, float64, float64) {
+			ms := float64(item.Duration) / float64(time.Millisecond)
+			return ms, ms, ms
+		}).Points, nil
+	}
+	if c.Type != "metric" {
+		return nil, fmt.Errorf("%s/%s is not a metric check, chart its status or duration instead", c.Group, c.Name)
+	}
+	return p.getMetricSeries(c.Group, c.Name, from, to, step, aggAvg).Points, nil
+}
+
+// grafanaStatusPoints charts the status of a check from its transitions,
+// since boolean checks only keep one result per day. Status is 1 while
+// the check is healthy and 0 while it is not, and steps in which the check
+// was unhealthy at any point are 0, so that short failures are not
+// averaged away. Steps before the first result and after now are skipped.
+func (p *Patrol) grafanaStatusPoints(c *checker.Checker, from, to time.Time, step time.Duration) []metricPoint {
+	points := []metricPoint{}
+	transitions := p.History.GetTransitions(c.Group, c.Name)
+	next := len(transitions) - 1
+	status := ""
+	now := time.Now()
+	for start := from; start.Before(to) && start.Before(now); start = start.Add(step) {
+		for next >= 0 && !transitions[next].CreatedAt.After(start) {
+			status = transitions[next].To
+			next--
+		}
+		unhealthy := status == "unhealthy"
+		for next >= 0 && transitions[next].CreatedAt.Before(start.Add(step)) {
+			status = transitions[next].To
+			unhealthy = unhealthy || status == "unhealthy"
+			next--
+		}
+		if status == "" {
+			continue
+		}
+
+		point := metricPoint{Time: start, Value: 1}
+		if unhealthy {
+			point.Value = 0
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// grafanaTable lists the results of a check within the given times, most
+// recent first.
+func (p *Patrol) grafanaTable(c *checker.Checker, from, to time.Time, limit int) grafanaTable {
+	table := grafanaTable{
+		Type: "table",
+		Columns: []grafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Status", Type: "string"},
+			{Text: "Value", Type: "number"},
+			{Text: "Duration", Type: "number"},
+			{Text: "Error", Type: "string"},
+		},
+		Rows: [][]interface{}{},
+	}
+	p.History.EachItem(c.Group, c.Name, func(item history.Item, load func() history.Item) bool {
+		if item.CreatedAt.Before(from) {
+			return false
+		}
+		if !item.CreatedAt.Before(to) {
+			return true
+		}
+		item = load()
+		var value interface{}
+		if item.Type == "metric" {
+			value = item.Metric
+		}
+		table.Rows = append(table.Rows, []interface{}{
+			grafanaTime(item.CreatedAt),
+			item.Status,
+			value,
+			float64(item.Duration) / float64(time.Millisecond),
+			item.Error,
+		})
+		return len(table.Rows) < limit
+	})
+	return table
+}
+
+// serveGrafana implements the API of Grafana's simple JSON data source
+// under '/api/grafana', so that results can be charted in Grafana: '/'
+// tests the connection, '/search' lists the targets, '/query' charts
+// targets as time series or tables, and '/annotations' marks incidents.
+func (p *Patrol) serveGrafana(res http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/grafana"), "/")
+	if path == "" {
+		writeJSON(res, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	if path != "search" && path != "query" && path != "annotations" {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("Unrecognized Grafana endpoint: '%s'", path))
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	body := http.MaxBytesReader(res, req.Body, 1<<20)
+	showPrivate := p.showPrivate(req)
+	switch path {
+	case "search":
+		var query struct {
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(body).Decode(&query); err != nil {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse search: %s", err))
+			return
+		}
+		targets := []string{}
+		for _, target := range p.grafanaTargets(showPrivate) {
+			if strings.Contains(strings.ToLower(target), strings.ToLower(query.Target)) {
+				targets = append(targets, target)
+			}
+		}
+		writeJSON(res, http.StatusOK, targets)
+
+	case "query":
+		var query grafanaQuery
+		if err := json.NewDecoder(body).Decode(&query); err != nil {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse query: %s", err))
+			return
+		}
+		from, to := query.Range.From, query.Range.To
+		if !from.Before(to) {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("'from' must be before 'to'"))
+			return
+		}
+		maxPoints := query.MaxDataPoints
+		if maxPoints <= 0 || maxPoints > maxMetricPoints {
+			maxPoints = maxMetricPoints
+		}
+		step := time.Duration(query.IntervalMs) * time.Millisecond
+		if min := to.Sub(from) / time.Duration(maxPoints); step < min {
+			step = min
+		}
+		step = step.Truncate(time.Second)
+		if step < time.Second {
+			step = time.Second
+		}
+
+		results := []interface{}{}
+		for _, target := range query.Targets {
+			c, suffix := p.grafanaChecker(target.Target, showPrivate)
+			if c == nil {
+				writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s", errCheckerNotFound, target.Target))
+				return
+			}
+			if target.Type == "table" {
+				results = append(results, p.grafanaTable(c, from, to, maxPoints))
+				continue
+			}
+
+			points, err := p.grafanaSeries(c, suffix, from, to, step)
+			if err != nil {
+				writeJSONError(res, http.StatusBadRequest, err)
+				return
+			}
+			timeseries := grafanaTimeseries{Target: target.Target, Datapoints: [][2]float64{}}
+			for _, point := range points {
+				timeseries.Datapoints = append(timeseries.Datapoints, [2]float64{point.Value, float64(grafanaTime(point.Time))})
+			}
+			results = append(results, timeseries)
+		}
+		writeJSON(res, http.StatusOK, results)
+
+	case "annotations":
+		var query grafanaAnnotationQuery
+		if err := json.NewDecoder(body).Decode(&query); err != nil {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse annotation query: %s", err))
+			return
+		}
+
+		// The query of an annotation selects a service or a single check,
+		// and all incidents are marked if it is empty
+		filter := strings.TrimSpace(query.Annotation.Query)
+		now := time.Now()
+		annotations := []grafanaAnnotation{}
+		for _, i := range p.getIncidents(showPrivate) {
+			if filter != "" && filter != i.Group && filter != i.Group+"/"+i.Name {
+				continue
+			}
+			end := i.ResolvedAt
+			if i.Ongoing() {
+				end = now
+			}
+			if !i.StartedAt.Before(query.Range.To) || end.Before(query.Range.From) {
+				continue
+			}
+
+			text := fmt.Sprintf("Unhealthy for %s", end.Sub(i.StartedAt).Round(time.Second))
+			if i.Ongoing() {
+				text = fmt.Sprintf("Unhealthy since %s", i.StartedAt.UTC().Format(time.RFC3339))
+			}
+			if i.AcknowledgedBy != "" {
+				text += fmt.Sprintf(", acknowledged by %s", i.AcknowledgedBy)
+			} else if i.Acknowledged {
+				text += ", acknowledged"
+			}
+			annotations = append(annotations, grafanaAnnotation{
+				Annotation: query.Annotation,
+				Title:      fmt.Sprintf("%s / %s is unhealthy", i.Group, i.Name),
+				Text:       text,
+				Time:       grafanaTime(i.StartedAt),
+				TimeEnd:    grafanaTime(end),
+				Tags:       []string{i.Group, i.Name},
+			})
+		}
+		writeJSON(res, http.StatusOK, annotations)
+	}
+}
@@ -0,0 +1,126 @@
+package patrol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Options for grouping failure notifications during mass outages. Once
+// 'Threshold' checks have started failing within 'Window', notifications of
+// further failures are held until the window ends, and sent as a single
+// notification.
+type GroupingOptions struct {
+	Threshold int
+	Window    time.Duration
+}
+
+// heldFailure is a failure notification that is held for grouping, along
+// with the handlers that it would have been sent to.
+type heldFailure struct {
+	event    notificationEvent
+	handlers []*singleNotificationConfig
+}
+
+// holdFailure records that a check started failing, and returns whether
+// its notification is held for grouping instead of being sent now.
+func (p *Patrol) holdFailure(event notificationEvent, handlers []*singleNotificationConfig) bool {
+	if p.grouping == nil || len(handlers) == 0 {
+		return false
+	}
+
+	p.groupMux.Lock()
+	defer p.groupMux.Unlock()
+
+	now := time.Now()
+	recent := p.recentFailures[:0]
+	for _, at := range p.recentFailures {
+		if now.Sub(at) < p.grouping.Window {
+			recent = append(recent, at)
+		}
+	}
+	p.recentFailures = append(recent, now)
+	if len(p.recentFailures) < p.grouping.Threshold && len(p.heldFailures) == 0 {
+		return false
+	}
+
+	if len(p.heldFailures) == 0 {
+		p.logger.Infof("%d checks started failing within %s, grouping notifications", len(p.recentFailures), p.grouping.Window)
+		p.background.Add(1)
+		p.heldTimer = time.AfterFunc(p.grouping.Window, func() {
+			defer p.background.Done()
+			p.sendHeldFailures()
+		})
+	}
+	p.heldFailures = append(p.heldFailures, heldFailure{event, handlers})
+	return true
+}
+
+// sendHeldFailures sends a single notification for the held failures of
+// checks that are still failing, to each of their handlers.
+func (p *Patrol) sendHeldFailures() {
+	p.groupMux.Lock()
+	held := p.heldFailures
+	p.heldFailures = nil
+	p.groupMux.Unlock()
+
+	var failures []heldFailure
+	for _, failure := range held {
+		if item, ok := p.History.GetLatestItem(failure.event.Group, failure.event.Check); ok && item.Status == "unhealthy" {
+			failures = append(failures, failure)
+		}
+	}
+	if len(failures) == 0 {
+		return
+	}
+	if len(failures) == 1 {
+		for _, n := range failures[0].handlers {
+			p.deliver(n, failures[0].event)
+		}
+		return
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		a, b := failures[i].event, failures[j].event
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Check < b.Check
+	})
+	var groups, breakdown []string
+	var handlers []*singleNotificationConfig
+	seen := make(map[*singleNotificationConfig]bool)
+	for _, failure := range failures {
+		if len(groups) == 0 || groups[len(groups)-1] != failure.event.Group {
+			groups = append(groups, failure.event.Group)
+		}
+		line := failure.event.Group + " / " + failure.event.Check
+		if failure.event.Error != "" {
+			line += ": " + failure.event.Error
+		}
+		breakdown = append(breakdown, line)
+		for _, n := range failure.handlers {
+			if !seen[n] {
+				seen[n] = true
+				handlers = append(handlers, n)
+			}
+		}
+	}
+
+	event := notificationEvent{
+		Status:      "unhealthy",
+		Group:       strings.Join(groups, ", "),
+		Check:       fmt.Sprintf("%d checks failing across %d services", len(failures), len(groups)),
+		Error:       strings.Join(breakdown, "\n"),
+		NumFailing:  len(failures),
+		NumServices: len(groups),
+	}
+	if p.url != "" {
+		event.Link = p.url + "/?status=unhealthy"
+	}
+	p.logger.Infof("Sending grouped notification: %s", event.Check)
+	for _, n := range handlers {
+		p.deliver(n, event)
+	}
+}
@@ -0,0 +1,103 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestGrouping(t *testing.T) {
+	os.Remove("grouping-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "grouping-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var bodiesMux sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodiesMux.Lock()
+		bodies = append(bodies, string(body))
+		bodiesMux.Unlock()
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	p, err := New(CreatePatrolOptions{
+		URL: "https://status.example.com/",
+		Grouping: &GroupingOptions{
+			Threshold: 3,
+			Window:    200 * time.Millisecond,
+		},
+		GlobalEventHandlers: EventHandlers{
+			"unhealthy": []*singleNotificationConfig{{
+				Webhook: &webhookNotification{
+					Method: "POST",
+					URL:    u,
+					Body:   "{{check.name}} ({{failing.count}}) {{link}}",
+				},
+			}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, check := range [][2]string{{"API", "a"}, {"API", "b"}, {"API", "c"}, {"Web", "d"}, {"Web", "e"}} {
+		item, err := historyFile.Append(history.Item{
+			Group:  check[0],
+			Name:   check[1],
+			Type:   "boolean",
+			Status: "unhealthy",
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p.OnCheckerStatus(item.Status, item.Group, item.Name)
+	}
+
+	// Check 'e' recovers before the window ends, so it is left out
+	if _, err := historyFile.Append(history.Item{Group: "Web", Name: "e", Type: "boolean", Status: "healthy"}); err != nil {
+		t.Error(err)
+		return
+	}
+	<-time.After(100 * time.Millisecond)
+	bodiesMux.Lock()
+	if len(bodies) != 2 {
+		t.Error(fmt.Errorf("Expected 2 notifications before grouping, got %v", bodies))
+		bodiesMux.Unlock()
+		return
+	}
+	bodiesMux.Unlock()
+
+	<-time.After(300 * time.Millisecond)
+	bodiesMux.Lock()
+	defer bodiesMux.Unlock()
+	sort.Strings(bodies)
+	expected := []string{
+		"2 checks failing across 2 services (2) https://status.example.com/?status=unhealthy",
+		"a () https://status.example.com/check?check=a&group=API",
+		"b () https://status.example.com/check?check=b&group=API",
+	}
+	if fmt.Sprint(bodies) != fmt.Sprint(expected) {
+		t.Error(fmt.Errorf("Wrong notifications: %q", bodies))
+		return
+	}
+}
@@ -0,0 +1,68 @@
+package patrol
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// serveHealthz reports whether a group is up according to its status rule
+// (by default, whether all of its checks are passing), for load balancers
+// and uptime monitors that only look at the status code. The group is taken
+// from the path ('/healthz/{group}'), and all groups are included if it is
+// empty. Checks that have not run yet or whose latest result is stale are
+// ignored, and so are statuspage checks, and private checks unless the
+// request is authenticated.
+func (p *Patrol) serveHealthz(res http.ResponseWriter, req *http.Request) {
+	group := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/healthz"), "/")
+	showPrivate := p.showPrivate(req)
+
+	found := false
+	groups := make(map[string]map[string]bool)
+	for _, checker := range p.checkers {
+		if (group != "" && checker.Group != group) || (checker.Private && !showPrivate) {
+			continue
+		}
+		found = true
+
+		if _, ok := groups[checker.Group]; !ok {
+			groups[checker.Group] = make(map[string]bool)
+		}
+		if checker.StatusPage != nil {
+			continue
+		}
+		if item, ok := p.History.GetLatestItem(checker.Group, checker.Name); ok && !p.isStale(item) {
+			groups[checker.Group][checker.Name] = item.Status == "unhealthy"
+		}
+	}
+
+	// Only the failing checks of groups that are down are listed
+	var failing []string
+	for groupName, checks := range groups {
+		if !p.groupIsDown(groupName, checks) {
+			continue
+		}
+		for name, isFailing := range checks {
+			if isFailing {
+				failing = append(failing, groupName+"/"+name)
+			}
+		}
+	}
+	sort.Strings(failing)
+
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-cache")
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "unknown group: %s\n", group)
+		return
+	}
+	if len(failing) > 0 {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(res, "unhealthy\n%s\n", strings.Join(failing, "\n"))
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintln(res, "healthy")
+}
@@ -0,0 +1,127 @@
+package patrol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// IncidentEvent describes an incident that was opened or closed, which is
+// a period in which a check was unhealthy.
+type IncidentEvent struct {
+	Group string
+	Check string
+
+	// Identifies the incident in URLs and API requests
+	ID string
+
+	StartedAt time.Time
+
+	// Zero value while the incident is open
+	ResolvedAt time.Time
+}
+
+// hooks are the callbacks that programs embedding patrol have registered.
+type hooks struct {
+	mux             sync.RWMutex
+	onResult        []func(history.Item)
+	onStatusChange  []func(history.Transition)
+	onIncidentOpen  []func(IncidentEvent)
+	onIncidentClose []func(IncidentEvent)
+}
+
+// OnResult registers a callback that is run with every result of a check,
+// once it has been written to the history file. This includes the first
+// result of a check, which does not send notifications.
+//
+// Hooks run in the order in which they were registered, and they run
+// before the notifications of the result are sent. They do not hold up
+// writes to the history file, but they must not block, since they hold up
+// the hooks and notifications of other results: slow work should be moved
+// to a goroutine.
+func (p *Patrol) OnResult(fn func(item history.Item)) {
+	p.hooks.mux.Lock()
+	defer p.hooks.mux.Unlock()
+	p.hooks.onResult = append(p.hooks.onResult, fn)
+}
+
+// OnStatusChange registers a callback that is run when a check starts or
+// stops passing, including when a check records its first result (whose
+// transition has an empty 'From'). See OnResult for when hooks run.
+func (p *Patrol) OnStatusChange(fn func(t history.Transition)) {
+	p.hooks.mux.Lock()
+	defer p.hooks.mux.Unlock()
+	p.hooks.onStatusChange = append(p.hooks.onStatusChange, fn)
+}
+
+// OnIncidentOpen registers a callback that is run when a check becomes
+// unhealthy. See OnResult for when hooks run.
+func (p *Patrol) OnIncidentOpen(fn func(i IncidentEvent)) {
+	p.hooks.mux.Lock()
+	defer p.hooks.mux.Unlock()
+	p.hooks.onIncidentOpen = append(p.hooks.onIncidentOpen, fn)
+}
+
+// OnIncidentClose registers a callback that is run when an unhealthy check
+// recovers. See OnResult for when hooks run.
+func (p *Patrol) OnIncidentClose(fn func(i IncidentEvent)) {
+	p.hooks.mux.Lock()
+	defer p.hooks.mux.Unlock()
+	p.hooks.onIncidentClose = append(p.hooks.onIncidentClose, fn)
+}
+
+// OnCheckerResult runs the hooks of a result that was written. Whether the
+// result changed the check's status is read back from its transitions,
+// which are recorded along with the result.
+func (p *Patrol) OnCheckerResult(item history.Item) {
+	// Hooks may register other hooks, so they do not run under the lock
+	p.hooks.mux.RLock()
+	h := hooks{
+		onResult:        p.hooks.onResult,
+		onStatusChange:  p.hooks.onStatusChange,
+		onIncidentOpen:  p.hooks.onIncidentOpen,
+		onIncidentClose: p.hooks.onIncidentClose,
+	}
+	p.hooks.mux.RUnlock()
+
+	for _, fn := range h.onResult {
+		fn(item)
+	}
+	if len(h.onStatusChange) == 0 && len(h.onIncidentOpen) == 0 && len(h.onIncidentClose) == 0 {
+		return
+	}
+
+	// Results that were merged into an earlier identical result share its
+	// time, but did not change the status again
+	transitions := p.History.GetTransitions(item.Group, item.Name)
+	if item.Count > 1 || len(transitions) == 0 || !transitions[0].CreatedAt.Equal(item.CreatedAt) {
+		return
+	}
+	for _, fn := range h.onStatusChange {
+		fn(transitions[0])
+	}
+
+	incidents := incidentsFromTransitions(transitions)
+	if len(incidents) == 0 {
+		return
+	}
+	i := incidents[len(incidents)-1]
+	event := IncidentEvent{
+		Group:      i.Group,
+		Check:      i.Name,
+		ID:         i.ID,
+		StartedAt:  i.StartedAt,
+		ResolvedAt: i.ResolvedAt,
+	}
+	switch {
+	case i.Ongoing() && i.StartedAt.Equal(item.CreatedAt):
+		for _, fn := range h.onIncidentOpen {
+			fn(event)
+		}
+	case !i.Ongoing() && i.ResolvedAt.Equal(item.CreatedAt):
+		for _, fn := range h.onIncidentClose {
+			fn(event)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestHooks(t *testing.T) {
+	os.Remove("hooks-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "hooks-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var events []string
+	p.OnResult(func(item history.Item) {
+		events = append(events, "result:"+item.Status)
+	})
+	p.OnStatusChange(func(t history.Transition) {
+		events = append(events, fmt.Sprintf("change:%s->%s", t.From, t.To))
+	})
+	var opened IncidentEvent
+	p.OnIncidentOpen(func(i IncidentEvent) {
+		opened = i
+		events = append(events, "open:"+i.Check)
+	})
+	p.OnIncidentClose(func(i IncidentEvent) {
+		if i.ID != opened.ID || i.ResolvedAt.IsZero() {
+			t.Error(fmt.Errorf("Closed incident %#v does not match opened incident %#v", i, opened))
+		}
+		events = append(events, "close:"+i.Check)
+	})
+
+	for _, status := range []string{"healthy", "healthy", "unhealthy", "unhealthy", "healthy"} {
+		item, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   "bar",
+			Type:   "boolean",
+			Status: status,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p.OnCheckerResult(item)
+	}
+
+	expected := "[result:healthy change:->healthy result:healthy result:unhealthy change:healthy->unhealthy open:bar result:unhealthy result:recovered change:unhealthy->recovered close:bar]"
+	if fmt.Sprint(events) != expected {
+		t.Error(fmt.Errorf("Wrong hooks were run:\n%s\nExpected:\n%s", events, expected))
+		return
+	}
+}
@@ -0,0 +1,224 @@
+package patrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+var errIncidentNotFound = errors.New("No such incident")
+
+// incident is a period in which a check was unhealthy. Incidents are not
+// stored, but derived from the check's transitions.
+type incident struct {
+	Group      string
+	Name       string
+	StartedAt  time.Time
+	ResolvedAt time.Time `json:",omitempty"`
+
+	// Identifies the incident in URLs and API requests
+	ID            string
+	HasPostmortem bool
+	Comments      []history.Comment
+
+	// Set once someone is handling an ongoing incident. Who acknowledged
+	// it is only included along with private data.
+	Acknowledged   bool
+	AcknowledgedBy string    `json:",omitempty"`
+	AcknowledgedAt time.Time `json:",omitempty"`
+}
+
+func (i incident) Ongoing() bool {
+	return i.ResolvedAt.IsZero()
+}
+
+func incidentID(startedAt time.Time) string {
+	return startedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// incidentsFromTransitions finds the incidents in the transitions of a
+// check, which are given newest first. Incidents are returned oldest first.
+func incidentsFromTransitions(transitions []history.Transition) []incident {
+	var incidents []incident
+	var current *incident
+	for i := len(transitions) - 1; i >= 0; i-- {
+		t := transitions[i]
+		if t.To == "unhealthy" && current == nil {
+			current = &incident{
+				Group:     t.Group,
+				Name:      t.Name,
+				StartedAt: t.CreatedAt,
+				ID:        incidentID(t.CreatedAt),
+			}
+		} else if t.To != "unhealthy" && current != nil {
+			current.ResolvedAt = t.CreatedAt
+			incidents = append(incidents, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		incidents = append(incidents, *current)
+	}
+	return incidents
+}
+
+// getIncidents returns the incidents of all checks, with the most recent
+// incident first. Incidents of private checks, and who acknowledged
+// incidents, are only included if asked for.
+func (p *Patrol) getIncidents(includePrivate bool) []incident {
+	var incidents []incident
+	for _, checker := range p.checkers {
+		if checker.Private && !includePrivate {
+			continue
+		}
+		incidents = append(incidents, incidentsFromTransitions(p.History.GetTransitions(checker.Group, checker.Name))...)
+	}
+
+	for i := range incidents {
+		_, incidents[i].HasPostmortem = p.History.GetPostmortem(incidents[i].Group, incidents[i].Name, incidents[i].StartedAt)
+		incidents[i].Comments = p.History.GetComments(incidents[i].Group, incidents[i].Name, incidents[i].StartedAt)
+		if ack, ok := p.acknowledged(incidents[i].Group, incidents[i].Name, incidents[i].ID); ok {
+			incidents[i].Acknowledged = true
+			incidents[i].AcknowledgedAt = ack.At
+			if includePrivate {
+				incidents[i].AcknowledgedBy = ack.By
+			}
+		}
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].StartedAt.After(incidents[j].StartedAt)
+	})
+	return incidents
+}
+
+func (p *Patrol) getIncident(group, name, id string, includePrivate bool) (incident, error) {
+	for _, i := range p.getIncidents(includePrivate) {
+		if i.Group == group && i.Name == name && i.ID == id {
+			return i, nil
+		}
+	}
+	return incident{}, fmt.Errorf("%w: %s/%s at %s", errIncidentNotFound, group, name, id)
+}
+
+// serveIncidents lists the incidents of all checks as JSON.
+func (p *Patrol) serveIncidents(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, p.getIncidents(p.showPrivate(req)))
+}
+
+// serveSetPostmortem attaches a markdown postmortem to an incident.
+func (p *Patrol) serveSetPostmortem(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	i, err := p.getIncident(req.FormValue("group"), req.FormValue("check"), req.FormValue("incident"), true)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, err)
+		return
+	}
+	pm := history.Postmortem{
+		Group:      i.Group,
+		Name:       i.Name,
+		IncidentAt: i.StartedAt,
+		Markdown:   req.FormValue("markdown"),
+	}
+	if err := p.History.SetPostmortem(pm); err != nil {
+		writeJSONError(res, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !redirectBack(res, req) {
+		writeJSON(res, http.StatusOK, map[string]interface{}{
+			"group":    i.Group,
+			"check":    i.Name,
+			"incident": i.ID,
+		})
+	}
+}
+
+// serveAddComment posts an update on an incident, on behalf of the user
+// that sent the request.
+func (p *Patrol) serveAddComment(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	body := strings.TrimSpace(req.FormValue("body"))
+	if body == "" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Comments must have a 'body'"))
+		return
+	}
+	i, err := p.getIncident(req.FormValue("group"), req.FormValue("check"), req.FormValue("incident"), true)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, err)
+		return
+	}
+
+	// Only authenticated requests reach this handler
+	author, _, _ := req.BasicAuth()
+	comment, err := p.History.AddComment(history.Comment{
+		Group:      i.Group,
+		Name:       i.Name,
+		IncidentAt: i.StartedAt,
+		Author:     author,
+		Body:       body,
+	})
+	if err != nil {
+		writeJSONError(res, http.StatusInternalServerError, err)
+		return
+	}
+	p.notify("comment", i.Group, i.Name)
+
+	if !redirectBack(res, req) {
+		writeJSON(res, http.StatusOK, comment)
+	}
+}
+
+func (p *Patrol) serveIncidentsPage(res http.ResponseWriter, req *http.Request) {
+	p.executePage(res, "incidents", struct {
+		Name         string
+		AdminEnabled bool
+		Incidents    []incident
+	}{
+		Name:         p.name,
+		AdminEnabled: p.admin != nil,
+		Incidents:    p.getIncidents(p.showPrivate(req)),
+	})
+}
+
+func (p *Patrol) serveIncidentPage(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	i, err := p.getIncident(query.Get("group"), query.Get("check"), query.Get("incident"), p.showPrivate(req))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	pm, _ := p.History.GetPostmortem(i.Group, i.Name, i.StartedAt)
+
+	p.executePage(res, "incident", struct {
+		Name         string
+		AdminEnabled bool
+		Incident     incident
+		Postmortem   history.Postmortem
+	}{
+		Name:         p.name,
+		AdminEnabled: p.admin != nil,
+		Incident:     i,
+		Postmortem:   pm,
+	})
+}
+
+func (p *Patrol) executePage(res http.ResponseWriter, name string, data interface{}) {
+	if err := pageView.ExecuteTemplate(res, name, data); err != nil {
+		p.logger.Warnf("Failed to execute template: %s", err)
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+	}
+}
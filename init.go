@@ -0,0 +1,245 @@
+package patrol
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Notifiers that a generated config can send notifications to
+const (
+	InitNotifierSlack   = "slack"
+	InitNotifierDiscord = "discord"
+	InitNotifierWebhook = "webhook"
+)
+
+// InitOptions describes the starter config that is generated by
+// 'patrol init'.
+type InitOptions struct {
+	Name string
+	Port int
+	DB   string
+
+	// URLs that must respond successfully, host:port pairs that must
+	// accept TCP connections, and mount points whose usage is recorded.
+	// If none are given, the config checks an example URL and the usage
+	// of '/'.
+	HTTP  []string
+	TCP   []string
+	Disks []string
+
+	// Notifier that is told about failures and recoveries ('slack',
+	// 'discord' or 'webhook'), at the given URL. Empty for none.
+	Notifier    string
+	NotifierURL string
+}
+
+type initCheck struct {
+	Name     string
+	Interval string
+	Type     string
+	Unit     string
+	Cmd      string
+}
+
+type initService struct {
+	Name   string
+	Checks []initCheck
+}
+
+type initNotifier struct {
+	Name          string
+	URL           string
+	FailureBody   string
+	RecoveredBody string
+}
+
+// yamlQuote quotes a string for YAML, so that it is read back as is.
+func yamlQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
+
+var initTemplate = template.Must(template.New("patrol.yml").Funcs(template.FuncMap{
+	"quote": yamlQuote,
+}).Parse(`## Generated by 'patrol init'. See the README for all options:
+## https://github.com/karimsa/patrol#creating-health-checks
+name: {{quote .Name}}
+db: {{quote .DB}}
+port: {{.Port}}
+
+## Public URL of the status page, which notifications link to.
+# url: https://status.example.com
+
+## Credentials for the admin page and for actions such as pausing checks.
+# admin:
+#   username: admin
+#   password: change-me
+
+## Services shown on the status page, and their checks. Commands are run
+## with the default shell, and a check fails if its command fails.
+services:
+{{- range .Services}}
+  {{quote .Name}}:
+    checks:
+{{- range .Checks}}
+    - name: {{quote .Name}}
+      interval: {{.Interval}}
+{{- if .Type}}
+      type: {{.Type}}
+      unit: {{quote .Unit}}
+{{- end}}
+      cmd: {{quote .Cmd}}
+{{- end}}
+{{- end}}
+{{- with .Notifier}}
+
+## Notifications for failures and recoveries of all checks.
+on_failure:
+- name: {{.Name}}
+  webhook:
+    method: post
+    url: {{quote .URL}}
+    headers:
+      Content-Type: application/json
+    body: {{quote .FailureBody}}
+on_recovered:
+- name: {{.Name}}
+  webhook:
+    method: post
+    url: {{quote .URL}}
+    headers:
+      Content-Type: application/json
+    body: {{quote .RecoveredBody}}
+{{- end}}
+`))
+
+// initServices creates the checks of a generated config.
+func (opts InitOptions) initServices() ([]initService, error) {
+	var services []initService
+	if len(opts.HTTP) == 0 && len(opts.TCP) == 0 && len(opts.Disks) == 0 {
+		opts.HTTP = []string{"https://example.com"}
+		opts.Disks = []string{"/"}
+	}
+
+	if len(opts.HTTP) > 0 {
+		service := initService{Name: "Web"}
+		for _, str := range opts.HTTP {
+			u, err := url.Parse(str)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Contains(str, "'") {
+				return nil, fmt.Errorf("Invalid URL '%s': must be an http or https URL without quotes", str)
+			}
+			service.Checks = append(service.Checks, initCheck{
+				Name:     fmt.Sprintf("%s responds", u.Host+strings.TrimSuffix(u.Path, "/")),
+				Interval: "60s",
+				Cmd:      fmt.Sprintf("curl -fsSL -o /dev/null '%s'", str),
+			})
+		}
+		services = append(services, service)
+	}
+
+	if len(opts.TCP) > 0 {
+		service := initService{Name: "Network"}
+		for _, addr := range opts.TCP {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || host == "" || !domainPattern.MatchString(host+":"+port) {
+				return nil, fmt.Errorf("Invalid address '%s': must be a host and a port, i.e. db.example.com:5432", addr)
+			}
+			service.Checks = append(service.Checks, initCheck{
+				Name:     fmt.Sprintf("%s accepts connections", addr),
+				Interval: "60s",
+				Cmd:      fmt.Sprintf("nc -z -w 5 %s %s", host, port),
+			})
+		}
+		services = append(services, service)
+	}
+
+	if len(opts.Disks) > 0 {
+		service := initService{Name: "Server"}
+		for _, path := range opts.Disks {
+			if !filepath.IsAbs(path) || strings.ContainsAny(path, "'\n") {
+				return nil, fmt.Errorf("Invalid mount point '%s': must be an absolute path without quotes", path)
+			}
+			service.Checks = append(service.Checks, initCheck{
+				Name:     fmt.Sprintf("Disk usage of %s", path),
+				Interval: "5m",
+				Type:     "metric",
+				Unit:     "%",
+				Cmd:      fmt.Sprintf("df --output=pcent '%s' | tail -n1 | tr -d ' %%'", path),
+			})
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// initNotifier creates the notifier of a generated config, if any.
+func (opts InitOptions) initNotifier() (*initNotifier, error) {
+	if opts.Notifier == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(opts.NotifierURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("The %s notifier needs the URL of its webhook", opts.Notifier)
+	}
+
+	n := &initNotifier{Name: opts.Notifier, URL: opts.NotifierURL}
+	failure := "{{check.name}} ({{service}}) is down: {{check.error}}"
+	recovery := "{{check.name}} ({{service}}) has recovered"
+	switch opts.Notifier {
+	case InitNotifierSlack:
+		n.FailureBody = fmt.Sprintf(`{"text": "%s"}`, failure)
+		n.RecoveredBody = fmt.Sprintf(`{"text": "%s"}`, recovery)
+	case InitNotifierDiscord:
+		n.FailureBody = fmt.Sprintf(`{"content": "%s"}`, failure)
+		n.RecoveredBody = fmt.Sprintf(`{"content": "%s"}`, recovery)
+	case InitNotifierWebhook:
+		body := `{"service": "{{service}}", "check": "{{check.name}}", "status": "{{check.status}}", "error": "{{check.error}}"}`
+		n.FailureBody = body
+		n.RecoveredBody = body
+	default:
+		return nil, fmt.Errorf("Unrecognized notifier: '%s' (must be slack, discord or webhook)", opts.Notifier)
+	}
+	return n, nil
+}
+
+// GenerateConfig generates a starter config with checks of the given URLs,
+// TCP addresses and disks, and notifications through the given notifier.
+// The config is validated before it is returned.
+func GenerateConfig(opts InitOptions) ([]byte, error) {
+	if opts.Name == "" {
+		opts.Name = "Statuspage"
+	}
+	if opts.Port <= 0 {
+		opts.Port = 8080
+	}
+	if opts.DB == "" {
+		opts.DB = "data.db"
+	}
+	services, err := opts.initServices()
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := opts.initNotifier()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := initTemplate.Execute(&buf, map[string]interface{}{
+		"Name":     opts.Name,
+		"Port":     opts.Port,
+		"DB":       opts.DB,
+		"Services": services,
+		"Notifier": notifier,
+	}); err != nil {
+		return nil, err
+	}
+	if err := ValidateConfig(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("Generated config is invalid: %s", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestGenerateConfig(t *testing.T) {
+	data, err := GenerateConfig(InitOptions{
+		Name:        "It's ours",
+		HTTP:        []string{"https://example.com/health"},
+		TCP:         []string{"db.internal:5432"},
+		Disks:       []string{"/var/lib"},
+		Notifier:    InitNotifierSlack,
+		NotifierURL: "https://hooks.slack.com/services/T0/B0/x",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "patrol-init-test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	p, _, err := FromConfig(data, &history.NewOptions{File: filepath.Join(dir, "data.db")})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer p.Shutdown(context.Background())
+
+	if p.name != "It's ours" || p.port != 8080 {
+		t.Error(fmt.Errorf("Expected default port and quoted name, got %q on %d", p.name, p.port))
+		return
+	}
+	expected := map[string]string{
+		"Web/example.com/health responds":              "curl -fsSL -o /dev/null 'https://example.com/health'",
+		"Network/db.internal:5432 accepts connections": "nc -z -w 5 db.internal 5432",
+		"Server/Disk usage of /var/lib":                "df --output=pcent '/var/lib' | tail -n1 | tr -d ' %'",
+	}
+	if len(p.checkers) != len(expected) {
+		t.Error(fmt.Errorf("Expected %d checks, got %d", len(expected), len(p.checkers)))
+		return
+	}
+	for _, c := range p.checkers {
+		cmd, ok := expected[c.Group+"/"+c.Name]
+		if !ok || c.Cmd != cmd {
+			t.Error(fmt.Errorf("Unexpected check %s/%s: %q", c.Group, c.Name, c.Cmd))
+			return
+		}
+	}
+	if !strings.Contains(string(data), `body: '{"text": "{{check.name}} ({{service}}) is down: {{check.error}}"}'`) {
+		t.Error(fmt.Errorf("Expected a slack notification on failure:\n%s", data))
+		return
+	}
+
+	// Without any checks, the config has examples
+	data, err = GenerateConfig(InitOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(data), "example.com responds") || !strings.Contains(string(data), "Disk usage of /") {
+		t.Error(fmt.Errorf("Expected example checks:\n%s", data))
+		return
+	}
+
+	for _, opts := range []InitOptions{
+		{HTTP: []string{"ftp://example.com"}},
+		{HTTP: []string{"https://example.com/'; rm -rf ~"}},
+		{TCP: []string{"db.internal"}},
+		{TCP: []string{"db.internal:5432; true"}},
+		{Disks: []string{"var"}},
+		{Notifier: "pager", NotifierURL: "https://example.com"},
+		{Notifier: InitNotifierDiscord},
+	} {
+		if _, err := GenerateConfig(opts); err == nil {
+			t.Error(fmt.Errorf("Expected %#v to be rejected", opts))
+			return
+		}
+	}
+}
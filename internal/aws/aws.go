@@ -0,0 +1,345 @@
+// Package aws implements the few parts of the AWS APIs that patrol needs to
+// read CloudWatch metrics: signing requests with Signature Version 4, and
+// finding credentials the way the AWS SDKs and CLI do.
+package aws
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints of the credentials of ECS tasks and EC2 instances, which are
+// replaced by tests
+var (
+	ecsCredentialsURL = "http://169.254.170.2"
+	ec2MetadataURL    = "http://169.254.169.254"
+)
+
+// Client for the local endpoints of credentials, which are never reached
+// through a proxy. They are given little time, in case patrol does not run
+// on ECS or EC2.
+var localClient = &http.Client{
+	Transport: &http.Transport{},
+	Timeout:   2 * time.Second,
+}
+
+// Credentials sign requests to AWS.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Set for temporary credentials
+	Expires time.Time
+}
+
+// Options describe how to reach an AWS service.
+type Options struct {
+	// Region of the service, which defaults to AWS_REGION or
+	// AWS_DEFAULT_REGION
+	Region string
+
+	// Profile of the shared credentials file, which defaults to
+	// AWS_PROFILE or "default"
+	Profile string
+
+	// Base URL of the service, which defaults to its regional endpoint
+	Endpoint string
+
+	// Client that sends requests, i.e. through a proxy
+	Client *http.Client
+}
+
+// DefaultRegion returns the region that is set in the environment.
+func DefaultRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+func (opts Options) region() string {
+	if opts.Region != "" {
+		return opts.Region
+	}
+	return DefaultRegion()
+}
+
+func (opts Options) endpoint(service string) string {
+	if opts.Endpoint != "" {
+		return strings.TrimSuffix(opts.Endpoint, "/")
+	}
+	region := opts.region()
+	if strings.HasPrefix(region, "cn-") {
+		return fmt.Sprintf("https://%s.%s.amazonaws.com.cn", service, region)
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+}
+
+// Temporary credentials are cached until shortly before they expire, by
+// profile
+var (
+	cacheMux sync.Mutex
+	cache    = make(map[string]Credentials)
+)
+
+// LoadCredentials finds credentials in the same places as the AWS SDKs, in
+// order: the environment, the shared credentials file, the role of the ECS
+// task and the role of the EC2 instance. Sources of credentials that are
+// not supported (web identities, assumed roles and SSO) fail instead of
+// being skipped.
+func LoadCredentials(profile string) (Credentials, error) {
+	// Credentials in the environment are only used if no profile is
+	// given explicitly
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" && profile == "" {
+		return Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	creds, found, err := sharedCredentials(profile)
+	if found || err != nil {
+		return creds, err
+	}
+
+	// The AWS SDKs use web identities (i.e. IAM roles for EKS service
+	// accounts) before the roles of ECS tasks and EC2 instances, so falling
+	// back to those would sign requests with another role than expected
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" || os.Getenv("AWS_ROLE_ARN") != "" {
+		return Credentials{}, fmt.Errorf("Web identity credentials (AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN) are not supported")
+	}
+
+	cacheMux.Lock()
+	creds, ok := cache[profile]
+	cacheMux.Unlock()
+	if ok && time.Until(creds.Expires) > 5*time.Minute {
+		return creds, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		creds, err = containerCredentials(ecsCredentialsURL+uri, "")
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		creds, err = containerCredentials(uri, os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"))
+	} else if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		creds, err = instanceCredentials()
+	} else {
+		err = fmt.Errorf("No AWS credentials found")
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	cacheMux.Lock()
+	cache[profile] = creds
+	cacheMux.Unlock()
+	return creds, nil
+}
+
+// Settings of profiles that the AWS SDKs get credentials from, but which
+// are not supported
+var unsupportedSettings = []string{
+	"role_arn",
+	"credential_process",
+	"credential_source",
+	"web_identity_token_file",
+	"sso_start_url",
+	"sso_session",
+}
+
+// sharedCredentials reads a profile from the shared credentials file
+// (~/.aws/credentials, or AWS_SHARED_CREDENTIALS_FILE). Profiles that
+// assume roles or use SSO, in either the shared credentials file or the
+// shared config file, are not supported and fail, rather than falling back
+// to the credentials of the ECS task or EC2 instance.
+func sharedCredentials(profile string) (Credentials, bool, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = defaultPath("credentials")
+	}
+	settings, err := readProfile(path, profile)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	if settings["aws_access_key_id"] != "" {
+		return Credentials{
+			AccessKeyID:     settings["aws_access_key_id"],
+			SecretAccessKey: settings["aws_secret_access_key"],
+			SessionToken:    settings["aws_session_token"],
+		}, true, nil
+	}
+
+	// Profiles other than the default one are prefixed in the config file
+	configPath := os.Getenv("AWS_CONFIG_FILE")
+	if configPath == "" {
+		configPath = defaultPath("config")
+	}
+	section := profile
+	if profile != "default" {
+		section = "profile " + profile
+	}
+	config, err := readProfile(configPath, section)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	for _, setting := range unsupportedSettings {
+		if settings[setting] != "" || config[setting] != "" {
+			return Credentials{}, false, fmt.Errorf("Profile '%s' uses %s, which is not supported (only access keys are)", profile, setting)
+		}
+	}
+	if profile != "default" {
+		return Credentials{}, false, fmt.Errorf("Profile '%s' has no access key in %s", profile, path)
+	}
+	return Credentials{}, false, nil
+}
+
+// defaultPath returns the path of a file in ~/.aws, or an empty path if
+// the home directory is unknown.
+func defaultPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readProfile reads the settings of a section of a shared credentials or
+// config file. Files that do not exist have no settings.
+func readProfile(path, section string) (map[string]string, error) {
+	settings := make(map[string]string)
+	if path == "" {
+		return settings, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			found = strings.TrimSpace(strings.Trim(line, "[]")) == section
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if found && len(parts) == 2 {
+			settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// roleCredentials is the format in which ECS and EC2 serve the temporary
+// credentials of roles.
+type roleCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func getJSON(req *http.Request, v interface{}) error {
+	res, err := localClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", req.URL, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (rc roleCredentials) credentials() Credentials {
+	return Credentials{
+		AccessKeyID:     rc.AccessKeyID,
+		SecretAccessKey: rc.SecretAccessKey,
+		SessionToken:    rc.Token,
+		Expires:         rc.Expiration,
+	}
+}
+
+func containerCredentials(url, token string) (Credentials, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var rc roleCredentials
+	if err := getJSON(req, &rc); err != nil {
+		return Credentials{}, fmt.Errorf("Failed to get credentials of ECS task: %s", err)
+	}
+	return rc.credentials(), nil
+}
+
+// instanceCredentials reads the credentials of the instance's role from
+// the EC2 metadata service, using a session token (IMDSv2).
+func instanceCredentials() (Credentials, error) {
+	req, err := http.NewRequest("PUT", ec2MetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	res, err := localClient.Do(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("No AWS credentials found (and no EC2 metadata service: %s)", err)
+	}
+	token, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("Failed to get EC2 metadata token (status %d)", res.StatusCode)
+	}
+
+	req, err = http.NewRequest("GET", ec2MetadataURL+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	res, err = localClient.Do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	roles, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("EC2 instance has no IAM role (status %d)", res.StatusCode)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+
+	req, err = http.NewRequest("GET", ec2MetadataURL+"/latest/meta-data/iam/security-credentials/"+role, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	var rc roleCredentials
+	if err := getJSON(req, &rc); err != nil {
+		return Credentials{}, fmt.Errorf("Failed to get credentials of EC2 instance role: %s", err)
+	}
+	return rc.credentials(), nil
+}
@@ -0,0 +1,181 @@
+package aws
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// Test vectors from the Signature Version 4 test suite
+	creds := Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for target, signature := range map[string]string{
+		"/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	} {
+		req, _ := http.NewRequest("GET", "https://example.amazonaws.com"+target, nil)
+		Sign(req, nil, creds, "us-east-1", "service", now)
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("Expected %s to be signed as:\n%s\ngot:\n%s", target, expected, auth)
+		}
+	}
+}
+
+func TestSharedCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	ioutil.WriteFile(path, []byte(strings.Join([]string{
+		"[default]",
+		"aws_access_key_id = AKIDDEFAULT",
+		"aws_secret_access_key = default-secret",
+		"",
+		"# Temporary credentials",
+		"[staging]",
+		"aws_access_key_id=AKIDSTAGING",
+		"aws_secret_access_key=staging-secret",
+		"aws_session_token=staging-token",
+	}, "\n")), 0600)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	creds, err := LoadCredentials("staging")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if creds.AccessKeyID != "AKIDSTAGING" || creds.SecretAccessKey != "staging-secret" || creds.SessionToken != "staging-token" {
+		t.Errorf("Wrong credentials for staging profile: %#v", creds)
+	}
+	if _, err := LoadCredentials("production"); err == nil {
+		t.Errorf("Expected missing profile to fail")
+	}
+
+	// Credentials that are not supported fail, instead of falling back to
+	// the role of the instance
+	configPath := filepath.Join(t.TempDir(), "config")
+	ioutil.WriteFile(configPath, []byte(strings.Join([]string{
+		"[profile deploy]",
+		"role_arn = arn:aws:iam::123456789012:role/deploy",
+		"source_profile = default",
+	}, "\n")), 0600)
+	os.Setenv("AWS_CONFIG_FILE", configPath)
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+	if _, err := LoadCredentials("deploy"); err == nil || !strings.Contains(err.Error(), "role_arn") {
+		t.Errorf("Expected profile that assumes a role to fail, got: %v", err)
+	}
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if _, err := LoadCredentials(""); err == nil || !strings.Contains(err.Error(), "Web identity") {
+		t.Errorf("Expected web identity credentials to fail, got: %v", err)
+	}
+}
+
+func TestInstanceCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/latest/api/token" {
+			if req.Method != "PUT" {
+				res.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			res.Write([]byte("token"))
+			return
+		}
+		if req.Header.Get("X-Aws-Ec2-Metadata-Token") != "token" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			res.Write([]byte("patrol\n"))
+		case "/latest/meta-data/iam/security-credentials/patrol":
+			res.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIAINSTANCE","SecretAccessKey":"instance-secret","Token":"instance-token","Expiration":"` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { ec2MetadataURL = url }(ec2MetadataURL)
+	ec2MetadataURL = server.URL
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	creds, err := instanceCredentials()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if creds.AccessKeyID != "ASIAINSTANCE" || creds.SessionToken != "instance-token" || creds.Expires.IsZero() {
+		t.Errorf("Wrong instance credentials: %#v", creds)
+	}
+}
+
+func TestGetMetricStatistics(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+		req.ParseForm()
+		form = req.PostForm
+		res.Write([]byte(`<GetMetricStatisticsResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">
+  <GetMetricStatisticsResult>
+    <Datapoints>
+      <member>
+        <Timestamp>2021-05-01T12:05:00Z</Timestamp>
+        <ExtendedStatistics><entry><key>p99</key><value>0.25</value></entry></ExtendedStatistics>
+        <Unit>Seconds</Unit>
+      </member>
+      <member>
+        <Timestamp>2021-05-01T12:00:00Z</Timestamp>
+        <ExtendedStatistics><entry><key>p99</key><value>0.5</value></entry></ExtendedStatistics>
+        <Unit>Seconds</Unit>
+      </member>
+    </Datapoints>
+    <Label>TargetResponseTime</Label>
+  </GetMetricStatisticsResult>
+</GetMetricStatisticsResponse>`))
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	end := time.Date(2021, 5, 1, 12, 10, 0, 0, time.UTC)
+	datapoints, err := GetMetricStatistics(Options{
+		Region:   "us-east-1",
+		Endpoint: server.URL,
+	}, MetricQuery{
+		Namespace:  "AWS/ApplicationELB",
+		MetricName: "TargetResponseTime",
+		Dimensions: map[string]string{"LoadBalancer": "app/web/1234"},
+		Statistic:  "p99",
+		Period:     5 * time.Minute,
+		Start:      end.Add(-15 * time.Minute),
+		End:        end,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if form.Get("ExtendedStatistics.member.1") != "p99" || form.Get("Dimensions.member.1.Value") != "app/web/1234" || form.Get("Period") != "300" {
+		t.Errorf("Wrong request: %v", form)
+	}
+	if len(datapoints) != 2 || datapoints[1].Value != 0.25 || datapoints[1].Unit != "Seconds" {
+		t.Errorf("Wrong datapoints: %#v", datapoints)
+	}
+}
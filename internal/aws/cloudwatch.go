@@ -0,0 +1,175 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Statistics of CloudWatch, apart from percentiles
+var Statistics = []string{"Average", "Sum", "Minimum", "Maximum", "SampleCount"}
+
+// PercentilePattern matches the extended statistics that are percentiles
+// (i.e. p99 or p99.9)
+var PercentilePattern = regexp.MustCompile(`^p\d{1,2}(\.\d+)?$`)
+
+// MetricQuery selects the datapoints of a CloudWatch metric.
+type MetricQuery struct {
+	Namespace  string
+	MetricName string
+	Dimensions map[string]string
+
+	// One of the statistics, or a percentile
+	Statistic string
+
+	// Length of the periods that datapoints are aggregated over
+	Period time.Duration
+
+	Start time.Time
+	End   time.Time
+}
+
+// Datapoint is the value of a statistic over a period.
+type Datapoint struct {
+	Timestamp time.Time
+	Value     float64
+	Unit      string
+}
+
+type metricStatisticsResponse struct {
+	Datapoints []struct {
+		Timestamp          time.Time
+		Unit               string
+		Average            *float64
+		Sum                *float64
+		Minimum            *float64
+		Maximum            *float64
+		SampleCount        *float64
+		ExtendedStatistics []struct {
+			Key   string  `xml:"key"`
+			Value float64 `xml:"value"`
+		} `xml:"ExtendedStatistics>entry"`
+	} `xml:"GetMetricStatisticsResult>Datapoints>member"`
+}
+
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (q MetricQuery) form() url.Values {
+	form := url.Values{
+		"Action":     {"GetMetricStatistics"},
+		"Version":    {"2010-08-01"},
+		"Namespace":  {q.Namespace},
+		"MetricName": {q.MetricName},
+		"StartTime":  {q.Start.UTC().Format(time.RFC3339)},
+		"EndTime":    {q.End.UTC().Format(time.RFC3339)},
+		"Period":     {strconv.Itoa(int(q.Period / time.Second))},
+	}
+	if PercentilePattern.MatchString(q.Statistic) {
+		form.Set("ExtendedStatistics.member.1", q.Statistic)
+	} else {
+		form.Set("Statistics.member.1", q.Statistic)
+	}
+
+	names := make([]string, 0, len(q.Dimensions))
+	for name := range q.Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		form.Set(fmt.Sprintf("Dimensions.member.%d.Name", i+1), name)
+		form.Set(fmt.Sprintf("Dimensions.member.%d.Value", i+1), q.Dimensions[name])
+	}
+	return form
+}
+
+// GetMetricStatistics returns the datapoints of a metric, ordered from
+// oldest to newest.
+func GetMetricStatistics(opts Options, q MetricQuery) ([]Datapoint, error) {
+	region := opts.region()
+	if region == "" {
+		return nil, fmt.Errorf("No AWS region is configured")
+	}
+	creds, err := LoadCredentials(opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte(q.form().Encode())
+	req, err := http.NewRequest("POST", opts.endpoint("monitoring")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	Sign(req, body, creds, region, "monitoring", time.Now())
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach CloudWatch: %s", err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		var errRes errorResponse
+		if xml.Unmarshal(data, &errRes) == nil && errRes.Code != "" {
+			return nil, fmt.Errorf("CloudWatch returned %s: %s", errRes.Code, errRes.Message)
+		}
+		return nil, fmt.Errorf("CloudWatch returned status %d", res.StatusCode)
+	}
+
+	var stats metricStatisticsResponse
+	if err := xml.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("Invalid response from CloudWatch: %s", err)
+	}
+	datapoints := make([]Datapoint, 0, len(stats.Datapoints))
+	for _, point := range stats.Datapoints {
+		var value *float64
+		switch q.Statistic {
+		case "Average":
+			value = point.Average
+		case "Sum":
+			value = point.Sum
+		case "Minimum":
+			value = point.Minimum
+		case "Maximum":
+			value = point.Maximum
+		case "SampleCount":
+			value = point.SampleCount
+		default:
+			for _, entry := range point.ExtendedStatistics {
+				if entry.Key == q.Statistic {
+					v := entry.Value
+					value = &v
+				}
+			}
+		}
+		if value == nil {
+			continue
+		}
+		datapoints = append(datapoints, Datapoint{
+			Timestamp: point.Timestamp,
+			Value:     *value,
+			Unit:      point.Unit,
+		})
+	}
+	sort.Slice(datapoints, func(i, j int) bool {
+		return datapoints[i].Timestamp.Before(datapoints[j].Timestamp)
+	})
+	return datapoints, nil
+}
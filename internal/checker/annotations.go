@@ -0,0 +1,66 @@
+package checker
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// Prefix of the lines of a command's output that annotate its result, i.e.
+// '::patrol::version=1.4.2'
+const annotationPrefix = "::patrol::"
+
+// Annotations beyond these limits are ignored, so that a chatty command
+// cannot bloat the history file
+const (
+	maxAnnotations      = 32
+	maxAnnotationLength = 1024
+)
+
+var annotationKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// parseAnnotations removes the annotation lines from a command's output,
+// and returns the rest of the output along with the annotations. Later
+// annotations replace earlier ones with the same key. Lines that start
+// with the prefix but are not valid annotations are kept in the output.
+func parseAnnotations(output []byte) ([]byte, map[string]string) {
+	if !bytes.Contains(output, []byte(annotationPrefix)) {
+		return output, nil
+	}
+
+	var annotations map[string]string
+	rest := make([]byte, 0, len(output))
+	for len(output) > 0 {
+		line := output
+		if idx := bytes.IndexByte(output, '\n'); idx != -1 {
+			line = output[:idx+1]
+		}
+		output = output[len(line):]
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if !bytes.HasPrefix(trimmed, []byte(annotationPrefix)) {
+			rest = append(rest, line...)
+			continue
+		}
+		parts := bytes.SplitN(trimmed[len(annotationPrefix):], []byte("="), 2)
+		if len(parts) != 2 || !annotationKeyPattern.Match(parts[0]) {
+			rest = append(rest, line...)
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		addAnnotation(annotations, string(parts[0]), string(parts[1]))
+	}
+	return rest, annotations
+}
+
+// addAnnotation sets an annotation, unless it exceeds the limits.
+func addAnnotation(annotations map[string]string, key, value string) {
+	if _, exists := annotations[key]; !exists && len(annotations) >= maxAnnotations {
+		return
+	}
+	if len(value) > maxAnnotationLength {
+		value = value[:maxAnnotationLength]
+	}
+	annotations[key] = value
+}
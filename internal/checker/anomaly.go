@@ -0,0 +1,61 @@
+package checker
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// AnomalyOptions enables anomaly detection for metric checks. Each result
+// is compared to the mean and standard deviation of the check's recent
+// results, and flagged as an anomaly if it is too far from the mean.
+// Anomalies stay healthy, but send 'degraded' notifications.
+type AnomalyOptions struct {
+	// Number of recent results that make up the expected range. No results
+	// are flagged until this many results have been recorded.
+	Window int
+
+	// Number of standard deviations that a result may be away from the
+	// mean before it is flagged
+	Deviations float64
+}
+
+// detectAnomaly flags the given metric item as an anomaly if its value is
+// outside of the range of recent results.
+func (c *Checker) detectAnomaly(item *history.Item) {
+	values := make([]float64, 0, c.Anomaly.Window)
+	for _, prev := range c.recentMetrics(c.Anomaly.Window) {
+		values = append(values, prev.Metric)
+	}
+	if len(values) < c.Anomaly.Window {
+		return
+	}
+
+	mean, stddev := meanStddev(values)
+	// A constant series has no spread to compare against
+	if stddev == 0 {
+		return
+	}
+
+	deviation := (item.Metric - mean) / stddev
+	if math.Abs(deviation) > c.Anomaly.Deviations {
+		item.Anomaly = fmt.Sprintf(
+			"Value %g%s is %.1f standard deviations from the mean of the last %d results (%g%s)",
+			item.Metric, c.MetricUnit, deviation, len(values), mean, c.MetricUnit,
+		)
+	}
+}
+
+func meanStddev(values []float64) (mean, stddev float64) {
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+
+	for _, value := range values {
+		stddev += (value - mean) * (value - mean)
+	}
+	stddev = math.Sqrt(stddev / float64(len(values)))
+	return
+}
@@ -0,0 +1,36 @@
+package checker
+
+import (
+	"fmt"
+)
+
+// Bounds are the range that a value must stay within. Both bounds are
+// inclusive and optional.
+type Bounds struct {
+	Min *float64
+	Max *float64
+}
+
+// Validate checks that the minimum is not greater than the maximum.
+func (b Bounds) Validate() error {
+	if b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+		return fmt.Errorf("min cannot be greater than max")
+	}
+	return nil
+}
+
+func (b Bounds) isSet() bool {
+	return b.Min != nil || b.Max != nil
+}
+
+// check returns an error if the value is out of bounds, which describes
+// the value by the given name (i.e. 'Value is 3, above the maximum of 2').
+func (b Bounds) check(name string, value float64) error {
+	if b.Min != nil && value < *b.Min {
+		return fmt.Errorf("%s is %g, below the minimum of %g", name, value, *b.Min)
+	}
+	if b.Max != nil && value > *b.Max {
+		return fmt.Errorf("%s is %g, above the maximum of %g", name, value, *b.Max)
+	}
+	return nil
+}
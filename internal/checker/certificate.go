@@ -0,0 +1,100 @@
+package checker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// CertificateOptions configure checks of when the TLS certificate that a
+// server presents expires.
+type CertificateOptions struct {
+	// Host of the server, with an optional port (which defaults to 443)
+	Host string
+
+	// Checks fail when the certificate expires in fewer days than this,
+	// which defaults to 14
+	MinDays int `yaml:"minDays"`
+}
+
+// Validate checks the options without contacting the server.
+func (opts CertificateOptions) Validate() error {
+	if opts.Host == "" {
+		return fmt.Errorf("A host is required")
+	}
+	if opts.MinDays < 0 {
+		return fmt.Errorf("minDays cannot be negative")
+	}
+	return nil
+}
+
+// sampleCertificate completes a TLS handshake with the check's host (on
+// port 443 unless it has a port), and records the number of days until the
+// leaf certificate expires as the check's metric. The check fails once
+// fewer than minDays are left, or if the handshake fails, which includes
+// certificates that are not trusted.
+func (c *Checker) sampleCertificate() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	addr := c.Certificate.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	config := &tls.Config{}
+	if c.TLS != nil {
+		var err error
+		if config, err = c.TLS.Config(); err != nil {
+			item.CreatedAt = time.Now()
+			item.Status = "unhealthy"
+			item.Error = err.Error()
+			return item
+		}
+	}
+	config.ServerName = host
+
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: c.CmdTimeout}, "tcp", addr, config)
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("TLS connection to %s failed: %s", addr, err)
+		return item
+	}
+	defer conn.Close()
+
+	cert := conn.ConnectionState().PeerCertificates[0]
+	days := int(time.Until(cert.NotAfter).Hours() / 24)
+	item.Metric = float64(days)
+	item.Output = []byte(fmt.Sprintf(
+		"subject: %s\nissuer: %s\nnames: %s\nexpires: %s\n",
+		cert.Subject,
+		cert.Issuer,
+		strings.Join(cert.DNSNames, ", "),
+		cert.NotAfter.UTC().Format(time.RFC1123),
+	))
+
+	minDays := c.Certificate.MinDays
+	if minDays == 0 {
+		minDays = 14
+	}
+	if days < minDays {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Certificate of %s expires in %d days, on %s", host, days, cert.NotAfter.UTC().Format("Jan 2, 2006"))
+	} else {
+		item.Status = "healthy"
+	}
+	return item
+}
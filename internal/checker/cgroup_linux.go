@@ -0,0 +1,184 @@
+package checker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cgroupRoot is the cgroup that the cgroups of commands are created in,
+// which is set up the first time that a command has a memory limit.
+var cgroupRoot struct {
+	sync.Once
+	path string
+	err  error
+}
+
+// memoryCgroupRoot returns the cgroup that the cgroups of commands are
+// created in, or an error if cgroup v2 memory limits are not available.
+func memoryCgroupRoot() (string, error) {
+	cgroupRoot.Do(func() {
+		cgroupRoot.path, cgroupRoot.err = setupCgroupRoot()
+	})
+	return cgroupRoot.path, cgroupRoot.err
+}
+
+// setupCgroupRoot enables the memory controller for the children of
+// patrol's own cgroup. Cgroups that have processes cannot enable
+// controllers for their children, so patrol first moves itself into a
+// child cgroup, which requires its cgroup to be delegated to it (i.e. with
+// 'Delegate=yes' in its systemd unit).
+func setupCgroupRoot() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	rel := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			rel = line[3:]
+		}
+	}
+	if rel == "" {
+		return "", fmt.Errorf("Patrol is not in a cgroup v2")
+	}
+	mount, root, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	if root != "/" {
+		rel = strings.TrimPrefix(rel, root)
+	}
+	dir := filepath.Join(mount, rel)
+
+	controllers, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	if !hasField(controllers, "memory") {
+		return "", fmt.Errorf("The memory controller is not available in %s", dir)
+	}
+	enabled, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+	if hasField(enabled, "memory") {
+		return dir, nil
+	}
+
+	// The root cgroup is the only one that can have both processes and
+	// controllers for its children
+	if filepath.Clean(rel) != "/" {
+		leaf := filepath.Join(dir, "patrol")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", err
+		}
+	}
+	if err := writeCgroupFile(dir, "cgroup.subtree_control", "+memory"); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted, and the
+// cgroup that is mounted there (which is not the root cgroup in some
+// containers).
+func cgroup2Mount() (string, string, error) {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "cgroup2 ") {
+			continue
+		}
+		if fields := strings.Fields(parts[0]); len(fields) >= 5 {
+			return fields[4], fields[3], nil
+		}
+	}
+	return "", "", fmt.Errorf("cgroup v2 is not mounted")
+}
+
+func hasField(data []byte, field string) bool {
+	for _, f := range strings.Fields(string(data)) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	fd, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.WriteString(value)
+	return err
+}
+
+// memoryCgroup limits the memory that the processes of a single run of a
+// command can use together.
+type memoryCgroup struct {
+	path string
+}
+
+func newMemoryCgroup(limit int64) (*memoryCgroup, error) {
+	root, err := memoryCgroupRoot()
+	if err != nil {
+		return nil, err
+	}
+	path, err := ioutil.TempDir(root, "check-")
+	if err != nil {
+		return nil, err
+	}
+	cg := &memoryCgroup{path: path}
+	if err := writeCgroupFile(path, "memory.max", strconv.FormatInt(limit, 10)); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	// Commands that could swap would slow down rather than be stopped
+	if err := writeCgroupFile(path, "memory.swap.max", "0"); err != nil && !os.IsNotExist(err) {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// add moves a process into the cgroup. Processes that it starts from then
+// on are in the cgroup as well.
+func (cg *memoryCgroup) add(pid int) error {
+	return writeCgroupFile(cg.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// oomKilled returns whether the kernel killed any of the cgroup's processes
+// because the cgroup reached its memory limit.
+func (cg *memoryCgroup) oomKilled() bool {
+	data, err := ioutil.ReadFile(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes the cgroup, which fails if processes that the command
+// left behind are still running in it.
+func (cg *memoryCgroup) remove() {
+	os.Remove(cg.path)
+}
@@ -0,0 +1,40 @@
+package checker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func TestMemoryCgroupRun(t *testing.T) {
+	// A plain directory stands in for the cgroup, so that commands are
+	// only released once their pid was written to it
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/cgroup.procs", nil, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	limits := &runLimits{cgroup: &memoryCgroup{path: dir}}
+
+	cmd := exec.Command(cmdShell, "-c", `cat "$0/cgroup.procs"; echo " $$"`, dir)
+	path, args := (LimitOptions{Memory: 64 << 20}).wrap(cmd.Path, cmd.Args[1:], true)
+	cmd = exec.Command(path, args...)
+	output := bytes.Buffer{}
+	cmd.Stdout = &output
+	if err := limits.run(cmd); err != nil {
+		t.Error(err)
+		return
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if output.String() != pid+" "+pid+"\n" {
+		t.Error(fmt.Errorf("Expected command to start after being added to the cgroup as %s, got: %q", pid, output.String()))
+		return
+	}
+	if limits.oomKilled {
+		t.Error(fmt.Errorf("Expected command not to be OOM killed"))
+		return
+	}
+}
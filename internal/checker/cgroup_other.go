@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package checker
+
+import "fmt"
+
+func memoryCgroupRoot() (string, error) {
+	return "", fmt.Errorf("cgroups are only supported on Linux")
+}
+
+type memoryCgroup struct{}
+
+func newMemoryCgroup(limit int64) (*memoryCgroup, error) {
+	_, err := memoryCgroupRoot()
+	return nil, err
+}
+
+func (cg *memoryCgroup) add(pid int) error {
+	return nil
+}
+
+func (cg *memoryCgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *memoryCgroup) remove() {}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,15 +40,103 @@ type Checker struct {
 	Type          string
 	Cmd           string
 	MetricUnit    string
+	Severity      Severity
+	Dedupe        history.Dedupe
 	Interval      time.Duration
 	CmdTimeout    time.Duration
 	MaxRetries    int
+	Samples       int
+	Region        string
+	Quorum        int
 	RetryInterval time.Duration
+	Retention     history.Retention
+	Anomaly       *AnomalyOptions
+	Forecast      *ForecastOptions
+	Proxy         *ProxyOptions
+	TLS           *TLSOptions
+	RunAs         *RunAsOptions
+	Limits        *LimitOptions
 	History       *history.File
 
-	logger   logger.Logger
-	doneChan chan bool
-	wg       *sync.WaitGroup
+	// Pool that limits how many checks run at once, and the priority of
+	// the check's runs within the pool
+	Pool     *Pool
+	Priority Priority
+
+	// Private checks run and send notifications as usual, but are only
+	// shown to the admin and responders
+	Private bool
+
+	// Who is responsible for the check, and the runbook to follow when it
+	// fails. Both are shown on the status page and sent in notifications.
+	Owner      string
+	RunbookURL string
+
+	// Tags of the check, such as 'region:eu', which silences can match
+	Tags []string
+
+	// Statuspage checks of the providers that the check depends on, as
+	// 'group/check', whose outages are shown next to the check's failures
+	DependsOn []string
+
+	// External checks are not run by patrol, their results are recorded
+	// when they are reported (see Record)
+	External bool
+
+	// Address families ("ipv4", "ipv6") that the check must pass over,
+	// which are checked independently
+	AddressFamilies []string
+
+	// External program that runs the check instead of Cmd, and the JSON
+	// options that are passed to it
+	Plugin       *Plugin
+	PluginConfig []byte
+
+	// Sources that are polled instead of running Cmd
+	SNMP        *SNMPOptions
+	RabbitMQ    *RabbitMQOptions
+	Kafka       *KafkaOptions
+	Domain      *DomainOptions
+	NTP         *NTPOptions
+	Content     *ContentOptions
+	LogWatch    *LogWatchOptions
+	Certificate *CertificateOptions
+	Prometheus  *PrometheusOptions
+	CloudWatch  *CloudWatchOptions
+	StatusPage  *StatusPageOptions
+
+	// Simulated results that are recorded instead of running the check
+	// or polling its source
+	Simulation *SimulationOptions
+
+	logger    logger.Logger
+	doneChan  chan bool
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
+
+	// Closed when a paused checker is resumed, nil while running
+	pauseMux   *sync.Mutex
+	resumeChan chan bool
+
+	stateMux *sync.Mutex
+	state    State
+	receiver eventReceiver
+
+	// Where the previous run stopped reading the log file of logwatch
+	// checks
+	logPosition *logPosition
+
+	// Patterns of content and logwatch checks, which are compiled once
+	contentIgnore []*regexp.Regexp
+	logPatterns   []*regexp.Regexp
+	logExclude    []*regexp.Regexp
+
+	// Latest results that new results are compared to
+	recent *recentResults
+
+	// Latest results reported by other regions, by region name
+	regionMux     *sync.Mutex
+	regionResults map[string]history.Item
 }
 
 func New(c *Checker) *Checker {
@@ -55,7 +144,21 @@ func New(c *Checker) *Checker {
 		c.CmdTimeout = 1 * time.Minute
 	}
 	c.doneChan = make(chan bool, 1)
+	c.closeOnce = &sync.Once{}
 	c.wg = &sync.WaitGroup{}
+	c.pauseMux = &sync.Mutex{}
+	c.stateMux = &sync.Mutex{}
+	c.regionMux = &sync.Mutex{}
+	c.regionResults = make(map[string]history.Item)
+	c.logPosition = &logPosition{}
+	c.recent = &recentResults{}
+	if c.Content != nil {
+		c.contentIgnore = compilePatterns(c.Content.Ignore)
+	}
+	if c.LogWatch != nil {
+		c.logPatterns = compilePatterns(c.LogWatch.Patterns)
+		c.logExclude = compilePatterns(c.LogWatch.Exclude)
+	}
 	c.SetLogLevel(logger.LevelInfo)
 	if c.History != nil {
 		c.History.AddChecker(c)
@@ -66,6 +169,12 @@ func New(c *Checker) *Checker {
 	if c.RetryInterval == 0 {
 		c.RetryInterval = 5 * time.Second
 	}
+	if c.Severity == "" {
+		c.Severity = SeverityMajor
+	}
+	if c.Priority == "" {
+		c.Priority = PriorityNormal
+	}
 	return c
 }
 
@@ -77,6 +186,38 @@ func (c *Checker) GetName() string {
 	return c.Name
 }
 
+func (c *Checker) GetRetention() history.Retention {
+	return c.Retention
+}
+
+// Pause stops the checker from running until 'Resume()' is called. A run
+// that is already in progress is not interrupted.
+func (c *Checker) Pause() {
+	c.pauseMux.Lock()
+	if c.resumeChan == nil {
+		c.logger.Infof("Pausing checker")
+		c.resumeChan = make(chan bool)
+	}
+	c.pauseMux.Unlock()
+}
+
+// Resume restarts a paused checker, which runs immediately.
+func (c *Checker) Resume() {
+	c.pauseMux.Lock()
+	if c.resumeChan != nil {
+		c.logger.Infof("Resuming checker")
+		close(c.resumeChan)
+		c.resumeChan = nil
+	}
+	c.pauseMux.Unlock()
+}
+
+func (c *Checker) IsPaused() bool {
+	c.pauseMux.Lock()
+	defer c.pauseMux.Unlock()
+	return c.resumeChan != nil
+}
+
 func (c *Checker) SetLogLevel(level logger.LogLevel) {
 	c.logger = logger.New(
 		level,
@@ -95,7 +236,17 @@ func (c *Checker) Check() history.Item {
 				return item
 			}
 		}
+		c.updateState(func(state *State) {
+			state.Running = true
+			state.RunStartedAt = time.Now()
+			state.Attempt = i + 1
+			state.Attempts++
+		})
 		item = c.check()
+		c.updateState(func(state *State) {
+			state.Running = false
+			state.Attempt = 0
+		})
 		if item.Status != "unhealthy" {
 			return item
 		}
@@ -106,6 +257,78 @@ func (c *Checker) Check() history.Item {
 func (c *Checker) check() history.Item {
 	c.logger.Debugf("Checking status")
 
+	var item history.Item
+	if len(c.AddressFamilies) > 0 {
+		item = c.checkFamilies()
+	} else {
+		item = c.sample()
+	}
+	if c.Type == "metric" && item.Status == "healthy" {
+		if c.Samples > 1 {
+			item = c.takeSamples(item)
+		}
+		if item.Status == "healthy" && c.Anomaly != nil && c.History != nil {
+			c.detectAnomaly(&item)
+		}
+	}
+	c.annotateRegions(&item)
+	if c.Quorum > 0 {
+		c.applyConsensus(&item)
+	}
+
+	c.logger.Infof("Check completed: %s", item)
+	return item
+}
+
+// sample runs the check's command once, with the given variables added
+// to its environment.
+func (c *Checker) sample(env ...string) history.Item {
+	if c.Simulation != nil {
+		return c.sampleSimulation(time.Now())
+	}
+	if c.SNMP != nil {
+		return c.sampleSNMP()
+	}
+	if c.RabbitMQ != nil {
+		return c.sampleRabbitMQ()
+	}
+	if c.Kafka != nil {
+		return c.sampleKafka()
+	}
+	if c.Domain != nil {
+		return c.sampleDomain()
+	}
+	if c.NTP != nil {
+		return c.sampleNTP()
+	}
+	if c.Content != nil {
+		return c.sampleContent()
+	}
+	if c.LogWatch != nil {
+		return c.sampleLogWatch()
+	}
+	if c.Certificate != nil {
+		return c.sampleCertificate()
+	}
+	if c.Prometheus != nil {
+		return c.samplePrometheus()
+	}
+	if c.CloudWatch != nil {
+		return c.sampleCloudWatch()
+	}
+	if c.StatusPage != nil {
+		return c.sampleStatusPage()
+	}
+	if c.Proxy != nil {
+		env = append(c.Proxy.Env(), env...)
+	}
+	if c.TLS != nil {
+		env = append(c.TLS.Env(), env...)
+	}
+	if c.Plugin != nil {
+		return c.samplePlugin(env)
+	}
+
 	stdout := bytes.Buffer{}
 	stderr := bytes.Buffer{}
 	combinedOutput := bytes.Buffer{}
@@ -125,22 +348,36 @@ func (c *Checker) check() history.Item {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = io.MultiWriter(&stdout, &combinedOutput)
 	cmd.Stderr = io.MultiWriter(&stderr, &combinedOutput)
+	output := c.limitOutput(cancel, &cmd.Stdout, &cmd.Stderr)
 
 	cmdStart := time.Now()
-	err := cmd.Run()
+	var limits *runLimits
+	err := c.runAs(cmd, env)
+	if err == nil {
+		limits, err = c.prepareLimits(cmd)
+	}
+	if err == nil {
+		err = limits.run(cmd)
+	}
 	cancel()
 
+	// Annotations are removed from the output, so that they are neither
+	// shown with it nor mistaken for a metric
+	stdoutBytes, _ := parseAnnotations(stdout.Bytes())
+	outputBytes, annotations := parseAnnotations(combinedOutput.Bytes())
 	item := history.Item{
-		Group:      c.Group,
-		Name:       c.Name,
-		Type:       c.Type,
-		Output:     combinedOutput.Bytes(),
-		CreatedAt:  time.Now(),
-		Duration:   time.Since(cmdStart),
-		Metric:     0,
-		MetricUnit: c.MetricUnit,
-		Status:     "",
-		Error:      "",
+		Group:       c.Group,
+		Name:        c.Name,
+		Type:        c.Type,
+		Dedupe:      c.Dedupe,
+		Output:      outputBytes,
+		Annotations: annotations,
+		CreatedAt:   time.Now(),
+		Duration:    time.Since(cmdStart),
+		Metric:      0,
+		MetricUnit:  c.MetricUnit,
+		Status:      "",
+		Error:       "",
 	}
 
 	if exitErr, ok := err.(*exec.ExitError); err != nil && ok {
@@ -153,7 +390,7 @@ func (c *Checker) check() history.Item {
 		item.Status = "healthy"
 
 		if c.Type == "metric" {
-			n, err := strconv.ParseFloat(strings.TrimSpace(string(stdout.Bytes())), 10)
+			n, err := strconv.ParseFloat(strings.TrimSpace(string(stdoutBytes)), 10)
 			if err == nil {
 				item.Metric = n
 			} else {
@@ -162,16 +399,29 @@ func (c *Checker) check() history.Item {
 			}
 		}
 	}
-
-	c.logger.Infof("Check completed: %s", item)
+	c.checkLimits(&item, cmd, output, limits)
 	return item
 }
 
 type eventReceiver interface {
+	OnCheckerResult(item history.Item)
 	OnCheckerStatus(status, service, check string)
 }
 
 func (c *Checker) Start(receiver eventReceiver) error {
+	c.stateMux.Lock()
+	c.receiver = receiver
+	c.stateMux.Unlock()
+	if c.External {
+		c.logger.Debugf("Waiting for results of external check")
+		return nil
+	}
+
+	// Checks that have never reported a result are pending. Their first
+	// result only establishes what is normal, so it does not notify anyone
+	_, hasResults := c.History.GetLatestItem(c.Group, c.Name)
+	pending := !hasResults
+
 	c.wg.Add(1)
 	go func() {
 		defer func() {
@@ -180,7 +430,68 @@ func (c *Checker) Start(receiver eventReceiver) error {
 		}()
 
 		for {
+			c.pauseMux.Lock()
+			resumeChan := c.resumeChan
+			c.pauseMux.Unlock()
+			if resumeChan != nil {
+				c.logger.Debugf("Waiting for checker to be resumed")
+				select {
+				case <-resumeChan:
+				case <-c.doneChan:
+					return
+				}
+			}
+
+			c.updateState(func(state *State) {
+				state.NextRunAt = time.Time{}
+			})
+			queued := func() {
+				c.updateState(func(state *State) {
+					state.Queued = true
+				})
+			}
+			if !c.Pool.acquire(c.Priority, c.doneChan, queued) {
+				select {
+				case <-c.doneChan:
+					return
+				default:
+				}
+				c.skipRun()
+				select {
+				case <-time.After(c.Interval):
+					continue
+				case <-c.doneChan:
+					return
+				}
+			}
+			c.updateState(func(state *State) {
+				state.Queued = false
+			})
+			runStart := time.Now()
 			item := c.Check()
+			c.Pool.release()
+
+			// Warnings are only sent when a check is first projected to
+			// cross its threshold, not for every result after that
+			newForecast := false
+			if c.Forecast != nil && item.Status != "unhealthy" {
+				forecastAt := c.forecast(item)
+				c.updateState(func(state *State) {
+					newForecast = !forecastAt.IsZero() && state.ForecastAt.IsZero()
+					state.ForecastAt = forecastAt
+				})
+			}
+
+			c.updateState(func(state *State) {
+				state.LastRunAt = runStart
+				state.LastDuration = time.Since(runStart)
+				state.LastStatus = item.Status
+				state.NextRunAt = time.Now().Add(c.Interval)
+				state.Runs++
+				if item.Status == "unhealthy" {
+					state.Failures++
+				}
+			})
 
 			// Only perform write if the 'Close()' was not called already
 			select {
@@ -188,14 +499,29 @@ func (c *Checker) Start(receiver eventReceiver) error {
 				c.logger.Debugf("Skipping write, checker is closed")
 
 			default:
-				var err error
-				item, err = c.History.Append(item)
-				if err != nil {
-					panic(err)
-				}
-				if receiver != nil {
-					receiver.OnCheckerStatus(item.Status, item.Group, item.Name)
-				}
+				// The write is not waited on, so that checks are not held
+				// up by disk flushes - 'Close()' waits for pending writes
+				c.wg.Add(1)
+				c.updateState(func(state *State) {
+					state.PendingWrites++
+				})
+				firstResult := pending
+				pending = false
+				c.History.AppendAsync(item, func(item history.Item, err error) {
+					defer c.wg.Done()
+					c.updateState(func(state *State) {
+						state.PendingWrites--
+					})
+					if err != nil {
+						c.logger.Warnf("Failed to write result: %s", err)
+						return
+					}
+					c.rememberResult(item)
+					if firstResult {
+						c.logger.Infof("Recorded first result (%s), skipping notifications", item.Status)
+					}
+					c.notifyReceiver(receiver, item, newForecast, firstResult)
+				})
 			}
 
 			c.logger.Infof("Waiting %s before checking again", c.Interval)
@@ -209,7 +535,67 @@ func (c *Checker) Start(receiver eventReceiver) error {
 	return nil
 }
 
-func (c *Checker) Close() {
-	close(c.doneChan)
-	c.wg.Wait()
+// skipRun records that a run was skipped, because all slots of the pool
+// were taken by checks of a higher priority.
+func (c *Checker) skipRun() {
+	c.logger.Warnf("Skipping run, all %d slots are taken", c.Pool.Size())
+	c.updateState(func(state *State) {
+		state.Queued = false
+		state.LastRunAt = time.Now()
+		state.LastDuration = 0
+		state.LastStatus = "skipped"
+		state.NextRunAt = time.Now().Add(c.Interval)
+		state.Skipped++
+	})
+}
+
+// notifyReceiver reports a result that was written, and its events. The
+// first result of a check has no events, since it does not notify anyone.
+func (c *Checker) notifyReceiver(receiver eventReceiver, item history.Item, newForecast, firstResult bool) {
+	if receiver == nil {
+		return
+	}
+	receiver.OnCheckerResult(item)
+	if firstResult {
+		return
+	}
+	receiver.OnCheckerStatus(item.Status, item.Group, item.Name)
+	if newForecast {
+		receiver.OnCheckerStatus("forecast", item.Group, item.Name)
+	}
+	if item.ContentChanged {
+		receiver.OnCheckerStatus("changed", item.Group, item.Name)
+	}
+	if item.Anomaly != "" {
+		receiver.OnCheckerStatus("degraded", item.Group, item.Name)
+	}
+}
+
+// Stop signals the checker to stop without waiting for it, so that many
+// checkers can be stopped at once before Close waits on each of them.
+func (c *Checker) Stop() {
+	c.closeOnce.Do(func() {
+		close(c.doneChan)
+	})
+}
+
+// Close stops the checker, and waits for its current run to finish and
+// for its results to be written to the history file. A result whose run
+// finishes after Close was called is not written. It returns an error if
+// ctx is done first, in which case some results may not have been written
+// yet. Calling Close again waits for the same outcome.
+func (c *Checker) Close(ctx context.Context) error {
+	c.Stop()
+
+	stopped := make(chan bool)
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for %s/%s to stop (%d results not written yet): %w", c.Group, c.Name, c.GetState().PendingWrites, ctx.Err())
+	}
 }
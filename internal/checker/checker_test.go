@@ -1,8 +1,16 @@
 package checker
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -10,6 +18,7 @@ import (
 
 	"github.com/karimsa/patrol/internal/history"
 	"github.com/karimsa/patrol/internal/logger"
+	"github.com/karimsa/patrol/internal/snmp"
 )
 
 func TestBooleanChecks(t *testing.T) {
@@ -30,6 +39,11 @@ func TestBooleanChecks(t *testing.T) {
 
 type notificationTester struct {
 	notifications [][]string
+	results       int
+}
+
+func (nt *notificationTester) OnCheckerResult(item history.Item) {
+	nt.results++
 }
 
 func (nt *notificationTester) OnCheckerStatus(status, group, item string) {
@@ -62,13 +76,37 @@ func TestRunLoop(t *testing.T) {
 		items = historyFile.GetItems(checker)
 		time.Sleep(1 * time.Second)
 	}
-	checker.Close()
-	historyFile.Close()
+	checker.Close(context.Background())
 
 	if len(items) != 1 {
 		t.Error(fmt.Errorf("Bad result for history: %#v", items))
 		return
 	}
+	if len(nt.notifications) != 0 {
+		t.Error(fmt.Errorf("Notifications were sent for the first result of a check: %#v", nt.notifications))
+		return
+	}
+	if nt.results != 1 {
+		t.Error(fmt.Errorf("Expected the first result to be reported, got %d results", nt.results))
+		return
+	}
+
+	// Once the check has a result, the next run notifies as usual
+	checker = New(&Checker{
+		Group:    "staging",
+		Name:     "Network is up",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		Cmd:      "ping -c3 localhost",
+		History:  historyFile,
+	})
+	checker.Start(nt)
+	for i := 0; i < 10 && len(nt.notifications) == 0; i++ {
+		time.Sleep(1 * time.Second)
+	}
+	checker.Close(context.Background())
+	historyFile.Close(context.Background())
+
 	if len(nt.notifications) == 0 {
 		t.Error(fmt.Errorf("No notifications were sent"))
 		return
@@ -81,6 +119,128 @@ func TestRunLoop(t *testing.T) {
 	}
 }
 
+func TestRecord(t *testing.T) {
+	os.Remove("history-record.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "history-record.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	checker := New(&Checker{
+		Group:      "staging",
+		Name:       "Backup size",
+		Type:       "metric",
+		MetricUnit: "GB",
+		Interval:   24 * time.Hour,
+		External:   true,
+		History:    historyFile,
+	})
+	nt := &notificationTester{notifications: make([][]string, 0, 1)}
+	checker.Start(nt)
+	defer checker.Close(context.Background())
+
+	for _, status := range []string{"healthy", "unhealthy"} {
+		item, err := checker.Record(history.Item{
+			Name:        "Something else",
+			Status:      status,
+			Metric:      42,
+			Annotations: map[string]string{"host": "db-1"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if item.Group != "staging" || item.Name != "Backup size" || item.Metric != 42 || item.MetricUnit != "GB" || item.Annotations["host"] != "db-1" {
+			t.Error(fmt.Errorf("Unexpected recorded result: %s", item))
+			return
+		}
+	}
+	if items := historyFile.GetItems(checker); len(items) != 2 || items[0].Status != "unhealthy" {
+		t.Error(fmt.Errorf("Expected results to be written to history, got: %#v", items))
+		return
+	}
+	if fmt.Sprintf("%#v", nt.notifications) != `[][]string{[]string{"unhealthy", "staging", "Backup size"}}` {
+		t.Error(fmt.Errorf("Expected a notification for the second result only, got: %#v", nt.notifications))
+		return
+	}
+
+	for _, result := range []history.Item{
+		{Status: "down"},
+		{Status: "healthy", Annotations: map[string]string{"not a key": "value"}},
+	} {
+		if _, err := checker.Record(result); !errors.Is(err, ErrInvalidResult) {
+			t.Error(fmt.Errorf("Expected invalid result to be rejected, got: %v", err))
+			return
+		}
+	}
+	checker.Pause()
+	if _, err := checker.Record(history.Item{Status: "healthy"}); !errors.Is(err, ErrPaused) {
+		t.Error(fmt.Errorf("Expected result of paused check to be rejected, got: %v", err))
+		return
+	}
+	checker.External = false
+	if _, err := checker.Record(history.Item{Status: "healthy"}); !errors.Is(err, ErrNotExternal) {
+		t.Error(fmt.Errorf("Expected result of scheduled check to be rejected, got: %v", err))
+		return
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	os.Remove("history-clock-skew.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "history-clock-skew.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	// A result from the future stands in for the clock being stepped back
+	// after it was recorded
+	future := time.Now().Add(time.Hour)
+	for _, err := range historyFile.AppendBatch([]history.Item{
+		{Group: "staging", Name: "Ping", Type: "boolean", Dedupe: history.DedupeEveryRun, Status: "unhealthy", CreatedAt: future},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Ping",
+		Type:     "boolean",
+		Dedupe:   history.DedupeEveryRun,
+		Interval: 1 * time.Minute,
+		Cmd:      "true",
+		History:  historyFile,
+	})
+	nt := &notificationTester{notifications: make([][]string, 0, 1)}
+	checker.Start(nt)
+	for i := 0; i < 50 && len(historyFile.GetItems(checker)) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	checker.Close(context.Background())
+
+	// The result is moved forward rather than hidden behind the result
+	// from the future, so the check recovers
+	latest, ok := historyFile.GetLatestItem("staging", "Ping")
+	if !ok || latest.Status != "recovered" || latest.ClockSkew < 59*time.Minute || !latest.CreatedAt.Equal(future) {
+		t.Error(fmt.Errorf("Expected result to be moved forward to the latest result, got: %s (skew: %s)", latest, latest.ClockSkew))
+		return
+	}
+	if fmt.Sprintf("%#v", nt.notifications) != `[][]string{[]string{"recovered", "staging", "Ping"}}` {
+		t.Error(fmt.Errorf("Expected the check to recover, got: %#v", nt.notifications))
+		return
+	}
+}
+
 func TestRetries(t *testing.T) {
 	fd, err := ioutil.TempFile(os.TempDir(), "*")
 	if err != nil {
@@ -96,7 +256,7 @@ func TestRetries(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	defer historyFile.Close()
+	defer historyFile.Close(context.Background())
 
 	checker := New(&Checker{
 		Group:         "file writer",
@@ -110,7 +270,7 @@ func TestRetries(t *testing.T) {
 	checker.SetLogLevel(logger.LevelDebug)
 	checker.Start(nil)
 	<-time.After(1 * time.Second)
-	checker.Close()
+	checker.Close(context.Background())
 
 	var items []history.Item
 	for i := 0; i < 10 && len(items) == 0; i++ {
@@ -133,3 +293,1403 @@ func TestRetries(t *testing.T) {
 		return
 	}
 }
+
+func TestPause(t *testing.T) {
+	fd, err := ioutil.TempFile(os.TempDir(), "*")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fd.Close()
+
+	historyFile, err := history.New(history.NewOptions{
+		File: fd.Name() + "-history-pause.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	checker := New(&Checker{
+		Group:    "file writer",
+		Name:     "write hello",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		Cmd:      fmt.Sprintf("echo hello world >> %s", fd.Name()),
+		History:  historyFile,
+	})
+	checker.Pause()
+	checker.Start(nil)
+	<-time.After(500 * time.Millisecond)
+
+	if data, err := ioutil.ReadFile(fd.Name()); err != nil {
+		t.Error(err)
+		return
+	} else if len(data) > 0 {
+		t.Error(fmt.Errorf("Paused checker was run: %s", data))
+		return
+	}
+
+	checker.Resume()
+	<-time.After(500 * time.Millisecond)
+	checker.Close(context.Background())
+
+	if data, err := ioutil.ReadFile(fd.Name()); err != nil {
+		t.Error(err)
+		return
+	} else if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 {
+		t.Error(fmt.Errorf("Resumed checker was not run once: %#v", lines))
+		return
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	pool := NewPool(1)
+	done := make(chan bool)
+	if !pool.acquire(PriorityNormal, done, func() {}) {
+		t.Error(fmt.Errorf("Expected a free slot"))
+		return
+	}
+	if pool.acquire(PriorityLow, done, func() {}) {
+		t.Error(fmt.Errorf("Expected low-priority run to be skipped"))
+		return
+	}
+
+	// Checks wait in order of priority, regardless of when they were due
+	order := make(chan Priority, 2)
+	for _, priority := range []Priority{PriorityNormal, PriorityHigh} {
+		queued := make(chan bool)
+		go func(priority Priority) {
+			if pool.acquire(priority, done, func() { close(queued) }) {
+				order <- priority
+			}
+		}(priority)
+		<-queued
+	}
+	pool.release()
+	if priority := <-order; priority != PriorityHigh {
+		t.Error(fmt.Errorf("Expected high-priority check to run first, got %s", priority))
+		return
+	}
+	pool.release()
+	if priority := <-order; priority != PriorityNormal {
+		t.Error(fmt.Errorf("Expected normal-priority check to run second, got %s", priority))
+		return
+	}
+
+	// Closing a checker stops it from waiting
+	closed := make(chan bool)
+	go func() {
+		closed <- pool.acquire(PriorityHigh, done, func() {})
+	}()
+	close(done)
+	if <-closed {
+		t.Error(fmt.Errorf("Expected closed checker to stop waiting"))
+		return
+	}
+	pool.release()
+	if pool.running != 0 || len(pool.waiting) != 0 {
+		t.Error(fmt.Errorf("Expected all slots to be free, got %d running and %d waiting", pool.running, len(pool.waiting)))
+		return
+	}
+
+	// Low-priority checks skip their runs while the pool is saturated
+	historyFile, err := history.New(history.NewOptions{
+		File: "./history-priorities.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		historyFile.Close(context.Background())
+		os.Remove("./history-priorities.db")
+	}()
+	pool = NewPool(1)
+	slow := New(&Checker{
+		Group:    "jobs",
+		Name:     "slow",
+		Type:     "boolean",
+		Cmd:      "sleep 0.5",
+		Interval: 1 * time.Minute,
+		History:  historyFile,
+		Pool:     pool,
+	})
+	low := New(&Checker{
+		Group:    "jobs",
+		Name:     "low",
+		Type:     "boolean",
+		Cmd:      "true",
+		Interval: 100 * time.Millisecond,
+		History:  historyFile,
+		Pool:     pool,
+		Priority: PriorityLow,
+	})
+	slow.Start(nil)
+	<-time.After(100 * time.Millisecond)
+	low.Start(nil)
+	<-time.After(250 * time.Millisecond)
+	if state := low.GetState(); state.Runs != 0 || state.Skipped == 0 || state.LastStatus != "skipped" {
+		t.Error(fmt.Errorf("Expected low-priority check to be skipped: %#v", state))
+		return
+	}
+	<-time.After(500 * time.Millisecond)
+	slow.Close(context.Background())
+	low.Close(context.Background())
+	if state := low.GetState(); state.Runs == 0 {
+		t.Error(fmt.Errorf("Expected low-priority check to run once the pool is free: %#v", state))
+		return
+	}
+}
+
+func TestAnomaly(t *testing.T) {
+	os.Remove("history-anomaly.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "history-anomaly.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	for _, value := range []float64{10, 11, 9, 10, 12, 8} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "staging",
+			Name:   "latency",
+			Type:   "metric",
+			Status: "healthy",
+			Metric: value,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for cmd, anomaly := range map[string]bool{
+		"echo 11": false,
+		"echo 50": true,
+		"echo -5": true,
+	} {
+		checker := New(&Checker{
+			Group:      "staging",
+			Name:       "latency",
+			Type:       "metric",
+			MetricUnit: "ms",
+			Interval:   1 * time.Minute,
+			Cmd:        cmd,
+			History:    historyFile,
+			Anomaly: &AnomalyOptions{
+				Window:     5,
+				Deviations: 3,
+			},
+		})
+
+		// Anomalies are flagged without changing the status of the result
+		item := checker.Check()
+		if item.Status != "healthy" || (item.Anomaly != "") != anomaly {
+			t.Error(fmt.Errorf("Expected anomaly of %s to be %t, got: %s (%s)", cmd, anomaly, item, item.Anomaly))
+			return
+		}
+	}
+
+	// A check that fails after an anomaly transitions from healthy to
+	// unhealthy, which opens an incident
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "latency",
+		Type:     "metric",
+		Interval: 1 * time.Minute,
+		History:  historyFile,
+		Anomaly:  &AnomalyOptions{Window: 5, Deviations: 3},
+	})
+	for _, cmd := range []string{"echo 50", "exit 1"} {
+		checker.Cmd = cmd
+		item := checker.Check()
+		if _, err := historyFile.Append(item); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	transitions := historyFile.GetTransitions("staging", "latency")
+	if len(transitions) < 2 || transitions[0].From != "healthy" || transitions[0].To != "unhealthy" {
+		t.Error(fmt.Errorf("Expected a transition from healthy to unhealthy, got: %v", transitions))
+		return
+	}
+}
+
+func TestRecentResults(t *testing.T) {
+	os.Remove("history-recent.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "history-recent.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	for _, value := range []float64{1, 2} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "staging",
+			Name:   "queue",
+			Type:   "metric",
+			Status: "healthy",
+			Metric: value,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "queue",
+		Type:     "metric",
+		Interval: 1 * time.Minute,
+		External: true,
+		History:  historyFile,
+		Anomaly: &AnomalyOptions{
+			Window:     3,
+			Deviations: 3,
+		},
+	})
+
+	// Results that are recorded after the recent results were read from
+	// history are added to them, and unhealthy results are left out
+	for _, result := range []history.Item{
+		{Status: "healthy", Metric: 3},
+		{Status: "unhealthy", Metric: 100},
+		{Status: "healthy", Metric: 4},
+	} {
+		if _, err := checker.Record(result); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	var values []float64
+	for _, item := range checker.recentMetrics(3) {
+		values = append(values, item.Metric)
+	}
+	if fmt.Sprintf("%v", values) != "[4 3 2]" {
+		t.Error(fmt.Errorf("Expected the latest healthy results, got: %v", values))
+		return
+	}
+}
+
+func TestForecast(t *testing.T) {
+	os.Remove("history-forecast.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "history-forecast.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	// Disk usage grows by 5% per hour
+	now := time.Now()
+	items := make([]history.Item, 5)
+	for i := range items {
+		items[i] = history.Item{
+			Group:     "staging",
+			Name:      "disk",
+			Type:      "metric",
+			Status:    "healthy",
+			Metric:    float64(50 + 5*i),
+			CreatedAt: now.Add(time.Duration(i-5) * time.Hour),
+		}
+	}
+	for _, err := range historyFile.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	item := history.Item{
+		Group:     "staging",
+		Name:      "disk",
+		Type:      "metric",
+		Status:    "healthy",
+		Metric:    75,
+		CreatedAt: now,
+	}
+	for _, test := range []struct {
+		threshold float64
+		horizon   time.Duration
+		eta       time.Duration
+	}{
+		{90, 72 * time.Hour, 3 * time.Hour},
+		{90, 1 * time.Hour, 0},
+		{40, 72 * time.Hour, 0},
+	} {
+		checker := New(&Checker{
+			Group:      "staging",
+			Name:       "disk",
+			Type:       "metric",
+			MetricUnit: "%",
+			Interval:   1 * time.Minute,
+			Cmd:        "true",
+			History:    historyFile,
+			Forecast: &ForecastOptions{
+				Threshold: test.threshold,
+				Horizon:   test.horizon,
+				Window:    6,
+			},
+		})
+
+		forecastAt := checker.forecast(item)
+		if test.eta == 0 {
+			if !forecastAt.IsZero() {
+				t.Error(fmt.Errorf("Expected no forecast for %#v, got: %s", test, forecastAt))
+				return
+			}
+		} else if eta := forecastAt.Sub(now); eta < test.eta-time.Minute || eta > test.eta+time.Minute {
+			t.Error(fmt.Errorf("Expected forecast in %s for %#v, got: %s", test.eta, test, eta))
+			return
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	os.Remove("checker-samples.txt")
+	defer os.Remove("checker-samples.txt")
+
+	checker := New(&Checker{
+		Group:      "staging",
+		Name:       "latency",
+		Type:       "metric",
+		MetricUnit: "ms",
+		Interval:   1 * time.Minute,
+		Samples:    5,
+		Cmd:        `n=$(( $(cat checker-samples.txt 2>/dev/null || echo 0) + 1 )); echo $n > checker-samples.txt; echo $(( (n * 7) % 5 ))`,
+	})
+
+	item := checker.Check()
+	if item.Status != "healthy" || item.Samples == nil {
+		t.Error(fmt.Errorf("Unexpected result from check: %s", item))
+		return
+	}
+	samples := *item.Samples
+	if samples != (history.Samples{Count: 5, Min: 0, P50: 2, P95: 4, Max: 4}) || item.Metric != 2 {
+		t.Error(fmt.Errorf("Wrong samples recorded: %#v (metric: %f)", samples, item.Metric))
+		return
+	}
+}
+
+func TestConsensus(t *testing.T) {
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Website is up",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		Cmd:      "false",
+		Region:   "us",
+		Quorum:   2,
+	})
+
+	checker.ReportRegionResult("eu", history.Item{Status: "healthy", CreatedAt: time.Now()})
+	item := checker.Check()
+	if item.Status != "healthy" || item.Regions["us"] != "unhealthy" || item.Regions["eu"] != "healthy" {
+		t.Error(fmt.Errorf("Expected single region failure to be below quorum: %s (regions: %v)", item, item.Regions))
+		return
+	}
+
+	checker.ReportRegionResult("eu", history.Item{Status: "unhealthy", CreatedAt: time.Now()})
+	item = checker.Check()
+	if item.Status != "unhealthy" {
+		t.Error(fmt.Errorf("Expected failures in two regions to reach quorum: %s", item))
+		return
+	}
+
+	// Stale results from other regions are ignored
+	checker.ReportRegionResult("eu", history.Item{Status: "unhealthy", CreatedAt: time.Now().Add(-1 * time.Hour)})
+	item = checker.Check()
+	if item.Status != "healthy" || len(item.Regions) != 1 {
+		t.Error(fmt.Errorf("Expected stale region results to be ignored: %s (regions: %v)", item, item.Regions))
+		return
+	}
+}
+
+func TestAddressFamilies(t *testing.T) {
+	checker := New(&Checker{
+		Group:           "staging",
+		Name:            "Website is up",
+		Type:            "boolean",
+		Interval:        1 * time.Minute,
+		Cmd:             `echo "checking $PATROL_IP_FLAG"; test "$PATROL_ADDRESS_FAMILY" = ipv4`,
+		AddressFamilies: []string{"ipv4", "ipv6"},
+	})
+
+	item := checker.Check()
+	if item.Status != "unhealthy" || item.AddressFamilies["ipv4"] != "healthy" || item.AddressFamilies["ipv6"] != "unhealthy" {
+		t.Error(fmt.Errorf("Expected ipv6 failure to be reported: %s (families: %v)", item, item.AddressFamilies))
+		return
+	}
+	if !strings.HasPrefix(item.Error, "ipv6:") || string(item.Output) != "checking -6\n" {
+		t.Error(fmt.Errorf("Expected output of failed family to be kept: %s", item))
+		return
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Deployed version",
+		Type:     "metric",
+		Interval: 1 * time.Minute,
+		Cmd:      `echo '::patrol::version=1.4.2'; echo '::patrol::runbook=https://wiki/deploys' >&2; echo '::patrol::not an annotation' >&2; echo 42`,
+	})
+	item := checker.Check()
+	if item.Status != "healthy" || item.Metric != 42 {
+		t.Error(fmt.Errorf("Expected annotations to be removed before parsing the metric: %s", item))
+		return
+	}
+	if len(item.Annotations) != 2 || item.Annotations["version"] != "1.4.2" || item.Annotations["runbook"] != "https://wiki/deploys" {
+		t.Error(fmt.Errorf("Unexpected annotations: %#v", item.Annotations))
+		return
+	}
+	if output := string(item.Output); len(output) != len("::patrol::not an annotation\n42\n") || !strings.Contains(output, "::patrol::not an annotation\n") {
+		t.Error(fmt.Errorf("Expected only annotations to be removed from output, got: %q", item.Output))
+		return
+	}
+
+	checker.Cmd = "echo done"
+	if item := checker.Check(); item.Annotations != nil {
+		t.Error(fmt.Errorf("Expected no annotations, got: %#v", item.Annotations))
+		return
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy := ProxyOptions{
+		HTTP:    "http://proxy:3128",
+		HTTPS:   "socks5://proxy:1080",
+		NoProxy: "localhost, .internal.example.com",
+	}
+
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Website is up",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		Cmd:      `test "$HTTPS_PROXY" = socks5://proxy:1080 && test "$no_proxy" = "localhost, .internal.example.com"`,
+		Proxy:    &proxy,
+	})
+	if item := checker.Check(); item.Status != "healthy" {
+		t.Error(fmt.Errorf("Proxy was not passed to command: %s", item))
+		return
+	}
+
+	proxyFunc := proxy.ProxyFunc()
+	for target, expected := range map[string]string{
+		"http://example.com/":                "http://proxy:3128",
+		"https://example.com/":               "socks5://proxy:1080",
+		"http://localhost:8080/":             "",
+		"https://api.internal.example.com/":  "",
+		"https://internal.example.com.evil/": "socks5://proxy:1080",
+	} {
+		req, _ := http.NewRequest("GET", target, nil)
+		u, err := proxyFunc(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if (u == nil && expected != "") || (u != nil && u.String() != expected) {
+			t.Error(fmt.Errorf("Wrong proxy for %s: %v (expected: '%s')", target, u, expected))
+			return
+		}
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Unknown user",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		Cmd:      "true",
+		RunAs:    &RunAsOptions{User: "patrol-missing-user"},
+	})
+	if item := checker.Check(); item.Status != "unhealthy" || !strings.Contains(item.Error, "Unknown user 'patrol-missing-user'") {
+		t.Error(fmt.Errorf("Expected check to fail for an unknown user: %s", item))
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("Switching users requires root")
+	}
+
+	// Patrol's environment is not passed on to other users
+	os.Setenv("PATROL_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("PATROL_TEST_SECRET")
+	checker = New(&Checker{
+		Group:    "staging",
+		Name:     "Unprivileged",
+		Type:     "metric",
+		Interval: 1 * time.Minute,
+		Cmd:      `test "$USER" = nobody && test -z "$(id -G | tr -d 0-9)" && test -z "$PATROL_TEST_SECRET" && test -n "$PATH" && id -u`,
+		RunAs:    &RunAsOptions{User: "nobody", Group: "nogroup"},
+	})
+	item := checker.Check()
+	if item.Status != "healthy" || item.Metric == 0 {
+		t.Error(fmt.Errorf("Expected command to run as nobody: %s", item))
+		return
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for cmd, limits := range map[string]LimitOptions{
+		"yes | head -c 100000": {Output: 1000},
+		"while :; do :; done":  {CPU: 1 * time.Second},
+		`x=$(head -c 200000000 /dev/zero | tr '\0' a); echo ${#x}`: {Memory: 64 << 20},
+	} {
+		limits := limits
+		if _, err := memoryCgroupRoot(); limits.Memory > 0 && err != nil {
+			t.Logf("Skipping memory limit: %s", err)
+			continue
+		}
+		checker := New(&Checker{
+			Group:      "staging",
+			Name:       "Misbehaving",
+			Type:       "boolean",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 10 * time.Second,
+			Cmd:        cmd,
+			Limits:     &limits,
+		})
+		item := checker.Check()
+		if item.Status != "unhealthy" || item.Failure != history.FailureResourceLimit {
+			t.Error(fmt.Errorf("Expected '%s' to exceed its limits: %s (%s)", cmd, item, item.Failure))
+			return
+		}
+		if limits.Output > 0 && len(item.Output) != int(limits.Output) {
+			t.Error(fmt.Errorf("Expected output to be cut at %d bytes, got %d", limits.Output, len(item.Output)))
+			return
+		}
+	}
+
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Well behaved",
+		Type:     "metric",
+		Interval: 1 * time.Minute,
+		Cmd:      "echo 42",
+		Limits:   &LimitOptions{CPU: 5 * time.Second, Memory: 256 << 20, Output: 1000},
+	})
+	if item := checker.Check(); item.Status != "healthy" || item.Metric != 42 || item.Failure != "" {
+		t.Error(fmt.Errorf("Expected command to run within its limits: %s", item))
+		return
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	// The plugin reports the threshold it was configured with as its metric,
+	// and fails if it is not configured
+	pluginPath := t.TempDir() + "/plugin"
+	if err := ioutil.WriteFile(pluginPath, []byte(`#!/bin/sh
+request=$(cat)
+echo "checking $1" >&2
+case "$request" in
+	*'"config":{"threshold":5}'*) echo '{"status": "healthy", "metric": 5, "output": "threshold is 5"}' ;;
+	*'"config":{}'*) echo '{"status": "unhealthy", "error": "threshold is required"}' ;;
+	*) echo 'not json' ;;
+esac
+`), 0755); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, test := range []struct {
+		config string
+		status string
+		metric float64
+		error  string
+		output string
+	}{
+		{`{"threshold":5}`, "healthy", 5, "", "threshold is 5\nchecking snmp\n"},
+		{"", "unhealthy", 0, "threshold is required", "checking snmp\n"},
+		{`{"threshold":6}`, "unhealthy", 0, "Plugin 'test' returned an invalid result: invalid character 'o' in literal null (expecting 'u')", "not json\nchecking snmp\n"},
+	} {
+		checker := New(&Checker{
+			Group:        "staging",
+			Name:         "Switch is up",
+			Type:         "metric",
+			Interval:     1 * time.Minute,
+			Plugin:       &Plugin{Name: "test", Path: pluginPath, Args: []string{"snmp"}},
+			PluginConfig: []byte(test.config),
+		})
+
+		item := checker.Check()
+		if item.Status != test.status || item.Metric != test.metric || item.Error != test.error || string(item.Output) != test.output {
+			t.Error(fmt.Errorf("Wrong result for plugin config %s: %s (output: %q)", test.config, item, item.Output))
+			return
+		}
+	}
+}
+
+func TestBounds(t *testing.T) {
+	min, max := 10.0, 20.0
+	for _, test := range []struct {
+		bounds Bounds
+		value  float64
+		err    string
+	}{
+		{Bounds{}, 100, ""},
+		{Bounds{Min: &min, Max: &max}, 10, ""},
+		{Bounds{Min: &min, Max: &max}, 20, ""},
+		{Bounds{Min: &min}, 9.5, "Value is 9.5, below the minimum of 10"},
+		{Bounds{Max: &max}, 21, "Value is 21, above the maximum of 20"},
+	} {
+		err := test.bounds.check("Value", test.value)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Error(fmt.Errorf("Expected %g to fail with '%s', got: %v", test.value, test.err, err))
+			return
+		}
+	}
+	if err := (Bounds{Min: &max, Max: &min}).Validate(); err == nil {
+		t.Error(fmt.Errorf("Expected a minimum above the maximum to be rejected"))
+		return
+	}
+}
+
+func TestSNMPThresholds(t *testing.T) {
+	min, max, up := 10.0, 80.0, "1"
+	for _, test := range []struct {
+		object   SNMPObject
+		value    interface{}
+		expected string
+	}{
+		{SNMPObject{OID: "1.3.6.1.4.1.9.9.109.1.1.1.1.8.1", Bounds: Bounds{Max: &max}}, int64(42), ""},
+		{SNMPObject{OID: "1.3.6.1.4.1.9.9.109.1.1.1.1.8.1", Bounds: Bounds{Max: &max}}, uint64(95), "1.3.6.1.4.1.9.9.109.1.1.1.1.8.1 is 95, above the maximum of 80"},
+		{SNMPObject{OID: "1.3.6.1.4.1.2021.4.6.0", Bounds: Bounds{Min: &min}}, "9.5", "1.3.6.1.4.1.2021.4.6.0 is 9.5, below the minimum of 10"},
+		{SNMPObject{OID: "1.3.6.1.4.1.2021.4.6.0", Bounds: Bounds{Min: &min}}, "n/a", "1.3.6.1.4.1.2021.4.6.0 is not numeric: 'n/a'"},
+		{SNMPObject{OID: "1.3.6.1.2.1.2.2.1.8.1", Equals: &up}, int64(1), ""},
+		{SNMPObject{OID: "1.3.6.1.2.1.2.2.1.8.1", Equals: &up}, int64(2), "1.3.6.1.2.1.2.2.1.8.1 is '2', expected '1'"},
+	} {
+		err := test.object.evaluate(snmp.Variable{OID: test.object.OID, Value: test.value})
+		if (err == nil && test.expected != "") || (err != nil && err.Error() != test.expected) {
+			t.Error(fmt.Errorf("Wrong result for %v: %v (expected: '%s')", test.value, err, test.expected))
+			return
+		}
+	}
+
+	checker := New(&Checker{
+		Group:    "network",
+		Name:     "Core switch",
+		Type:     "boolean",
+		Interval: 1 * time.Minute,
+		SNMP: &SNMPOptions{
+			Options: snmp.Options{Host: "127.0.0.1", Port: 1, Timeout: 100 * time.Millisecond},
+			Objects: []SNMPObject{{OID: "1.3.6.1.2.1.1.5.0"}},
+		},
+	})
+	item := checker.Check()
+	if item.Status != "unhealthy" || !strings.HasPrefix(item.Error, "SNMP request to 127.0.0.1 failed: ") {
+		t.Error(fmt.Errorf("Expected unreachable agent to fail: %s", item))
+		return
+	}
+}
+
+func TestRabbitMQ(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if username, password, _ := req.BasicAuth(); username != "guest" || password != "guest" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.EscapedPath() != "/api/queues/%2F/orders" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.Write([]byte(`{"messages":120,"messages_ready":100,"messages_unacknowledged":20,"consumers":0,"state":"running"}`))
+	}))
+	defer server.Close()
+
+	max := int64(500)
+	for _, test := range []struct {
+		opts     RabbitMQOptions
+		status   string
+		expected string
+	}{
+		{RabbitMQOptions{Queue: "orders", Max: &max}, "healthy", ""},
+		{RabbitMQOptions{Queue: "orders", MinConsumers: 1}, "unhealthy", "0 consumers connected, below the minimum of 1"},
+		{RabbitMQOptions{Queue: "invoices"}, "unhealthy", "Queue 'invoices' does not exist in vhost '/'"},
+	} {
+		test.opts.URL = server.URL
+		test.opts.Username = "guest"
+		test.opts.Password = "guest"
+		checker := New(&Checker{
+			Group:      "queues",
+			Name:       test.opts.Queue,
+			Type:       "metric",
+			MetricUnit: "messages",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			RabbitMQ:   &test.opts,
+		})
+		item := checker.Check()
+		if item.Status != test.status || item.Error != test.expected {
+			t.Error(fmt.Errorf("Wrong result for %s: %s", test.opts.Queue, item))
+			return
+		}
+		if test.status == "healthy" && (item.Metric != 120 || !strings.Contains(string(item.Output), "100 ready")) {
+			t.Error(fmt.Errorf("Wrong metric recorded: %f (output: %s)", item.Metric, item.Output))
+			return
+		}
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/query" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.URL.Query().Get("query") {
+		case "up":
+			res.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"api"},"value":[1600000000,"1"]},{"metric":{"job":"db"},"value":[1600000000,"0"]}]}}`))
+		case `sum(up{job="api"})`:
+			res.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"api"},"value":[1600000000,"3"]}]}}`))
+		case "scalar(time())":
+			res.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1600000000,"1600000000"]}}`))
+		case "absent":
+			res.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+		}
+	}))
+	defer server.Close()
+
+	two, four := 2.0, 4.0
+	for _, test := range []struct {
+		opts     PrometheusOptions
+		status   string
+		metric   float64
+		expected string
+	}{
+		{PrometheusOptions{Query: `sum(up{job="api"})`, Bounds: Bounds{Min: &two, Max: &four}}, "healthy", 3, ""},
+		{PrometheusOptions{Query: `sum(up{job="api"})`, Bounds: Bounds{Max: &two}}, "unhealthy", 3, "Value is 3, above the maximum of 2"},
+		{PrometheusOptions{Query: `sum(up{job="api"})`, Bounds: Bounds{Min: &four}}, "unhealthy", 3, "Value is 3, below the minimum of 4"},
+		{PrometheusOptions{Query: "scalar(time())"}, "healthy", 1600000000, ""},
+		{PrometheusOptions{Query: "up"}, "unhealthy", 0, "Query returned 2 series, but must return a single value (i.e. use sum() or max())"},
+		{PrometheusOptions{Query: "absent"}, "unhealthy", 0, "Query returned no data"},
+		{PrometheusOptions{Query: "up{"}, "unhealthy", 0, "Query failed: parse error"},
+	} {
+		test.opts.URL = server.URL
+		checker := New(&Checker{
+			Group:      "metrics",
+			Name:       test.opts.Query,
+			Type:       "metric",
+			MetricUnit: "targets",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			Prometheus: &test.opts,
+		})
+		item := checker.Check()
+		if item.Status != test.status || item.Error != test.expected || item.Metric != test.metric {
+			t.Error(fmt.Errorf("Wrong result for %s: %s", test.opts.Query, item))
+			return
+		}
+	}
+}
+
+func TestCloudWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if !strings.Contains(req.Header.Get("Authorization"), "/us-east-1/monitoring/aws4_request") {
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.PostForm.Get("MetricName") {
+		case "CPUUtilization":
+			fmt.Fprintf(res, `<GetMetricStatisticsResponse><GetMetricStatisticsResult><Datapoints>
+				<member><Timestamp>%s</Timestamp><Average>72.5</Average><Unit>Percent</Unit></member>
+				<member><Timestamp>%s</Timestamp><Average>40</Average><Unit>Percent</Unit></member>
+			</Datapoints></GetMetricStatisticsResult></GetMetricStatisticsResponse>`,
+				time.Now().Add(-5*time.Minute).UTC().Format(time.RFC3339),
+				time.Now().Add(-10*time.Minute).UTC().Format(time.RFC3339),
+			)
+		case "Missing":
+			res.Write([]byte(`<GetMetricStatisticsResponse><GetMetricStatisticsResult><Datapoints/></GetMetricStatisticsResult></GetMetricStatisticsResponse>`))
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>InvalidParameterValue</Code><Message>Unknown metric</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	fifty := 50.0
+	for _, test := range []struct {
+		opts     CloudWatchOptions
+		status   string
+		metric   float64
+		expected string
+	}{
+		{CloudWatchOptions{Metric: "CPUUtilization"}, "healthy", 72.5, ""},
+		{CloudWatchOptions{Metric: "CPUUtilization", Bounds: Bounds{Max: &fifty}}, "unhealthy", 72.5, "Value is 72.5, above the maximum of 50"},
+		{CloudWatchOptions{Metric: "Missing"}, "unhealthy", 0, "No datapoints in the last 15m0s"},
+		{CloudWatchOptions{Metric: "Unknown"}, "unhealthy", 0, "CloudWatch returned InvalidParameterValue: Unknown metric"},
+	} {
+		test.opts.Region = "us-east-1"
+		test.opts.Endpoint = server.URL
+		test.opts.Namespace = "AWS/EC2"
+		test.opts.Dimensions = map[string]string{"InstanceId": "i-1234"}
+		if err := test.opts.Validate(); err != nil {
+			t.Error(err)
+			return
+		}
+		checker := New(&Checker{
+			Group:      "metrics",
+			Name:       test.opts.Metric,
+			Type:       "metric",
+			MetricUnit: "%",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			CloudWatch: &test.opts,
+		})
+		item := checker.Check()
+		if item.Status != test.status || item.Error != test.expected || item.Metric != test.metric {
+			t.Error(fmt.Errorf("Wrong result for %s: %s", test.opts.Metric, item))
+			return
+		}
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/github/api/v2/summary.json":
+			res.Write([]byte(`{
+				"status": {"indicator": "minor", "description": "Partially Degraded Service"},
+				"components": [
+					{"name": "Git Operations", "status": "operational"},
+					{"name": "Actions", "status": "partial_outage"},
+					{"name": "Pages", "status": "under_maintenance"}
+				],
+				"incidents": [{"name": "Delayed Actions runs", "shortlink": "https://stspg.io/abc"}]
+			}`))
+		case "/statusio/gitlab":
+			res.Write([]byte(`{"result": {
+				"status_overall": {"status": "Operational", "status_code": 100},
+				"status": [{"name": "Website", "status": "Operational", "status_code": 100}],
+				"incidents": []
+			}}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	statusIOURL = server.URL + "/statusio/"
+
+	for _, test := range []struct {
+		opts     StatusPageOptions
+		status   string
+		expected string
+	}{
+		{StatusPageOptions{URL: server.URL + "/github"}, "unhealthy", "Partially Degraded Service"},
+		{StatusPageOptions{URL: server.URL + "/github", Components: []string{"git operations", "Pages"}}, "healthy", ""},
+		{StatusPageOptions{URL: server.URL + "/github", Components: []string{"Actions", "Packages"}}, "unhealthy", "Actions: partial outage, Packages: not found on status page"},
+		{StatusPageOptions{URL: server.URL + "/missing"}, "unhealthy", "Status page returned status 404"},
+		{StatusPageOptions{Format: "statusio", PageID: "gitlab"}, "healthy", ""},
+	} {
+		if err := test.opts.Validate(); err != nil {
+			t.Error(err)
+			return
+		}
+		checker := New(&Checker{
+			Group:      "dependencies",
+			Name:       "status page",
+			Type:       "boolean",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			StatusPage: &test.opts,
+		})
+		item := checker.Check()
+		if item.Status != test.status || item.Error != test.expected {
+			t.Error(fmt.Errorf("Wrong result for %v: %s", test.opts, item))
+			return
+		}
+		if strings.HasSuffix(test.opts.URL, "/github") && item.Annotations["incident.link"] != "https://stspg.io/abc" {
+			t.Error(fmt.Errorf("Expected incident to be linked: %v", item.Annotations))
+			return
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	expiresAt := time.Now().Add(45 * 24 * time.Hour).UTC().Truncate(time.Second)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/dns.json":
+			fmt.Fprintf(res, `{"services": [[["com", "net"], ["%s/com/"]], [["co.uk"], ["%s/uk/"]]]}`, server.URL, server.URL)
+		case "/com/domain/example.com":
+			fmt.Fprintf(res, `{"events": [{"eventAction": "registration", "eventDate": "1995-08-14T04:00:00Z"}, {"eventAction": "expiration", "eventDate": "%s"}]}`, expiresAt.Format(time.RFC3339))
+		case "/uk/domain/example.co.uk":
+			res.Write([]byte(`{"events": []}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	rdapBootstrapURL = server.URL + "/dns.json"
+
+	whoisServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer whoisServer.Close()
+	go func() {
+		for {
+			conn, err := whoisServer.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%% WHOIS example.io\r\nDomain Name: EXAMPLE.IO\r\nRegistry Expiry Date: %s\r\n", time.Now().Add(10*24*time.Hour).UTC().Format("2006-01-02T15:04:05Z"))
+			conn.Close()
+		}
+	}()
+
+	for _, test := range []struct {
+		opts   DomainOptions
+		status string
+		err    string
+		metric float64
+	}{
+		{DomainOptions{Domain: "example.com"}, "healthy", "", 44},
+		{DomainOptions{Domain: "example.com", MinDays: 60}, "unhealthy", "Registration of example.com expires in 44 days, on " + expiresAt.Format("Jan 2, 2006"), 44},
+		{DomainOptions{Domain: "unregistered.com"}, "unhealthy", "Domain 'unregistered.com' is not registered", 0},
+		{DomainOptions{Domain: "example.co.uk"}, "unhealthy", "Registry does not publish the expiration date of 'example.co.uk'", 0},
+		{DomainOptions{Domain: "example.io", WHOIS: whoisServer.Addr().String()}, "unhealthy", "", 9},
+	} {
+		checker := New(&Checker{
+			Group:      "domains",
+			Name:       test.opts.Domain,
+			Type:       "metric",
+			MetricUnit: "days",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			Domain:     &test.opts,
+		})
+		item := checker.sample()
+		if item.Status != test.status || (test.err != "" && item.Error != test.err) || item.Metric != test.metric {
+			t.Error(fmt.Errorf("Wrong result for %s: %s (metric: %f)", test.opts.Domain, item, item.Metric))
+			return
+		}
+	}
+}
+
+func startNTPServer(t *testing.T, skew time.Duration, stratum byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		request := make([]byte, 48)
+		for {
+			_, addr, err := conn.ReadFrom(request)
+			if err != nil {
+				return
+			}
+			response := make([]byte, 48)
+			response[0] = 0x24
+			response[1] = stratum
+			copy(response[12:], "RATE")
+			copy(response[24:32], request[40:48])
+			now := toNTPTime(time.Now().Add(skew))
+			binary.BigEndian.PutUint64(response[32:], now)
+			binary.BigEndian.PutUint64(response[40:], now)
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	expiresAt := server.Certificate().NotAfter
+
+	for minDays, status := range map[int]string{
+		0: "healthy",
+		int(time.Until(expiresAt).Hours()/24) + 1: "unhealthy",
+	} {
+		checker := New(&Checker{
+			Group:       "staging",
+			Name:        "Certificate",
+			Type:        "metric",
+			MetricUnit:  "days",
+			Interval:    1 * time.Hour,
+			TLS:         &TLSOptions{InsecureSkipVerify: true},
+			Certificate: &CertificateOptions{Host: host, MinDays: minDays},
+		})
+		item := checker.sample()
+		if item.Status != status || item.Metric != float64(int(time.Until(expiresAt).Hours()/24)) {
+			t.Error(fmt.Errorf("Expected %s result with minDays = %d: %s", status, minDays, item))
+			return
+		}
+	}
+
+	// The test server's certificate is not trusted
+	checker := New(&Checker{
+		Group:       "staging",
+		Name:        "Certificate",
+		Type:        "metric",
+		MetricUnit:  "days",
+		Interval:    1 * time.Hour,
+		Certificate: &CertificateOptions{Host: host},
+	})
+	if item := checker.sample(); item.Status != "unhealthy" || !strings.Contains(item.Error, "TLS connection to "+host+" failed") {
+		t.Error(fmt.Errorf("Expected untrusted certificate to fail: %s", item))
+		return
+	}
+}
+
+func TestNTP(t *testing.T) {
+	for _, test := range []struct {
+		skew    time.Duration
+		stratum byte
+		status  string
+		err     string
+	}{
+		{20 * time.Millisecond, 2, "healthy", ""},
+		{2 * time.Second, 2, "unhealthy", "Clock is off by -2s"},
+		{-time.Second, 1, "unhealthy", "Clock is off by 1s"},
+		{0, 0, "unhealthy", "NTP request to %s failed: Server sent kiss-o'-death code 'RATE'"},
+	} {
+		server := startNTPServer(t, test.skew, test.stratum)
+		checker := New(&Checker{
+			Group:      "clocks",
+			Name:       "NTP",
+			Type:       "metric",
+			MetricUnit: "ms",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			NTP:        &NTPOptions{Server: server},
+		})
+		item := checker.sample()
+		expectedErr := test.err
+		if strings.Contains(expectedErr, "%s") {
+			expectedErr = fmt.Sprintf(expectedErr, server)
+		}
+		if item.Status != test.status || !strings.HasPrefix(item.Error, expectedErr) {
+			t.Error(fmt.Errorf("Wrong result for skew of %s: %s", test.skew, item))
+			return
+		}
+		if test.stratum > 0 && math.Abs(item.Metric+float64(test.skew/time.Millisecond)) > 10 {
+			t.Error(fmt.Errorf("Wrong offset for skew of %s: %f", test.skew, item.Metric))
+			return
+		}
+	}
+}
+
+func TestContentChanges(t *testing.T) {
+	dir := t.TempDir()
+	historyFile, err := history.New(history.NewOptions{
+		File: dir + "/history-content.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	page := "<html><p>Welcome</p><input name=csrf value=abc></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	for _, onChange := range []string{"fail", "notify"} {
+		checker := New(&Checker{
+			Group:      "content",
+			Name:       onChange,
+			Type:       "boolean",
+			Interval:   1 * time.Minute,
+			CmdTimeout: 5 * time.Second,
+			History:    historyFile,
+			Content: &ContentOptions{
+				URL:      server.URL,
+				Ignore:   []string{`value=\w+`},
+				OnChange: onChange,
+			},
+		})
+
+		run := func(content string) history.Item {
+			page = content
+			item := checker.sample()
+			written, err := historyFile.Append(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker.rememberResult(written)
+			return item
+		}
+
+		// The first result sets the baseline, and ignored parts can change
+		if item := run("<html><p>Welcome</p><input name=csrf value=abc></html>"); item.Status != "healthy" || item.ContentChanged || item.ContentHash == "" {
+			t.Error(fmt.Errorf("Wrong first result: %s", item))
+			return
+		}
+		if item := run("<html><p>Welcome</p><input name=csrf value=def></html>"); item.Status != "healthy" || item.ContentChanged {
+			t.Error(fmt.Errorf("Ignored content was detected as a change: %s", item))
+			return
+		}
+
+		item := run("<html><p>Hacked</p><input name=csrf value=def></html>")
+		expectedStatus := "unhealthy"
+		if onChange == "notify" {
+			expectedStatus = "healthy"
+		}
+		if !item.ContentChanged || item.Status != expectedStatus {
+			t.Error(fmt.Errorf("Change was not detected with onChange=%s: %s", onChange, item))
+			return
+		}
+
+		// The changed content becomes the new baseline
+		if item := run("<html><p>Hacked</p><input name=csrf value=ghi></html>"); item.Status != "healthy" || item.ContentChanged {
+			t.Error(fmt.Errorf("Unchanged content was detected as a change: %s", item))
+			return
+		}
+	}
+
+	expected := "a8f3c1e4"
+	file := dir + "/app.conf"
+	ioutil.WriteFile(file, []byte("listen 80\n"), 0644)
+	checker := New(&Checker{
+		Group:   "content",
+		Name:    "config",
+		Type:    "boolean",
+		Content: &ContentOptions{File: file, SHA256: strings.Repeat(expected, 8)},
+	})
+	if item := checker.sample(); item.Status != "unhealthy" || !strings.HasSuffix(item.Error, "expected "+strings.Repeat(expected, 8)) {
+		t.Error(fmt.Errorf("Expected drifted config to fail: %s", item))
+		return
+	}
+}
+
+func TestLogWatch(t *testing.T) {
+	file := t.TempDir() + "/app.log"
+	ioutil.WriteFile(file, []byte("ERROR old failure\n"), 0644)
+	appendLog := func(lines string) {
+		fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.WriteString(lines)
+		fd.Close()
+	}
+
+	checker := New(&Checker{
+		Group: "logs",
+		Name:  "app",
+		Type:  "boolean",
+		LogWatch: &LogWatchOptions{
+			File:     file,
+			Patterns: []string{`ERROR`, `panic:`},
+			Exclude:  []string{`ERROR.*expected`},
+			MaxLines: 2,
+		},
+	})
+
+	// Lines from before the first run are skipped
+	if item := checker.sample(); item.Status != "healthy" {
+		t.Error(fmt.Errorf("Old lines were matched: %s", item))
+		return
+	}
+
+	appendLog("INFO started\nERROR connection refused\nERROR expected timeout\npanic: nil map\nERROR disk full\nERROR partial")
+	item := checker.sample()
+	if item.Status != "unhealthy" || item.Metric != 3 || string(item.Output) != "ERROR connection refused\npanic: nil map\n(1 more)\n" {
+		t.Error(fmt.Errorf("Wrong result for new errors: %s (metric: %f)", item, item.Metric))
+		return
+	}
+
+	// The incomplete line is matched once it is complete
+	appendLog(" line\nINFO ok\n")
+	if item := checker.sample(); item.Status != "unhealthy" || item.Metric != 1 || string(item.Output) != "ERROR partial line\n" {
+		t.Error(fmt.Errorf("Wrong result for completed line: %s", item))
+		return
+	}
+	if item := checker.sample(); item.Status != "healthy" {
+		t.Error(fmt.Errorf("Lines were matched twice: %s", item))
+		return
+	}
+
+	// Rotated files are read from the start
+	os.Rename(file, file+".1")
+	ioutil.WriteFile(file, []byte("ERROR after rotation\n"), 0644)
+	if item := checker.sample(); item.Status != "unhealthy" || string(item.Output) != "ERROR after rotation\n" {
+		t.Error(fmt.Errorf("Rotated file was not read: %s", item))
+		return
+	}
+}
+
+func TestLogWatchRestart(t *testing.T) {
+	os.Remove("./logwatch-restart.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "./logwatch-restart.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		historyFile.Close(context.Background())
+		os.Remove("./logwatch-restart.db")
+	}()
+
+	file := t.TempDir() + "/app.log"
+	ioutil.WriteFile(file, []byte("ERROR old failure\n"), 0644)
+	newChecker := func() *Checker {
+		return New(&Checker{
+			Group:    "logs",
+			Name:     "app",
+			Type:     "boolean",
+			History:  historyFile,
+			LogWatch: &LogWatchOptions{File: file, Patterns: []string{`ERROR`}},
+		})
+	}
+	if item := newChecker().sample(); item.Status != "healthy" {
+		t.Error(fmt.Errorf("Old lines were matched: %s", item))
+		return
+	}
+
+	// Lines that are written while patrol is stopped are read once it is
+	// started again
+	fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fd.WriteString("ERROR while stopped\n")
+	fd.Close()
+	if item := newChecker().sample(); item.Status != "unhealthy" || string(item.Output) != "ERROR while stopped\n" {
+		t.Error(fmt.Errorf("Lines written while stopped were not read: %s", item))
+		return
+	}
+	if state := historyFile.GetCheckState("logs", "app"); state.LogPosition == nil || state.LogPosition.Offset != 38 {
+		t.Error(fmt.Errorf("Wrong saved position: %s", state))
+		return
+	}
+
+	// Files that were rotated while patrol is stopped are read from the
+	// start
+	os.Rename(file, file+".1")
+	ioutil.WriteFile(file, []byte("ERROR after rotation\n"), 0644)
+	if item := newChecker().sample(); item.Status != "unhealthy" || string(item.Output) != "ERROR after rotation\n" {
+		t.Error(fmt.Errorf("Rotated file was not read: %s", item))
+		return
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	os.Remove("./history-close.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "./history-close.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		historyFile.Close(context.Background())
+		os.Remove("./history-close.db")
+	}()
+
+	checker := New(&Checker{
+		Group:    "staging",
+		Name:     "Slow",
+		Type:     "boolean",
+		Interval: time.Minute,
+		Cmd:      "sleep 1",
+		History:  historyFile,
+	})
+	checker.Start(&notificationTester{})
+	for i := 0; i < 100 && !checker.GetState().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := checker.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(fmt.Errorf("Expected closing during a run to time out, got: %v", err))
+		return
+	}
+
+	// The run is waited on, but its result is not written
+	if err := checker.Close(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+	if items := historyFile.GetItems(checker); len(items) != 0 {
+		t.Error(fmt.Errorf("Expected result of interrupted run to be dropped, got %#v", items))
+		return
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	midnight := time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		opts      SimulationOptions
+		at        time.Duration
+		unhealthy bool
+	}{
+		{SimulationOptions{Pattern: SimulateHealthy}, 0, false},
+		{SimulationOptions{Pattern: SimulateUnhealthy, Error: "Connection refused"}, 0, true},
+		{SimulationOptions{Pattern: SimulateFlapping}, 0, false},
+		{SimulationOptions{Pattern: SimulateFlapping}, time.Minute, true},
+		{SimulationOptions{Pattern: SimulateOutage}, 9 * time.Minute, true},
+		{SimulationOptions{Pattern: SimulateOutage}, 10 * time.Minute, false},
+		{SimulationOptions{Pattern: SimulateOutage, Every: 30 * time.Minute, For: time.Minute}, 30 * time.Minute, true},
+		{SimulationOptions{FailureRate: 1}, 0, true},
+	} {
+		opts := test.opts
+		if err := opts.Validate(); err != nil {
+			t.Error(err)
+			return
+		}
+		checker := New(&Checker{
+			Group:      "Payments",
+			Name:       "Queue depth",
+			Type:       "metric",
+			MetricUnit: "jobs",
+			Interval:   time.Minute,
+			Cmd:        "false",
+			Simulation: &opts,
+		})
+
+		item := checker.sampleSimulation(midnight.Add(test.at))
+		if (item.Status == "unhealthy") != test.unhealthy || (test.unhealthy && item.Error != opts.Error) {
+			t.Error(fmt.Errorf("Wrong result of %s pattern at %s: %s", opts.Pattern, test.at, item))
+			return
+		}
+		if !test.unhealthy && (item.Metric < opts.Min || item.Metric > opts.Max) {
+			t.Error(fmt.Errorf("Metric of %s pattern is out of range: %f", opts.Pattern, item.Metric))
+			return
+		}
+		if item.Duration > opts.Latency || !item.CreatedAt.Equal(midnight.Add(test.at)) {
+			t.Error(fmt.Errorf("Wrong timing of %s pattern: %s", opts.Pattern, item))
+			return
+		}
+	}
+
+	// Simulations replace the check's command
+	checker := New(&Checker{Group: "Payments", Name: "Up", Type: "boolean", Interval: time.Minute, Cmd: "false", Simulation: &SimulationOptions{Pattern: SimulateHealthy}})
+	if item := checker.sample(); item.Status != "healthy" {
+		t.Error(fmt.Errorf("Expected simulated result instead of running the command, got: %s", item))
+		return
+	}
+}
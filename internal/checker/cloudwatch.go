@@ -0,0 +1,148 @@
+package checker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/aws"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// CloudWatchOptions configure checks of the latest value of an AWS
+// CloudWatch metric. Credentials are found like the AWS CLI does (i.e. in
+// the environment, ~/.aws/credentials or the instance's role).
+type CloudWatchOptions struct {
+	Region   string
+	Profile  string
+	Endpoint string
+
+	Namespace  string
+	Metric     string
+	Dimensions map[string]string
+
+	// One of Average, Sum, Minimum, Maximum and SampleCount, or a
+	// percentile (i.e. p99), which defaults to Average
+	Statistic string
+
+	// Period that the statistic is computed over, which defaults to 5m.
+	// The config sets it from a duration string like the check's interval.
+	Period time.Duration `yaml:"-"`
+
+	// Bounds for the value
+	Bounds `yaml:",inline"`
+}
+
+// Validate checks the options without contacting CloudWatch, and fills in
+// the defaults.
+func (opts *CloudWatchOptions) Validate() error {
+	if opts.Namespace == "" || opts.Metric == "" {
+		return fmt.Errorf("A namespace and metric are required")
+	}
+	if opts.Region == "" && aws.DefaultRegion() == "" {
+		return fmt.Errorf("A region is required (or AWS_REGION must be set)")
+	}
+	if opts.Statistic == "" {
+		opts.Statistic = "Average"
+	}
+	valid := aws.PercentilePattern.MatchString(opts.Statistic)
+	for _, statistic := range aws.Statistics {
+		valid = valid || opts.Statistic == statistic
+	}
+	if !valid {
+		return fmt.Errorf("Unknown statistic '%s' (must be one of %s, or a percentile like p99)", opts.Statistic, strings.Join(aws.Statistics, ", "))
+	}
+	if opts.Period == 0 {
+		opts.Period = 5 * time.Minute
+	}
+	switch opts.Period {
+	case 1 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second:
+	default:
+		if opts.Period < time.Minute || opts.Period%time.Minute != 0 {
+			return fmt.Errorf("Period must be 1s, 5s, 10s, 30s or a multiple of 1m")
+		}
+	}
+	return opts.Bounds.Validate()
+}
+
+// describe formats the metric like the CloudWatch console does, i.e.
+// 'AWS/EC2 CPUUtilization (InstanceId=i-1234)'.
+func (opts CloudWatchOptions) describe() string {
+	names := make([]string, 0, len(opts.Dimensions))
+	for name := range opts.Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dimensions := make([]string, len(names))
+	for i, name := range names {
+		dimensions[i] = name + "=" + opts.Dimensions[name]
+	}
+	return fmt.Sprintf("%s %s (%s)", opts.Namespace, opts.Metric, strings.Join(dimensions, ", "))
+}
+
+// sampleCloudWatch reads the check's statistic over the last three periods
+// from CloudWatch, and records the latest datapoint as the check's metric.
+// The check fails if no datapoint was published in that time, or if the
+// latest one is out of bounds.
+func (c *Checker) sampleCloudWatch() history.Item {
+	opts := c.CloudWatch
+	start := time.Now()
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+		Status:     "healthy",
+	}
+
+	// Metrics are published with a delay, so a few periods are read to
+	// find the latest datapoint
+	var datapoints []aws.Datapoint
+	client, err := c.httpClient()
+	if err == nil {
+		datapoints, err = aws.GetMetricStatistics(aws.Options{
+			Region:   opts.Region,
+			Profile:  opts.Profile,
+			Endpoint: opts.Endpoint,
+			Client:   client,
+		}, aws.MetricQuery{
+			Namespace:  opts.Namespace,
+			MetricName: opts.Metric,
+			Dimensions: opts.Dimensions,
+			Statistic:  opts.Statistic,
+			Period:     opts.Period,
+			Start:      start.Add(-3 * opts.Period),
+			End:        start,
+		})
+	}
+	if err == nil && len(datapoints) == 0 {
+		err = fmt.Errorf("No datapoints in the last %s", 3*opts.Period)
+	}
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+		item.Output = []byte(fmt.Sprintf("metric: %s\n", opts.describe()))
+		return item
+	}
+
+	latest := datapoints[len(datapoints)-1]
+	item.Metric = latest.Value
+	item.Output = []byte(fmt.Sprintf(
+		"metric: %s\n%s: %g %s\ntimestamp: %s\n",
+		opts.describe(),
+		opts.Statistic,
+		latest.Value,
+		latest.Unit,
+		latest.Timestamp.Format(time.RFC3339),
+	))
+	if err := opts.check("Value", latest.Value); err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+	}
+	return item
+}
@@ -0,0 +1,132 @@
+package checker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Content larger than this is only hashed up to this size
+const maxContentSize = 10 << 20
+
+// ContentOptions configure checks that detect changes to the content of a
+// URL or a local file, i.e. to detect defacement or configuration drift.
+type ContentOptions struct {
+	// Either a URL to fetch or the path of a local file
+	URL  string
+	File string
+
+	// SHA-256 hash (in hex) that the content must have. Without it, the
+	// content is compared to the check's previous result.
+	SHA256 string `yaml:"sha256"`
+
+	// Regular expressions that match parts of the content that change on
+	// their own (i.e. timestamps or CSRF tokens), which are not hashed
+	Ignore []string
+
+	// What happens when the content changes: "fail" (the default) marks
+	// the result that noticed the change as unhealthy, while "notify" only
+	// sends on_change notifications
+	OnChange string `yaml:"onChange"`
+}
+
+// Validate checks the options without reading the content.
+func (opts ContentOptions) Validate() error {
+	if (opts.URL == "") == (opts.File == "") {
+		return fmt.Errorf("Exactly one of url and file is required")
+	}
+	if opts.SHA256 != "" {
+		if hash, err := hex.DecodeString(opts.SHA256); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("sha256 must be a hex encoded SHA-256 hash")
+		}
+	}
+	for _, pattern := range opts.Ignore {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Invalid ignore pattern: %s", err)
+		}
+	}
+	if opts.OnChange != "" && opts.OnChange != "fail" && opts.OnChange != "notify" {
+		return fmt.Errorf("onChange must be either 'fail' or 'notify'")
+	}
+	return nil
+}
+
+func (c *Checker) readContent() ([]byte, error) {
+	if c.Content.File != "" {
+		fd, err := os.Open(c.Content.File)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		return ioutil.ReadAll(io.LimitReader(fd, maxContentSize))
+	}
+
+	client, err := c.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Get(c.Content.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned status %d", c.Content.URL, res.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxContentSize))
+}
+
+// sampleContent hashes the check's URL or file, without the parts that
+// match the ignore patterns. The check fails if the hash differs from the
+// expected one, or else, unless onChange is 'notify', if it differs from
+// the latest hash that was recorded.
+func (c *Checker) sampleContent() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	start := time.Now()
+	content, err := c.readContent()
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Failed to read content: %s", err)
+		return item
+	}
+
+	size := len(content)
+	for _, pattern := range c.contentIgnore {
+		content = pattern.ReplaceAll(content, nil)
+	}
+	hash := sha256.Sum256(content)
+	item.ContentHash = hex.EncodeToString(hash[:])
+	item.Output = []byte(fmt.Sprintf("sha256: %s\nsize: %d bytes\n", item.ContentHash, size))
+	item.Status = "healthy"
+
+	// Results that failed to read the content have no hash
+	previous := c.previousContent()
+	item.ContentChanged = previous.ContentHash != "" && previous.ContentHash != item.ContentHash
+
+	if c.Content.SHA256 != "" {
+		if item.ContentHash != c.Content.SHA256 {
+			item.Status = "unhealthy"
+			item.Error = fmt.Sprintf("Content hash is %s, expected %s", item.ContentHash, c.Content.SHA256)
+		}
+	} else if item.ContentChanged && c.Content.OnChange != "notify" {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Content has changed since %s", previous.CreatedAt.Format(time.RFC1123))
+	}
+	return item
+}
@@ -0,0 +1,293 @@
+package checker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// DomainOptions configure checks of when a domain's registration expires,
+// which is looked up over RDAP, or WHOIS for TLDs that do not support RDAP.
+type DomainOptions struct {
+	Domain string
+
+	// Checks fail when the registration expires in fewer days than this,
+	// which defaults to 30
+	MinDays int `yaml:"minDays"`
+
+	// RDAP server to query instead of the one that IANA lists for the TLD
+	// (i.e. https://rdap.nic.example/)
+	RDAP string `yaml:"rdap"`
+
+	// WHOIS server ("host" or "host:port") to query instead of the one that
+	// IANA lists, for TLDs without RDAP
+	WHOIS string `yaml:"whois"`
+}
+
+// Validate checks the options without contacting any registry.
+func (opts DomainOptions) Validate() error {
+	if !strings.Contains(strings.Trim(opts.Domain, "."), ".") {
+		return fmt.Errorf("A domain name (i.e. example.com) is required")
+	}
+	if opts.MinDays < 0 {
+		return fmt.Errorf("minDays cannot be negative")
+	}
+	return nil
+}
+
+// Registries that are queried for the servers of each TLD
+var (
+	rdapBootstrapURL = "https://data.iana.org/rdap/dns.json"
+	ianaWhoisServer  = "whois.iana.org:43"
+)
+
+// rdapBootstrap caches IANA's list of RDAP servers by TLD, which rarely
+// changes.
+var rdapBootstrap struct {
+	sync.Mutex
+	servers   map[string]string
+	fetchedAt time.Time
+}
+
+func rdapServer(client *http.Client, domain string) (string, error) {
+	rdapBootstrap.Lock()
+	defer rdapBootstrap.Unlock()
+
+	if time.Since(rdapBootstrap.fetchedAt) > 24*time.Hour {
+		res, err := client.Get(rdapBootstrapURL)
+		if err != nil {
+			return "", fmt.Errorf("Failed to fetch RDAP servers: %s", err)
+		}
+		defer res.Body.Close()
+		var bootstrap struct {
+			Services [][][]string `json:"services"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&bootstrap); err != nil {
+			return "", fmt.Errorf("Failed to parse RDAP servers: %s", err)
+		}
+
+		rdapBootstrap.servers = make(map[string]string)
+		for _, service := range bootstrap.Services {
+			if len(service) < 2 || len(service[1]) == 0 {
+				continue
+			}
+			for _, tld := range service[0] {
+				rdapBootstrap.servers[strings.ToLower(tld)] = service[1][0]
+			}
+		}
+		rdapBootstrap.fetchedAt = time.Now()
+	}
+
+	// Registries can be responsible for second-level domains (i.e. co.uk),
+	// so the longest suffix wins
+	labels := strings.Split(domain, ".")
+	for i := 1; i < len(labels); i++ {
+		if server, ok := rdapBootstrap.servers[strings.Join(labels[i:], ".")]; ok {
+			return server, nil
+		}
+	}
+	return "", nil
+}
+
+func rdapExpiry(client *http.Client, server, domain string) (time.Time, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/domain/"+domain, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	res, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("RDAP request failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return time.Time{}, fmt.Errorf("Domain '%s' is not registered", domain)
+	}
+	if res.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("RDAP server returned status %d", res.StatusCode)
+	}
+
+	var response struct {
+		Events []struct {
+			Action string    `json:"eventAction"`
+			Date   time.Time `json:"eventDate"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid RDAP response: %s", err)
+	}
+	for _, event := range response.Events {
+		if event.Action == "expiration" {
+			return event.Date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Registry does not publish the expiration date of '%s'", domain)
+}
+
+// whois sends a query to a WHOIS server, and returns the lines of its
+// response.
+func whois(server, query string, timeout time.Duration) ([]string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "43")
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(conn, query+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	return lines, scanner.Err()
+}
+
+// Keys that registries use for the expiration date in WHOIS responses
+var whoisExpiryKeys = []string{
+	"registry expiry date",
+	"registrar registration expiration date",
+	"expiration date",
+	"expiry date",
+	"expire date",
+	"expires on",
+	"expires",
+	"paid-till",
+	"renewal date",
+}
+
+var whoisDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006.01.02",
+	"2006/01/02",
+	"02-Jan-2006",
+	"02.01.2006",
+}
+
+func parseWhoisDate(value string) (time.Time, bool) {
+	candidates := []string{value}
+	if fields := strings.Fields(value); len(fields) > 1 {
+		candidates = append(candidates, fields[0])
+	}
+	for _, candidate := range candidates {
+		for _, layout := range whoisDateLayouts {
+			if t, err := time.Parse(layout, candidate); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func whoisExpiry(server, domain string, timeout time.Duration) (time.Time, error) {
+	if server == "" {
+		labels := strings.Split(domain, ".")
+		lines, err := whois(ianaWhoisServer, labels[len(labels)-1], timeout)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Failed to find WHOIS server: %s", err)
+		}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "whois:") {
+				server = strings.TrimSpace(strings.TrimPrefix(line, "whois:"))
+			}
+		}
+		if server == "" {
+			return time.Time{}, fmt.Errorf("TLD of '%s' has neither an RDAP nor a WHOIS server", domain)
+		}
+	}
+
+	lines, err := whois(server, domain, timeout)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("WHOIS request failed: %s", err)
+	}
+	for _, key := range whoisExpiryKeys {
+		for _, line := range lines {
+			idx := strings.Index(line, ":")
+			if idx < 0 || strings.ToLower(strings.TrimSpace(line[:idx])) != key {
+				continue
+			}
+			if expiresAt, ok := parseWhoisDate(strings.TrimSpace(line[idx+1:])); ok {
+				return expiresAt, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("No expiration date found in WHOIS response from %s", server)
+}
+
+// sampleDomain looks up when the registration of the check's domain
+// expires, over RDAP (from the check's server, or the one that IANA lists
+// for the domain's TLD) or else over WHOIS, and records the number of days
+// left as the check's metric. The check fails once fewer than minDays are
+// left.
+func (c *Checker) sampleDomain() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+	start := time.Now()
+	domain := strings.ToLower(strings.Trim(c.Domain.Domain, "."))
+
+	expiresAt, source, err := func() (time.Time, string, error) {
+		client, err := c.httpClient()
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		server := c.Domain.RDAP
+		if server == "" && c.Domain.WHOIS == "" {
+			if server, err = rdapServer(client, domain); err != nil {
+				return time.Time{}, "", err
+			}
+		}
+		if server != "" {
+			expiresAt, err := rdapExpiry(client, server, domain)
+			return expiresAt, "RDAP server " + server, err
+		}
+		expiresAt, err := whoisExpiry(c.Domain.WHOIS, domain, c.CmdTimeout)
+		return expiresAt, "WHOIS", err
+	}()
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+		return item
+	}
+
+	days := int(time.Until(expiresAt).Hours() / 24)
+	item.Metric = float64(days)
+	item.Output = []byte(fmt.Sprintf("%s expires on %s (according to %s)\n", domain, expiresAt.UTC().Format(time.RFC1123), source))
+
+	minDays := c.Domain.MinDays
+	if minDays == 0 {
+		minDays = 30
+	}
+	if expiresAt.Before(time.Now()) {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Registration of %s expired on %s", domain, expiresAt.UTC().Format("Jan 2, 2006"))
+	} else if days < minDays {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Registration of %s expires in %d days, on %s", domain, days, expiresAt.UTC().Format("Jan 2, 2006"))
+	} else {
+		item.Status = "healthy"
+	}
+	return item
+}
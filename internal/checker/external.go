@@ -0,0 +1,99 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+var (
+	// ErrNotExternal is returned when recording a result of a check that
+	// patrol runs itself
+	ErrNotExternal = errors.New("Results can only be recorded for external checks")
+
+	// ErrPaused is returned when recording a result of a paused check
+	ErrPaused = errors.New("Check is paused")
+
+	// ErrInvalidResult is returned when recording a malformed result
+	ErrInvalidResult = errors.New("Invalid result")
+)
+
+// Output of recorded results is cut at this size
+const maxRecordedOutput = 64 << 10
+
+// Record writes a result that was reported for an external check (i.e. by
+// a cron job, through 'patrol append'), which is handled like the result
+// of a run of a check that patrol runs itself. Only the status, metric,
+// error, output and annotations of the item are used.
+func (c *Checker) Record(result history.Item) (history.Item, error) {
+	if !c.External {
+		return history.Item{}, ErrNotExternal
+	}
+	if c.IsPaused() {
+		return history.Item{}, ErrPaused
+	}
+	if result.Status != "healthy" && result.Status != "unhealthy" {
+		return history.Item{}, fmt.Errorf("%w: status must be 'healthy' or 'unhealthy', not '%s'", ErrInvalidResult, result.Status)
+	}
+
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		Output:     result.Output,
+		MetricUnit: c.MetricUnit,
+		Status:     result.Status,
+		Error:      result.Error,
+	}
+	if len(item.Output) > maxRecordedOutput {
+		item.Output = item.Output[:maxRecordedOutput]
+	}
+	if c.Type == "metric" {
+		item.Metric = result.Metric
+	}
+	for key, value := range result.Annotations {
+		if !annotationKeyPattern.MatchString(key) {
+			return history.Item{}, fmt.Errorf("%w: invalid annotation key '%s'", ErrInvalidResult, key)
+		}
+		if item.Annotations == nil {
+			item.Annotations = make(map[string]string)
+		}
+		addAnnotation(item.Annotations, key, value)
+	}
+	if item.Status == "healthy" && c.Type == "metric" && c.Anomaly != nil {
+		c.detectAnomaly(&item)
+	}
+
+	newForecast := false
+	if c.Forecast != nil && item.Status != "unhealthy" {
+		forecastAt := c.forecast(item)
+		c.updateState(func(state *State) {
+			newForecast = !forecastAt.IsZero() && state.ForecastAt.IsZero()
+			state.ForecastAt = forecastAt
+		})
+	}
+	c.updateState(func(state *State) {
+		state.LastRunAt = time.Now()
+		state.LastStatus = item.Status
+		state.Runs++
+		if item.Status == "unhealthy" {
+			state.Failures++
+		}
+	})
+
+	_, hasResults := c.History.GetLatestItem(c.Group, c.Name)
+	item, err := c.History.Append(item)
+	if err != nil {
+		return item, err
+	}
+	c.logger.Infof("Recorded result: %s", item)
+	c.rememberResult(item)
+	c.stateMux.Lock()
+	receiver := c.receiver
+	c.stateMux.Unlock()
+	c.notifyReceiver(receiver, item, newForecast, !hasResults)
+	return item, nil
+}
@@ -0,0 +1,47 @@
+package checker
+
+import (
+	"fmt"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Flags that select an address family for common network tools, such as
+// curl, ping, nc and dig
+var addressFamilyFlags = map[string]string{
+	"ipv4": "-4",
+	"ipv6": "-6",
+}
+
+// ValidAddressFamily returns true if the given address family is supported.
+func ValidAddressFamily(family string) bool {
+	_, ok := addressFamilyFlags[family]
+	return ok
+}
+
+// checkFamilies runs the check's command once for each address family,
+// so that a broken family is not hidden by tools falling back to another
+// one. The command selects the family using the PATROL_ADDRESS_FAMILY
+// ('ipv4' or 'ipv6') or PATROL_IP_FLAG ('-4' or '-6') variables. The check
+// is unhealthy if it fails for any family.
+func (c *Checker) checkFamilies() history.Item {
+	var item history.Item
+	families := make(map[string]string, len(c.AddressFamilies))
+	for _, family := range c.AddressFamilies {
+		result := c.sample(
+			"PATROL_ADDRESS_FAMILY="+family,
+			"PATROL_IP_FLAG="+addressFamilyFlags[family],
+		)
+		families[family] = result.Status
+
+		// Keep the first failure, since its output explains the failure
+		if item.Status != "unhealthy" {
+			item = result
+			if result.Status == "unhealthy" {
+				item.Error = fmt.Sprintf("%s: %s", family, result.Error)
+			}
+		}
+	}
+	item.AddressFamilies = families
+	return item
+}
@@ -0,0 +1,63 @@
+package checker
+
+import (
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// ForecastOptions enables trend forecasting for metric checks. A linear
+// trend is fitted to the check's recent results, and the checker warns
+// when the trend is projected to cross the threshold within the horizon.
+type ForecastOptions struct {
+	// Value that the metric should not reach, such as 90 for a disk
+	// usage percentage. The metric may trend up or down towards it.
+	Threshold float64
+
+	// How far ahead to project the trend
+	Horizon time.Duration
+
+	// Number of recent results that the trend is fitted to. No forecasts
+	// are made until this many results have been recorded.
+	Window int
+}
+
+// forecast returns the time at which the trend of the check's results,
+// including the given item, is projected to cross the threshold. The zero
+// value is returned if the threshold will not be crossed within the horizon.
+func (c *Checker) forecast(item history.Item) time.Time {
+	items := append([]history.Item{item}, c.recentMetrics(c.Forecast.Window-1)...)
+	if len(items) < c.Forecast.Window {
+		return time.Time{}
+	}
+
+	// Least squares fit of the metric over time, with times in seconds
+	// relative to the latest result
+	var sumX, sumY, sumXY, sumXX float64
+	for _, i := range items {
+		x := i.CreatedAt.Sub(item.CreatedAt).Seconds()
+		sumX += x
+		sumY += i.Metric
+		sumXY += x * i.Metric
+		sumXX += x * x
+	}
+	n := float64(len(items))
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return time.Time{}
+	}
+	slope := (n*sumXY - sumX*sumY) / denom
+	current := (sumY - slope*sumX) / n
+
+	// Trends that are flat, moving away from the threshold or that have
+	// already crossed it cannot be projected to cross it
+	remaining := c.Forecast.Threshold - current
+	if slope == 0 || remaining == 0 || (remaining > 0) != (slope > 0) {
+		return time.Time{}
+	}
+	eta := time.Duration(remaining / slope * float64(time.Second))
+	if eta > c.Forecast.Horizon {
+		return time.Time{}
+	}
+	return item.CreatedAt.Add(eta)
+}
@@ -0,0 +1,220 @@
+package checker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// LimitOptions limit the resources that a check's command (or plugin) can
+// use, so that a misbehaving command cannot starve the host. Results of
+// commands that exceed a limit fail with history.FailureResourceLimit.
+type LimitOptions struct {
+	// CPU time that each process of the command can use
+	CPU time.Duration
+
+	// Bytes of memory that the processes of the command can use together,
+	// which is only enforced where cgroup v2 is available
+	Memory int64
+
+	// Bytes of output (stdout and stderr together) that are read from the
+	// command, which is killed once it writes more
+	Output int64
+}
+
+// Validate checks that no limit is negative.
+func (opts LimitOptions) Validate() error {
+	if opts.CPU < 0 || opts.Memory < 0 || opts.Output < 0 {
+		return fmt.Errorf("Limits cannot be negative")
+	}
+	if opts.CPU > 0 && opts.CPU < time.Second {
+		return fmt.Errorf("The cpu limit must be at least 1s")
+	}
+	if opts.Memory > 0 && opts.Memory < 1<<20 {
+		return fmt.Errorf("The memory limit must be at least 1MB")
+	}
+	return nil
+}
+
+// wrap returns the program and arguments that run the given command with
+// the CPU limit applied, using the shell's 'ulimit', which is inherited by
+// all processes that the command starts. Commands that are run in a cgroup
+// wait until a line is written to fd 3, so that they only start once they
+// were moved into the cgroup.
+func (opts LimitOptions) wrap(name string, args []string, cgroup bool) (string, []string) {
+	var limits []string
+	if cgroup {
+		limits = append(limits, "read -r _ <&3", "exec 3<&-")
+	}
+	if opts.CPU > 0 {
+		// The hard limit is a second past the soft limit, so that processes
+		// are sent SIGXCPU (rather than SIGKILL) when they reach the limit
+		seconds := int64((opts.CPU + time.Second - 1) / time.Second)
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", seconds+1), fmt.Sprintf("ulimit -S -t %d", seconds))
+	}
+	script := fmt.Sprintf(`%s && exec "$0" "$@"`, strings.Join(limits, " && "))
+	return cmdShell, append([]string{"-c", script, name}, args...)
+}
+
+// limitedOutput is shared by the output streams of a command, and calls
+// 'exceeded' once more than 'limit' bytes have been written to them.
+type limitedOutput struct {
+	sync.Mutex
+	limit      int64
+	written    int64
+	isExceeded bool
+	exceeded   func()
+}
+
+type limitedWriter struct {
+	out *limitedOutput
+	w   io.Writer
+}
+
+func (lw limitedWriter) Write(buf []byte) (int, error) {
+	lw.out.Lock()
+	defer lw.out.Unlock()
+
+	// Output past the limit is discarded rather than failing the write, so
+	// that the command is killed instead of seeing a broken pipe
+	n := len(buf)
+	if lw.out.isExceeded {
+		return n, nil
+	}
+	if remaining := lw.out.limit - lw.out.written; int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+		lw.out.isExceeded = true
+		lw.out.exceeded()
+	}
+	lw.out.written += int64(len(buf))
+	if _, err := lw.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// limitOutput wraps the writers of a command's output, if the check has an
+// output limit.
+func (c *Checker) limitOutput(cancel func(), writers ...*io.Writer) *limitedOutput {
+	if c.Limits == nil || c.Limits.Output == 0 {
+		return nil
+	}
+	out := &limitedOutput{limit: c.Limits.Output, exceeded: cancel}
+	for _, w := range writers {
+		*w = limitedWriter{out: out, w: *w}
+	}
+	return out
+}
+
+// Memory limits are only enforced with cgroup v2, which is reported once if
+// it is not available
+var warnNoCgroup sync.Once
+
+// runLimits are the limits of a single run of a command.
+type runLimits struct {
+	cgroup    *memoryCgroup
+	oomKilled bool
+}
+
+// prepareLimits applies the check's CPU and memory limits to a command,
+// which must then be run with the returned limits.
+func (c *Checker) prepareLimits(cmd *exec.Cmd) (*runLimits, error) {
+	if c.Limits == nil || (c.Limits.CPU == 0 && c.Limits.Memory == 0) {
+		return nil, nil
+	}
+	limits := &runLimits{}
+	if c.Limits.Memory > 0 {
+		if _, err := memoryCgroupRoot(); err != nil {
+			warnNoCgroup.Do(func() {
+				c.logger.Warnf("Memory limits are not enforced, since cgroup v2 is not available: %s", err)
+			})
+		} else if limits.cgroup, err = newMemoryCgroup(c.Limits.Memory); err != nil {
+			return nil, fmt.Errorf("Failed to create cgroup: %s", err)
+		}
+	}
+	if c.Limits.CPU == 0 && limits.cgroup == nil {
+		return limits, nil
+	}
+
+	path, args := c.Limits.wrap(cmd.Path, cmd.Args[1:], limits.cgroup != nil)
+	wrapped := exec.Command(path, args...)
+	cmd.Path = wrapped.Path
+	cmd.Args = wrapped.Args
+	cmd.Err = wrapped.Err
+	return limits, nil
+}
+
+// run runs a command with the limits. Commands that have a cgroup are
+// moved into it before they are released, so that none of their memory is
+// left out of the limit.
+func (limits *runLimits) run(cmd *exec.Cmd) error {
+	if limits == nil || limits.cgroup == nil {
+		return cmd.Run()
+	}
+	defer limits.cgroup.remove()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = []*os.File{r}
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	// Closing the pipe without writing to it makes the command exit
+	if err := limits.cgroup.add(cmd.Process.Pid); err != nil {
+		w.Close()
+		cmd.Wait()
+		return fmt.Errorf("Failed to move command into cgroup: %s", err)
+	}
+	w.Write([]byte("\n"))
+	w.Close()
+
+	err = cmd.Wait()
+	limits.oomKilled = limits.cgroup.oomKilled()
+	return err
+}
+
+// checkLimits marks a result as a resource limit failure, if the command
+// exceeded one of the check's limits.
+func (c *Checker) checkLimits(item *history.Item, cmd *exec.Cmd, output *limitedOutput, limits *runLimits) {
+	if output != nil && output.isExceeded {
+		item.Status = "unhealthy"
+		item.Failure = history.FailureResourceLimit
+		item.Error = fmt.Sprintf("Output exceeded the limit of %d bytes", c.Limits.Output)
+		return
+	}
+	if c.Limits == nil || item.Status != "unhealthy" {
+		return
+	}
+	if state := cmd.ProcessState; c.Limits.CPU > 0 && state != nil {
+		// Shells exit with 128 + SIGXCPU (24) when a child process is
+		// stopped by the limit, and commands that are exec'd by the shell
+		// are stopped by the signal themselves
+		cpuTime := state.UserTime() + state.SystemTime()
+		if state.ExitCode() == 152 || killedByCPULimit(state) || cpuTime >= c.Limits.CPU {
+			item.Failure = history.FailureResourceLimit
+			item.Error = fmt.Sprintf("Process exceeded its CPU time limit of %s", c.Limits.CPU)
+			return
+		}
+	}
+	if state := cmd.ProcessState; limits != nil && limits.oomKilled && state != nil {
+		// The kernel kills processes that exceed the limit with SIGKILL,
+		// and shells exit with 128 + SIGKILL (9) when it kills a child
+		if state.ExitCode() == 137 || killedBySIGKILL(state) {
+			item.Failure = history.FailureResourceLimit
+			item.Error = fmt.Sprintf("Process exceeded its memory limit of %d MB", c.Limits.Memory>>20)
+			return
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package checker
+
+import (
+	"os"
+	"syscall"
+)
+
+// killedByCPULimit returns true if the process was stopped by SIGXCPU,
+// which the kernel sends once its CPU time limit is reached.
+func killedByCPULimit(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXCPU
+}
+
+// killedBySIGKILL returns true if the process was killed by SIGKILL, which
+// the kernel sends to processes that exceed the memory limit of their
+// cgroup.
+func killedBySIGKILL(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
@@ -0,0 +1,11 @@
+package checker
+
+import "os"
+
+func killedByCPULimit(state *os.ProcessState) bool {
+	return false
+}
+
+func killedBySIGKILL(state *os.ProcessState) bool {
+	return false
+}
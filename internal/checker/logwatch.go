@@ -0,0 +1,223 @@
+package checker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Maximum amount of a log file that is read in a single run, so that a
+// burst of logging cannot stall the checker
+const maxLogRead = 64 << 20
+
+// LogWatchOptions configure checks that follow a log file, and fail when
+// lines that were written since the previous run match error patterns.
+type LogWatchOptions struct {
+	File string
+
+	// Regular expressions of lines that fail the check
+	Patterns []string
+
+	// Regular expressions of lines that are ignored, even if they match one
+	// of the patterns
+	Exclude []string
+
+	// Number of matched lines kept as output, which defaults to 20
+	MaxLines int `yaml:"maxLines"`
+}
+
+// Validate checks the options without reading the file.
+func (opts LogWatchOptions) Validate() error {
+	if opts.File == "" {
+		return fmt.Errorf("A file is required")
+	}
+	if len(opts.Patterns) == 0 {
+		return fmt.Errorf("At least one pattern is required")
+	}
+	for _, pattern := range append(opts.Patterns, opts.Exclude...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Invalid pattern: %s", err)
+		}
+	}
+	if opts.MaxLines < 0 {
+		return fmt.Errorf("maxLines cannot be negative")
+	}
+	return nil
+}
+
+// logPosition is where the previous run stopped reading a log file.
+type logPosition struct {
+	sync.Mutex
+	offset int64
+	info   os.FileInfo
+
+	// Position that was last persisted in the check's state
+	saved history.LogPosition
+}
+
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		compiled[i] = regexp.MustCompile(pattern)
+	}
+	return compiled
+}
+
+func matchesAny(patterns []*regexp.Regexp, line []byte) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// savedLogOffset returns the offset of the log file that the check read up
+// to before patrol was restarted, so that lines that were written in the
+// meantime are not missed. Files that were never read are read from their
+// end, since older lines were not written while the file was watched, and
+// files that were rotated since are read from their start.
+func (c *Checker) savedLogOffset(info os.FileInfo) int64 {
+	if c.History == nil {
+		return info.Size()
+	}
+	saved := c.History.GetCheckState(c.Group, c.Name).LogPosition
+	if saved == nil || saved.File != c.LogWatch.File {
+		return info.Size()
+	}
+	c.logPosition.saved = *saved
+	if saved.Inode != fileInode(info) || info.Size() < saved.Offset {
+		return 0
+	}
+	return saved.Offset
+}
+
+// saveLogPosition persists the offset of the log file that was read up to
+// in the check's state, unless it did not move.
+func (c *Checker) saveLogPosition() {
+	position := history.LogPosition{
+		File:   c.LogWatch.File,
+		Inode:  fileInode(c.logPosition.info),
+		Offset: c.logPosition.offset,
+	}
+	if c.History == nil || position == c.logPosition.saved {
+		return
+	}
+	err := c.History.UpdateCheckState(c.Group, c.Name, func(state *history.CheckState) {
+		state.LogPosition = &position
+	})
+	if err != nil {
+		c.logger.Warnf("Failed to save position in %s: %s", c.LogWatch.File, err)
+		return
+	}
+	c.logPosition.saved = position
+}
+
+// readNewLines reads the complete lines that were appended to the check's
+// log file since the previous run, or since patrol last read it.
+func (c *Checker) readNewLines() ([][]byte, error) {
+	c.logPosition.Lock()
+	defer c.logPosition.Unlock()
+
+	fd, err := os.Open(c.LogWatch.File)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	prev := c.logPosition.info
+	c.logPosition.info = info
+	if prev == nil {
+		c.logPosition.offset = c.savedLogOffset(info)
+	} else if !os.SameFile(prev, info) || info.Size() < c.logPosition.offset {
+		// The file was rotated or truncated, so the new file is read from
+		// the start
+		c.logPosition.offset = 0
+	}
+	defer c.saveLogPosition()
+
+	if _, err := fd.Seek(c.logPosition.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(fd, maxLogRead))
+	if err != nil {
+		return nil, err
+	}
+
+	// Incomplete lines are read again once they are complete, unless a
+	// single line fills up the whole read
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == 0 && len(data) == maxLogRead {
+		end = len(data)
+	}
+	c.logPosition.offset += int64(end)
+	return bytes.Split(data[:end], []byte("\n")), nil
+}
+
+// sampleLogWatch counts the lines that were appended to the check's log
+// file since the previous run, which match one of its patterns and none of
+// its exclusions. The count is the check's metric, and any matching line
+// fails the check, with the first maxLines of them as its output.
+func (c *Checker) sampleLogWatch() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	start := time.Now()
+	lines, err := c.readNewLines()
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Failed to read log file: %s", err)
+		return item
+	}
+
+	maxLines := c.LogWatch.MaxLines
+	if maxLines == 0 {
+		maxLines = 20
+	}
+	var matched []string
+	numMatched := 0
+	for _, line := range lines {
+		if len(line) == 0 || !matchesAny(c.logPatterns, line) || matchesAny(c.logExclude, line) {
+			continue
+		}
+		numMatched++
+		if len(matched) < maxLines {
+			matched = append(matched, string(line))
+		}
+	}
+
+	item.Metric = float64(numMatched)
+	if numMatched == 0 {
+		item.Status = "healthy"
+		return item
+	}
+	item.Status = "unhealthy"
+	item.Error = fmt.Sprintf("%d new lines in %s match error patterns", numMatched, c.LogWatch.File)
+	if numMatched == 1 {
+		item.Error = fmt.Sprintf("A new line in %s matches error patterns", c.LogWatch.File)
+	}
+	if numMatched > len(matched) {
+		matched = append(matched, fmt.Sprintf("(%d more)", numMatched-len(matched)))
+	}
+	item.Output = []byte(strings.Join(matched, "\n") + "\n")
+	return item
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package checker
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of a file, which stays the same while the
+// file is renamed, so that rotated log files can be told apart.
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+package checker
+
+import "os"
+
+// fileInode returns zero, since files on Windows are only identified by
+// their handles.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,155 @@
+package checker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// NTPOptions configure checks of the local clock's offset from an NTP
+// server.
+type NTPOptions struct {
+	// Host of the server, with an optional port
+	Server string
+
+	// Checks fail once the clock is off by more than this, in either
+	// direction, which defaults to 100ms
+	MaxOffset time.Duration `yaml:"maxOffset"`
+}
+
+// Validate checks the options without contacting the server.
+func (opts NTPOptions) Validate() error {
+	if opts.Server == "" {
+		return fmt.Errorf("A server is required")
+	}
+	if opts.MaxOffset < 0 {
+		return fmt.Errorf("maxOffset cannot be negative")
+	}
+	return nil
+}
+
+// Seconds between the NTP epoch (1900) and the unix epoch
+const ntpEpochOffset = 2208988800
+
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / 1e9
+	return seconds<<32 | fraction
+}
+
+func fromNTPTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanoseconds := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(seconds, nanoseconds)
+}
+
+// ntpOffset queries an NTP server once (as an SNTP client, RFC 4330), and
+// returns the offset of the server's clock from the local clock.
+func ntpOffset(server string, timeout time.Duration) (offset, rtt time.Duration, stratum int, err error) {
+	if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// The transmit timestamp is echoed back as the originate timestamp,
+	// which identifies the response. Its low bits are randomized, so that
+	// responses cannot be forged without seeing the request.
+	request := make([]byte, 48)
+	request[0] = 0x23 // no leap indicator, version 4, client mode
+	rand.Read(request[44:48])
+	sentAt := time.Now()
+	transmit := toNTPTime(sentAt)&^0xffffffff | uint64(binary.BigEndian.Uint32(request[44:48]))
+	binary.BigEndian.PutUint64(request[40:], transmit)
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+
+	response := make([]byte, 48)
+	for {
+		var n int
+		n, err = conn.Read(response)
+		if err != nil {
+			return
+		}
+		if n >= 48 && binary.BigEndian.Uint64(response[24:]) == transmit {
+			break
+		}
+	}
+	receivedAt := time.Now()
+
+	if mode := response[0] & 0x7; mode != 4 {
+		err = fmt.Errorf("Unexpected NTP mode in response: %d", mode)
+		return
+	}
+	stratum = int(response[1])
+	if stratum == 0 {
+		err = fmt.Errorf("Server sent kiss-o'-death code '%s'", response[12:16])
+		return
+	}
+	if response[0]>>6 == 3 {
+		err = fmt.Errorf("Server clock is not synchronized")
+		return
+	}
+
+	// The transmit timestamp only has second precision after the random
+	// bits, so the local send time is used instead
+	t1 := sentAt
+	t2 := fromNTPTime(binary.BigEndian.Uint64(response[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(response[40:]))
+	t4 := receivedAt
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	rtt = t4.Sub(t1) - t3.Sub(t2)
+	return
+}
+
+// sampleNTP asks the check's NTP server for the time, and records the
+// offset of the local clock in milliseconds as the check's metric. A
+// positive offset means that the local clock is ahead. The check fails if
+// the offset is larger than maxOffset either way.
+func (c *Checker) sampleNTP() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	start := time.Now()
+	offset, rtt, stratum, err := ntpOffset(c.NTP.Server, c.CmdTimeout)
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("NTP request to %s failed: %s", c.NTP.Server, err)
+		return item
+	}
+
+	// The server's clock is ahead when the offset is positive, so the local
+	// clock's offset has the opposite sign
+	localOffset := -offset
+	item.Metric = math.Round(float64(localOffset)/float64(time.Microsecond)) / 1000
+	item.Output = []byte(fmt.Sprintf("offset: %s\nround trip: %s\nstratum: %d\n", localOffset, rtt, stratum))
+
+	maxOffset := c.NTP.MaxOffset
+	if maxOffset == 0 {
+		maxOffset = 100 * time.Millisecond
+	}
+	if localOffset > maxOffset || localOffset < -maxOffset {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Clock is off by %s, more than the maximum of %s", localOffset.Round(time.Millisecond), maxOffset)
+		return item
+	}
+	item.Status = "healthy"
+	return item
+}
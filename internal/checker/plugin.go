@@ -0,0 +1,164 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Plugin is an external program that implements a type of check, so that
+// checks can use protocols (i.e. SNMP) that patrol does not support itself.
+//
+// For each run, the plugin is executed with a PluginRequest as JSON on its
+// stdin, and must print a PluginResult as JSON to its stdout. Anything the
+// plugin writes to stderr is kept as the output of the check. If the plugin
+// exits with a non-zero status, the check fails.
+type Plugin struct {
+	Name string
+	Path string
+	Args []string
+}
+
+// PluginRequest is sent to a plugin on every run.
+type PluginRequest struct {
+	Group string `json:"group"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+
+	// Time the plugin has to run before it is killed, in seconds
+	Timeout float64 `json:"timeout"`
+
+	// Options of the check, as they appear in the config file
+	Config json.RawMessage `json:"config"`
+}
+
+// PluginResult is the result of a single run of a plugin.
+type PluginResult struct {
+	// Either "healthy" or "unhealthy"
+	Status string `json:"status"`
+
+	// Value of metric checks
+	Metric float64 `json:"metric"`
+
+	// Reason that the check failed
+	Error string `json:"error"`
+
+	// Additional output, which is shown when the check fails
+	Output string `json:"output"`
+
+	// Metadata to attach to the result, like the annotations of commands
+	Annotations map[string]string `json:"annotations"`
+}
+
+// samplePlugin runs the check's plugin with a PluginRequest on its stdin,
+// and reads its PluginResult from its stdout. Its stderr becomes the output
+// of the result, with annotations parsed like those of commands. Plugins
+// that exit with an error or print an invalid result fail the check.
+func (c *Checker) samplePlugin(env []string) history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	config := c.PluginConfig
+	if len(config) == 0 {
+		config = json.RawMessage("{}")
+	}
+	request, err := json.Marshal(PluginRequest{
+		Group:   c.Group,
+		Name:    c.Name,
+		Type:    c.Type,
+		Timeout: c.CmdTimeout.Seconds(),
+		Config:  config,
+	})
+	if err != nil {
+		item.CreatedAt = time.Now()
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Failed to encode plugin config: %s", err)
+		return item
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), c.CmdTimeout)
+	cmd := exec.CommandContext(ctx, c.Plugin.Path, c.Plugin.Args...)
+	cmd.Stdin = bytes.NewReader(request)
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	output := c.limitOutput(cancel, &cmd.Stdout, &cmd.Stderr)
+
+	cmdStart := time.Now()
+	var limits *runLimits
+	err = c.runAs(cmd, env)
+	if err == nil {
+		limits, err = c.prepareLimits(cmd)
+	}
+	if err == nil {
+		err = limits.run(cmd)
+	}
+	cancel()
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(cmdStart)
+	item.Output, item.Annotations = parseAnnotations(stderr.Bytes())
+	if err != nil {
+		item.Status = "unhealthy"
+	}
+	if c.checkLimits(&item, cmd, output, limits); item.Failure != "" {
+		return item
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); err != nil && ok {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Plugin '%s' exited with status %d", c.Plugin.Name, exitErr.ExitCode())
+		return item
+	} else if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Failed to run plugin '%s': %s", c.Plugin.Name, err)
+		return item
+	}
+
+	var result PluginResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Plugin '%s' returned an invalid result: %s", c.Plugin.Name, err)
+		item.Output = append(stdout.Bytes(), item.Output...)
+		return item
+	}
+	if result.Output != "" {
+		item.Output = append([]byte(strings.TrimSuffix(result.Output, "\n")+"\n"), item.Output...)
+	}
+	for key, value := range result.Annotations {
+		if !annotationKeyPattern.MatchString(key) {
+			continue
+		}
+		if item.Annotations == nil {
+			item.Annotations = make(map[string]string)
+		}
+		addAnnotation(item.Annotations, key, value)
+	}
+
+	switch result.Status {
+	case "healthy":
+		item.Status = "healthy"
+		item.Metric = result.Metric
+	case "unhealthy":
+		item.Status = "unhealthy"
+		item.Error = result.Error
+		if item.Error == "" {
+			item.Error = fmt.Sprintf("Plugin '%s' reported a failure", c.Plugin.Name)
+		}
+	default:
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Plugin '%s' returned an invalid status: '%s'", c.Plugin.Name, result.Status)
+	}
+	return item
+}
@@ -0,0 +1,148 @@
+package checker
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Priority decides which checks run first when more checks are due than
+// can run at once.
+type Priority string
+
+const (
+	// Runs ahead of all other checks
+	PriorityHigh Priority = "high"
+
+	// Runs ahead of low-priority checks. This is the default.
+	PriorityNormal Priority = "normal"
+
+	// Only runs if a slot is free, and is skipped otherwise
+	PriorityLow Priority = "low"
+)
+
+// ParsePriority validates a priority. The empty string is accepted, and
+// selects the default priority.
+func ParsePriority(str string) (Priority, error) {
+	switch Priority(str) {
+	case "":
+		return PriorityNormal, nil
+	case PriorityHigh, PriorityNormal, PriorityLow:
+		return Priority(str), nil
+	default:
+		return "", fmt.Errorf("Unrecognized priority: '%s'", str)
+	}
+}
+
+// Rank orders priorities from the highest (zero) to the lowest.
+func (p Priority) Rank() int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Pool limits the number of checks that run at once. Checks that are due
+// while all slots are taken wait for a slot in order of priority, except
+// for low-priority checks, which skip their run instead of being delayed.
+// A nil pool does not limit checks.
+type Pool struct {
+	mux     sync.Mutex
+	size    int
+	running int
+
+	// Checks that wait for a slot, by priority and then in the order in
+	// which they became due
+	waiting []*poolWaiter
+}
+
+type poolWaiter struct {
+	priority Priority
+	ready    chan bool
+}
+
+// NewPool creates a pool that runs up to 'size' checks at once.
+func NewPool(size int) *Pool {
+	return &Pool{size: size}
+}
+
+// Size returns the number of checks that can run at once.
+func (pool *Pool) Size() int {
+	if pool == nil {
+		return 0
+	}
+	return pool.size
+}
+
+// acquire waits for a slot, and returns false if the run should be skipped
+// instead, either because its priority is low and no slot is free, or
+// because the checker was closed while waiting. 'queued' is called before
+// waiting.
+func (pool *Pool) acquire(priority Priority, done <-chan bool, queued func()) bool {
+	if pool == nil {
+		return true
+	}
+
+	pool.mux.Lock()
+	if pool.running < pool.size && len(pool.waiting) == 0 {
+		pool.running++
+		pool.mux.Unlock()
+		return true
+	}
+	if priority == PriorityLow {
+		pool.mux.Unlock()
+		return false
+	}
+	waiter := &poolWaiter{priority: priority, ready: make(chan bool)}
+	idx := len(pool.waiting)
+	for i, w := range pool.waiting {
+		if priority.Rank() < w.priority.Rank() {
+			idx = i
+			break
+		}
+	}
+	pool.waiting = append(pool.waiting, nil)
+	copy(pool.waiting[idx+1:], pool.waiting[idx:])
+	pool.waiting[idx] = waiter
+	pool.mux.Unlock()
+
+	queued()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-done:
+	}
+
+	// The slot may have been handed over while the checker was closing
+	pool.mux.Lock()
+	for i, w := range pool.waiting {
+		if w == waiter {
+			pool.waiting = append(pool.waiting[:i], pool.waiting[i+1:]...)
+			pool.mux.Unlock()
+			return false
+		}
+	}
+	pool.mux.Unlock()
+	pool.release()
+	return false
+}
+
+// release frees a slot, which is handed over to the first waiting check.
+func (pool *Pool) release() {
+	if pool == nil {
+		return
+	}
+
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if len(pool.waiting) > 0 {
+		waiter := pool.waiting[0]
+		pool.waiting = pool.waiting[1:]
+		close(waiter.ready)
+		return
+	}
+	pool.running--
+}
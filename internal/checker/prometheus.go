@@ -0,0 +1,178 @@
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// PrometheusOptions configure checks of the value of a PromQL expression,
+// which is evaluated by a Prometheus server (or any server with the same
+// query API, i.e. Thanos or VictoriaMetrics).
+type PrometheusOptions struct {
+	// Base URL of the server (i.e. http://prometheus:9090)
+	URL      string
+	Username string
+	Password string `json:"-" secret:"true"`
+
+	// Expression that must evaluate to a scalar, or to a single series
+	Query string
+
+	// Bounds for the value
+	Bounds `yaml:",inline"`
+}
+
+// Validate checks the options without contacting the server.
+func (opts PrometheusOptions) Validate() error {
+	if opts.URL == "" || opts.Query == "" {
+		return fmt.Errorf("A url and query are required")
+	}
+	if _, err := url.Parse(opts.URL); err != nil {
+		return err
+	}
+	return opts.Bounds.Validate()
+}
+
+// prometheusSample is a value in a query response, as a pair of a
+// timestamp and the value as a string.
+type prometheusSample [2]interface{}
+
+func (s prometheusSample) value() (float64, error) {
+	str, ok := s[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("Invalid value in response: %v", s[1])
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// formatLabels formats the labels of a series like PromQL does, i.e.
+// '{instance="db-1", job="node"}'.
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// queryPrometheus evaluates the check's query once, and returns its value
+// along with a description of the series that it came from.
+func (c *Checker) queryPrometheus() (float64, string, error) {
+	opts := c.Prometheus
+	client, err := c.httpClient()
+	if err != nil {
+		return 0, "", err
+	}
+	query := url.Values{
+		"query":   {opts.Query},
+		"timeout": {strconv.FormatFloat(c.CmdTimeout.Seconds(), 'f', -1, 64)},
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(opts.URL, "/")+"/api/v1/query?"+query.Encode(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("Failed to reach Prometheus: %s", err)
+	}
+	defer res.Body.Close()
+
+	// Failed queries return an error in the body, along with a 4xx or 5xx
+	var body struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, "", fmt.Errorf("Invalid response from Prometheus (status %d): %s", res.StatusCode, err)
+	}
+	if body.Status != "success" {
+		if body.Error == "" {
+			body.Error = fmt.Sprintf("status %d", res.StatusCode)
+		}
+		return 0, "", fmt.Errorf("Query failed: %s", body.Error)
+	}
+
+	switch body.Data.ResultType {
+	case "scalar":
+		var sample prometheusSample
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, "", fmt.Errorf("Invalid response from Prometheus: %s", err)
+		}
+		value, err := sample.value()
+		return value, "scalar", err
+	case "vector":
+		var series []struct {
+			Metric map[string]string `json:"metric"`
+			Value  prometheusSample  `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &series); err != nil {
+			return 0, "", fmt.Errorf("Invalid response from Prometheus: %s", err)
+		}
+		if len(series) == 0 {
+			return 0, "", fmt.Errorf("Query returned no data")
+		}
+		if len(series) > 1 {
+			return 0, "", fmt.Errorf("Query returned %d series, but must return a single value (i.e. use sum() or max())", len(series))
+		}
+		value, err := series[0].Value.value()
+		return value, formatLabels(series[0].Metric), err
+	default:
+		return 0, "", fmt.Errorf("Query returned a %s, but must return a scalar or an instant vector", body.Data.ResultType)
+	}
+}
+
+// samplePrometheus evaluates the check's query as an instant query, and
+// records its value as the check's metric. Queries that return NaN or an
+// infinite value fail the check, as do values that are out of bounds.
+func (c *Checker) samplePrometheus() history.Item {
+	start := time.Now()
+	value, series, err := c.queryPrometheus()
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+		CreatedAt:  time.Now(),
+		Duration:   time.Since(start),
+		Status:     "healthy",
+	}
+	if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		err = fmt.Errorf("Query returned %g", value)
+	}
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+		item.Output = []byte(fmt.Sprintf("query: %s\n", c.Prometheus.Query))
+		return item
+	}
+
+	item.Metric = value
+	item.Output = []byte(fmt.Sprintf("query: %s\nseries: %s\nvalue: %g\n", c.Prometheus.Query, series, value))
+	if err := c.Prometheus.check("Value", value); err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+	}
+	return item
+}
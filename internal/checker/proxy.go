@@ -0,0 +1,70 @@
+package checker
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyOptions configures the proxies used to reach external endpoints.
+// Proxies are URLs such as 'http://proxy:3128' or 'socks5://proxy:1080'.
+type ProxyOptions struct {
+	HTTP  string `yaml:",omitempty" secret:"url"`
+	HTTPS string `yaml:",omitempty" secret:"url"`
+
+	// Comma-separated list of hosts that are reached directly. Entries
+	// match the host and all of its subdomains, and '*' matches all hosts.
+	NoProxy string `yaml:"noProxy,omitempty"`
+}
+
+// Env returns the environment variables that configure the proxy for
+// commands such as curl and wget.
+func (opts ProxyOptions) Env() []string {
+	var env []string
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, strings.ToUpper(name)+"="+value, name+"="+value)
+		}
+	}
+	add("http_proxy", opts.HTTP)
+	add("https_proxy", opts.HTTPS)
+	add("no_proxy", opts.NoProxy)
+	return env
+}
+
+// ProxyFunc returns a function that selects the proxy for a request, for
+// use in 'http.Transport'.
+func (opts ProxyOptions) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := opts.HTTP
+		if req.URL.Scheme == "https" {
+			proxy = opts.HTTPS
+		}
+		if proxy == "" || opts.bypass(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+func (opts ProxyOptions) bypass(host string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(opts.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+	"github.com/karimsa/patrol/internal/kafka"
+)
+
+// RabbitMQOptions configure checks of the number of messages in a RabbitMQ
+// queue, which are read from the management API.
+type RabbitMQOptions struct {
+	// Base URL of the management API (i.e. http://localhost:15672)
+	URL      string
+	Username string
+	Password string `json:"-" secret:"true"`
+
+	// Virtual host of the queue, which defaults to "/"
+	VHost string `yaml:"vhost"`
+	Queue string
+
+	// Checks fail once more messages than this are waiting
+	Max *int64
+
+	// Checks fail when fewer consumers than this are connected, since a
+	// queue without consumers only grows
+	MinConsumers int `yaml:"minConsumers"`
+}
+
+// Validate checks the options without contacting the server.
+func (opts RabbitMQOptions) Validate() error {
+	if opts.URL == "" || opts.Queue == "" {
+		return fmt.Errorf("A url and queue are required")
+	}
+	if _, err := url.Parse(opts.URL); err != nil {
+		return err
+	}
+	if opts.MinConsumers < 0 {
+		return fmt.Errorf("minConsumers cannot be negative")
+	}
+	return nil
+}
+
+// KafkaOptions configure checks of the lag of a Kafka consumer group, which
+// is the number of messages in a topic that the group has not committed.
+type KafkaOptions struct {
+	Brokers []string
+	Topic   string
+	Group   string
+
+	// Checks fail once the total lag across partitions is greater than this
+	Max *int64
+}
+
+// Validate checks the options without contacting the cluster.
+func (opts KafkaOptions) Validate() error {
+	if len(opts.Brokers) == 0 || opts.Topic == "" || opts.Group == "" {
+		return fmt.Errorf("Brokers, a topic and a group are required")
+	}
+	return nil
+}
+
+// httpClient returns a client that uses the check's proxy and certificates.
+func (c *Checker) httpClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != nil {
+		transport.Proxy = c.Proxy.ProxyFunc()
+	}
+	if c.TLS != nil {
+		config, err := c.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.CmdTimeout,
+	}, nil
+}
+
+// queueItem returns an item for a check of a queue, which records the
+// given number of messages as its metric.
+func (c *Checker) queueItem(start time.Time, messages int64, output string, err error) history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+		Output:     []byte(output),
+		CreatedAt:  time.Now(),
+		Duration:   time.Since(start),
+		Metric:     float64(messages),
+		Status:     "healthy",
+	}
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+	}
+	return item
+}
+
+// sampleRabbitMQ reads the check's queue from the RabbitMQ management API,
+// and records its number of messages as the check's metric. The check fails
+// if the queue holds more than the maximum, or has too few consumers.
+func (c *Checker) sampleRabbitMQ() history.Item {
+	start := time.Now()
+	opts := c.RabbitMQ
+	vhost := opts.VHost
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	client, err := c.httpClient()
+	if err != nil {
+		return c.queueItem(start, 0, "", err)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"%s/api/queues/%s/%s",
+		strings.TrimSuffix(opts.URL, "/"),
+		url.PathEscape(vhost),
+		url.PathEscape(opts.Queue),
+	), nil)
+	if err != nil {
+		return c.queueItem(start, 0, "", err)
+	}
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return c.queueItem(start, 0, "", fmt.Errorf("Failed to reach management API: %s", err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return c.queueItem(start, 0, "", fmt.Errorf("Queue '%s' does not exist in vhost '%s'", opts.Queue, vhost))
+	}
+	if res.StatusCode != http.StatusOK {
+		return c.queueItem(start, 0, "", fmt.Errorf("Management API returned status %d", res.StatusCode))
+	}
+
+	var queue struct {
+		Messages               int64  `json:"messages"`
+		MessagesReady          int64  `json:"messages_ready"`
+		MessagesUnacknowledged int64  `json:"messages_unacknowledged"`
+		Consumers              int    `json:"consumers"`
+		State                  string `json:"state"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&queue); err != nil {
+		return c.queueItem(start, 0, "", fmt.Errorf("Invalid response from management API: %s", err))
+	}
+
+	output := fmt.Sprintf(
+		"messages: %d (%d ready, %d unacknowledged)\nconsumers: %d\nstate: %s\n",
+		queue.Messages,
+		queue.MessagesReady,
+		queue.MessagesUnacknowledged,
+		queue.Consumers,
+		queue.State,
+	)
+	if opts.Max != nil && queue.Messages > *opts.Max {
+		err = fmt.Errorf("%d messages in queue, above the maximum of %d", queue.Messages, *opts.Max)
+	} else if queue.Consumers < opts.MinConsumers {
+		err = fmt.Errorf("%d consumers connected, below the minimum of %d", queue.Consumers, opts.MinConsumers)
+	}
+	return c.queueItem(start, queue.Messages, output, err)
+}
+
+// sampleKafka reads the committed offsets of the check's consumer group,
+// and records how far they are behind the newest offsets of the topic's
+// partitions, summed over all partitions, as the check's metric. The check
+// fails if the group lags by more than the maximum.
+func (c *Checker) sampleKafka() history.Item {
+	start := time.Now()
+	opts := kafka.Options{
+		Brokers: c.Kafka.Brokers,
+		Timeout: c.CmdTimeout,
+	}
+	if c.TLS != nil {
+		config, err := c.TLS.Config()
+		if err != nil {
+			return c.queueItem(start, 0, "", err)
+		}
+		opts.TLS = config
+	}
+
+	lag, err := kafka.ConsumerLag(opts, c.Kafka.Group, c.Kafka.Topic)
+	if err != nil {
+		return c.queueItem(start, 0, "", err)
+	}
+
+	partitions := make([]int32, 0, len(lag))
+	for partition := range lag {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i] < partitions[j]
+	})
+	var total int64
+	var output strings.Builder
+	for _, partition := range partitions {
+		total += lag[partition]
+		fmt.Fprintf(&output, "%s/%d: %d\n", c.Kafka.Topic, partition, lag[partition])
+	}
+
+	if c.Kafka.Max != nil && total > *c.Kafka.Max {
+		err = fmt.Errorf("Consumer group '%s' lags by %d messages, above the maximum of %d", c.Kafka.Group, total, *c.Kafka.Max)
+	}
+	return c.queueItem(start, total, output.String(), err)
+}
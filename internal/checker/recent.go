@@ -0,0 +1,116 @@
+package checker
+
+import (
+	"sync"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// recentResults are the latest results of a check that new results are
+// compared to, so that anomaly detection, forecasts and content checks do
+// not scan the check's history on every run. They are read from history
+// once, and then kept up to date as the checker writes results.
+type recentResults struct {
+	sync.Mutex
+	loaded bool
+
+	// Latest results that were not unhealthy, with the most recent first
+	metrics []history.Item
+
+	// Latest result that has a content hash
+	content history.Item
+}
+
+// metricWindow is the number of results that anomaly detection and
+// forecasts are based on.
+func (c *Checker) metricWindow() int {
+	window := 0
+	if c.Anomaly != nil {
+		window = c.Anomaly.Window
+	}
+	if c.Forecast != nil && c.Forecast.Window > window {
+		window = c.Forecast.Window
+	}
+	return window
+}
+
+// loadRecent reads the recent results from history, the first time that
+// they are needed. The caller must hold the lock of the recent results.
+func (c *Checker) loadRecent() {
+	recent := c.recent
+	if recent.loaded || c.History == nil {
+		return
+	}
+	recent.loaded = true
+
+	window := c.metricWindow()
+	c.History.EachItem(c.Group, c.Name, func(item history.Item, _ func() history.Item) bool {
+		if item.Status != "unhealthy" && len(recent.metrics) < window {
+			recent.metrics = append(recent.metrics, item)
+		}
+		if recent.content.ContentHash == "" && item.ContentHash != "" {
+			recent.content = item
+		}
+		return len(recent.metrics) < window || (c.Content != nil && recent.content.ContentHash == "")
+	})
+}
+
+// recentMetrics returns up to n of the latest results that were not
+// unhealthy, with the most recent first.
+func (c *Checker) recentMetrics(n int) []history.Item {
+	c.recent.Lock()
+	defer c.recent.Unlock()
+	c.loadRecent()
+
+	if n > len(c.recent.metrics) {
+		n = len(c.recent.metrics)
+	}
+	return append([]history.Item(nil), c.recent.metrics[:n]...)
+}
+
+// previousContent returns the latest result that has a content hash, or
+// the zero value if there is none.
+func (c *Checker) previousContent() history.Item {
+	c.recent.Lock()
+	defer c.recent.Unlock()
+	c.loadRecent()
+	return c.recent.content
+}
+
+// rememberResult adds a result that was written to history to the recent
+// results. It does not use the history file, so that it can be called
+// from write callbacks.
+func (c *Checker) rememberResult(item history.Item) {
+	c.recent.Lock()
+	defer c.recent.Unlock()
+
+	// Results that are written before the recent results are first needed
+	// are read from history along with the rest
+	if !c.recent.loaded {
+		return
+	}
+	item.Output = nil
+	item.Error = ""
+
+	if item.ContentHash != "" && !item.CreatedAt.Before(c.recent.content.CreatedAt) {
+		c.recent.content = item
+	}
+	if item.Status == "unhealthy" {
+		return
+	}
+
+	// Results are usually the most recent, but clock skew corrections and
+	// backfilled results can be older
+	metrics := c.recent.metrics
+	i := 0
+	for i < len(metrics) && metrics[i].CreatedAt.After(item.CreatedAt) {
+		i++
+	}
+	metrics = append(metrics, history.Item{})
+	copy(metrics[i+1:], metrics[i:])
+	metrics[i] = item
+	if window := c.metricWindow(); len(metrics) > window {
+		metrics = metrics[:window]
+	}
+	c.recent.metrics = metrics
+}
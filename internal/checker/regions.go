@@ -0,0 +1,81 @@
+package checker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// ReportRegionResult records the result of running this check from another
+// region. Results from other regions are only used by checks that have a
+// quorum, and are ignored once they are older than two intervals.
+func (c *Checker) ReportRegionResult(region string, item history.Item) {
+	if region == "" || region == c.region() {
+		return
+	}
+
+	c.regionMux.Lock()
+	c.regionResults[region] = item
+	c.regionMux.Unlock()
+}
+
+// annotateRegions tags a local result with the region it was run from, and
+// with the status and duration of the check in each region that recently
+// reported a result for it.
+func (c *Checker) annotateRegions(item *history.Item) {
+	item.Region = c.Region
+
+	c.regionMux.Lock()
+	defer c.regionMux.Unlock()
+	for region, result := range c.regionResults {
+		if time.Since(result.CreatedAt) > 2*c.Interval {
+			delete(c.regionResults, region)
+		}
+	}
+	if len(c.regionResults) == 0 && c.Quorum == 0 {
+		return
+	}
+
+	item.Regions = map[string]string{c.region(): item.Status}
+	item.RegionLatency = map[string]time.Duration{c.region(): item.Duration}
+	for region, result := range c.regionResults {
+		item.Regions[region] = result.Status
+		item.RegionLatency[region] = result.Duration
+	}
+}
+
+// applyConsensus replaces the status of the local result with the status
+// that the regions agree on. The check is only unhealthy if at least
+// 'Quorum' regions report it as unhealthy.
+func (c *Checker) applyConsensus(item *history.Item) {
+	failedRegions := make([]string, 0, len(item.Regions))
+	for region, status := range item.Regions {
+		if status == "unhealthy" {
+			failedRegions = append(failedRegions, region)
+		}
+	}
+	sort.Strings(failedRegions)
+
+	if len(failedRegions) >= c.Quorum {
+		item.Status = "unhealthy"
+		if item.Error == "" {
+			item.Error = fmt.Sprintf("Failed in regions: %s", strings.Join(failedRegions, ", "))
+		}
+	} else if item.Status == "unhealthy" {
+		item.Status = "healthy"
+		item.Error = fmt.Sprintf(
+			"Failed in %d of %d regions (%s), which is below the quorum of %d",
+			len(failedRegions), len(item.Regions), strings.Join(failedRegions, ", "), c.Quorum,
+		)
+	}
+}
+
+func (c *Checker) region() string {
+	if c.Region == "" {
+		return "local"
+	}
+	return c.Region
+}
@@ -0,0 +1,130 @@
+package checker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+)
+
+// RunAsOptions configure the user and group that a check's command (or
+// plugin) runs as. Switching users requires patrol to run as root, or with
+// the CAP_SETUID and CAP_SETGID capabilities.
+type RunAsOptions struct {
+	// Name or ID of the user
+	User string
+
+	// Name or ID of the group, which defaults to the user's primary group.
+	// When it is not set, the command also keeps the user's supplementary
+	// groups.
+	Group string
+}
+
+// runAsCredential is a resolved RunAsOptions.
+type runAsCredential struct {
+	uid, gid uint32
+	groups   []uint32
+	user     *user.User
+}
+
+// Validate checks that the user and group exist.
+func (opts RunAsOptions) Validate() error {
+	if opts.User == "" {
+		return fmt.Errorf("A user is required")
+	}
+	_, err := opts.resolve()
+	return err
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+// resolve looks up the user and group. They are looked up on every run, so
+// that changes to the users of the system do not require a restart.
+func (opts RunAsOptions) resolve() (runAsCredential, error) {
+	u, err := lookupUser(opts.User)
+	if err != nil {
+		return runAsCredential{}, fmt.Errorf("Unknown user '%s': %s", opts.User, err)
+	}
+	cred := runAsCredential{user: u}
+	if cred.uid, err = parseID(u.Uid); err != nil {
+		return runAsCredential{}, fmt.Errorf("User '%s' has a non-numeric ID: %s", opts.User, u.Uid)
+	}
+
+	if opts.Group != "" {
+		g, err := lookupGroup(opts.Group)
+		if err != nil {
+			return runAsCredential{}, fmt.Errorf("Unknown group '%s': %s", opts.Group, err)
+		}
+		if cred.gid, err = parseID(g.Gid); err != nil {
+			return runAsCredential{}, fmt.Errorf("Group '%s' has a non-numeric ID: %s", opts.Group, g.Gid)
+		}
+		return cred, nil
+	}
+
+	if cred.gid, err = parseID(u.Gid); err != nil {
+		return runAsCredential{}, fmt.Errorf("User '%s' has a non-numeric group ID: %s", opts.User, u.Gid)
+	}
+	if groupIDs, err := u.GroupIds(); err == nil {
+		for _, id := range groupIDs {
+			if gid, err := parseID(id); err == nil {
+				cred.groups = append(cred.groups, gid)
+			}
+		}
+	}
+	return cred, nil
+}
+
+// Env returns the environment variables that describe the user, which
+// replace the ones of the user that patrol runs as.
+func (cred runAsCredential) Env() []string {
+	return []string{
+		"USER=" + cred.user.Username,
+		"LOGNAME=" + cred.user.Username,
+		"HOME=" + cred.user.HomeDir,
+	}
+}
+
+// PATH of commands that run as another user, if patrol has none
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// runAs sets the environment of a command to patrol's own, along with the
+// check's environment variables (env), and makes it run as the check's
+// user if it has one. Commands that run as another user do not inherit
+// patrol's environment, which may hold secrets that the user should not
+// see, and only get a PATH and the variables that describe the user.
+func (c *Checker) runAs(cmd *exec.Cmd, env []string) error {
+	if c.RunAs == nil {
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		return nil
+	}
+	cred, err := c.RunAs.resolve()
+	if err != nil {
+		return err
+	}
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = defaultPath
+	}
+	cmd.Env = append(append([]string{"PATH=" + path}, cred.Env()...), env...)
+	return setCredential(cmd, cred)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package checker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCredential makes the command run as the given user and group. Without
+// explicit groups, the supplementary groups of patrol itself are dropped.
+func setCredential(cmd *exec.Cmd, cred runAsCredential) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.uid,
+		Gid:    cred.gid,
+		Groups: cred.groups,
+	}
+	return nil
+}
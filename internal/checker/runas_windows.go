@@ -0,0 +1,10 @@
+package checker
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, cred runAsCredential) error {
+	return fmt.Errorf("Running checks as another user is not supported on Windows")
+}
@@ -0,0 +1,47 @@
+package checker
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// takeSamples runs a metric check until it has 'Samples' values, starting
+// from the given successful sample. The run fails if any of the samples
+// fail.
+func (c *Checker) takeSamples(first history.Item) history.Item {
+	item := first
+	values := make([]float64, 1, c.Samples)
+	values[0] = first.Metric
+	for len(values) < c.Samples {
+		next := c.sample()
+		if next.Status != "healthy" {
+			return next
+		}
+		values = append(values, next.Metric)
+		item.Duration += next.Duration
+	}
+
+	sort.Float64s(values)
+	item.Samples = &history.Samples{
+		Count: len(values),
+		Min:   values[0],
+		P50:   percentile(values, 50),
+		P95:   percentile(values, 95),
+		Max:   values[len(values)-1],
+	}
+	item.Metric = item.Samples.P50
+	item.CreatedAt = time.Now()
+	return item
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(values []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
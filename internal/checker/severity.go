@@ -0,0 +1,49 @@
+package checker
+
+import (
+	"fmt"
+)
+
+// Severity describes how much a failure of a check affects users.
+type Severity string
+
+const (
+	// The service is unusable
+	SeverityCritical Severity = "critical"
+
+	// A significant part of the service is unusable. This is the default.
+	SeverityMajor Severity = "major"
+
+	// The service is usable, but some functionality is impaired
+	SeverityMinor Severity = "minor"
+
+	// Failures are worth knowing about, but do not affect users
+	SeverityInfo Severity = "info"
+)
+
+// ParseSeverity validates a severity. The empty string is accepted, and
+// selects the default severity.
+func ParseSeverity(str string) (Severity, error) {
+	switch Severity(str) {
+	case "":
+		return SeverityMajor, nil
+	case SeverityCritical, SeverityMajor, SeverityMinor, SeverityInfo:
+		return Severity(str), nil
+	default:
+		return "", fmt.Errorf("Unrecognized severity: '%s'", str)
+	}
+}
+
+// Rank orders severities from the most severe (zero) to the least severe.
+func (s Severity) Rank() int {
+	switch s {
+	case SeverityCritical:
+		return 0
+	case SeverityMinor:
+		return 2
+	case SeverityInfo:
+		return 3
+	default:
+		return 1
+	}
+}
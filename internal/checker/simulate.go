@@ -0,0 +1,136 @@
+package checker
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Patterns that simulated results follow
+const (
+	SimulateRandom    = "random"
+	SimulateHealthy   = "healthy"
+	SimulateUnhealthy = "unhealthy"
+	SimulateFlapping  = "flapping"
+	SimulateOutage    = "outage"
+)
+
+// SimulationOptions configure the synthetic results that a check records
+// instead of running, so that the status page and notifications can be
+// tried out without breaking anything.
+type SimulationOptions struct {
+	// How results change over time, which is 'random' by default
+	Pattern string `yaml:",omitempty"`
+
+	// Chance that a result of the 'random' pattern fails, which defaults
+	// to 0.1
+	FailureRate float64 `yaml:"failureRate,omitempty"`
+
+	// The 'outage' pattern fails for 'for' at the start of every 'every',
+	// counted from midnight UTC. Defaults to 10m every 1h.
+	Every time.Duration `yaml:",omitempty"`
+	For   time.Duration `yaml:"for,omitempty"`
+
+	// Range of the values of metric checks, 0 to 100 by default. Values
+	// rise and fall over each hour, with some noise.
+	Min float64 `yaml:",omitempty"`
+	Max float64 `yaml:",omitempty"`
+
+	// Longest time that a run takes, which defaults to 100ms. Runs do not
+	// actually take this long, it is only recorded.
+	Latency time.Duration `yaml:",omitempty"`
+
+	// Error of failed results
+	Error string `yaml:",omitempty"`
+}
+
+// Validate checks the options and fills in their defaults.
+func (opts *SimulationOptions) Validate() error {
+	switch opts.Pattern {
+	case "":
+		opts.Pattern = SimulateRandom
+	case SimulateRandom, SimulateHealthy, SimulateUnhealthy, SimulateFlapping, SimulateOutage:
+	default:
+		return fmt.Errorf("Unrecognized pattern: '%s' (must be random, healthy, unhealthy, flapping or outage)", opts.Pattern)
+	}
+	if opts.FailureRate < 0 || opts.FailureRate > 1 {
+		return fmt.Errorf("failureRate must be between 0 and 1")
+	}
+	if opts.FailureRate == 0 {
+		opts.FailureRate = 0.1
+	}
+	if opts.Every < 0 || opts.For < 0 || opts.Latency < 0 {
+		return fmt.Errorf("Durations cannot be negative")
+	}
+	if opts.Every == 0 {
+		opts.Every = time.Hour
+	}
+	if opts.For == 0 {
+		opts.For = 10 * time.Minute
+	}
+	if opts.For >= opts.Every {
+		return fmt.Errorf("Outages must be shorter than the time between them")
+	}
+	if opts.Min > opts.Max {
+		return fmt.Errorf("min cannot be greater than max")
+	}
+	if opts.Min == 0 && opts.Max == 0 {
+		opts.Max = 100
+	}
+	if opts.Latency == 0 {
+		opts.Latency = 100 * time.Millisecond
+	}
+	if opts.Error == "" {
+		opts.Error = "Simulated failure"
+	}
+	return nil
+}
+
+// failsAt returns whether a simulated result fails at the given time.
+func (opts *SimulationOptions) failsAt(now time.Time, interval time.Duration) bool {
+	switch opts.Pattern {
+	case SimulateHealthy:
+		return false
+	case SimulateUnhealthy:
+		return true
+	case SimulateFlapping:
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		return now.UnixNano()/int64(interval)%2 == 1
+	case SimulateOutage:
+		return now.UnixNano()%int64(opts.Every) < int64(opts.For)
+	}
+	return rand.Float64() < opts.FailureRate
+}
+
+// sampleSimulation records a simulated result at the given time.
+func (c *Checker) sampleSimulation(now time.Time) history.Item {
+	opts := c.Simulation
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+		CreatedAt:  now,
+		Duration:   time.Duration(rand.Int63n(int64(opts.Latency) + 1)),
+		Output:     []byte(fmt.Sprintf("Simulated result (%s)\n", opts.Pattern)),
+	}
+	if opts.failsAt(now, c.Interval) {
+		item.Status = "unhealthy"
+		item.Error = opts.Error
+		return item
+	}
+
+	item.Status = "healthy"
+	if c.Type == "metric" {
+		wave := math.Sin(2 * math.Pi * float64(now.UnixNano()%int64(time.Hour)) / float64(time.Hour))
+		level := 0.5 + 0.4*wave + 0.1*(2*rand.Float64()-1)
+		item.Metric = math.Round((opts.Min+(opts.Max-opts.Min)*level)*100) / 100
+	}
+	return item
+}
@@ -0,0 +1,126 @@
+package checker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+	"github.com/karimsa/patrol/internal/snmp"
+)
+
+// SNMPObject is a value that is fetched from an SNMP agent, along with the
+// thresholds that it must stay within.
+type SNMPObject struct {
+	OID string
+
+	// Bounds for numeric values
+	Bounds `yaml:",inline"`
+
+	// Exact value that the object must have (i.e. an interface's status)
+	Equals *string
+}
+
+func (o SNMPObject) evaluate(v snmp.Variable) error {
+	if o.Equals != nil && v.String() != *o.Equals {
+		return fmt.Errorf("%s is '%s', expected '%s'", o.OID, v, *o.Equals)
+	}
+	if !o.isSet() {
+		return nil
+	}
+
+	n, ok := v.Float()
+	if !ok {
+		return fmt.Errorf("%s is not numeric: '%s'", o.OID, v)
+	}
+	return o.check(o.OID, n)
+}
+
+// SNMPOptions configure checks of network devices over SNMP, which run
+// instead of a command.
+type SNMPOptions struct {
+	snmp.Options `yaml:",inline"`
+
+	// Objects to fetch in a single request. The value of the first object
+	// is recorded by metric checks.
+	Objects []SNMPObject `yaml:"oids"`
+}
+
+// Validate checks the options without contacting the agent.
+func (opts SNMPOptions) Validate() error {
+	if err := opts.Options.Validate(); err != nil {
+		return err
+	}
+	if len(opts.Objects) == 0 {
+		return fmt.Errorf("At least one OID is required")
+	}
+	for _, object := range opts.Objects {
+		if err := snmp.ValidateOID(object.OID); err != nil {
+			return err
+		}
+		if err := object.Bounds.Validate(); err != nil {
+			return fmt.Errorf("%s: %s", object.OID, err)
+		}
+	}
+	return nil
+}
+
+// sampleSNMP fetches all of the check's objects in a single GET request,
+// and fails if any of them is out of its bounds or does not equal its
+// expected value. Metric checks record the first object's value.
+func (c *Checker) sampleSNMP() history.Item {
+	item := history.Item{
+		Group:      c.Group,
+		Name:       c.Name,
+		Type:       c.Type,
+		Dedupe:     c.Dedupe,
+		MetricUnit: c.MetricUnit,
+	}
+
+	oids := make([]string, len(c.SNMP.Objects))
+	for i, object := range c.SNMP.Objects {
+		oids[i] = object.OID
+	}
+
+	start := time.Now()
+	variables, err := snmp.Get(c.SNMP.Options, oids...)
+	item.CreatedAt = time.Now()
+	item.Duration = time.Since(start)
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("SNMP request to %s failed: %s", c.SNMP.Host, err)
+		return item
+	}
+	if len(variables) != len(oids) {
+		item.Status = "unhealthy"
+		item.Error = fmt.Sprintf("Expected %d values from %s, got %d", len(oids), c.SNMP.Host, len(variables))
+		return item
+	}
+
+	var output strings.Builder
+	var failures []string
+	for i, v := range variables {
+		fmt.Fprintf(&output, "%s = %s: %s\n", c.SNMP.Objects[i].OID, v.Type, v)
+		if err := c.SNMP.Objects[i].evaluate(v); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	item.Output = []byte(output.String())
+
+	if c.Type == "metric" {
+		n, ok := variables[0].Float()
+		if !ok {
+			item.Status = "unhealthy"
+			item.Error = fmt.Sprintf("Failed to parse metric from %s: '%s'", oids[0], variables[0])
+			return item
+		}
+		item.Metric = n
+	}
+	if len(failures) > 0 {
+		item.Status = "unhealthy"
+		item.Error = strings.Join(failures, "; ")
+		return item
+	}
+	item.Status = "healthy"
+	return item
+}
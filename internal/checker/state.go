@@ -0,0 +1,66 @@
+package checker
+
+import (
+	"time"
+)
+
+// State describes what a checker is currently doing. It is meant for
+// introspection only - a checker's state changes constantly.
+type State struct {
+	Group   string
+	Name    string
+	Paused  bool
+	Private bool
+
+	// Set while the check waits for a slot of the pool
+	Queued bool
+
+	// Set while the check's command is being executed. Attempt is the
+	// number of the current attempt, which is larger than 1 while the
+	// check is being retried.
+	Running      bool
+	RunStartedAt time.Time
+	Attempt      int
+
+	// Outcome of the most recent run, where runs that were skipped because
+	// the pool was saturated have the status 'skipped'
+	LastRunAt    time.Time
+	LastDuration time.Duration
+	LastStatus   string
+
+	// Zero value while the checker is running, paused or stopped
+	NextRunAt time.Time
+
+	// Time at which the check's metric is projected to cross its forecast
+	// threshold. Zero value if it is not projected to cross it.
+	ForecastAt time.Time
+
+	// Number of completed runs, of attempts across all runs (including
+	// retries), of runs that ended unhealthy, and of runs that were skipped
+	Runs, Attempts, Failures, Skipped int
+
+	// Number of results that were handed to the history file but
+	// have not been written yet
+	PendingWrites int
+}
+
+func (c *Checker) GetState() State {
+	c.stateMux.Lock()
+	state := c.state
+	c.stateMux.Unlock()
+
+	state.Group = c.Group
+	state.Name = c.Name
+	state.Paused = c.IsPaused()
+	state.Private = c.Private
+	if state.Paused {
+		state.NextRunAt = time.Time{}
+	}
+	return state
+}
+
+func (c *Checker) updateState(update func(state *State)) {
+	c.stateMux.Lock()
+	update(&c.state)
+	c.stateMux.Unlock()
+}
@@ -0,0 +1,264 @@
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Formats of status pages
+const (
+	// Pages hosted by Atlassian Statuspage (i.e. www.githubstatus.com)
+	statusPageFormatStatuspage = "statuspage"
+
+	// Pages hosted by Status.io (i.e. status.gitlab.com), which are read
+	// through api.status.io
+	statusPageFormatStatusIO = "statusio"
+)
+
+// StatusPageOptions configure checks of the status page of a third-party
+// provider, which report the provider's outages as failures.
+type StatusPageOptions struct {
+	// Base URL of a Statuspage page, or the ID of a Status.io page
+	URL    string
+	PageID string `yaml:"pageId"`
+
+	// Either 'statuspage' or 'statusio', which defaults to 'statuspage'
+	Format string
+
+	// Components of the page to check (i.e. 'Actions'), which default to
+	// the page's overall status
+	Components []string
+}
+
+// Validate checks the options without contacting the status page, and
+// fills in the defaults.
+func (opts *StatusPageOptions) Validate() error {
+	if opts.Format == "" {
+		opts.Format = statusPageFormatStatuspage
+	}
+	switch opts.Format {
+	case statusPageFormatStatuspage:
+		if opts.URL == "" {
+			return fmt.Errorf("A url is required")
+		}
+		if _, err := url.Parse(opts.URL); err != nil {
+			return err
+		}
+	case statusPageFormatStatusIO:
+		if opts.PageID == "" {
+			return fmt.Errorf("A pageId is required")
+		}
+	default:
+		return fmt.Errorf("Unknown format '%s' (must be 'statuspage' or 'statusio')", opts.Format)
+	}
+	return nil
+}
+
+// Endpoint of the Status.io API, which is replaced by tests
+var statusIOURL = "https://api.status.io/1.0/status/"
+
+// statusPageComponent is the status of a component of a status page, in
+// the words of the page.
+type statusPageComponent struct {
+	Name        string
+	Status      string
+	Operational bool
+}
+
+// statusPageIncident is an unresolved incident on a status page.
+type statusPageIncident struct {
+	Name string
+	Link string
+}
+
+type statusPageSummary struct {
+	// Overall status of the page
+	Description string
+	Operational bool
+
+	Components []statusPageComponent
+	Incidents  []statusPageIncident
+}
+
+func (c *Checker) getStatusPage(url string, v interface{}) error {
+	client, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+	res, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("Failed to reach status page: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status page returned status %d", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("Invalid response from status page: %s", err)
+	}
+	return nil
+}
+
+// readStatuspage reads the summary of a page that is hosted by Statuspage.
+func (c *Checker) readStatuspage() (statusPageSummary, error) {
+	var body struct {
+		Status struct {
+			Indicator   string `json:"indicator"`
+			Description string `json:"description"`
+		} `json:"status"`
+		Components []struct {
+			Name   string `json:"name"`
+			Status string `json:"status"`
+		} `json:"components"`
+		Incidents []struct {
+			Name      string `json:"name"`
+			Shortlink string `json:"shortlink"`
+		} `json:"incidents"`
+	}
+	if err := c.getStatusPage(strings.TrimSuffix(c.StatusPage.URL, "/")+"/api/v2/summary.json", &body); err != nil {
+		return statusPageSummary{}, err
+	}
+
+	summary := statusPageSummary{
+		Description: body.Status.Description,
+		Operational: body.Status.Indicator == "none" || body.Status.Indicator == "maintenance",
+	}
+	for _, component := range body.Components {
+		summary.Components = append(summary.Components, statusPageComponent{
+			Name:        component.Name,
+			Status:      strings.ReplaceAll(component.Status, "_", " "),
+			Operational: component.Status == "operational" || component.Status == "under_maintenance",
+		})
+	}
+	for _, incident := range body.Incidents {
+		summary.Incidents = append(summary.Incidents, statusPageIncident{
+			Name: incident.Name,
+			Link: incident.Shortlink,
+		})
+	}
+	return summary, nil
+}
+
+// readStatusIO reads the status of a page that is hosted by Status.io.
+// Status codes below 300 are operational or in planned maintenance.
+func (c *Checker) readStatusIO() (statusPageSummary, error) {
+	var body struct {
+		Result struct {
+			StatusOverall struct {
+				Status     string `json:"status"`
+				StatusCode int    `json:"status_code"`
+			} `json:"status_overall"`
+			Status []struct {
+				Name       string `json:"name"`
+				Status     string `json:"status"`
+				StatusCode int    `json:"status_code"`
+			} `json:"status"`
+			Incidents []struct {
+				Name string `json:"name"`
+			} `json:"incidents"`
+		} `json:"result"`
+	}
+	if err := c.getStatusPage(statusIOURL+url.PathEscape(c.StatusPage.PageID), &body); err != nil {
+		return statusPageSummary{}, err
+	}
+
+	result := body.Result
+	summary := statusPageSummary{
+		Description: result.StatusOverall.Status,
+		Operational: result.StatusOverall.StatusCode < 300,
+	}
+	for _, component := range result.Status {
+		summary.Components = append(summary.Components, statusPageComponent{
+			Name:        component.Name,
+			Status:      strings.ToLower(component.Status),
+			Operational: component.StatusCode < 300,
+		})
+	}
+	for _, incident := range result.Incidents {
+		summary.Incidents = append(summary.Incidents, statusPageIncident{Name: incident.Name})
+	}
+	return summary, nil
+}
+
+// sampleStatusPage reads the summary of a provider's status page, and fails
+// while the provider reports an outage of the selected components (or any
+// outage, if no components are selected). Selected components that are
+// missing from the page fail too, since they are likely misspelled.
+func (c *Checker) sampleStatusPage() history.Item {
+	start := time.Now()
+	var summary statusPageSummary
+	var err error
+	if c.StatusPage.Format == statusPageFormatStatusIO {
+		summary, err = c.readStatusIO()
+	} else {
+		summary, err = c.readStatuspage()
+	}
+	item := history.Item{
+		Group:     c.Group,
+		Name:      c.Name,
+		Type:      c.Type,
+		Dedupe:    c.Dedupe,
+		CreatedAt: time.Now(),
+		Duration:  time.Since(start),
+		Status:    "healthy",
+	}
+	if err != nil {
+		item.Status = "unhealthy"
+		item.Error = err.Error()
+		return item
+	}
+
+	output := strings.Builder{}
+	fmt.Fprintf(&output, "status: %s\n", summary.Description)
+	if len(c.StatusPage.Components) == 0 {
+		if !summary.Operational {
+			item.Status = "unhealthy"
+			item.Error = summary.Description
+		}
+		for _, component := range summary.Components {
+			fmt.Fprintf(&output, "%s: %s\n", component.Name, component.Status)
+		}
+	} else {
+		var outages []string
+		for _, name := range c.StatusPage.Components {
+			found := false
+			for _, component := range summary.Components {
+				if !strings.EqualFold(component.Name, name) {
+					continue
+				}
+				found = true
+				fmt.Fprintf(&output, "%s: %s\n", component.Name, component.Status)
+				if !component.Operational {
+					outages = append(outages, fmt.Sprintf("%s: %s", component.Name, component.Status))
+				}
+			}
+			if !found {
+				outages = append(outages, fmt.Sprintf("%s: not found on status page", name))
+			}
+		}
+		if len(outages) > 0 {
+			item.Status = "unhealthy"
+			item.Error = strings.Join(outages, ", ")
+		}
+	}
+
+	// The first unresolved incident is linked from the check
+	for _, incident := range summary.Incidents {
+		fmt.Fprintf(&output, "incident: %s\n", incident.Name)
+	}
+	if len(summary.Incidents) > 0 {
+		item.Annotations = make(map[string]string)
+		addAnnotation(item.Annotations, "incident", summary.Incidents[0].Name)
+		if summary.Incidents[0].Link != "" {
+			addAnnotation(item.Annotations, "incident.link", summary.Incidents[0].Link)
+		}
+	}
+	item.Output = []byte(output.String())
+	return item
+}
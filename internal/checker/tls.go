@@ -0,0 +1,78 @@
+package checker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions configures how TLS connections are verified and
+// authenticated, for services that use a private PKI.
+type TLSOptions struct {
+	// Path to a PEM bundle of CA certificates that are trusted
+	// instead of the system's certificates
+	CA string `yaml:",omitempty"`
+
+	// Paths to a PEM client certificate and key, for mutual TLS
+	Cert string `yaml:",omitempty"`
+	Key  string `yaml:",omitempty"`
+
+	// Disables verification of the server's certificate
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Env returns the environment variables that describe these options to
+// check commands. SSL_CERT_FILE and CURL_CA_BUNDLE are used by most tools
+// for the CA bundle, while the PATROL_TLS_* variables can be passed to a
+// tool's own flags (i.e. curl's '--cert' and '--key').
+func (opts TLSOptions) Env() []string {
+	var env []string
+	if opts.CA != "" {
+		env = append(env,
+			"SSL_CERT_FILE="+opts.CA,
+			"CURL_CA_BUNDLE="+opts.CA,
+			"PATROL_TLS_CA="+opts.CA,
+		)
+	}
+	if opts.Cert != "" {
+		env = append(env, "PATROL_TLS_CERT="+opts.Cert)
+	}
+	if opts.Key != "" {
+		env = append(env, "PATROL_TLS_KEY="+opts.Key)
+	}
+	if opts.InsecureSkipVerify {
+		env = append(env, "PATROL_TLS_INSECURE=1")
+	}
+	return env
+}
+
+// Config loads the certificates and returns the matching TLS client config.
+func (opts TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CA != "" {
+		pem, err := ioutil.ReadFile(opts.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle: %s", opts.CA)
+		}
+	}
+
+	if opts.Cert != "" || opts.Key != "" {
+		if opts.Cert == "" || opts.Key == "" {
+			return nil, fmt.Errorf("Both 'cert' and 'key' must be specified for client certificates")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,79 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Comment is an update that was posted on an incident by a responder. Like
+// postmortems, incidents are identified by the check that failed and the
+// time at which it started failing.
+type Comment struct {
+	Group      string
+	Name       string
+	IncidentAt time.Time
+	Author     string
+	Body       string
+	CreatedAt  time.Time
+}
+
+func (c Comment) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Comment{"),
+		fmt.Sprintf("\tGroup: %s,", c.Group),
+		fmt.Sprintf("\tName: %s,", c.Name),
+		fmt.Sprintf("\tIncidentAt: %s,", c.IncidentAt),
+		fmt.Sprintf("\tAuthor: %s,", c.Author),
+		fmt.Sprintf("\tBody: (%d chars),", len(c.Body)),
+		fmt.Sprintf("\tCreatedAt: %s,", c.CreatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (c Comment) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		Comment Comment
+	}{c})
+}
+
+// AddComment appends a comment to an incident.
+func (file *File) AddComment(c Comment) (Comment, error) {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	c.CreatedAt = time.Now()
+	n, err := c.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return c, err
+	}
+	container := file.container(c.Group, c.Name)
+	container.comments = append(container.comments, c)
+	file.logger.Debugf("Added comment: %s", c)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return c, nil
+}
+
+// GetComments returns the comments on the incident of a check that started
+// at the given time, with the oldest comment first.
+func (file *File) GetComments(group, checkName string, incidentAt time.Time) []Comment {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	comments := []Comment{}
+	if container, ok := file.data[group][checkName]; ok {
+		for _, c := range container.comments {
+			if c.IncidentAt.Equal(incidentAt) {
+				comments = append(comments, c)
+			}
+		}
+	}
+	return comments
+}
@@ -0,0 +1,144 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statuses of deliveries
+const (
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+	DeliveryRetrying = "retrying"
+	DeliveryPending  = "pending"
+)
+
+// Maximum number of deliveries that are kept once they are sent or have
+// failed. Deliveries that are pending or being retried are always kept.
+const maxDeliveries = 1000
+
+// Delivery is an attempt to send a notification through a notifier. Each
+// update of a delivery replaces its previous state, so that deliveries that
+// are still pending or being retried survive restarts. Deliveries are
+// recorded before they are first sent.
+type Delivery struct {
+	ID       string
+	Notifier string
+
+	// Event that the notification was sent for
+	Event string
+	Group string
+	Name  string
+
+	// Details of the event, which the request is rendered from with the
+	// notifier's current configuration on each attempt. The request itself
+	// is never stored, since it may include secrets.
+	Details json.RawMessage `json:",omitempty"`
+
+	Status        string
+	Attempts      int
+	Error         string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (d Delivery) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Delivery{"),
+		fmt.Sprintf("\tID: %s,", d.ID),
+		fmt.Sprintf("\tNotifier: %s,", d.Notifier),
+		fmt.Sprintf("\tEvent: %s,", d.Event),
+		fmt.Sprintf("\tGroup: %s,", d.Group),
+		fmt.Sprintf("\tName: %s,", d.Name),
+		fmt.Sprintf("\tStatus: %s,", d.Status),
+		fmt.Sprintf("\tAttempts: %d,", d.Attempts),
+		fmt.Sprintf("\tError: %s,", d.Error),
+		fmt.Sprintf("\tNextAttemptAt: %s,", d.NextAttemptAt),
+		fmt.Sprintf("\tUpdatedAt: %s,", d.UpdatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (d Delivery) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		Delivery Delivery
+	}{d})
+}
+
+// addDelivery replaces the previous state of a delivery, and drops the
+// oldest deliveries that are done once there are too many.
+func (file *File) addDelivery(d Delivery) {
+	if file.deliveries == nil {
+		file.deliveries = make(map[string]Delivery)
+	}
+	file.deliveries[d.ID] = d
+	if len(file.deliveries) <= maxDeliveries {
+		return
+	}
+
+	var done []Delivery
+	for _, d := range file.deliveries {
+		if d.Status != DeliveryRetrying && d.Status != DeliveryPending {
+			done = append(done, d)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].CreatedAt.Before(done[j].CreatedAt)
+	})
+	for i := 0; i < len(done) && len(file.deliveries) > maxDeliveries; i++ {
+		delete(file.deliveries, done[i].ID)
+	}
+}
+
+// SetDelivery persists the state of a delivery, replacing its previous
+// state.
+func (file *File) SetDelivery(d Delivery) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	d.UpdatedAt = time.Now()
+	n, err := d.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	file.addDelivery(d)
+	file.logger.Debugf("Updated delivery: %s", d)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return nil
+}
+
+// GetDelivery returns the latest state of a delivery, if it is kept.
+func (file *File) GetDelivery(id string) (Delivery, bool) {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	d, ok := file.deliveries[id]
+	return d, ok
+}
+
+// GetDeliveries returns all deliveries that are kept, with the most recent
+// delivery first.
+func (file *File) GetDeliveries() []Delivery {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	list := make([]Delivery, 0, len(file.deliveries))
+	for _, d := range file.deliveries {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
@@ -0,0 +1,222 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Periods that the results of metric checks are downsampled into
+const (
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// Aggregate summarizes the results of a metric check over an hour or a
+// (UTC) day, which replace the results once they are old enough.
+type Aggregate struct {
+	Period   string
+	Count    int
+	Failures int
+	Min, Max float64
+}
+
+// periodLength returns the length of a period, or zero for results that
+// are not aggregated.
+func periodLength(period string) time.Duration {
+	switch period {
+	case PeriodHour:
+		return time.Hour
+	case PeriodDay:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+func (item Item) period() string {
+	if item.Aggregate == nil {
+		return ""
+	}
+	return item.Aggregate.Period
+}
+
+// Results returns the number of results that an item stands for, and how
+// many of them failed. Aggregates stand for all the results of their
+// period, and deduplicated items for all of their identical results.
+func (item Item) Results() (count, failures int) {
+	if item.Aggregate != nil {
+		return item.Aggregate.Count, item.Aggregate.Failures
+	}
+	if !item.isUp() {
+		return item.count(), item.count()
+	}
+	return item.count(), 0
+}
+
+// targetPeriod returns the period that an item should be aggregated into
+// under the given retention, or the empty string if it should be kept as
+// is. Only periods that have ended before the retention's threshold are
+// aggregated, so that aggregates do not miss results of their period.
+func (r Retention) targetPeriod(createdAt, now time.Time) string {
+	if r.DailyAfter > 0 && !createdAt.Truncate(24*time.Hour).Add(24*time.Hour).After(now.Add(-r.DailyAfter)) {
+		return PeriodDay
+	}
+	if r.HourlyAfter > 0 && !createdAt.Truncate(time.Hour).Add(time.Hour).After(now.Add(-r.HourlyAfter)) {
+		return PeriodHour
+	}
+	return ""
+}
+
+// merge adds an item, which is either a result or a finer aggregate, into
+// an aggregate item. The aggregate's metric is the average of its results.
+func (agg *Item) merge(item Item) {
+	count, failures, min, max := 1, 0, item.Metric, item.Metric
+	if item.Aggregate != nil {
+		count, failures, min, max = item.Aggregate.Count, item.Aggregate.Failures, item.Aggregate.Min, item.Aggregate.Max
+	} else if !item.isUp() {
+		failures = 1
+	}
+	if count == 0 {
+		return
+	}
+
+	a := agg.Aggregate
+	if a.Count == 0 || min < a.Min {
+		a.Min = min
+	}
+	if a.Count == 0 || max > a.Max {
+		a.Max = max
+	}
+	agg.Metric = (agg.Metric*float64(a.Count) + item.Metric*float64(count)) / float64(a.Count+count)
+	a.Count += count
+	a.Failures += failures
+	if item.MetricUnit != "" {
+		agg.MetricUnit = item.MetricUnit
+	}
+
+	agg.Status = "healthy"
+	agg.Error = ""
+	if a.Failures > 0 {
+		agg.Status = "unhealthy"
+		agg.Error = fmt.Sprintf("%d of %d results failed", a.Failures, a.Count)
+	}
+}
+
+// remove unlinks a node from the container.
+func (container *dataContainer) remove(node *listNode) {
+	if node.prev == nil {
+		container.head = node.next
+	} else {
+		node.prev.next = node.next
+	}
+	if node.next == nil {
+		container.tail = node.prev
+	} else {
+		node.next.prev = node.prev
+	}
+	node.prev = nil
+	node.next = nil
+	delete(container.byID, node.value.ID)
+}
+
+// removeAggregated drops the items that an aggregate item replaces, which
+// are the results and finer aggregates of the aggregate's period. Items
+// are only dropped when an aggregate is written, so this only has an
+// effect while reading back a history file that has not been compacted
+// since the aggregate was written.
+func (container *dataContainer) removeAggregated(agg Item) {
+	end := agg.CreatedAt.Add(periodLength(agg.period()))
+	for curr := container.head; curr != nil; {
+		next := curr.next
+		item := curr.value
+		if item.ID != agg.ID && !item.CreatedAt.Before(agg.CreatedAt) && item.CreatedAt.Before(end) && periodLength(item.period()) < periodLength(agg.period()) {
+			container.remove(curr)
+		}
+		curr = next
+	}
+}
+
+// downsample replaces the results of a metric check that are older than
+// its retention's thresholds with hourly or daily aggregates. The new
+// aggregates are written to out.
+func (file *File) downsample(container *dataContainer, out io.Writer) error {
+	retention := container.retention
+	if retention.HourlyAfter <= 0 && retention.DailyAfter <= 0 {
+		return nil
+	}
+
+	// Items are ordered by CreatedAt, so the oldest items are aggregated
+	// first and the first item to keep ends the search
+	now := time.Now()
+	aggregates := make(map[string]*Item)
+	var replaced []*listNode
+	for curr := container.tail; curr != nil; curr = curr.prev {
+		period := retention.targetPeriod(curr.value.CreatedAt, now)
+		if period == "" {
+			break
+		}
+		item := file.nodeValue(curr)
+		if item.Type != "metric" || periodLength(period) <= periodLength(item.period()) {
+			continue
+		}
+
+		start := item.CreatedAt.UTC().Truncate(periodLength(period))
+		id := fmt.Sprintf("%s|%s|%d|%s", item.Group, item.Name, start.UnixNano(), period)
+		agg, ok := aggregates[id]
+		if !ok {
+			agg = &Item{
+				ID:        id,
+				Group:     item.Group,
+				Name:      item.Name,
+				Type:      item.Type,
+				CreatedAt: start,
+				Aggregate: &Aggregate{Period: period},
+			}
+			if existing, ok := container.byID[id]; ok {
+				agg.merge(file.nodeValue(existing))
+			}
+			aggregates[id] = agg
+		}
+		agg.merge(item)
+		replaced = append(replaced, curr)
+	}
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	for _, node := range replaced {
+		container.remove(node)
+	}
+	ids := make([]string, 0, len(aggregates))
+	for id := range aggregates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		agg := *aggregates[id]
+		file.logger.Debugf("Downsampling into %s aggregate: %s", agg.Aggregate.Period, agg)
+		offset := file.writeOffset
+		n, err := agg.writeTo(out)
+		file.writeOffset += int64(n)
+		if err != nil {
+			return err
+		}
+
+		node, exists := container.byID[id]
+		if !exists {
+			node = &listNode{}
+			container.byID[id] = node
+		}
+		node.value = agg
+		node.offset = offset
+		node.size = n
+		node.paged = false
+		if !exists {
+			container.insert(node)
+		}
+	}
+	return nil
+}
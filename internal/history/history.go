@@ -3,10 +3,14 @@ package history
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,18 +19,119 @@ import (
 	"github.com/karimsa/patrol/internal/logger"
 )
 
+// Dedupe controls which results of a check are kept as separate items
+// in the history.
+type Dedupe string
+
+const (
+	// Keep only the latest result of each (UTC) day. This is the
+	// default for boolean checks.
+	DedupeLatestPerDay Dedupe = "latest-per-day"
+
+	// Keep only the latest result of each streak of results with the
+	// same health, so that every status change starts a new item.
+	DedupeLatestPerStreak Dedupe = "latest-per-streak"
+
+	// Keep every result as a separate item. This is the default for
+	// metric checks.
+	DedupeEveryRun Dedupe = "every-run"
+
+	// Collapse consecutive results with the same status and output into a
+	// single item, which counts the results and when the latest of them
+	// was seen.
+	DedupeIdentical Dedupe = "identical"
+)
+
+// ParseDedupe validates a dedupe mode. The empty string is accepted,
+// and selects the default mode for the type of check.
+func ParseDedupe(str string) (Dedupe, error) {
+	switch Dedupe(str) {
+	case "", DedupeLatestPerDay, DedupeLatestPerStreak, DedupeEveryRun, DedupeIdentical:
+		return Dedupe(str), nil
+	default:
+		return "", fmt.Errorf("Unrecognized dedupe mode: '%s'", str)
+	}
+}
+
 type Item struct {
-	ID         string
-	Group      string
-	Name       string
-	Type       string
-	Output     []byte
-	CreatedAt  time.Time
+	ID        string
+	Group     string
+	Name      string
+	Type      string
+	Dedupe    Dedupe
+	Output    []byte
+	CreatedAt time.Time
+
+	// Measured with the monotonic clock, so that it is not affected by
+	// changes to the wall clock
 	Duration   time.Duration
 	Metric     float64
 	MetricUnit string
 	Status     string
 	Error      string
+
+	// Set for metric checks that take multiple samples per run, in which
+	// case Metric is the median of the samples
+	Samples *Samples `json:",omitempty"`
+
+	// Region that the check was run from, and the status and duration of
+	// the check in each region, for checks that are run from multiple
+	// regions
+	Region        string                   `json:",omitempty"`
+	Regions       map[string]string        `json:",omitempty"`
+	RegionLatency map[string]time.Duration `json:",omitempty"`
+
+	// Status of the check over each address family, for checks that
+	// verify IPv4 and IPv6 separately
+	AddressFamilies map[string]string `json:",omitempty"`
+
+	// Hash of the content of content checks, and whether it differs from
+	// the hash in the check's previous result
+	ContentHash    string `json:",omitempty"`
+	ContentChanged bool   `json:",omitempty"`
+
+	// Set for healthy metric results that are far outside of the check's
+	// recent results (see checker.AnomalyOptions), to how far they are.
+	// Anomalies do not change the status of a result, so they neither
+	// open nor resolve incidents.
+	Anomaly string `json:",omitempty"`
+
+	// Reason that an unhealthy item failed, if the check did not fail by
+	// itself (i.e. FailureResourceLimit)
+	Failure string `json:",omitempty"`
+
+	// Metadata that the check's command attached to the result (i.e. the
+	// version that is deployed), from its '::patrol::key=value' lines
+	Annotations map[string]string `json:",omitempty"`
+
+	// Set for items that replace the results of a metric check over an hour
+	// or a day, in which case Metric is the average of the results
+	Aggregate *Aggregate `json:",omitempty"`
+
+	// Set for items that stand for multiple identical results (see
+	// DedupeIdentical), in which case CreatedAt is when the first of them
+	// was seen. OutputHash identifies the status and output of the
+	// results, which is kept when the output is paged out.
+	Count      int        `json:",omitempty"`
+	LastSeen   *time.Time `json:",omitempty"`
+	OutputHash string     `json:",omitempty"`
+
+	// Set for items that were written while the clock was behind the
+	// latest result of the check (i.e. after an NTP step), in which case
+	// CreatedAt was moved forward by this much to keep results in the
+	// order they were recorded
+	ClockSkew time.Duration `json:",omitempty"`
+}
+
+// Failure of results whose command exceeded one of the check's resource
+// limits
+const FailureResourceLimit = "resource-limit"
+
+// Samples summarizes the values of a metric check that was run multiple
+// times in a single run.
+type Samples struct {
+	Count              int
+	Min, P50, P95, Max float64
 }
 
 func (item Item) String() string {
@@ -40,50 +145,149 @@ func (item Item) String() string {
 		fmt.Sprintf("\tGroup: %s,", item.Group),
 		fmt.Sprintf("\tName: %s,", item.Name),
 		fmt.Sprintf("\tType: %s,", item.Type),
+		fmt.Sprintf("\tDedupe: %s,", item.dedupe()),
 		fmt.Sprintf("\tOutput: %s,", output),
 		fmt.Sprintf("\tCreatedAt: %s,", item.CreatedAt),
 		fmt.Sprintf("\tDuration: %s,", item.Duration),
 		fmt.Sprintf("\tMetric: %.2f %s,", item.Metric, item.MetricUnit),
 		fmt.Sprintf("\tStatus: %s,", item.Status),
 		fmt.Sprintf("\tError: '%s',", item.Error),
+		fmt.Sprintf("\tCount: %d,", item.count()),
 		fmt.Sprintf("}"),
 	}, "\n")
 }
 
-func (item Item) writeTo(out io.Writer) error {
-	data, err := json.Marshal(item)
-	if err != nil {
-		return err
+// count returns the number of results that an item stands for.
+func (item Item) count() int {
+	if item.Count > 0 {
+		return item.Count
 	}
-	n, err := out.Write(append(data, '\n'))
-	if n < len(data) && n > 0 {
-		// TODO: How to recover from this?
-		panic(fmt.Errorf("Wrote partial data (error: %s)", err))
+	return 1
+}
+
+// SeenAt returns when the latest result that an item stands for was
+// recorded.
+func (item Item) SeenAt() time.Time {
+	if item.LastSeen != nil {
+		return *item.LastSeen
 	}
-	if err != nil {
-		return err
+	return item.CreatedAt
+}
+
+// outputHash identifies the status, output and error of an item.
+func (item Item) outputHash() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t\x00%g\x00%s\x00%d\x00", item.isUp(), item.Metric, item.Error, len(item.Output))
+	hash.Write(item.Output)
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+func (item Item) dedupe() Dedupe {
+	if item.Dedupe != "" {
+		return item.Dedupe
 	}
-	if n == 0 {
-		return fmt.Errorf("Failed to write data out to file")
+	if item.Type == "boolean" {
+		return DedupeLatestPerDay
 	}
-	return nil
+	return DedupeEveryRun
 }
 
-func sendError(receivers []*writeRequest, err error) {
+// isUp returns true if the item represents a passing check.
+func (item Item) isUp() bool {
+	return item.Status == "healthy" || item.Status == "recovered"
+}
+
+func (item Item) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, item)
+}
+
+func (file *File) sendResults(receivers []*writeRequest) {
 	for _, recv := range receivers {
-		recv.errChan <- err
+		if recv.done != nil {
+			recv.done <- true
+		}
+	}
+	file.callbacks.push(receivers)
+}
+
+// callbackQueue runs the callbacks of write requests on a goroutine of its
+// own, in the order in which the requests were written, so that slow
+// callbacks do not hold up the writer.
+type callbackQueue struct {
+	mux     sync.Mutex
+	ready   *sync.Cond
+	pending []*writeRequest
+	closed  bool
+}
+
+func newCallbackQueue() *callbackQueue {
+	queue := &callbackQueue{}
+	queue.ready = sync.NewCond(&queue.mux)
+	return queue
+}
+
+func (queue *callbackQueue) push(requests []*writeRequest) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	for _, req := range requests {
+		if req.callback != nil {
+			queue.pending = append(queue.pending, req)
+		}
+	}
+	queue.ready.Signal()
+}
+
+// close stops the queue once the callbacks that were already queued have
+// run.
+func (queue *callbackQueue) close() {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	queue.closed = true
+	queue.ready.Signal()
+}
+
+func (queue *callbackQueue) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		queue.mux.Lock()
+		for len(queue.pending) == 0 && !queue.closed {
+			queue.ready.Wait()
+		}
+		requests := queue.pending
+		queue.pending = nil
+		queue.mux.Unlock()
+
+		if len(requests) == 0 {
+			return
+		}
+		for _, req := range requests {
+			req.callback(req.items, req.errs)
+		}
 	}
 }
 
+// writeRequest is a batch of items that are written together. Each item
+// succeeds or fails on its own, so 'errs' holds one outcome per item.
 type writeRequest struct {
-	item    Item
-	errChan chan error
+	items    []Item
+	errs     []error
+	done     chan bool
+	callback func([]Item, []error)
 }
 
 type listNode struct {
 	value Item
 	next  *listNode
 	prev  *listNode
+
+	// Location of the item's record in the history file
+	offset int64
+	size   int
+
+	// Set when the item has been dropped from memory, except for the
+	// fields that are kept by pageOutNode, and must be read back from the
+	// history file
+	paged bool
 }
 
 func (ln *listNode) String() string {
@@ -91,9 +295,68 @@ func (ln *listNode) String() string {
 }
 
 type dataContainer struct {
-	byID map[string]*listNode
-	head *listNode
-	tail *listNode
+	byID        map[string]*listNode
+	head        *listNode
+	tail        *listNode
+	transitions []Transition
+	retention   Retention
+	state       CheckState
+
+	// Postmortems by the UnixNano() of the incident's start
+	postmortems map[int64]Postmortem
+
+	// Comments on all incidents, in the order they were posted
+	comments []Comment
+
+	notificationState NotificationState
+}
+
+// Retention limits the items that are kept for a single check. The zero
+// value applies the history file's MaxEntries.
+type Retention struct {
+	// Maximum number of items to keep. If this is zero and MaxAge is
+	// set, items are only limited by age.
+	MaxEntries int
+
+	// Maximum age of the items to keep. Zero value indicates that items
+	// are never dropped because of their age.
+	MaxAge time.Duration
+
+	// Age after which the results of metric checks are replaced by hourly
+	// and daily aggregates. Zero value indicates that results are never
+	// aggregated into the period.
+	HourlyAfter time.Duration
+	DailyAfter  time.Duration
+}
+
+// newID returns the ID that a new item should be stored under. Items that
+// share an ID with an existing item replace it, as per the item's dedupe
+// mode. Otherwise, IDs are unique within the container.
+func (container *dataContainer) newID(item Item) string {
+	switch item.dedupe() {
+	case DedupeLatestPerDay:
+		return fmt.Sprintf("%s|%s|%d|0", item.Group, item.Name, item.CreatedAt.UTC().UnixNano()/int64(24*time.Hour))
+
+	case DedupeLatestPerStreak:
+		if latest := container.head; latest != nil && latest.value.isUp() == item.isUp() && !item.CreatedAt.Before(latest.value.CreatedAt) {
+			return latest.value.ID
+		}
+
+	case DedupeIdentical:
+		if latest := container.head; latest != nil && latest.value.OutputHash == item.OutputHash && !item.CreatedAt.Before(latest.value.SeenAt()) {
+			return latest.value.ID
+		}
+	}
+
+	n := int64(0)
+	prefix := fmt.Sprintf("%s|%s|%d|", item.Group, item.Name, item.CreatedAt.UTC().UnixNano())
+	for {
+		id := prefix + strconv.FormatInt(n, 10)
+		if _, exists := container.byID[id]; !exists {
+			return id
+		}
+		n++
+	}
 }
 
 func (container *dataContainer) MarshalJSON() ([]byte, error) {
@@ -129,17 +392,117 @@ func (o CompactOptions) String() string {
 	}, "\n")
 }
 
+// Durability controls when writes to the history file are flushed
+// to disk.
+type Durability string
+
+const (
+	// Flush the file after every write. This is the default.
+	DurabilityFsyncAlways Durability = "fsync-always"
+
+	// Flush the file on a fixed interval. Writes made since the
+	// last flush may be lost on a crash.
+	DurabilityFsyncInterval Durability = "fsync-interval"
+
+	// Never flush explicitly, leaving it up to the OS. Flushes
+	// still occur on compaction and when the file is closed.
+	DurabilityOSCache Durability = "os-cache"
+)
+
+// ParseDurability validates a durability mode. The empty string is
+// accepted as the default mode.
+func ParseDurability(str string) (Durability, error) {
+	switch Durability(str) {
+	case "":
+		return DurabilityFsyncAlways, nil
+	case DurabilityFsyncAlways, DurabilityFsyncInterval, DurabilityOSCache:
+		return Durability(str), nil
+	default:
+		return "", fmt.Errorf("Unrecognized durability mode: '%s'", str)
+	}
+}
+
+// Upper bounds of the buckets of WriteStats.Latency. The last bucket
+// counts all batches that took longer than the last bound.
+var LatencyBuckets = [numLatencyBuckets - 1]time.Duration{
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+const numLatencyBuckets = 8
+
+// WriteStats describes the work done by the writer of a history file
+// since it was opened.
+type WriteStats struct {
+	// Number of batches written, and the number of items that were
+	// written successfully or failed across all batches.
+	Batches, Items, Errors int
+
+	// Number of items in the most recent and in the largest batch.
+	LastBatchSize, MaxBatchSize int
+
+	// Number of write requests waiting to be picked up by the writer.
+	Pending int
+
+	// Number of items that were written while the clock was behind the
+	// latest result of their check (see Item.ClockSkew).
+	ClockSkews int
+
+	// Histogram of the time taken to write and flush each batch, using
+	// the bounds in LatencyBuckets.
+	Latency [numLatencyBuckets]int
+}
+
+func (stats *WriteStats) observeLatency(latency time.Duration) {
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			stats.Latency[i]++
+			return
+		}
+	}
+	stats.Latency[len(LatencyBuckets)]++
+}
+
+type subscription struct {
+	group string
+	items chan Item
+}
+
 type File struct {
 	fd             *os.File
 	writes         chan *writeRequest
 	writerWg       *sync.WaitGroup
+	callbacks      *callbackQueue
 	done           chan bool
+	closeOnce      *sync.Once
+	closeErr       error
 	data           map[string]map[string]*dataContainer
 	validGroups    map[string]map[string]bool
 	rwMux          *sync.RWMutex
+	subMux         *sync.Mutex
+	subscribers    map[*subscription]bool
 	maxEntries     int
+	retention      map[string]map[string]Retention
+	maxInMemory    int
+	maxTransitions int
+	writeOffset    int64
 	compactOptions CompactOptions
+	durability     Durability
+	fsyncInterval  time.Duration
+	dirty          bool
+	stats          WriteStats
 	logger         logger.Logger
+
+	// Deliveries of notifications by ID
+	deliveries map[string]Delivery
+
+	// Silences by ID
+	silences map[string]Silence
 }
 
 type NewOptions struct {
@@ -149,6 +512,26 @@ type NewOptions struct {
 	Compact             CompactOptions
 	Groups              map[string]map[string]bool
 	LogLevel            logger.LogLevel
+
+	// Durability mode for writes. Zero value is 'fsync-always'.
+	Durability Durability
+
+	// Flush interval used by the 'fsync-interval' durability mode.
+	// Zero value indicates an interval of 1 second.
+	FsyncInterval time.Duration
+
+	// Maximum number of items per check that are kept entirely in
+	// memory. Older items are read back from the history file when
+	// they are requested. Zero value keeps all items in memory.
+	MaxItemsInMemory int
+
+	// Per-check retention, keyed by group and check name. Checks that
+	// are not listed are limited by MaxEntries.
+	Retention map[string]map[string]Retention
+
+	// Maximum number of status transitions to keep for each check.
+	// Zero value indicates a maximum of 1000 transitions.
+	MaxTransitions int
 }
 
 func New(options NewOptions) (*File, error) {
@@ -170,42 +553,93 @@ func New(options NewOptions) (*File, error) {
 	if options.Compact.MaxWrites == 0 {
 		options.Compact.MaxWrites = 100
 	}
+	if options.Durability == "" {
+		options.Durability = DurabilityFsyncAlways
+	}
+	if options.MaxTransitions == 0 {
+		options.MaxTransitions = 1000
+	}
+	if options.FsyncInterval == 0 {
+		options.FsyncInterval = 1 * time.Second
+	}
 
 	file := &File{
 		fd:             fd,
 		writes:         make(chan *writeRequest, options.MaxConcurrentWrites),
 		writerWg:       &sync.WaitGroup{},
+		callbacks:      newCallbackQueue(),
 		done:           make(chan bool),
+		closeOnce:      &sync.Once{},
 		data:           map[string]map[string]*dataContainer{},
 		validGroups:    options.Groups,
 		rwMux:          &sync.RWMutex{},
+		subMux:         &sync.Mutex{},
+		subscribers:    make(map[*subscription]bool),
 		maxEntries:     options.MaxEntries,
+		retention:      options.Retention,
+		maxInMemory:    options.MaxItemsInMemory,
+		maxTransitions: options.MaxTransitions,
 		compactOptions: options.Compact,
+		durability:     options.Durability,
+		fsyncInterval:  options.FsyncInterval,
 	}
 	if file.validGroups == nil {
 		file.validGroups = make(map[string]map[string]bool)
 	}
+	if file.retention == nil {
+		file.retention = make(map[string]map[string]Retention)
+	}
 	file.SetLogLevel(options.LogLevel)
 	file.logger.Debugf("Opened history file: %s", options.File)
 
 	bufferedReader := bufio.NewReader(fd)
-	var item Item
 	var line []byte
 	var lineNumber int
 	for err != io.EOF {
 		lineNumber++
 		line, err = bufferedReader.ReadBytes('\n')
+		file.writeOffset += int64(len(line))
 		if len(line) > 0 {
-			if err := json.Unmarshal(line[:len(line)-1], &item); err != nil {
+			// Records must not share buffers, since the decoder may reuse
+			// the previous item's Output slice
+			var rec record
+			if err := json.Unmarshal(line[:len(line)-1], &rec); err != nil {
 				fmt.Fprintf(os.Stderr, "warning: skipping line %d of history file: %s\n", lineNumber, err)
+			} else if rec.Transition != nil {
+				file.addTransition(*rec.Transition, nil)
+			} else if rec.State != nil {
+				file.container(rec.State.Group, rec.State.Name).state = *rec.State
+			} else if rec.NotificationState != nil {
+				file.container(rec.NotificationState.Group, rec.NotificationState.Name).notificationState = *rec.NotificationState
+			} else if rec.Postmortem != nil {
+				file.container(rec.Postmortem.Group, rec.Postmortem.Name).addPostmortem(*rec.Postmortem)
+			} else if rec.Comment != nil {
+				container := file.container(rec.Comment.Group, rec.Comment.Name)
+				container.comments = append(container.comments, *rec.Comment)
+			} else if rec.Delivery != nil {
+				file.addDelivery(*rec.Delivery)
+			} else if rec.Silence != nil {
+				file.addSilence(*rec.Silence)
 			} else {
-				file.addItem(item, nil)
+				file.addItem(rec.Item, nil, file.writeOffset-int64(len(line)), len(line))
 			}
 		}
 	}
 
-	file.writerWg.Add(1)
+	// Results may have aged past their retention's thresholds while the
+	// history file was closed
+	for _, group := range file.data {
+		for _, container := range group {
+			if err := file.downsample(container, fd); err != nil {
+				fd.Close()
+				return nil, err
+			}
+		}
+	}
+
+	file.writerWg.Add(2)
 	go file.bgWriter()
+	go file.callbacks.run(file.writerWg)
 	return file, nil
 }
 
@@ -245,33 +679,83 @@ func (file *File) String() string {
 		fmt.Sprintf("\tValidGroups: %s,", vgDataStr),
 		fmt.Sprintf("\tData: %s,", dataStr),
 		fmt.Sprintf("\tCompact: %s,", strings.Join(cs, "\n")),
+		fmt.Sprintf("\tWrites: %#v,", file.stats),
 		fmt.Sprintf("}"),
 	}, "\n")
 }
 
 func (file *File) doCompact() (numItems int, err error) {
 	writeBuffer := &bytes.Buffer{}
-	for _, group := range file.data {
-		for _, container := range group {
+	offsets := make(map[*listNode]int64, len(file.data))
+	var invalid [][2]string
+	for groupName, group := range file.data {
+		for checkName, container := range group {
+			if _, ok := file.validGroups[groupName][checkName]; !ok {
+				file.logger.Debugf("Skipping writes of invalid checker: %s/%s", groupName, checkName)
+				invalid = append(invalid, [2]string{groupName, checkName})
+				continue
+			}
+
 			for curr := container.head; curr != nil; curr = curr.next {
-				item := curr.value
-				if checkerNames, ok := file.validGroups[item.Group]; ok {
-					if _, ok := checkerNames[item.Name]; ok {
-						err = curr.value.writeTo(writeBuffer)
-						if err != nil {
-							return
-						}
-						numItems += 1
-					} else {
-						file.logger.Debugf("Skipping item write (invalid checker): %s", item)
-					}
-				} else {
-					file.logger.Debugf("Skipping item write (invalid group): %s", item)
+				offsets[curr] = int64(writeBuffer.Len())
+				_, err = file.nodeValue(curr).writeTo(writeBuffer)
+				if err != nil {
+					return
+				}
+				numItems += 1
+			}
+
+			for _, t := range container.transitions {
+				_, err = t.writeTo(writeBuffer)
+				if err != nil {
+					return
+				}
+			}
+			if state := container.state; !state.UpdatedAt.IsZero() {
+				_, err = state.writeTo(writeBuffer)
+				if err != nil {
+					return
+				}
+			}
+			if state := container.notificationState; !state.UpdatedAt.IsZero() {
+				_, err = state.writeTo(writeBuffer)
+				if err != nil {
+					return
+				}
+			}
+			for _, pm := range container.postmortems {
+				_, err = pm.writeTo(writeBuffer)
+				if err != nil {
+					return
+				}
+			}
+			for _, c := range container.comments {
+				_, err = c.writeTo(writeBuffer)
+				if err != nil {
+					return
 				}
 			}
 		}
 	}
 
+	for _, d := range file.deliveries {
+		if _, err = d.writeTo(writeBuffer); err != nil {
+			return
+		}
+	}
+
+	// Silences that have ended are dropped
+	now := time.Now()
+	for id, s := range file.silences {
+		if !s.EndsAt.After(now) {
+			delete(file.silences, id)
+			continue
+		}
+		if _, err = s.writeTo(writeBuffer); err != nil {
+			return
+		}
+	}
+
 	err = file.fd.Truncate(0)
 	if err != nil {
 		return
@@ -282,10 +766,24 @@ func (file *File) doCompact() (numItems int, err error) {
 		return
 	}
 
+	size := int64(writeBuffer.Len())
 	_, err = io.Copy(file.fd, writeBuffer)
 	if err != nil {
 		return
 	}
+	file.writeOffset = size
+	for node, offset := range offsets {
+		node.offset = offset
+	}
+
+	// Checks that were not written are dropped from memory as well, since
+	// their paged out items can no longer be read back
+	for _, check := range invalid {
+		delete(file.data[check[0]], check[1])
+		if len(file.data[check[0]]) == 0 {
+			delete(file.data, check[0])
+		}
+	}
 
 	err = file.fd.Sync()
 	if err != nil {
@@ -305,8 +803,18 @@ func (file *File) maybeCompact() {
 			file.compactOptions.numWritesSinceCompact = 0
 			file.compactOptions.lastCompactTime = time.Now()
 		}
-	} else if err := file.fd.Sync(); err != nil {
+	} else if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+}
+
+func (file *File) sync() {
+	if err := file.fd.Sync(); err != nil {
 		file.logger.Warnf("Failed to flush data file: %s", err)
+	} else {
+		file.dirty = false
 	}
 }
 
@@ -324,174 +832,539 @@ func (file *File) SetLogLevel(level logger.LogLevel) {
 type checker interface {
 	GetGroup() string
 	GetName() string
+	GetRetention() Retention
 }
 
 func (file *File) AddChecker(c checker) {
-	file.rwMux.RLock()
+	file.rwMux.Lock()
 	checkers, ok := file.validGroups[c.GetGroup()]
 	if !ok {
 		checkers = make(map[string]bool, 1)
 		file.validGroups[c.GetGroup()] = checkers
 	}
 	checkers[c.GetName()] = true
-	file.rwMux.RUnlock()
+
+	if retention := c.GetRetention(); retention != (Retention{}) {
+		if _, ok := file.retention[c.GetGroup()]; !ok {
+			file.retention[c.GetGroup()] = make(map[string]Retention, 1)
+		}
+		file.retention[c.GetGroup()][c.GetName()] = retention
+		if container, ok := file.data[c.GetGroup()][c.GetName()]; ok {
+			container.retention = retention
+		}
+	}
+	file.rwMux.Unlock()
 }
 
+// bgWriter is the only writer of the history file. Pending write requests
+// are collected into a single batch, so that concurrent appends share a
+// single flush, and each batch is sorted by CreatedAt before it is written.
+// Results of Append and AppendAsync are stamped by the writer, and never
+// behind the latest result of their check (see correctClockSkew), so they
+// are persisted in CreatedAt order. Items of AppendBatch keep their own
+// time, so they are only ordered within their batch: items that backfill
+// results from before the latest result are appended after it, and are
+// put in order when the file is read back.
 func (file *File) bgWriter() {
-	var err error
 	defer file.writerWg.Done()
 
+	var syncTicks <-chan time.Time
+	if file.durability == DurabilityFsyncInterval {
+		ticker := time.NewTicker(file.fsyncInterval)
+		defer ticker.Stop()
+		syncTicks = ticker.C
+	}
+
 	for {
 		select {
 		case req := <-file.writes:
+			file.writeRequests(req)
+
+		case <-syncTicks:
 			file.rwMux.Lock()
-			records := make([]*writeRequest, 1)
-			records[0] = req
+			if file.dirty {
+				file.sync()
+			}
+			file.rwMux.Unlock()
 
-			req.item, err = file.addItem(req.item, file.fd)
-			if err != nil {
-				sendError(records, err)
-			} else {
-				file.compactOptions.numWritesSinceCompact++
-				collect := true
-				var err error
-
-				for collect && err != nil {
-					select {
-					case r := <-file.writes:
-						records = append(records, r)
-						r.item, err = file.addItem(r.item, file.fd)
-					default:
-						collect = false
-					}
-				}
+		case <-file.done:
+			file.logger.Debugf("Closing history file")
 
-				if err != nil {
-					sendError(records, err)
-				} else {
-					file.logger.Debugf("Wrote %d records", len(records))
-					file.maybeCompact()
-					file.rwMux.Unlock()
-					sendError(records, nil)
+			// Writes that were queued before the file was closed are
+			// still written
+			for drain := true; drain; {
+				select {
+				case req := <-file.writes:
+					file.writeRequests(req)
+				default:
+					drain = false
 				}
 			}
 
-		case <-file.done:
-			file.logger.Debugf("Closing history file")
+			file.rwMux.Lock()
+			if err := file.fd.Sync(); err != nil {
+				file.closeErr = fmt.Errorf("Failed to flush history file: %s", err)
+			} else {
+				file.dirty = false
+			}
+			if err := file.fd.Close(); err != nil && file.closeErr == nil {
+				file.closeErr = fmt.Errorf("Failed to close history file: %s", err)
+			}
+			file.rwMux.Unlock()
+			file.callbacks.close()
 			return
 		}
 	}
 }
 
-func (file *File) addItem(item Item, out io.Writer) (Item, error) {
-	if _, ok := file.data[item.Group]; !ok {
-		file.data[item.Group] = make(map[string]*dataContainer, 1)
-	}
-	if _, ok := file.data[item.Group][item.Name]; !ok {
-		file.data[item.Group][item.Name] = &dataContainer{
-			byID: make(map[string]*listNode, 100),
+// writeRequests writes a request, along with the requests that are queued
+// behind it, as a single batch.
+func (file *File) writeRequests(req *writeRequest) {
+	file.rwMux.Lock()
+	batchStart := time.Now()
+	records := make([]*writeRequest, 1, cap(file.writes)+1)
+	records[0] = req
+
+	// Bounded by the size of the queue, so a steady stream of writes
+	// cannot hold the lock forever
+	for collect := true; collect && len(records) <= cap(file.writes); {
+		select {
+		case r := <-file.writes:
+			records = append(records, r)
+		default:
+			collect = false
 		}
 	}
-	container := file.data[item.Group][item.Name]
 
-	if item.Type == "boolean" {
-		item.ID = fmt.Sprintf("%s|%s|%d|0", item.Group, item.Name, item.CreatedAt.UTC().UnixNano()/int64(24*time.Hour))
-	} else {
-		n := int64(0)
-		prefix := fmt.Sprintf("%s|%s|%d|", item.Group, item.Name, item.CreatedAt.UTC().UnixNano())
-		for {
-			item.ID = prefix + strconv.FormatInt(n, 10)
-			if _, exists := container.byID[item.ID]; !exists {
-				break
+	numWrites := file.writeBatch(records)
+	file.compactOptions.numWritesSinceCompact += numWrites
+	file.logger.Debugf("Wrote %d records in %d requests", numWrites, len(records))
+	if numWrites > 0 {
+		file.maybeCompact()
+	}
+	file.stats.observeLatency(time.Since(batchStart))
+	file.rwMux.Unlock()
+	file.sendResults(records)
+	file.publish(records)
+}
+
+type batchEntry struct {
+	req *writeRequest
+	idx int
+
+	// Set if the item was stamped with the time at which it was written
+	stamped bool
+}
+
+func (entry batchEntry) createdAt() time.Time {
+	return entry.req.items[entry.idx].CreatedAt
+}
+
+// writeBatch writes all items of the given requests, recording an outcome
+// for each. It returns the number of items that were written successfully.
+func (file *File) writeBatch(records []*writeRequest) int {
+	entries := make([]batchEntry, 0, len(records))
+	for _, req := range records {
+		req.errs = make([]error, len(req.items))
+		for i := range req.items {
+			stamped := req.items[i].CreatedAt.IsZero()
+			if stamped {
+				req.items[i].CreatedAt = time.Now()
 			}
-			n++
+
+			// IDs are only ever assigned by the writer
+			req.items[i].ID = ""
+			entries = append(entries, batchEntry{req: req, idx: i, stamped: stamped})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].createdAt().Before(entries[j].createdAt())
+	})
+
+	numWrites := 0
+	for _, entry := range entries {
+		req := entry.req
+		if entry.stamped {
+			file.correctClockSkew(&req.items[entry.idx])
+		} else if item := req.items[entry.idx]; file.isBehindLatest(item) {
+			file.logger.Infof("Backfilling result of %s/%s at %s, behind its latest result", item.Group, item.Name, item.CreatedAt)
+		}
+		req.items[entry.idx], req.errs[entry.idx] = file.addItem(req.items[entry.idx], file.fd, file.writeOffset, 0)
+		if req.errs[entry.idx] == nil {
+			numWrites++
 		}
 	}
 
+	file.stats.Batches++
+	file.stats.Items += numWrites
+	file.stats.Errors += len(entries) - numWrites
+	file.stats.LastBatchSize = len(entries)
+	if file.stats.MaxBatchSize < len(entries) {
+		file.stats.MaxBatchSize = len(entries)
+	}
+	return numWrites
+}
+
+// correctClockSkew moves an item that was stamped while the clock was
+// behind the latest result of its check (i.e. after an NTP step) to the
+// time of that result. Otherwise, the item would be inserted behind the
+// latest result, and the check's status would not change until the clock
+// caught up. Checkers write through Append and AppendAsync, so their
+// results are always stamped here. Only AppendBatch takes an explicit
+// time, which is inserted as it is since it backfills results.
+func (file *File) correctClockSkew(item *Item) {
+	if !file.isBehindLatest(*item) {
+		return
+	}
+
+	latest := file.container(item.Group, item.Name).head.value.SeenAt()
+	item.ClockSkew = latest.Sub(item.CreatedAt)
+	item.CreatedAt = latest
+	file.stats.ClockSkews++
+	file.logger.Warnf("Clock is %s behind the latest result of %s/%s, recording the result at %s", item.ClockSkew, item.Group, item.Name, latest)
+}
+
+// isBehindLatest returns whether an item was created before the latest
+// result of its check.
+func (file *File) isBehindLatest(item Item) bool {
+	container := file.container(item.Group, item.Name)
+	return container.head != nil && item.CreatedAt.Before(container.head.value.SeenAt())
+}
+
+// addItem inserts an item into memory, and writes it to out if it is
+// non-nil. The item's record is expected to be located at the given
+// offset in the history file - if the item is written out, the size of
+// the record is taken from the write.
+func (file *File) addItem(item Item, out io.Writer, offset int64, size int) (Item, error) {
+	container := file.container(item.Group, item.Name)
+
+	// Items read back from the file keep the ID and status that were
+	// computed when they were first written, since replaying them may
+	// happen in a different order (i.e. after compaction)
+	if item.ID == "" {
+		if item.dedupe() == DedupeIdentical {
+			item.OutputHash = item.outputHash()
+		}
+		item.ID = container.newID(item)
+	}
+
 	node, exists := container.byID[item.ID]
 	if !exists {
 		node = &listNode{}
 		container.byID[item.ID] = node
 	}
 
-	lastValue := node.value
-	if item.Type == "metric" && container.tail != nil {
-		lastValue = container.tail.value
+	// Identical results extend the item of the first of them
+	if exists && out != nil && item.dedupe() == DedupeIdentical {
+		seenAt := item.CreatedAt
+		item.CreatedAt = node.value.CreatedAt
+		item.Count = node.value.count() + 1
+		item.LastSeen = &seenAt
 	}
-	if item.Type == "boolean" && item.Status == "healthy" && (lastValue.Status == "unhealthy" || lastValue.Status == "recovered") {
-		item.Status = "recovered"
+
+	if out != nil && item.Type == "boolean" && item.Status == "healthy" {
+		// Daily items only compare against earlier results of the same
+		// day, while other items compare against the latest result
+		lastValue := node.value
+		if item.dedupe() != DedupeLatestPerDay && container.head != nil {
+			lastValue = container.head.value
+		}
+		if lastValue.Status == "unhealthy" || (lastValue.Status == "recovered" && item.dedupe() != DedupeEveryRun) {
+			item.Status = "recovered"
+		}
 	}
 
 	// Write out first
 	if out != nil {
-		if err := item.writeTo(out); err != nil {
+		n, err := item.writeTo(out)
+		file.writeOffset += int64(n)
+		if err != nil {
 			return item, err
 		}
+		size = n
+
+		if t, ok := container.detectTransition(item); ok {
+			if err := file.addTransition(t, out); err != nil {
+				return item, err
+			}
+		}
 	}
 
 	// Writes to "item" after this will have no effect
 	node.value = item
+	node.offset = offset
+	node.size = size
+	node.paged = false
 
-	if item.Type == "metric" || !exists {
+	if !exists {
 		file.logger.Debugf("Inserting (size = %d): %s", len(container.byID), item)
 
-		if container.head == nil {
-			container.head = node
-			container.tail = node
-		} else {
-			inserted := false
-			var prev *listNode
-
-			for curr := container.head; curr != nil && !inserted; prev, curr = curr, curr.next {
-				if !node.value.CreatedAt.Before(curr.value.CreatedAt) {
-					if prev == nil {
-						node.next = container.head
-						container.head.prev = node
-						container.head = node
-					} else {
-						node.prev = prev
-						node.next = prev.next
-						prev.next = node
-					}
-					inserted = true
-				}
-			}
+		container.insert(node)
+	} else {
+		file.logger.Debugf("Replacing: %s", item)
+	}
+	if item.Aggregate != nil {
+		container.removeAggregated(item)
+	}
+	if out != nil {
+		if err := file.downsample(container, out); err != nil {
+			return item, err
+		}
+	}
+	if !exists {
+		file.trim(container)
+	}
 
-			if !inserted {
-				container.tail.next = node
-				node.prev = container.tail
-				container.tail = node
-			}
+	if file.maxInMemory > 0 {
+		file.pageOut(container, node)
+	}
+	return item, nil
+}
 
-			for len(container.byID) > file.maxEntries {
-				drop := container.tail
-				file.logger.Debugf("Dropping old item: %s", drop.value)
-				container.tail = drop.prev
-				if container.tail == nil {
-					container.head = nil
-				} else {
-					container.tail.next = nil
-				}
-				delete(container.byID, drop.value.ID)
+// insert links a node into the container, keeping the items ordered by
+// CreatedAt with the most recent first.
+func (container *dataContainer) insert(node *listNode) {
+	if container.head == nil {
+		container.head = node
+		container.tail = node
+		return
+	}
+
+	for curr := container.head; curr != nil; curr = curr.next {
+		if !node.value.CreatedAt.Before(curr.value.CreatedAt) {
+			node.prev = curr.prev
+			node.next = curr
+			if curr.prev == nil {
+				container.head = node
+			} else {
+				curr.prev.next = node
 			}
+			curr.prev = node
+			return
 		}
-	} else {
-		file.logger.Debugf("Replacing: %s", item)
 	}
 
-	return item, nil
+	container.tail.next = node
+	node.prev = container.tail
+	container.tail = node
+}
+
+func (file *File) container(group, checkName string) *dataContainer {
+	if _, ok := file.data[group]; !ok {
+		file.data[group] = make(map[string]*dataContainer, 1)
+	}
+	if _, ok := file.data[group][checkName]; !ok {
+		file.data[group][checkName] = &dataContainer{
+			byID:      make(map[string]*listNode, 100),
+			retention: file.retention[group][checkName],
+		}
+	}
+	return file.data[group][checkName]
+}
+
+// trim drops the oldest items of a container that are outside of its
+// retention.
+func (file *File) trim(container *dataContainer) {
+	maxEntries := container.retention.MaxEntries
+	if maxEntries == 0 && container.retention.MaxAge == 0 {
+		maxEntries = file.maxEntries
+	}
+	minCreatedAt := time.Now().Add(-container.retention.MaxAge)
+
+	for drop := container.tail; drop != nil; drop = container.tail {
+		tooMany := maxEntries > 0 && len(container.byID) > maxEntries
+		tooOld := container.retention.MaxAge > 0 && drop.value.SeenAt().Before(minCreatedAt)
+		if !tooMany && !tooOld {
+			return
+		}
+
+		file.logger.Debugf("Dropping old item: %s", drop.value)
+		container.tail = drop.prev
+		if container.tail == nil {
+			container.head = nil
+		} else {
+			container.tail.next = nil
+		}
+		delete(container.byID, drop.value.ID)
+	}
+}
+
+// pageOut drops the payload of items beyond the in-memory limit. Only a
+// single item was added since the last call, so at most two items can
+// have moved past the limit: the item at the limit, and the added item.
+func (file *File) pageOut(container *dataContainer, node *listNode) {
+	idx := 0
+	inMemory := false
+	for curr := container.head; curr != nil && idx <= file.maxInMemory; curr = curr.next {
+		if idx == file.maxInMemory {
+			file.pageOutNode(curr)
+		} else if curr == node {
+			inMemory = true
+		}
+		idx++
+	}
+	if !inMemory {
+		file.pageOutNode(node)
+	}
+}
+
+// pageOutNode drops an item from memory. Only the fields that are needed
+// to order, trim, dedupe and aggregate the check's items without reading
+// them back are kept.
+func (file *File) pageOutNode(node *listNode) {
+	node.value = Item{
+		ID:        node.value.ID,
+		CreatedAt: node.value.CreatedAt,
+		Status:    node.value.Status,
+		Count:     node.value.Count,
+		LastSeen:  node.value.LastSeen,
+		Aggregate: node.value.Aggregate,
+	}
+	node.paged = true
+}
+
+// nodeValue returns the full item stored in a node, reading it back from
+// the history file if it has been paged out. Callers must hold the lock.
+func (file *File) nodeValue(node *listNode) Item {
+	if !node.paged {
+		return node.value
+	}
+
+	buffer := make([]byte, node.size)
+	if _, err := file.fd.ReadAt(buffer, node.offset); err != nil {
+		file.logger.Warnf("Failed to read paged item %s: %s", node.value.ID, err)
+		return node.value
+	}
+	var item Item
+	if err := json.Unmarshal(bytes.TrimSpace(buffer), &item); err != nil {
+		file.logger.Warnf("Failed to decode paged item %s: %s", node.value.ID, err)
+		return node.value
+	}
+
+	// Computed fields are kept from memory, in case the stored
+	// record was written before they were computed
+	item.ID = node.value.ID
+	item.Status = node.value.Status
+	return item
 }
 
+// Append writes an item to the history file and waits for the write. The
+// item is stamped with the time at which it is written, replacing the time
+// it was sampled at, so that results of a check stay in order even if the
+// clock goes backwards (see correctClockSkew).
 func (file *File) Append(item Item) (Item, error) {
-	errChan := make(chan error)
-	item.CreatedAt = time.Now()
+	item.CreatedAt = time.Time{}
+	items := []Item{item}
+	errs := file.AppendBatch(items)
+	return items[0], errs[0]
+}
+
+// AppendBatch writes all given items to the history file as a single
+// write request. Items that have a zero CreatedAt are stamped with the
+// time at which they are written. The returned slice holds the outcome
+// for each item, and the items slice is updated in place with the stored
+// values (i.e. with IDs and computed statuses).
+func (file *File) AppendBatch(items []Item) []error {
 	req := &writeRequest{
-		item:    item,
-		errChan: errChan,
+		items: make([]Item, len(items)),
+		done:  make(chan bool, 1),
 	}
+	copy(req.items, items)
+
 	file.writes <- req
-	err := <-errChan
-	return req.item, err
+	<-req.done
+	copy(items, req.items)
+	return req.errs
+}
+
+// Subscribe returns a channel that receives every item once it has been
+// written to the history file. If group is non-empty, only items belonging
+// to that group are delivered. Subscribers that cannot keep up will miss
+// items rather than block writes. The returned function must be called to
+// release the subscription.
+func (file *File) Subscribe(group string) (<-chan Item, func()) {
+	sub := &subscription{
+		group: group,
+		items: make(chan Item, 100),
+	}
+
+	file.subMux.Lock()
+	file.subscribers[sub] = true
+	file.subMux.Unlock()
+
+	return sub.items, func() {
+		file.subMux.Lock()
+		delete(file.subscribers, sub)
+		file.subMux.Unlock()
+	}
+}
+
+func (file *File) publish(records []*writeRequest) {
+	file.subMux.Lock()
+	defer file.subMux.Unlock()
+
+	for sub := range file.subscribers {
+		for _, r := range records {
+			for i, item := range r.items {
+				if r.errs[i] != nil || (sub.group != "" && sub.group != item.Group) {
+					continue
+				}
+				select {
+				case sub.items <- item:
+				default:
+					file.logger.Debugf("Dropping item for slow subscriber: %s", item)
+				}
+			}
+		}
+	}
+}
+
+// AppendAsync queues an item to be written without waiting for the
+// write to complete. Like Append, the item is stamped by the writer. If
+// callback is non-nil, it is called with the stored item and the write
+// outcome once the write has been processed. Callbacks run in the order
+// in which their items were written, on a goroutine that is separate from
+// the writer, so a slow callback delays the callbacks after it but not
+// other writes. Close waits for queued callbacks to run.
+func (file *File) AppendAsync(item Item, callback func(Item, error)) {
+	item.CreatedAt = time.Time{}
+	req := &writeRequest{
+		items: []Item{item},
+	}
+	if callback != nil {
+		req.callback = func(items []Item, errs []error) {
+			callback(items[0], errs[0])
+		}
+	}
+	file.writes <- req
+}
+
+// Stats returns a snapshot of the writer's statistics.
+func (file *File) Stats() WriteStats {
+	file.rwMux.RLock()
+	stats := file.stats
+	file.rwMux.RUnlock()
+
+	stats.Pending = len(file.writes)
+	return stats
+}
+
+// IsResponsive returns false if the history file could not be read within
+// the timeout, i.e. because a write is stuck.
+func (file *File) IsResponsive(timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		file.rwMux.RLock()
+		file.rwMux.RUnlock()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func (file *File) GetItems(c checker) []Item {
@@ -507,7 +1380,7 @@ func (file *File) GetData() map[string]map[string][]Item {
 		for checkName, container := range group {
 			list := make([]Item, 0, len(container.byID))
 			for curr := container.head; curr != nil; curr = curr.next {
-				list = append(list, curr.value)
+				list = append(list, file.nodeValue(curr))
 			}
 			data[groupName][checkName] = list
 		}
@@ -531,24 +1404,148 @@ func (file *File) GetGroups() []string {
 	return keys
 }
 
+// GetLatestItems returns the most recent item of every check that has any
+// items, by group and check name.
+func (file *File) GetLatestItems() map[string]map[string]Item {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	data := make(map[string]map[string]Item, len(file.data))
+	for groupName, group := range file.data {
+		for checkName, container := range group {
+			if container.head == nil {
+				continue
+			}
+			if _, ok := data[groupName]; !ok {
+				data[groupName] = make(map[string]Item, len(group))
+			}
+			data[groupName][checkName] = file.nodeValue(container.head)
+		}
+	}
+	return data
+}
+
+// GetLatestItem returns the most recent item of a check, if it has any.
+func (file *File) GetLatestItem(group, checkName string) (Item, bool) {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	container, ok := file.data[group][checkName]
+	if !ok || container.head == nil {
+		return Item{}, false
+	}
+	return file.nodeValue(container.head), true
+}
+
+// EachItem calls fn with each item of a check, with the most recent first,
+// until fn returns false. Items are passed without their output and error,
+// which fn gets by calling load. Items that were paged out are read back
+// from the history file as they are passed, so scans should stop as soon
+// as they can. fn runs while the history file is locked, so it must not
+// use the history file.
+func (file *File) EachItem(group, checkName string, fn func(item Item, load func() Item) bool) {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	container := file.data[group][checkName]
+	if container == nil {
+		return
+	}
+	for curr := container.head; curr != nil; curr = curr.next {
+		node := curr
+		item := file.nodeValue(node)
+		item.Output = nil
+		item.Error = ""
+		if !fn(item, func() Item { return file.nodeValue(node) }) {
+			return
+		}
+	}
+}
+
+// Cursor points at an item of a check, to page through its items from the
+// most recent to the oldest. A cursor stays valid once its item is gone
+// (i.e. after it was downsampled), since paging then continues with the
+// items that were created before it.
+type Cursor struct {
+	ID        string
+	CreatedAt time.Time
+}
+
+// GetItemsPage returns up to limit items of a check with the most recent
+// first, starting after the item that the cursor points at, or with the
+// most recent item if the cursor is nil. Only the returned items are read
+// back from the history file. It also returns the cursor of the next page,
+// which is nil once there are no older items.
+func (file *File) GetItemsPage(group, checkName string, after *Cursor, limit int) ([]Item, *Cursor) {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	container := file.data[group][checkName]
+	if container == nil {
+		return []Item{}, nil
+	}
+
+	start := container.head
+	if after != nil {
+		if node, ok := container.byID[after.ID]; ok {
+			start = node.next
+		} else {
+			for start != nil && !start.value.CreatedAt.Before(after.CreatedAt) {
+				start = start.next
+			}
+		}
+	}
+
+	list := make([]Item, 0, limit)
+	curr := start
+	for ; curr != nil && len(list) < limit; curr = curr.next {
+		list = append(list, file.nodeValue(curr))
+	}
+	if curr == nil || len(list) == 0 {
+		return list, nil
+	}
+	last := list[len(list)-1]
+	return list, &Cursor{ID: last.ID, CreatedAt: last.CreatedAt}
+}
+
 func (file *File) GetGroupItems(group, checkName string) []Item {
 	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
 	g, _ := file.data[group]
 	container, _ := g[checkName]
-	file.rwMux.RUnlock()
-
 	if container == nil {
 		return []Item{}
 	}
 
 	list := make([]Item, 0, len(container.byID))
 	for curr := container.head; curr != nil; curr = curr.next {
-		list = append(list, curr.value)
+		list = append(list, file.nodeValue(curr))
 	}
 	return list
 }
 
-func (file *File) Close() {
-	close(file.done)
-	file.writerWg.Wait()
+// Close stops the writer once the writes that were queued before Close
+// was called have been written, and then flushes and closes the history
+// file. It also waits for the callbacks of those writes. It returns an
+// error if the file could not be flushed, in which case recent writes may
+// have been lost, or if ctx is done before the writer has stopped. Writes
+// must not be queued once Close is called. Calling Close again waits for
+// the same outcome.
+func (file *File) Close(ctx context.Context) error {
+	file.closeOnce.Do(func() {
+		close(file.done)
+	})
+
+	stopped := make(chan bool)
+	go func() {
+		file.writerWg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return file.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for history writes: %w", ctx.Err())
+	}
 }
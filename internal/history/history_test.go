@@ -1,9 +1,12 @@
 package history
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -59,7 +62,7 @@ func TestMultiOpen(t *testing.T) {
 			panic(fmt.Errorf("Incorrectly ordered results:\n\n%#v\n\n%#v\n", order, items))
 		}
 
-		history.Close()
+		history.Close(context.Background())
 	}
 
 	// 1st open/create
@@ -139,7 +142,7 @@ func TestUpserts(t *testing.T) {
 		return
 	}
 
-	history.Close()
+	history.Close(context.Background())
 }
 
 func TestAutoCompact(t *testing.T) {
@@ -201,7 +204,7 @@ func TestAutoCompact(t *testing.T) {
 		return
 	}
 
-	history.Close()
+	history.Close(context.Background())
 
 	// With compaction options
 	history, err = New(
@@ -230,7 +233,7 @@ func TestAutoCompact(t *testing.T) {
 			return
 		}
 	}
-	history.Close()
+	history.Close(context.Background())
 	if data, err := ioutil.ReadFile(dbFile); err != nil {
 		t.Error(err)
 		return
@@ -239,3 +242,1138 @@ func TestAutoCompact(t *testing.T) {
 		return
 	}
 }
+
+func TestAppendBatch(t *testing.T) {
+	dbFile := "./history-test-batch.db"
+	os.Remove(dbFile)
+	history, err := New(
+		NewOptions{
+			File: dbFile,
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+
+	start := time.Now().Add(-1 * time.Hour)
+	items := make([]Item, 10)
+	for i := range items {
+		items[i] = Item{
+			Group:     "staging",
+			Name:      "Latency",
+			Type:      "metric",
+			Metric:    float64(i),
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		}
+	}
+
+	errs := history.AppendBatch(items)
+	if len(errs) != len(items) {
+		t.Error(fmt.Errorf("Expected %d results, got %d", len(items), len(errs)))
+		return
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Error(fmt.Errorf("Failed to write item %d: %s", i, err))
+			return
+		}
+		if items[i].ID == "" {
+			t.Error(fmt.Errorf("Item %d was not assigned an ID: %s", i, items[i]))
+			return
+		}
+	}
+
+	stored := history.GetGroupItems("staging", "Latency")
+	if len(stored) != len(items) {
+		t.Error(fmt.Errorf("Expected %d stored items, got %d", len(items), len(stored)))
+		return
+	}
+	for i, item := range stored {
+		if item.Metric != float64(len(items)-i-1) || !item.CreatedAt.Equal(items[len(items)-i-1].CreatedAt) {
+			t.Error(fmt.Errorf("Incorrectly stored batch item at %d: %s", i, item))
+			return
+		}
+	}
+}
+
+func TestAppendAsync(t *testing.T) {
+	dbFile := "./history-test-async.db"
+	os.Remove(dbFile)
+	history, err := New(
+		NewOptions{
+			File:          dbFile,
+			Durability:    DurabilityFsyncInterval,
+			FsyncInterval: 10 * time.Millisecond,
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	results := make(chan Item, 10)
+	for i := 0; i < 10; i++ {
+		history.AppendAsync(Item{
+			Group:  "staging",
+			Name:   "Latency",
+			Type:   "metric",
+			Metric: float64(i),
+		}, func(item Item, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			results <- item
+		})
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case item := <-results:
+			if item.ID == "" {
+				t.Error(fmt.Errorf("Callback received unsaved item: %s", item))
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Error(fmt.Errorf("Timed out waiting for write %d", i))
+			return
+		}
+	}
+
+	// Callbacks do not run on the writer, so a callback that blocks does
+	// not hold up other writes, and callbacks may use the history file
+	release := make(chan bool)
+	history.AppendAsync(Item{Group: "staging", Name: "Latency", Type: "metric"}, func(item Item, err error) {
+		<-release
+		history.GetLatestItem(item.Group, item.Name)
+	})
+	written := make(chan error, 1)
+	go func() {
+		_, err := history.Append(Item{Group: "staging", Name: "Latency", Type: "metric"})
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error(fmt.Errorf("Write was held up by a blocked callback"))
+		return
+	}
+	close(release)
+	history.Close(context.Background())
+
+	history, err = New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	if items := history.GetGroupItems("staging", "Latency"); len(items) != 12 {
+		t.Error(fmt.Errorf("Expected 12 items after reopen, got %d", len(items)))
+		return
+	}
+}
+
+func TestClose(t *testing.T) {
+	dbFile := "./history-test-close.db"
+	os.Remove(dbFile)
+	history, err := New(NewOptions{
+		File:       dbFile,
+		Durability: DurabilityOSCache,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Writes that are still queued are written before the file is closed
+	for i := 0; i < 50; i++ {
+		history.AppendAsync(Item{
+			Group:  "staging",
+			Name:   "Latency",
+			Type:   "metric",
+			Metric: float64(i),
+		}, nil)
+	}
+	if err := history.Close(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := history.Close(context.Background()); err != nil {
+		t.Error(fmt.Errorf("Expected closing twice to succeed, got: %s", err))
+		return
+	}
+
+	history, err = New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	if items := history.GetGroupItems("staging", "Latency"); len(items) != 50 {
+		t.Error(fmt.Errorf("Expected 50 items after reopen, got %d", len(items)))
+		return
+	}
+}
+
+func TestWriteOrdering(t *testing.T) {
+	dbFile := "./history-test-ordering.db"
+	os.Remove(dbFile)
+	history, err := New(
+		NewOptions{
+			File:                dbFile,
+			MaxConcurrentWrites: 100,
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Holding the lock stalls the writer, so that all appends below
+	// are queued up and written as a single batch
+	history.rwMux.Lock()
+	base := time.Now().Add(-1 * time.Hour)
+	done := make(chan bool, 50)
+	for i := 0; i < 50; i++ {
+		item := Item{
+			Group:  "staging",
+			Name:   "Latency",
+			Type:   "metric",
+			Metric: float64(i),
+		}
+		if i%2 == 0 {
+			// Explicit timestamps in reverse order of submission
+			item.CreatedAt = base.Add(time.Duration(50-i) * time.Second)
+			go func() {
+				history.AppendBatch([]Item{item})
+				done <- true
+			}()
+		} else {
+			history.AppendAsync(item, func(Item, error) {
+				done <- true
+			})
+		}
+	}
+	for len(history.writes) < 49 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	history.rwMux.Unlock()
+	for i := 0; i < 50; i++ {
+		<-done
+	}
+
+	// Backfilled items are appended behind newer results
+	backfill := Item{Group: "staging", Name: "Latency", Type: "metric", Metric: 100, CreatedAt: base.Add(-1 * time.Minute)}
+	if errs := history.AppendBatch([]Item{backfill}); errs[0] != nil {
+		t.Error(errs[0])
+		return
+	}
+	history.Close(context.Background())
+
+	stats := history.Stats()
+	if stats.Items != 51 || stats.Errors != 0 || stats.Batches >= 50 || stats.MaxBatchSize < 2 {
+		t.Error(fmt.Errorf("Writes were not batched: %#v", stats))
+		return
+	}
+
+	data, err := ioutil.ReadFile(dbFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var last time.Time
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for idx, line := range lines {
+		var rec record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Error(err)
+			return
+		}
+		if rec.Transition != nil {
+			continue
+		}
+		if item := rec.Item; item.Metric == 100 {
+			if idx != len(lines)-1 {
+				t.Error(fmt.Errorf("Expected backfilled item to be appended last, found it on line %d", idx+1))
+				return
+			}
+		} else if item.CreatedAt.Before(last) {
+			t.Error(fmt.Errorf("Item on line %d was persisted out of order: %s", idx+1, item))
+			return
+		}
+		last = rec.CreatedAt
+	}
+
+	// Items are put in order when the file is read back
+	history, err = New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	items := history.GetGroupItems("staging", "Latency")
+	if len(items) != 51 || items[50].Metric != 100 {
+		t.Error(fmt.Errorf("Expected backfilled item to be the oldest, got: %v", items))
+		return
+	}
+	for i := 1; i < len(items); i++ {
+		if items[i].CreatedAt.After(items[i-1].CreatedAt) {
+			t.Error(fmt.Errorf("Items were read back out of order: %v", items))
+			return
+		}
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	dbFile := "./history-test-clock-skew.db"
+	os.Remove(dbFile)
+	history, err := New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A result from the future stands in for the clock being stepped back
+	// after it was recorded
+	future := time.Now().Add(time.Hour)
+	for _, err := range history.AppendBatch([]Item{
+		{Group: "staging", Name: "Ping", Type: "boolean", Dedupe: DedupeEveryRun, Status: "healthy", CreatedAt: future},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	item, err := history.Append(Item{Group: "staging", Name: "Ping", Type: "boolean", Dedupe: DedupeEveryRun, Status: "unhealthy"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !item.CreatedAt.Equal(future) || item.ClockSkew < 59*time.Minute || history.Stats().ClockSkews != 1 {
+		t.Error(fmt.Errorf("Expected result to be moved forward to the latest result, got: %s (skew: %s)", item, item.ClockSkew))
+		return
+	}
+
+	// Results with an explicit time backfill the history instead
+	past := time.Now().Add(-time.Hour)
+	for _, err := range history.AppendBatch([]Item{
+		{Group: "staging", Name: "Ping", Type: "boolean", Dedupe: DedupeEveryRun, Status: "healthy", CreatedAt: past},
+	}) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	history.Close(context.Background())
+
+	history, err = New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+
+	items := history.GetGroupItems("staging", "Ping")
+	if len(items) != 3 || items[0].Status != "unhealthy" || items[0].ClockSkew == 0 || items[1].ClockSkew != 0 || !items[2].CreatedAt.Equal(past) {
+		t.Error(fmt.Errorf("Wrong order of results: %v", items))
+		return
+	}
+	if latest, ok := history.GetLatestItem("staging", "Ping"); !ok || latest.Status != "unhealthy" {
+		t.Error(fmt.Errorf("Expected latest result to be unhealthy, got: %s", latest))
+		return
+	}
+	if transitions := history.GetTransitions("staging", "Ping"); len(transitions) != 2 || transitions[0].To != "unhealthy" {
+		t.Error(fmt.Errorf("Expected transition to unhealthy, got: %v", transitions))
+		return
+	}
+}
+
+func TestPaging(t *testing.T) {
+	dbFile := "./history-test-paging.db"
+	os.Remove(dbFile)
+
+	var runAsserts = func(history *File) {
+		items := history.GetGroupItems("staging", "Latency")
+		if len(items) != 20 {
+			t.Error(fmt.Errorf("Expected 20 items, got %d", len(items)))
+			return
+		}
+		for i, item := range items {
+			if expected := fmt.Sprintf("%d-th", 19-i); string(item.Output) != expected {
+				t.Error(fmt.Errorf("Expected output %s for item %d, got: %s", expected, i, item))
+				return
+			}
+		}
+
+		numPaged := 0
+		container := history.data["staging"]["Latency"]
+		for curr := container.head; curr != nil; curr = curr.next {
+			if curr.paged {
+				numPaged++
+				if curr.value.Group != "" || curr.value.Annotations != nil {
+					t.Error(fmt.Errorf("Expected paged item to be dropped from memory, got: %#v", curr.value))
+					return
+				}
+			}
+		}
+		if numPaged != 15 {
+			t.Error(fmt.Errorf("Expected 15 paged items, got %d", numPaged))
+			return
+		}
+
+		// Scans only read back the items that they load
+		numScanned := 0
+		history.EachItem("staging", "Latency", func(item Item, load func() Item) bool {
+			if item.Output != nil {
+				t.Error(fmt.Errorf("Expected item to be passed without its output, got: %s", item))
+				return false
+			}
+			if expected := fmt.Sprintf("%d-th", 19-numScanned); string(load().Output) != expected {
+				t.Error(fmt.Errorf("Expected to load output %s, got: %s", expected, load()))
+				return false
+			}
+			numScanned++
+			return numScanned < 10
+		})
+		if numScanned != 10 {
+			t.Error(fmt.Errorf("Expected scan to stop after 10 items, got %d", numScanned))
+			return
+		}
+	}
+
+	groups := map[string]map[string]bool{
+		"staging": {"Latency": true},
+	}
+	history, err := New(NewOptions{
+		File:             dbFile,
+		MaxItemsInMemory: 5,
+		Groups:           groups,
+		Compact: CompactOptions{
+			MaxWrites: 1000,
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := history.Append(Item{
+			Group:  "staging",
+			Name:   "Latency",
+			Type:   "metric",
+			Output: []byte(fmt.Sprintf("%d-th", i)),
+
+			Annotations: map[string]string{"run": strconv.Itoa(i)},
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	runAsserts(history)
+
+	// Checks that are no longer configured are dropped by compaction, so
+	// their paged items are not read back from stale offsets
+	for i := 0; i < 10; i++ {
+		if _, err := history.Append(Item{Group: "staging", Name: "Removed", Type: "metric"}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Offsets must be kept up to date by compaction
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	runAsserts(history)
+	if _, ok := history.data["staging"]["Removed"]; ok {
+		t.Error(fmt.Errorf("Expected removed check to be dropped by compaction"))
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(NewOptions{
+		File:             dbFile,
+		MaxItemsInMemory: 5,
+		Groups:           groups,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	runAsserts(history)
+}
+
+type retainedChecker struct {
+	group, name string
+	retention   Retention
+}
+
+func (c retainedChecker) GetGroup() string        { return c.group }
+func (c retainedChecker) GetName() string         { return c.name }
+func (c retainedChecker) GetRetention() Retention { return c.retention }
+
+func TestItemsPage(t *testing.T) {
+	dbFile := "./history-test-items-page.db"
+	os.Remove(dbFile)
+	history, err := New(NewOptions{File: dbFile})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+
+	// Results every 10 minutes over the last 5 hours
+	now := time.Now()
+	items := make([]Item, 30)
+	for i := range items {
+		items[i] = Item{Group: "staging", Name: "Latency", Type: "metric", Metric: float64(i), Status: "healthy", CreatedAt: now.Add(-time.Duration(len(items)-i) * 10 * time.Minute)}
+	}
+	for _, err := range history.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	page, next := history.GetItemsPage("staging", "Latency", nil, 10)
+	if len(page) != 10 || page[0].Metric != 29 || next == nil || next.ID != page[9].ID {
+		t.Error(fmt.Errorf("Wrong first page: %v (next: %v)", page, next))
+		return
+	}
+	page, _ = history.GetItemsPage("staging", "Latency", next, 10)
+	if len(page) != 10 || page[0].Metric != 19 {
+		t.Error(fmt.Errorf("Wrong second page: %v", page))
+		return
+	}
+
+	// Once the result that the cursor points at is downsampled, paging
+	// continues with the results that are older than it. The hour of the
+	// result ends at least 40 minutes ago, whatever the time of day.
+	history.AddChecker(retainedChecker{"staging", "Latency", Retention{HourlyAfter: 30 * time.Minute}})
+	if _, err := history.Append(Item{Group: "staging", Name: "Latency", Type: "metric", Status: "healthy"}); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, item := range history.GetGroupItems("staging", "Latency") {
+		if item.ID == next.ID {
+			t.Error(fmt.Errorf("Expected %s to be downsampled", item))
+			return
+		}
+	}
+	page, last := history.GetItemsPage("staging", "Latency", next, 100)
+	if len(page) == 0 || last != nil {
+		t.Error(fmt.Errorf("Expected the rest of the results after downsampling, got: %v (next: %v)", page, last))
+		return
+	}
+	for _, item := range page {
+		if !item.CreatedAt.Before(next.CreatedAt) {
+			t.Error(fmt.Errorf("Expected results older than %s, got: %s", next.CreatedAt, item))
+			return
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	dbFile := "./history-test-dedupe.db"
+	os.Remove(dbFile)
+	history, err := New(NewOptions{
+		File: dbFile,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+
+	statuses := []string{"healthy", "healthy", "unhealthy", "unhealthy", "healthy", "healthy"}
+	expected := map[Dedupe]string{
+		DedupeLatestPerDay:    "recovered",
+		DedupeLatestPerStreak: "recovered,unhealthy,healthy",
+		DedupeEveryRun:        "healthy,recovered,unhealthy,unhealthy,healthy,healthy",
+		DedupeIdentical:       "recovered,unhealthy,healthy",
+	}
+	for dedupe, order := range expected {
+		for _, status := range statuses {
+			if _, err := history.Append(Item{
+				Group:  "staging",
+				Name:   string(dedupe),
+				Type:   "boolean",
+				Dedupe: dedupe,
+				Status: status,
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		items := history.GetGroupItems("staging", string(dedupe))
+		found := make([]string, len(items))
+		for i, item := range items {
+			found[i] = item.Status
+		}
+		if strings.Join(found, ",") != order {
+			t.Error(fmt.Errorf("Wrong items kept with dedupe %s: %#v", dedupe, found))
+			return
+		}
+	}
+}
+
+func TestIdenticalResults(t *testing.T) {
+	dbFile := "./history-test-identical.db"
+	os.Remove(dbFile)
+	options := NewOptions{
+		File:   dbFile,
+		Groups: map[string]map[string]bool{"staging": {"Disk": true}},
+	}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	firstSeen := time.Now().Add(-1 * time.Hour)
+	lastSeen := time.Now()
+	results := []Item{
+		{Output: []byte("ok"), Status: "healthy", CreatedAt: firstSeen},
+		{Output: []byte("ok"), Status: "healthy", CreatedAt: firstSeen.Add(30 * time.Minute)},
+		{Output: []byte("ok"), Status: "healthy", CreatedAt: lastSeen.Add(-2 * time.Minute)},
+		{Output: []byte("full"), Status: "unhealthy", Error: "Disk is full", CreatedAt: lastSeen.Add(-1 * time.Minute)},
+		{Output: []byte("full"), Status: "unhealthy", Error: "Disk is full", CreatedAt: lastSeen},
+	}
+	for _, item := range results {
+		item.Group = "staging"
+		item.Name = "Disk"
+		item.Type = "boolean"
+		item.Dedupe = DedupeIdentical
+		if errs := history.AppendBatch([]Item{item}); errs[0] != nil {
+			t.Error(errs[0])
+			return
+		}
+	}
+
+	var runAsserts = func(when string) {
+		items := history.GetGroupItems("staging", "Disk")
+		if len(items) != 2 {
+			t.Error(fmt.Errorf("Expected 2 items %s, got %#v", when, items))
+			return
+		}
+		if items[0].Status != "unhealthy" || items[0].Count != 2 || !items[0].SeenAt().Equal(lastSeen) || !items[0].CreatedAt.Equal(lastSeen.Add(-1*time.Minute)) {
+			t.Error(fmt.Errorf("Wrong failing item %s: %s (last seen %s)", when, items[0], items[0].SeenAt()))
+		}
+		if items[1].Status != "healthy" || items[1].Count != 3 || !items[1].CreatedAt.Equal(firstSeen) || string(items[1].Output) != "ok" {
+			t.Error(fmt.Errorf("Wrong healthy item %s: %s", when, items[1]))
+		}
+	}
+
+	runAsserts("after appending")
+	history.Close(context.Background())
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	runAsserts("after reopening")
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	runAsserts("after compaction")
+}
+
+func TestTransitions(t *testing.T) {
+	dbFile := "./history-test-transitions.db"
+	os.Remove(dbFile)
+	options := NewOptions{
+		File:       dbFile,
+		MaxEntries: 2,
+		Groups: map[string]map[string]bool{
+			"staging": {"Website is up": true},
+		},
+	}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, status := range []string{"healthy", "healthy", "unhealthy", "unhealthy", "healthy", "healthy", "healthy"} {
+		if _, err := history.Append(Item{
+			Group:  "staging",
+			Name:   "Website is up",
+			Type:   "boolean",
+			Dedupe: DedupeEveryRun,
+			Status: status,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var runAsserts = func() {
+		transitions := history.GetTransitions("staging", "Website is up")
+		found := make([]string, len(transitions))
+		for i, t := range transitions {
+			found[i] = t.From + "->" + t.To
+		}
+		if strings.Join(found, ",") != "unhealthy->recovered,healthy->unhealthy,->healthy" {
+			t.Error(fmt.Errorf("Wrong transitions recorded: %#v", found))
+		}
+	}
+
+	runAsserts()
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	if items := history.GetGroupItems("staging", "Website is up"); len(items) != 2 {
+		t.Error(fmt.Errorf("Expected 2 items after reopen, got %d", len(items)))
+		return
+	}
+	runAsserts()
+}
+
+func TestRetention(t *testing.T) {
+	dbFile := "./history-test-retention.db"
+	os.Remove(dbFile)
+	history, err := New(NewOptions{
+		File:       dbFile,
+		MaxEntries: 5,
+		Retention: map[string]map[string]Retention{
+			"staging": {
+				"Noisy":  {MaxEntries: 2},
+				"Recent": {MaxAge: 1 * time.Hour},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+
+	start := time.Now().Add(-2 * time.Hour).Add(5 * time.Minute)
+	for _, name := range []string{"Default", "Noisy", "Recent"} {
+		items := make([]Item, 20)
+		for i := range items {
+			items[i] = Item{
+				Group:     "staging",
+				Name:      name,
+				Type:      "metric",
+				CreatedAt: start.Add(time.Duration(i) * 10 * time.Minute),
+			}
+		}
+		for _, err := range history.AppendBatch(items) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+
+	for name, expected := range map[string]int{
+		"Default": 5,
+		"Noisy":   2,
+		"Recent":  14,
+	} {
+		if items := history.GetGroupItems("staging", name); len(items) != expected {
+			t.Error(fmt.Errorf("Expected %d items for %s, got %d", expected, name, len(items)))
+		}
+	}
+}
+
+func TestIncidentRecords(t *testing.T) {
+	dbFile := "./history-test-incidents.db"
+	os.Remove(dbFile)
+	options := NewOptions{
+		File: dbFile,
+		Groups: map[string]map[string]bool{
+			"staging": {"Website is up": true},
+		},
+	}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	incidentAt := time.Now().Add(-1 * time.Hour)
+	for _, markdown := range []string{"# Draft", "# Final", ""} {
+		if err := history.SetPostmortem(Postmortem{
+			Group:      "staging",
+			Name:       "Website is up",
+			IncidentAt: incidentAt.Add(-1 * time.Hour),
+			Markdown:   markdown,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, markdown := range []string{"# Draft", "# Final"} {
+		if err := history.SetPostmortem(Postmortem{
+			Group:      "staging",
+			Name:       "Website is up",
+			IncidentAt: incidentAt,
+			Markdown:   markdown,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if _, err := history.AddComment(Comment{
+		Group:      "staging",
+		Name:       "Website is up",
+		IncidentAt: incidentAt,
+		Author:     "admin",
+		Body:       "Rolled back",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	incidentID := fmt.Sprintf("%d", incidentAt.UnixNano())
+	for _, by := range []string{"alice", "bob"} {
+		if err := history.SetNotificationState(NotificationState{
+			Group:    "staging",
+			Name:     "Website is up",
+			Ack:      &Acknowledgement{IncidentID: incidentID, By: by, At: incidentAt},
+			Reminder: &Reminder{IncidentID: incidentID, NotifiedAt: incidentAt, Escalated: true},
+			Issue:    &IssueState{ID: "7", Unhealthy: true},
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var runAsserts = func() {
+		state := history.GetNotificationState("staging", "Website is up")
+		if state.Ack == nil || state.Ack.By != "bob" || state.Reminder == nil || !state.Reminder.Escalated || state.Issue == nil || state.Issue.ID != "7" {
+			t.Error(fmt.Errorf("Wrong notification state returned: %s", state))
+		}
+		if comments := history.GetComments("staging", "Website is up", incidentAt); len(comments) != 1 || comments[0].Body != "Rolled back" {
+			t.Error(fmt.Errorf("Wrong comments returned: %#v", comments))
+		}
+		if _, ok := history.GetPostmortem("staging", "Website is up", incidentAt.Add(-1*time.Hour)); ok {
+			t.Error(fmt.Errorf("Expected empty postmortem to be removed"))
+		}
+		pm, ok := history.GetPostmortem("staging", "Website is up", incidentAt)
+		if !ok || pm.Markdown != "# Final" {
+			t.Error(fmt.Errorf("Wrong postmortem returned: %s", pm))
+		}
+		if pms := history.GetPostmortems("staging", "Website is up"); len(pms) != 1 {
+			t.Error(fmt.Errorf("Expected 1 postmortem, got %d", len(pms)))
+		}
+	}
+
+	runAsserts()
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	runAsserts()
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	runAsserts()
+}
+
+func TestDeliveryRecords(t *testing.T) {
+	dbFile := "./history-test-deliveries.db"
+	os.Remove(dbFile)
+	options := NewOptions{File: dbFile}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	createdAt := time.Now()
+	for i := 0; i < maxDeliveries+1; i++ {
+		if err := history.SetDelivery(Delivery{
+			ID:        fmt.Sprintf("sent-%d", i),
+			Notifier:  "slack",
+			Status:    DeliverySent,
+			CreatedAt: createdAt.Add(time.Duration(i) * time.Millisecond),
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, status := range []string{DeliveryPending, DeliveryRetrying} {
+		if err := history.SetDelivery(Delivery{
+			ID:        "pager",
+			Notifier:  "pager",
+			Status:    status,
+			Details:   json.RawMessage(`{"Status":"unhealthy"}`),
+			CreatedAt: createdAt,
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var runAsserts = func() {
+		deliveries := history.GetDeliveries()
+		if len(deliveries) != maxDeliveries {
+			t.Error(fmt.Errorf("Expected %d deliveries, got %d", maxDeliveries, len(deliveries)))
+			return
+		}
+		if deliveries[0].ID != fmt.Sprintf("sent-%d", maxDeliveries) {
+			t.Error(fmt.Errorf("Expected most recent delivery first, got %s", deliveries[0]))
+		}
+		last := deliveries[len(deliveries)-1]
+		if last.ID != "pager" || last.Status != DeliveryRetrying || string(last.Details) != `{"Status":"unhealthy"}` {
+			t.Error(fmt.Errorf("Expected retried delivery to be kept, got %s", last))
+		}
+	}
+
+	runAsserts()
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	runAsserts()
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	runAsserts()
+}
+
+func TestSilenceRecords(t *testing.T) {
+	dbFile := "./history-test-silences.db"
+	os.Remove(dbFile)
+	options := NewOptions{File: dbFile}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range []Silence{
+		{ID: "maintenance", Tags: []string{"region:eu"}, Reason: "DC maintenance", StartsAt: now, EndsAt: now.Add(2 * time.Hour)},
+		{ID: "deleted", Group: "API", StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{ID: "ended", Group: "API", StartsAt: now.Add(-2 * time.Hour), EndsAt: now.Add(-time.Hour)},
+		{ID: "deleted", Deleted: true},
+	} {
+		if err := history.SetSilence(s); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var runAsserts = func(ids ...string) bool {
+		silences := history.GetSilences()
+		var found []string
+		for _, s := range silences {
+			found = append(found, s.ID)
+		}
+		if strings.Join(found, ",") != strings.Join(ids, ",") {
+			t.Error(fmt.Errorf("Expected silences %v, got %v", ids, found))
+			return false
+		}
+		if last := silences[len(silences)-1]; last.Reason != "DC maintenance" || len(last.Tags) != 1 || last.Tags[0] != "region:eu" {
+			t.Error(fmt.Errorf("Wrong silence: %s", last))
+			return false
+		}
+		return true
+	}
+
+	if !runAsserts("ended", "maintenance") {
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !runAsserts("ended", "maintenance") {
+		return
+	}
+
+	// Silences that have ended are dropped by compaction
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+
+	history, err = New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	runAsserts("maintenance")
+}
+
+func TestDownsampling(t *testing.T) {
+	dbFile := "./history-test-downsampling.db"
+	os.Remove(dbFile)
+	options := NewOptions{
+		File:       dbFile,
+		MaxEntries: 1000,
+		Compact:    CompactOptions{MaxWrites: 100000},
+		Groups:     map[string]map[string]bool{"staging": {"Latency": true}},
+		Retention: map[string]map[string]Retention{
+			"staging": {
+				"Latency": {HourlyAfter: 2 * time.Hour, DailyAfter: 48 * time.Hour},
+			},
+		},
+	}
+	history, err := New(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Results every 10 minutes over the last 5 days, where every 7th
+	// result failed
+	now := time.Now()
+	items := make([]Item, 5*24*6)
+	sum := 0.0
+	for i := range items {
+		items[i] = Item{
+			Group:     "staging",
+			Name:      "Latency",
+			Type:      "metric",
+			Metric:    float64(i % 50),
+			Status:    "healthy",
+			CreatedAt: now.Add(-time.Duration(len(items)-i) * 10 * time.Minute),
+		}
+		if i%7 == 0 {
+			items[i].Status = "unhealthy"
+		}
+		sum += items[i].Metric
+	}
+	for _, err := range history.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	check := func(stage string) bool {
+		count, failures, total := 0, 0, 0.0
+		periods := map[string]int{}
+		for _, item := range history.GetGroupItems("staging", "Latency") {
+			switch item.period() {
+			case "":
+				if now.Sub(item.CreatedAt) > 3*time.Hour {
+					t.Error(fmt.Errorf("%s: result from %s was not downsampled", stage, item.CreatedAt))
+					return false
+				}
+				count++
+				total += item.Metric
+				if item.Status == "unhealthy" {
+					failures++
+				}
+
+			case PeriodHour:
+				if now.Sub(item.CreatedAt) > 4*24*time.Hour {
+					t.Error(fmt.Errorf("%s: hourly aggregate from %s was not downsampled", stage, item.CreatedAt))
+					return false
+				}
+				fallthrough
+
+			default:
+				agg := item.Aggregate
+				if agg.Min > item.Metric || agg.Max < item.Metric || (agg.Failures > 0) != (item.Status == "unhealthy") {
+					t.Error(fmt.Errorf("%s: inconsistent aggregate: %#v (%s)", stage, agg, item))
+					return false
+				}
+				count += agg.Count
+				failures += agg.Failures
+				total += item.Metric * float64(agg.Count)
+			}
+			periods[item.period()]++
+		}
+
+		if periods[PeriodHour] == 0 || periods[PeriodDay] == 0 {
+			t.Error(fmt.Errorf("%s: expected both hourly and daily aggregates, got: %#v", stage, periods))
+			return false
+		}
+		if count != len(items) || failures != (len(items)+6)/7 {
+			t.Error(fmt.Errorf("%s: aggregates cover %d results with %d failures, expected %d with %d", stage, count, failures, len(items), (len(items)+6)/7))
+			return false
+		}
+		if total < sum-0.001 || total > sum+0.001 {
+			t.Error(fmt.Errorf("%s: aggregates sum to %f, expected %f", stage, total, sum))
+			return false
+		}
+		return true
+	}
+	if !check("after writes") {
+		return
+	}
+
+	// Replaced results are only removed from the file by compaction, so
+	// they must not be counted twice when the file is read back
+	history.Close(context.Background())
+	if history, err = New(options); err != nil {
+		t.Error(err)
+		return
+	}
+	if !check("after reopening") {
+		return
+	}
+
+	if _, err := history.Compact(); err != nil {
+		t.Error(err)
+		return
+	}
+	history.Close(context.Background())
+	if history, err = New(options); err != nil {
+		t.Error(err)
+		return
+	}
+	defer history.Close(context.Background())
+	check("after compaction")
+}
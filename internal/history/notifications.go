@@ -0,0 +1,112 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// NotificationState holds what was notified about the incidents of a
+// check, so that restarting during an incident neither notifies it again
+// nor forgets who acknowledged it.
+type NotificationState struct {
+	Group string
+	Name  string
+
+	// Latest acknowledgement of an incident of the check
+	Ack *Acknowledgement `json:",omitempty"`
+
+	// Reminders of the check's ongoing incident
+	Reminder *Reminder `json:",omitempty"`
+
+	// Whether the check was flapping as of its latest result
+	Flapping bool `json:",omitempty"`
+
+	// Issue that is open for the check in an issue tracker
+	Issue *IssueState `json:",omitempty"`
+
+	UpdatedAt time.Time
+}
+
+// Acknowledgement records that someone is handling an incident, which is
+// identified by the time at which it started.
+type Acknowledgement struct {
+	IncidentID string
+	By         string
+	At         time.Time
+}
+
+// Reminder records when an incident was last notified, and whether it was
+// escalated.
+type Reminder struct {
+	IncidentID string
+	NotifiedAt time.Time
+	Escalated  bool
+}
+
+// IssueState tracks the issue that is open for a check.
+type IssueState struct {
+	ID  string
+	URL string `json:",omitempty"`
+
+	// Status of the check in the latest update of the issue, and since
+	// when the check has been healthy
+	Unhealthy    bool
+	HealthySince time.Time
+}
+
+func (state NotificationState) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("NotificationState{"),
+		fmt.Sprintf("\tGroup: %s,", state.Group),
+		fmt.Sprintf("\tName: %s,", state.Name),
+		fmt.Sprintf("\tAck: %+v,", state.Ack),
+		fmt.Sprintf("\tReminder: %+v,", state.Reminder),
+		fmt.Sprintf("\tFlapping: %t,", state.Flapping),
+		fmt.Sprintf("\tIssue: %+v,", state.Issue),
+		fmt.Sprintf("\tUpdatedAt: %s,", state.UpdatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (state NotificationState) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		NotificationState NotificationState
+	}{state})
+}
+
+// SetNotificationState persists the notification state of a check,
+// replacing its previous state.
+func (file *File) SetNotificationState(state NotificationState) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	state.UpdatedAt = time.Now()
+	n, err := state.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	file.container(state.Group, state.Name).notificationState = state
+	file.logger.Debugf("Updated notification state: %s", state)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return nil
+}
+
+// GetNotificationState returns the persisted notification state of a
+// check. Checks that never had their state set return the zero value.
+func (file *File) GetNotificationState(group, checkName string) NotificationState {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	if container, ok := file.data[group][checkName]; ok {
+		return container.notificationState
+	}
+	return NotificationState{}
+}
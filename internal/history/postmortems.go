@@ -0,0 +1,106 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Postmortem is a write-up of an incident, which is identified by the check
+// that failed and the time at which it started failing.
+type Postmortem struct {
+	Group      string
+	Name       string
+	IncidentAt time.Time
+	Markdown   string
+	UpdatedAt  time.Time
+}
+
+func (pm Postmortem) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Postmortem{"),
+		fmt.Sprintf("\tGroup: %s,", pm.Group),
+		fmt.Sprintf("\tName: %s,", pm.Name),
+		fmt.Sprintf("\tIncidentAt: %s,", pm.IncidentAt),
+		fmt.Sprintf("\tMarkdown: (%d chars),", len(pm.Markdown)),
+		fmt.Sprintf("\tUpdatedAt: %s,", pm.UpdatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (pm Postmortem) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		Postmortem Postmortem
+	}{pm})
+}
+
+func (container *dataContainer) addPostmortem(pm Postmortem) {
+	if container.postmortems == nil {
+		container.postmortems = make(map[int64]Postmortem)
+	}
+	key := pm.IncidentAt.UnixNano()
+	if pm.Markdown == "" {
+		delete(container.postmortems, key)
+	} else {
+		container.postmortems[key] = pm
+	}
+}
+
+// SetPostmortem stores the postmortem of an incident, replacing its previous
+// postmortem. Setting an empty postmortem removes it.
+func (file *File) SetPostmortem(pm Postmortem) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	pm.UpdatedAt = time.Now()
+	n, err := pm.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	file.container(pm.Group, pm.Name).addPostmortem(pm)
+	file.logger.Debugf("Updated postmortem: %s", pm)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return nil
+}
+
+// GetPostmortem returns the postmortem of the incident of a check that
+// started at the given time, if it has one.
+func (file *File) GetPostmortem(group, checkName string, incidentAt time.Time) (Postmortem, bool) {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	if container, ok := file.data[group][checkName]; ok {
+		pm, ok := container.postmortems[incidentAt.UnixNano()]
+		return pm, ok
+	}
+	return Postmortem{}, false
+}
+
+// GetPostmortems returns all postmortems of a check, with the most recent
+// incident first.
+func (file *File) GetPostmortems(group, checkName string) []Postmortem {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	container, ok := file.data[group][checkName]
+	if !ok {
+		return []Postmortem{}
+	}
+
+	list := make([]Postmortem, 0, len(container.postmortems))
+	for _, pm := range container.postmortems {
+		list = append(list, pm)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IncidentAt.After(list[j].IncidentAt)
+	})
+	return list
+}
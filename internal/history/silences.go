@@ -0,0 +1,107 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Silence mutes the notifications of the checks that it matches between
+// its start and its end, i.e. during planned maintenance. Each update of a
+// silence replaces its previous state, and silences are dropped once they
+// are deleted.
+type Silence struct {
+	ID string
+
+	// Patterns that the group, name and tags of silenced checks match.
+	// Empty patterns match all checks, and checks must match each of the
+	// tag patterns.
+	Group string   `json:",omitempty"`
+	Check string   `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+
+	Reason    string `json:",omitempty"`
+	CreatedBy string `json:",omitempty"`
+	StartsAt  time.Time
+	EndsAt    time.Time
+	CreatedAt time.Time
+	Deleted   bool `json:",omitempty"`
+}
+
+func (s Silence) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Silence{"),
+		fmt.Sprintf("\tID: %s,", s.ID),
+		fmt.Sprintf("\tGroup: %s,", s.Group),
+		fmt.Sprintf("\tCheck: %s,", s.Check),
+		fmt.Sprintf("\tTags: %v,", s.Tags),
+		fmt.Sprintf("\tReason: %s,", s.Reason),
+		fmt.Sprintf("\tStartsAt: %s,", s.StartsAt),
+		fmt.Sprintf("\tEndsAt: %s,", s.EndsAt),
+		fmt.Sprintf("\tDeleted: %t,", s.Deleted),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (s Silence) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		Silence Silence
+	}{s})
+}
+
+// addSilence replaces the previous state of a silence, or drops it if it
+// was deleted.
+func (file *File) addSilence(s Silence) {
+	if s.Deleted {
+		delete(file.silences, s.ID)
+		return
+	}
+	if file.silences == nil {
+		file.silences = make(map[string]Silence)
+	}
+	file.silences[s.ID] = s
+}
+
+// SetSilence persists a silence, replacing its previous state. Silences
+// that are marked as deleted are removed.
+func (file *File) SetSilence(s Silence) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	n, err := s.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	file.addSilence(s)
+	file.logger.Debugf("Updated silence: %s", s)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return nil
+}
+
+// GetSilences returns all silences that have not been deleted, including
+// those that have ended and were not compacted away yet, in the order that
+// they start.
+func (file *File) GetSilences() []Silence {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	list := make([]Silence, 0, len(file.silences))
+	for _, s := range file.silences {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].StartsAt.Equal(list[j].StartsAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].StartsAt.Before(list[j].StartsAt)
+	})
+	return list
+}
@@ -0,0 +1,103 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// CheckState holds the state of a check that is not derived from the
+// check's results, which is either set by users or kept by the checker
+// across restarts.
+type CheckState struct {
+	Group  string
+	Name   string
+	Paused bool
+
+	// Position up to which a log watch check has read its file
+	LogPosition *LogPosition `json:",omitempty"`
+
+	UpdatedAt time.Time
+}
+
+// LogPosition identifies the offset of a log file that was read up to. The
+// inode tells whether the file was rotated in the meantime, and is zero on
+// platforms that have none.
+type LogPosition struct {
+	File   string
+	Inode  uint64 `json:",omitempty"`
+	Offset int64
+}
+
+func (state CheckState) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("CheckState{"),
+		fmt.Sprintf("\tGroup: %s,", state.Group),
+		fmt.Sprintf("\tName: %s,", state.Name),
+		fmt.Sprintf("\tPaused: %t,", state.Paused),
+		fmt.Sprintf("\tLogPosition: %+v,", state.LogPosition),
+		fmt.Sprintf("\tUpdatedAt: %s,", state.UpdatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (state CheckState) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		State CheckState
+	}{state})
+}
+
+// SetCheckState persists the state of a check, replacing its previous state.
+func (file *File) SetCheckState(state CheckState) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+	return file.setCheckState(state)
+}
+
+// UpdateCheckState persists changes to the state of a check, which are
+// made to its current state while the history file is locked so that
+// concurrent updates of different fields are not lost.
+func (file *File) UpdateCheckState(group, checkName string, update func(state *CheckState)) error {
+	file.rwMux.Lock()
+	defer file.rwMux.Unlock()
+
+	state := CheckState{Group: group, Name: checkName}
+	if container, ok := file.data[group][checkName]; ok {
+		state = container.state
+	}
+	state.Group = group
+	state.Name = checkName
+	update(&state)
+	return file.setCheckState(state)
+}
+
+func (file *File) setCheckState(state CheckState) error {
+	state.UpdatedAt = time.Now()
+	n, err := state.writeTo(file.fd)
+	file.writeOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	file.container(state.Group, state.Name).state = state
+	file.logger.Debugf("Updated check state: %s", state)
+
+	if file.durability == DurabilityFsyncAlways {
+		file.sync()
+	} else {
+		file.dirty = true
+	}
+	return nil
+}
+
+// GetCheckState returns the persisted state of a check. Checks that never
+// had their state set return the zero value.
+func (file *File) GetCheckState(group, checkName string) CheckState {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	if container, ok := file.data[group][checkName]; ok {
+		return container.state
+	}
+	return CheckState{}
+}
@@ -0,0 +1,127 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Transition records a change in the health of a check. Transitions are
+// stored separately from the check's items, so they are retained even
+// after the items that caused them have been dropped.
+type Transition struct {
+	Group     string
+	Name      string
+	From      string
+	To        string
+	CreatedAt time.Time
+}
+
+func (t Transition) String() string {
+	return strings.Join([]string{
+		fmt.Sprintf("Transition{"),
+		fmt.Sprintf("\tGroup: %s,", t.Group),
+		fmt.Sprintf("\tName: %s,", t.Name),
+		fmt.Sprintf("\tFrom: %s,", t.From),
+		fmt.Sprintf("\tTo: %s,", t.To),
+		fmt.Sprintf("\tCreatedAt: %s,", t.CreatedAt),
+		fmt.Sprintf("}"),
+	}, "\n")
+}
+
+func (t Transition) writeTo(out io.Writer) (int, error) {
+	return writeRecord(out, struct {
+		Transition Transition
+	}{t})
+}
+
+// record is a single line of the history file. Lines hold items, unless
+// one of the other fields is set.
+type record struct {
+	Item
+	Transition        *Transition
+	State             *CheckState
+	NotificationState *NotificationState
+	Postmortem        *Postmortem
+	Comment           *Comment
+	Delivery          *Delivery
+	Silence           *Silence
+}
+
+// detectTransition returns the transition caused by writing the given item,
+// if any. The first result of a check is a transition from the empty status.
+func (container *dataContainer) detectTransition(item Item) (Transition, bool) {
+	latest := container.head
+	if latest != nil && (item.CreatedAt.Before(latest.value.CreatedAt) || latest.value.isUp() == item.isUp()) {
+		return Transition{}, false
+	}
+
+	t := Transition{
+		Group:     item.Group,
+		Name:      item.Name,
+		To:        item.Status,
+		CreatedAt: item.CreatedAt,
+	}
+	if latest != nil {
+		t.From = latest.value.Status
+	}
+	return t, true
+}
+
+func (file *File) addTransition(t Transition, out io.Writer) error {
+	if out != nil {
+		n, err := t.writeTo(out)
+		file.writeOffset += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	container := file.container(t.Group, t.Name)
+	container.transitions = append(container.transitions, t)
+	if drop := len(container.transitions) - file.maxTransitions; drop > 0 {
+		container.transitions = append(container.transitions[:0], container.transitions[drop:]...)
+	}
+	file.logger.Debugf("Recorded transition: %s", t)
+	return nil
+}
+
+// GetTransitions returns the recorded transitions of a check, with the
+// most recent transition first.
+func (file *File) GetTransitions(group, checkName string) []Transition {
+	file.rwMux.RLock()
+	defer file.rwMux.RUnlock()
+
+	g, _ := file.data[group]
+	container, _ := g[checkName]
+	if container == nil {
+		return []Transition{}
+	}
+
+	list := make([]Transition, len(container.transitions))
+	for i, t := range container.transitions {
+		list[len(list)-i-1] = t
+	}
+	return list
+}
+
+func writeRecord(out io.Writer, value interface{}) (int, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	n, err := out.Write(append(data, '\n'))
+	if n < len(data) && n > 0 {
+		// TODO: How to recover from this?
+		panic(fmt.Errorf("Wrote partial data (error: %s)", err))
+	}
+	if err != nil {
+		return n, err
+	}
+	if n == 0 {
+		return n, fmt.Errorf("Failed to write data out to file")
+	}
+	return n, nil
+}
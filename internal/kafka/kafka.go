@@ -0,0 +1,369 @@
+// Package kafka implements the few requests of the Kafka protocol that are
+// needed to compute the lag of consumer groups, without producing or
+// consuming any messages.
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const clientID = "patrol"
+
+// Special timestamps for ListOffsets
+const (
+	latestOffset   = -1
+	earliestOffset = -2
+)
+
+// Options describe how to reach a Kafka cluster.
+type Options struct {
+	// Addresses ("host:port") of brokers that the rest of the cluster is
+	// discovered from
+	Brokers []string
+
+	// Time allowed for each connection and request, which defaults to 10s
+	Timeout time.Duration
+
+	// Connects over TLS if set
+	TLS *tls.Config
+}
+
+type conn struct {
+	net.Conn
+	timeout       time.Duration
+	correlationID int32
+}
+
+func dial(opts Options, addr string) (*conn, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var c net.Conn
+	var err error
+	if opts.TLS != nil {
+		c, err = tls.DialWithDialer(dialer, "tcp", addr, opts.TLS)
+	} else {
+		c, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, timeout: opts.Timeout}, nil
+}
+
+// request sends a request and returns the body of its response.
+func (c *conn) request(apiKey, apiVersion int16, body []byte) (*decoder, error) {
+	c.correlationID++
+	header := encoder{}
+	header.int16(apiKey)
+	header.int16(apiVersion)
+	header.int32(c.correlationID)
+	header.string(clientID)
+
+	message := encoder{}
+	message.int32(int32(header.Len() + len(body)))
+	message.Write(header.Bytes())
+	message.Write(body)
+
+	c.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.Write(message.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > 64<<20 {
+		return nil, fmt.Errorf("Invalid Kafka response size: %d", size)
+	}
+	response := make([]byte, size)
+	if _, err := io.ReadFull(c, response); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{data: response}
+	if correlationID := d.int32(); correlationID != c.correlationID {
+		return nil, fmt.Errorf("Kafka response out of order: expected %d, got %d", c.correlationID, correlationID)
+	}
+	return d, nil
+}
+
+// client keeps a connection to each broker that is talked to.
+type client struct {
+	opts  Options
+	conns map[string]*conn
+
+	// Addresses of brokers by node ID
+	brokers map[int32]string
+}
+
+func (c *client) conn(addr string) (*conn, error) {
+	if existing, ok := c.conns[addr]; ok {
+		return existing, nil
+	}
+	conn, err := dial(c.opts, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+func (c *client) close() {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// bootstrap connects to the first reachable broker.
+func (c *client) bootstrap() (*conn, error) {
+	var lastErr error
+	for _, addr := range c.opts.Brokers {
+		conn, err := c.conn(addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("Failed to connect to any broker: %s", lastErr)
+}
+
+// partitionLeaders fetches the metadata of a topic, and returns the leader
+// of each of its partitions.
+func (c *client) partitionLeaders(topic string) (map[int32]int32, error) {
+	conn, err := c.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	// v4 allows disabling automatic topic creation, which would otherwise
+	// create misspelled topics
+	req := encoder{}
+	req.arrayLength(1)
+	req.string(topic)
+	req.bool(false)
+	d, err := conn.request(apiMetadata, 4, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	d.int32() // throttle_time_ms
+	for i := d.arrayLength(); i > 0; i-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		c.brokers[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+
+	leaders := make(map[int32]int32)
+	for i := d.arrayLength(); i > 0; i-- {
+		topicErr := errorCode(d.int16())
+		name := d.string()
+		d.bool() // is_internal
+		for j := d.arrayLength(); j > 0; j-- {
+			partitionErr := errorCode(d.int16())
+			partition := d.int32()
+			leader := d.int32()
+			for k := d.arrayLength(); k > 0; k-- {
+				d.int32() // replica_nodes
+			}
+			for k := d.arrayLength(); k > 0; k-- {
+				d.int32() // isr_nodes
+			}
+			if name == topic && partitionErr == nil && d.err == nil {
+				leaders[partition] = leader
+			}
+		}
+		if d.err == nil && name == topic && topicErr != nil {
+			return nil, fmt.Errorf("Failed to get metadata of topic '%s': %s", topic, topicErr)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("Topic '%s' has no available partitions", topic)
+	}
+	return leaders, nil
+}
+
+// listOffsets fetches the earliest or latest offset of the given
+// partitions from their leaders.
+func (c *client) listOffsets(topic string, leaders map[int32]int32, partitions []int32, timestamp int64) (map[int32]int64, error) {
+	byLeader := make(map[int32][]int32)
+	for _, partition := range partitions {
+		byLeader[leaders[partition]] = append(byLeader[leaders[partition]], partition)
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for leader, partitions := range byLeader {
+		addr, ok := c.brokers[leader]
+		if !ok {
+			return nil, fmt.Errorf("Leader %d of topic '%s' is not available", leader, topic)
+		}
+		conn, err := c.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		req := encoder{}
+		req.int32(-1) // replica_id
+		req.arrayLength(1)
+		req.string(topic)
+		req.arrayLength(len(partitions))
+		for _, partition := range partitions {
+			req.int32(partition)
+			req.int64(timestamp)
+		}
+		d, err := conn.request(apiListOffsets, 1, req.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		for i := d.arrayLength(); i > 0; i-- {
+			d.string() // name
+			for j := d.arrayLength(); j > 0; j-- {
+				partition := d.int32()
+				err := errorCode(d.int16())
+				d.int64() // timestamp
+				offset := d.int64()
+				if d.err == nil && err != nil {
+					return nil, fmt.Errorf("Failed to get offset of partition %d: %s", partition, err)
+				}
+				offsets[partition] = offset
+			}
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	return offsets, nil
+}
+
+// committedOffsets fetches the offsets that a consumer group has committed,
+// with -1 for partitions without a commit.
+func (c *client) committedOffsets(group, topic string, partitions []int32) (map[int32]int64, error) {
+	conn, err := c.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	req := encoder{}
+	req.string(group)
+	d, err := conn.request(apiFindCoordinator, 0, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	coordinatorErr := errorCode(d.int16())
+	d.int32() // node_id
+	host := d.string()
+	port := d.int32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if coordinatorErr != nil {
+		return nil, fmt.Errorf("Failed to find coordinator of group '%s': %s", group, coordinatorErr)
+	}
+	if conn, err = c.conn(net.JoinHostPort(host, strconv.Itoa(int(port)))); err != nil {
+		return nil, err
+	}
+
+	req = encoder{}
+	req.string(group)
+	req.arrayLength(1)
+	req.string(topic)
+	req.arrayLength(len(partitions))
+	for _, partition := range partitions {
+		req.int32(partition)
+	}
+	if d, err = conn.request(apiOffsetFetch, 1, req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for i := d.arrayLength(); i > 0; i-- {
+		d.string() // name
+		for j := d.arrayLength(); j > 0; j-- {
+			partition := d.int32()
+			offset := d.int64()
+			d.string() // metadata
+			err := errorCode(d.int16())
+			if d.err == nil && err != nil {
+				return nil, fmt.Errorf("Failed to get committed offset of partition %d: %s", partition, err)
+			}
+			offsets[partition] = offset
+		}
+	}
+	return offsets, d.err
+}
+
+// ConsumerLag returns the number of messages in each partition of a topic
+// that a consumer group has not committed yet. Partitions that the group
+// has never committed to lag by all of their retained messages.
+func ConsumerLag(opts Options, group, topic string) (map[int32]int64, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	c := &client{
+		opts:    opts,
+		conns:   make(map[string]*conn),
+		brokers: make(map[int32]string),
+	}
+	defer c.close()
+
+	leaders, err := c.partitionLeaders(topic)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]int32, 0, len(leaders))
+	for partition := range leaders {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i] < partitions[j]
+	})
+
+	latest, err := c.listOffsets(topic, leaders, partitions, latestOffset)
+	if err != nil {
+		return nil, err
+	}
+	committed, err := c.committedOffsets(group, topic, partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	var uncommitted []int32
+	for _, partition := range partitions {
+		if offset, ok := committed[partition]; !ok || offset < 0 {
+			uncommitted = append(uncommitted, partition)
+		}
+	}
+	if len(uncommitted) > 0 {
+		earliest, err := c.listOffsets(topic, leaders, uncommitted, earliestOffset)
+		if err != nil {
+			return nil, err
+		}
+		for partition, offset := range earliest {
+			committed[partition] = offset
+		}
+	}
+
+	lag := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		lag[partition] = latest[partition] - committed[partition]
+		if lag[partition] < 0 {
+			// Offsets can be committed before they are visible to us
+			lag[partition] = 0
+		}
+	}
+	return lag, nil
+}
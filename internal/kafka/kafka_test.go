@@ -0,0 +1,196 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// fakeBroker is a single-node cluster with one topic, "orders", that has
+// three partitions.
+type fakeBroker struct {
+	host      string
+	port      int32
+	earliest  map[int32]int64
+	latest    map[int32]int64
+	committed map[int32]int64
+}
+
+func startBroker(t *testing.T, broker *fakeBroker) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().(*net.TCPAddr)
+	broker.host = addr.IP.String()
+	broker.port = int32(addr.Port)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return addr.String()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		request := make([]byte, size)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		d := &decoder{data: request}
+		apiKey := d.int16()
+		d.int16() // api_version
+		correlationID := d.int32()
+		d.string() // client_id
+
+		res := encoder{}
+		res.int32(correlationID)
+		b.handle(apiKey, d, &res)
+
+		response := encoder{}
+		response.int32(int32(res.Len()))
+		response.Write(res.Bytes())
+		conn.Write(response.Bytes())
+	}
+}
+
+func (b *fakeBroker) handle(apiKey int16, d *decoder, res *encoder) {
+	switch apiKey {
+	case apiMetadata:
+		d.arrayLength()
+		topic := d.string()
+
+		res.int32(0) // throttle_time_ms
+		res.arrayLength(1)
+		res.int32(1)
+		res.string(b.host)
+		res.int32(b.port)
+		res.int16(-1) // rack
+		res.string("cluster")
+		res.int32(1) // controller_id
+		res.arrayLength(1)
+		if topic != "orders" {
+			res.int16(3)
+			res.string(topic)
+			res.bool(false)
+			res.arrayLength(0)
+			return
+		}
+		res.int16(0)
+		res.string(topic)
+		res.bool(false)
+		res.arrayLength(len(b.latest))
+		for partition := int32(0); partition < int32(len(b.latest)); partition++ {
+			res.int16(0)
+			res.int32(partition)
+			res.int32(1) // leader_id
+			res.arrayLength(1)
+			res.int32(1)
+			res.arrayLength(1)
+			res.int32(1)
+		}
+
+	case apiListOffsets:
+		d.int32() // replica_id
+		d.arrayLength()
+		topic := d.string()
+		res.arrayLength(1)
+		res.string(topic)
+		n := d.arrayLength()
+		res.arrayLength(n)
+		for ; n > 0; n-- {
+			partition := d.int32()
+			offsets := b.latest
+			if d.int64() == earliestOffset {
+				offsets = b.earliest
+			}
+			res.int32(partition)
+			res.int16(0)
+			res.int64(-1)
+			res.int64(offsets[partition])
+		}
+
+	case apiFindCoordinator:
+		res.int16(0)
+		res.int32(1)
+		res.string(b.host)
+		res.int32(b.port)
+
+	case apiOffsetFetch:
+		group := d.string()
+		d.arrayLength()
+		topic := d.string()
+		res.arrayLength(1)
+		res.string(topic)
+		n := d.arrayLength()
+		res.arrayLength(n)
+		for ; n > 0; n-- {
+			partition := d.int32()
+			offset, ok := b.committed[partition]
+			if !ok || group != "billing" {
+				offset = -1
+			}
+			res.int32(partition)
+			res.int64(offset)
+			res.string("")
+			res.int16(0)
+		}
+	}
+}
+
+func TestConsumerLag(t *testing.T) {
+	addr := startBroker(t, &fakeBroker{
+		earliest:  map[int32]int64{0: 5, 1: 5, 2: 5},
+		latest:    map[int32]int64{0: 100, 1: 50, 2: 10},
+		committed: map[int32]int64{0: 90, 1: 50},
+	})
+	opts := Options{Brokers: []string{"127.0.0.1:1", addr}}
+
+	lag, err := ConsumerLag(opts, "billing", "orders")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fmt.Sprint(lag) != "map[0:10 1:0 2:5]" {
+		t.Error(fmt.Errorf("Wrong lag: %v", lag))
+		return
+	}
+
+	// Groups that never committed lag by all retained messages
+	lag, err = ConsumerLag(opts, "reporting", "orders")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fmt.Sprint(lag) != "map[0:95 1:45 2:5]" {
+		t.Error(fmt.Errorf("Wrong lag for new group: %v", lag))
+		return
+	}
+
+	_, err = ConsumerLag(opts, "billing", "ordres")
+	if err == nil || err.Error() != "Failed to get metadata of topic 'ordres': Kafka error 3 (UNKNOWN_TOPIC_OR_PARTITION)" {
+		t.Error(fmt.Errorf("Expected unknown topic to fail, got: %v", err))
+		return
+	}
+
+	_, err = ConsumerLag(Options{Brokers: []string{"127.0.0.1:" + strconv.Itoa(1)}}, "billing", "orders")
+	if err == nil {
+		t.Error(fmt.Errorf("Expected unreachable cluster to fail"))
+		return
+	}
+}
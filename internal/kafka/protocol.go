@@ -0,0 +1,133 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// API keys of the requests that are used to compute consumer lag
+const (
+	apiListOffsets     = 2
+	apiMetadata        = 3
+	apiOffsetFetch     = 9
+	apiFindCoordinator = 10
+)
+
+var errorNames = map[int16]string{
+	1:  "OFFSET_OUT_OF_RANGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	14: "COORDINATOR_LOAD_IN_PROGRESS",
+	15: "COORDINATOR_NOT_AVAILABLE",
+	16: "NOT_COORDINATOR",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	30: "GROUP_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED",
+	69: "GROUP_ID_NOT_FOUND",
+}
+
+func errorCode(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	if name, ok := errorNames[code]; ok {
+		return fmt.Errorf("Kafka error %d (%s)", code, name)
+	}
+	return fmt.Errorf("Kafka error %d", code)
+}
+
+// encoder writes the primitive types of the Kafka protocol.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int16(n int16) {
+	binary.Write(&e.Buffer, binary.BigEndian, n)
+}
+
+func (e *encoder) int32(n int32) {
+	binary.Write(&e.Buffer, binary.BigEndian, n)
+}
+
+func (e *encoder) int64(n int64) {
+	binary.Write(&e.Buffer, binary.BigEndian, n)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+func (e *encoder) string(str string) {
+	e.int16(int16(len(str)))
+	e.WriteString(str)
+}
+
+func (e *encoder) arrayLength(n int) {
+	e.int32(int32(n))
+}
+
+// decoder reads the primitive types of the Kafka protocol. Once the data
+// runs out, all reads return zero values and err is set.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = fmt.Errorf("Truncated Kafka response")
+		return make([]byte, n)
+	}
+	buf := d.data[:n]
+	d.data = d.data[n:]
+	return buf
+}
+
+func (d *decoder) int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.next(2)))
+}
+
+func (d *decoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *decoder) int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.next(8)))
+}
+
+func (d *decoder) bool() bool {
+	return d.next(1)[0] != 0
+}
+
+// string reads strings and nullable strings, returning "" for null.
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLength reads the length of an array, returning 0 for null arrays.
+func (d *decoder) arrayLength() int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if n > len(d.data) {
+		// Every element takes at least a byte
+		d.err = fmt.Errorf("Truncated Kafka response")
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,222 @@
+// Package pdf writes simple PDF documents, made up of text, lines,
+// rectangles and images. Text uses the standard Helvetica fonts, so
+// characters outside of Latin-1 cannot be displayed.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// Size of an A4 page, in points
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+)
+
+type Font string
+
+const (
+	Regular Font = "F1"
+	Bold    Font = "F2"
+)
+
+var fontNames = map[Font]string{
+	Regular: "Helvetica",
+	Bold:    "Helvetica-Bold",
+}
+
+// Color is an RGB color with components between 0 and 1.
+type Color struct {
+	R, G, B float64
+}
+
+var Black = Color{0, 0, 0}
+
+type Document struct {
+	Title string
+
+	pages  []*Page
+	images [][]byte
+	sizes  []image.Point
+}
+
+// Page holds the drawing operations of a single page. Coordinates are in
+// points, with the origin at the bottom left of the page.
+type Page struct {
+	doc     *Document
+	content bytes.Buffer
+}
+
+func New(title string) *Document {
+	return &Document{Title: title}
+}
+
+func (doc *Document) AddPage() *Page {
+	page := &Page{doc: doc}
+	doc.pages = append(doc.pages, page)
+	return page
+}
+
+// escape encodes a string as a PDF string literal, using WinAnsiEncoding.
+func escape(str string) string {
+	var buffer strings.Builder
+	buffer.WriteByte('(')
+	for _, r := range str {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			buffer.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&buffer, "\\%03o", r)
+		default:
+			buffer.WriteByte('?')
+		}
+	}
+	buffer.WriteByte(')')
+	return buffer.String()
+}
+
+func (page *Page) Text(x, y, size float64, font Font, color Color, str string) {
+	fmt.Fprintf(&page.content, "BT %.3f %.3f %.3f rg /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", color.R, color.G, color.B, font, size, x, y, escape(str))
+}
+
+func (page *Page) Line(x1, y1, x2, y2, width float64, color Color) {
+	fmt.Fprintf(&page.content, "%.3f %.3f %.3f RG %.2f w %.2f %.2f m %.2f %.2f l S\n", color.R, color.G, color.B, width, x1, y1, x2, y2)
+}
+
+func (page *Page) Rect(x, y, width, height float64, color Color) {
+	fmt.Fprintf(&page.content, "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f\n", color.R, color.G, color.B, x, y, width, height)
+}
+
+// Image draws an image, scaled to the given size. The image's alpha
+// channel is ignored.
+func (page *Page) Image(img image.Image, x, y, width, height float64) error {
+	bounds := img.Bounds()
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	row := make([]byte, 0, 3*bounds.Dx())
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		row = row[:0]
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			r, g, b, _ := img.At(px, py).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	doc := page.doc
+	doc.images = append(doc.images, compressed.Bytes())
+	doc.sizes = append(doc.sizes, bounds.Size())
+	fmt.Fprintf(&page.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, x, y, len(doc.images))
+	return nil
+}
+
+type writer struct {
+	out     io.Writer
+	n       int64
+	offsets []int64
+	err     error
+}
+
+func (w *writer) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		var n int
+		n, w.err = fmt.Fprintf(w.out, format, args...)
+		w.n += int64(n)
+	}
+}
+
+// object starts the next object, which must be numbered 'id'.
+func (w *writer) object(id int) {
+	w.offsets = append(w.offsets, w.n)
+	w.printf("%d 0 obj\n", id)
+}
+
+func (w *writer) stream(dict string, data []byte) {
+	w.printf("<< %s /Length %d >>\nstream\n", dict, len(data))
+	if w.err == nil {
+		var n int
+		n, w.err = w.out.Write(data)
+		w.n += int64(n)
+	}
+	w.printf("\nendstream\nendobj\n")
+}
+
+// WriteTo writes the document. A document without pages gets a single
+// empty page, since PDF documents cannot be empty.
+func (doc *Document) WriteTo(out io.Writer) (int64, error) {
+	if len(doc.pages) == 0 {
+		doc.AddPage()
+	}
+
+	// Objects are numbered in the order: catalog, page tree, info, fonts,
+	// resources, images, then each page followed by its content
+	const catalogID, pagesID, infoID, firstFontID = 1, 2, 3, 4
+	resourcesID := firstFontID + len(fontNames)
+	firstImageID := resourcesID + 1
+	firstPageID := firstImageID + len(doc.images)
+
+	w := &writer{out: out}
+	w.printf("%%PDF-1.4\n")
+
+	w.object(catalogID)
+	w.printf("<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pagesID)
+
+	kids := make([]string, len(doc.pages))
+	for i := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageID+2*i)
+	}
+	w.object(pagesID)
+	w.printf("<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(doc.pages))
+
+	w.object(infoID)
+	w.printf("<< /Title %s /Producer (patrol) >>\nendobj\n", escape(doc.Title))
+
+	fonts := []Font{Regular, Bold}
+	fontRefs := make([]string, len(fonts))
+	for i, font := range fonts {
+		w.object(firstFontID + i)
+		w.printf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>\nendobj\n", fontNames[font])
+		fontRefs[i] = fmt.Sprintf("/%s %d 0 R", font, firstFontID+i)
+	}
+
+	imageRefs := make([]string, len(doc.images))
+	for i := range doc.images {
+		imageRefs[i] = fmt.Sprintf("/Im%d %d 0 R", i+1, firstImageID+i)
+	}
+	w.object(resourcesID)
+	w.printf("<< /Font << %s >> /XObject << %s >> >>\nendobj\n", strings.Join(fontRefs, " "), strings.Join(imageRefs, " "))
+
+	for i, data := range doc.images {
+		w.object(firstImageID + i)
+		w.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode", doc.sizes[i].X, doc.sizes[i].Y), data)
+	}
+
+	for i, page := range doc.pages {
+		pageID := firstPageID + 2*i
+		w.object(pageID)
+		w.printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.0f %.0f] /Resources %d 0 R /Contents %d 0 R >>\nendobj\n", pagesID, PageWidth, PageHeight, resourcesID, pageID+1)
+		w.object(pageID + 1)
+		w.stream("", page.content.Bytes())
+	}
+
+	xrefOffset := w.n
+	w.printf("xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, offset := range w.offsets {
+		w.printf("%010d 00000 n \n", offset)
+	}
+	w.printf("trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets)+1, catalogID, infoID, xrefOffset)
+	return w.n, w.err
+}
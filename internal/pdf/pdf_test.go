@@ -0,0 +1,64 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDocument(t *testing.T) {
+	doc := New("Test (report)")
+	page := doc.AddPage()
+	page.Text(40, 800, 12, Bold, Black, "Uptime: 99.9% (café)")
+	page.Rect(40, 700, 100, 50, Color{0.5, 0.5, 0.5})
+	if err := page.Image(image.NewRGBA(image.Rect(0, 0, 4, 2)), 40, 600, 100, 50); err != nil {
+		t.Error(err)
+		return
+	}
+	doc.AddPage().Line(40, 40, 100, 100, 1, Black)
+
+	var buffer bytes.Buffer
+	n, err := doc.WriteTo(&buffer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data := buffer.String()
+	if int(n) != len(data) {
+		t.Error(fmt.Errorf("Wrote %d bytes, but reported %d", len(data), n))
+		return
+	}
+
+	for _, expected := range []string{
+		"%PDF-1.4\n",
+		"/Title (Test \\(report\\))",
+		"(Uptime: 99.9% \\(caf\\351\\)) Tj",
+		"/Count 2",
+		"/Width 4 /Height 2",
+		"/Im1 Do",
+	} {
+		if !strings.Contains(data, expected) {
+			t.Error(fmt.Errorf("Expected document to contain %q:\n%s", expected, data))
+			return
+		}
+	}
+
+	// Every offset in the cross-reference table must point at its object
+	xref := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(data, -1)
+	for i, match := range xref {
+		offset, _ := strconv.Atoi(match[1])
+		if !strings.HasPrefix(data[offset:], fmt.Sprintf("%d 0 obj", i+1)) {
+			t.Error(fmt.Errorf("Offset of object %d is wrong: %d", i+1, offset))
+			return
+		}
+	}
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(data)
+	if offset, _ := strconv.Atoi(startxref[1]); !strings.HasPrefix(data[offset:], "xref\n") {
+		t.Error(fmt.Errorf("Offset of cross-reference table is wrong: %d", offset))
+		return
+	}
+}
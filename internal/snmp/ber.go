@@ -0,0 +1,199 @@
+package snmp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags used by SNMP
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+
+	tagIPAddress = 0x40
+	tagCounter32 = 0x41
+	tagGauge32   = 0x42
+	tagTimeTicks = 0x43
+	tagOpaque    = 0x44
+	tagCounter64 = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	tagGetRequest = 0xa0
+	tagResponse   = 0xa2
+	tagReport     = 0xa8
+)
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var buf []byte
+	for ; n > 0; n >>= 8 {
+		buf = append([]byte{byte(n)}, buf...)
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+func encodeTLV(tag byte, value []byte) []byte {
+	out := append([]byte{tag}, encodeLength(len(value))...)
+	return append(out, value...)
+}
+
+func encodeSequence(tag byte, elements ...[]byte) []byte {
+	return encodeTLV(tag, bytes.Join(elements, nil))
+}
+
+func encodeInteger(n int64) []byte {
+	// Minimal two's complement encoding
+	buf := []byte{byte(n)}
+	for n >= 0x80 || n < -0x80 {
+		n >>= 8
+		buf = append([]byte{byte(n)}, buf...)
+	}
+	return encodeTLV(tagInteger, buf)
+}
+
+func encodeOctetString(str []byte) []byte {
+	return encodeTLV(tagOctetString, str)
+}
+
+func parseOID(oid string) ([]uint64, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid OID '%s': must have at least two parts", oid)
+	}
+	ids := make([]uint64, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OID '%s': only numeric OIDs are supported", oid)
+		}
+		ids[i] = id
+	}
+	if ids[0] > 2 || (ids[0] < 2 && ids[1] >= 40) {
+		return nil, fmt.Errorf("Invalid OID '%s'", oid)
+	}
+	return ids, nil
+}
+
+// ValidateOID checks that an OID can be requested.
+func ValidateOID(oid string) error {
+	_, err := parseOID(oid)
+	return err
+}
+
+func encodeOID(oid string) ([]byte, error) {
+	ids, err := parseOID(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first two parts are combined into a single subidentifier
+	ids = append([]uint64{ids[0]*40 + ids[1]}, ids[2:]...)
+	var buf []byte
+	for _, id := range ids {
+		chunk := []byte{byte(id & 0x7f)}
+		for id >>= 7; id > 0; id >>= 7 {
+			chunk = append([]byte{0x80 | byte(id&0x7f)}, chunk...)
+		}
+		buf = append(buf, chunk...)
+	}
+	return encodeTLV(tagOID, buf), nil
+}
+
+// decodeTLV splits the first element off of BER encoded data.
+func decodeTLV(data []byte) (tag byte, value, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("Truncated SNMP message")
+	}
+	tag = data[0]
+	length := int(data[1])
+	offset := 2
+	if length&0x80 != 0 {
+		numBytes := length & 0x7f
+		if numBytes == 0 || numBytes > 4 || len(data) < 2+numBytes {
+			return 0, nil, nil, fmt.Errorf("Invalid length in SNMP message")
+		}
+		length = 0
+		for _, b := range data[2 : 2+numBytes] {
+			length = length<<8 | int(b)
+		}
+		offset += numBytes
+	}
+	if length < 0 || len(data) < offset+length {
+		return 0, nil, nil, fmt.Errorf("Truncated SNMP message")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// decodeExpected decodes the first element of data, which must have the
+// given tag.
+func decodeExpected(tag byte, data []byte) (value, rest []byte, err error) {
+	actual, value, rest, err := decodeTLV(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if actual != tag {
+		return nil, nil, fmt.Errorf("Unexpected element in SNMP message: expected tag 0x%02x, got 0x%02x", tag, actual)
+	}
+	return value, rest, nil
+}
+
+func decodeInteger(value []byte) int64 {
+	var n int64
+	if len(value) > 0 && value[0]&0x80 != 0 {
+		n = -1
+	}
+	for _, b := range value {
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func decodeUnsigned(value []byte) uint64 {
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func decodeOID(value []byte) string {
+	var ids []string
+	var id uint64
+	for i, b := range value {
+		id = id<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			if len(ids) == 0 {
+				// The first subidentifier holds the first two parts
+				first := id / 40
+				if first > 2 {
+					first = 2
+				}
+				ids = append(ids, strconv.FormatUint(first, 10), strconv.FormatUint(id-first*40, 10))
+			} else {
+				ids = append(ids, strconv.FormatUint(id, 10))
+			}
+			id = 0
+		} else if i == len(value)-1 {
+			ids = append(ids, "?")
+		}
+	}
+	return strings.Join(ids, ".")
+}
+
+func decodeIntegerElement(data []byte) (int64, []byte, error) {
+	value, rest, err := decodeExpected(tagInteger, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return decodeInteger(value), rest, nil
+}
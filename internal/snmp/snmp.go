@@ -0,0 +1,314 @@
+// Package snmp implements SNMP GET requests (v1, v2c and v3 with the
+// user-based security model), which are all that patrol needs to check
+// network devices.
+package snmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options describe how to reach an SNMP agent.
+type Options struct {
+	Host string
+	Port int
+
+	// "1", "2c" (the default) or "3"
+	Version string
+
+	// Community for v1 and v2c, which defaults to "public"
+	Community string `secret:"true"`
+
+	// User-based security for v3. Authentication and privacy are each
+	// enabled by setting their password. Auth protocols are "md5" and
+	// "sha" (the default), privacy protocols are "des" and "aes" (the
+	// default).
+	Username     string
+	AuthProtocol string `yaml:"authProtocol"`
+	AuthPassword string `yaml:"authPassword" json:"-" secret:"true"`
+	PrivProtocol string `yaml:"privProtocol"`
+	PrivPassword string `yaml:"privPassword" json:"-" secret:"true"`
+
+	// Time to wait for each response, and the number of times a request is
+	// sent again once it times out
+	Timeout time.Duration
+	Retries int
+}
+
+// Validate checks that the options are complete.
+func (opts Options) Validate() error {
+	if opts.Host == "" {
+		return fmt.Errorf("A host is required")
+	}
+	switch opts.Version {
+	case "", "1", "2c":
+		return nil
+	case "3":
+		if opts.Username == "" {
+			return fmt.Errorf("A username is required for SNMP v3")
+		}
+		if opts.PrivPassword != "" && opts.AuthPassword == "" {
+			return fmt.Errorf("Privacy requires an auth password")
+		}
+		for _, password := range []string{opts.AuthPassword, opts.PrivPassword} {
+			if password != "" && len(password) < 8 {
+				return fmt.Errorf("SNMP v3 passwords must be at least 8 characters long")
+			}
+		}
+		if _, err := authHash(opts.AuthProtocol); err != nil {
+			return err
+		}
+		if opts.PrivProtocol != "" && opts.PrivProtocol != "aes" && opts.PrivProtocol != "des" {
+			return fmt.Errorf("Unrecognized privacy protocol: '%s'", opts.PrivProtocol)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unrecognized SNMP version: '%s'", opts.Version)
+	}
+}
+
+// Variable is a value returned by an agent.
+type Variable struct {
+	OID string
+
+	// Name of the value's type (i.e. "Integer" or "Counter32")
+	Type string
+
+	// int64 for integers, uint64 for counters, gauges and time ticks, and
+	// string for all other types
+	Value interface{}
+}
+
+// Float returns the value of numeric variables.
+func (v Variable) Float() (float64, bool) {
+	switch n := v.Value.(type) {
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case string:
+		// Some devices (i.e. UPSes) report numbers as strings
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (v Variable) String() string {
+	return fmt.Sprint(v.Value)
+}
+
+var errTimeout = errors.New("Timed out waiting for a response")
+
+func randomInt32() int64 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return int64(binary.BigEndian.Uint32(buf[:]) & 0x7fffffff)
+}
+
+func encodePDU(tag byte, requestID int64, oids []string) ([]byte, error) {
+	varbinds := make([][]byte, len(oids))
+	for i, oid := range oids {
+		encoded, err := encodeOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		varbinds[i] = encodeSequence(tagSequence, encoded, encodeTLV(tagNull, nil))
+	}
+	return encodeSequence(tag,
+		encodeInteger(requestID),
+		encodeInteger(0),
+		encodeInteger(0),
+		encodeSequence(tagSequence, varbinds...),
+	), nil
+}
+
+var errorStatuses = []string{
+	"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr",
+	"noAccess", "wrongType", "wrongLength", "wrongEncoding", "wrongValue",
+	"noCreation", "inconsistentValue", "resourceUnavailable", "commitFailed",
+	"undoFailed", "authorizationError", "notWritable", "inconsistentName",
+}
+
+type pdu struct {
+	tag       byte
+	requestID int64
+	variables []Variable
+}
+
+func decodePDU(data []byte) (pdu, error) {
+	tag, value, _, err := decodeTLV(data)
+	if err != nil {
+		return pdu{}, err
+	}
+	p := pdu{tag: tag}
+	if p.requestID, value, err = decodeIntegerElement(value); err != nil {
+		return p, err
+	}
+	errorStatus, value, err := decodeIntegerElement(value)
+	if err != nil {
+		return p, err
+	}
+	errorIndex, value, err := decodeIntegerElement(value)
+	if err != nil {
+		return p, err
+	}
+	if errorStatus != 0 {
+		name := strconv.FormatInt(errorStatus, 10)
+		if errorStatus > 0 && errorStatus < int64(len(errorStatuses)) {
+			name = errorStatuses[errorStatus]
+		}
+		return p, fmt.Errorf("Agent returned error '%s' for variable %d", name, errorIndex)
+	}
+
+	varbinds, _, err := decodeExpected(tagSequence, value)
+	if err != nil {
+		return p, err
+	}
+	for len(varbinds) > 0 {
+		var varbind []byte
+		if varbind, varbinds, err = decodeExpected(tagSequence, varbinds); err != nil {
+			return p, err
+		}
+		oid, rest, err := decodeExpected(tagOID, varbind)
+		if err != nil {
+			return p, err
+		}
+		v, err := decodeVariable(decodeOID(oid), rest)
+		if err != nil {
+			return p, err
+		}
+		p.variables = append(p.variables, v)
+	}
+	return p, nil
+}
+
+func decodeVariable(oid string, data []byte) (Variable, error) {
+	tag, value, _, err := decodeTLV(data)
+	if err != nil {
+		return Variable{}, err
+	}
+	v := Variable{OID: oid}
+	switch tag {
+	case tagInteger:
+		v.Type, v.Value = "Integer", decodeInteger(value)
+	case tagOctetString:
+		v.Type, v.Value = "OctetString", string(value)
+	case tagOID:
+		v.Type, v.Value = "ObjectIdentifier", decodeOID(value)
+	case tagIPAddress:
+		v.Type, v.Value = "IpAddress", net.IP(value).String()
+	case tagCounter32:
+		v.Type, v.Value = "Counter32", decodeUnsigned(value)
+	case tagGauge32:
+		v.Type, v.Value = "Gauge32", decodeUnsigned(value)
+	case tagTimeTicks:
+		v.Type, v.Value = "TimeTicks", decodeUnsigned(value)
+	case tagCounter64:
+		v.Type, v.Value = "Counter64", decodeUnsigned(value)
+	case tagOpaque:
+		v.Type, v.Value = "Opaque", fmt.Sprintf("%x", value)
+	case tagNull:
+		v.Type, v.Value = "Null", ""
+	case tagNoSuchObject:
+		return v, fmt.Errorf("No such object: %s", oid)
+	case tagNoSuchInstance:
+		return v, fmt.Errorf("No such instance: %s", oid)
+	case tagEndOfMibView:
+		return v, fmt.Errorf("End of MIB view: %s", oid)
+	default:
+		return v, fmt.Errorf("Unsupported type 0x%02x for %s", tag, oid)
+	}
+	return v, nil
+}
+
+// roundTrip sends a request until a response that is accepted by 'parse'
+// arrives, or until all retries have timed out. Responses that are not
+// accepted (i.e. late responses to earlier requests) are skipped.
+func roundTrip(conn net.Conn, opts Options, request []byte, parse func([]byte) (bool, error)) error {
+	buffer := make([]byte, 65535)
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(opts.Timeout))
+		for {
+			n, err := conn.Read(buffer)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return err
+			}
+			if ok, err := parse(buffer[:n]); ok || err != nil {
+				return err
+			}
+		}
+	}
+	return errTimeout
+}
+
+// Get fetches the values of the given OIDs. Only numeric OIDs are
+// supported, since MIBs are not loaded.
+func Get(opts Options, oids ...string) ([]Variable, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Port == 0 {
+		opts.Port = 161
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if opts.Version == "3" {
+		return getV3(conn, opts, oids)
+	}
+
+	version := int64(1)
+	if opts.Version == "1" {
+		version = 0
+	}
+	community := opts.Community
+	if community == "" {
+		community = "public"
+	}
+	requestID := randomInt32()
+	encodedPDU, err := encodePDU(tagGetRequest, requestID, oids)
+	if err != nil {
+		return nil, err
+	}
+	request := encodeSequence(tagSequence, encodeInteger(version), encodeOctetString([]byte(community)), encodedPDU)
+
+	var variables []Variable
+	err = roundTrip(conn, opts, request, func(data []byte) (bool, error) {
+		message, _, err := decodeExpected(tagSequence, data)
+		if err != nil {
+			return false, nil
+		}
+		if _, message, err = decodeIntegerElement(message); err != nil {
+			return false, nil
+		}
+		if _, message, err = decodeExpected(tagOctetString, message); err != nil {
+			return false, nil
+		}
+		response, err := decodePDU(message)
+		if response.requestID != requestID {
+			return false, nil
+		}
+		variables = response.variables
+		return true, err
+	})
+	return variables, err
+}
@@ -0,0 +1,272 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalizeKey(t *testing.T) {
+	// Test vectors from RFC 3414 (A.3)
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	for protocol, expected := range map[string]string{
+		"md5": "526f5eed9fcce26f8964c2930787d82b",
+		"sha": "6695febc9288e36282235fc7151f128497b38f3f",
+	} {
+		newHash, err := authHash(protocol)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		key := hex.EncodeToString(localizeKey(newHash, "maplesyrup", engineID))
+		if key != expected {
+			t.Errorf("Expected %s key to be %s, got %s", protocol, expected, key)
+		}
+	}
+}
+
+// fakeAgent answers GET requests for a fixed set of values.
+type fakeAgent struct {
+	conn     net.PacketConn
+	opts     Options
+	engineID []byte
+	values   map[string][]byte
+}
+
+func startAgent(t *testing.T, opts Options) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	agent := &fakeAgent{
+		conn:     conn,
+		opts:     opts,
+		engineID: []byte("\x80\x00\x1f\x88\x04patrol"),
+		values: map[string][]byte{
+			"1.3.6.1.2.1.1.5.0":         encodeOctetString([]byte("core-switch")),
+			"1.3.6.1.2.1.2.2.1.8.1":     encodeInteger(1),
+			"1.3.6.1.2.1.2.2.1.10.1":    encodeTLV(tagCounter32, []byte{0x00, 0xff, 0xff, 0xff, 0xff}),
+			"1.3.6.1.4.1.2021.10.1.3.1": encodeOctetString([]byte("0.42")),
+		},
+	}
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if response := agent.handle(buffer[:n]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (a *fakeAgent) respond(request []byte) []byte {
+	req, err := decodePDU(request)
+	if err != nil {
+		return nil
+	}
+	var varbinds [][]byte
+	for _, v := range req.variables {
+		oid, _ := encodeOID(v.OID)
+		value, ok := a.values[v.OID]
+		if !ok {
+			value = encodeTLV(tagNoSuchObject, nil)
+		}
+		varbinds = append(varbinds, encodeSequence(tagSequence, oid, value))
+	}
+	return encodeSequence(tagResponse, encodeInteger(req.requestID), encodeInteger(0), encodeInteger(0), encodeSequence(tagSequence, varbinds...))
+}
+
+func (a *fakeAgent) report(msgID int64, stat string) []byte {
+	oid, _ := encodeOID(stat)
+	pdu := encodeSequence(tagReport, encodeInteger(0), encodeInteger(0), encodeInteger(0), encodeSequence(tagSequence,
+		encodeSequence(tagSequence, oid, encodeTLV(tagCounter32, []byte{1})),
+	))
+	return v3Message{
+		msgID:     msgID,
+		params:    usmParams{engineID: a.engineID, boots: 3, time: 1000},
+		scopedPDU: encodeSequence(tagSequence, encodeOctetString(a.engineID), encodeOctetString(nil), pdu),
+	}.encode()
+}
+
+func (a *fakeAgent) handle(data []byte) []byte {
+	if a.opts.Version != "3" {
+		message, _, err := decodeExpected(tagSequence, data)
+		if err != nil {
+			return nil
+		}
+		if _, message, err = decodeIntegerElement(message); err != nil {
+			return nil
+		}
+		community, message, err := decodeExpected(tagOctetString, message)
+		if err != nil || string(community) != a.opts.Community {
+			return nil
+		}
+		return encodeSequence(tagSequence, encodeInteger(1), encodeOctetString(community), a.respond(message))
+	}
+
+	request, err := decodeV3Message(data)
+	if err != nil {
+		return nil
+	}
+	if len(request.params.engineID) == 0 {
+		return a.report(request.msgID, "1.3.6.1.6.3.15.1.1.4.0")
+	}
+
+	newHash, _ := authHash(a.opts.AuthProtocol)
+	authKey := localizeKey(newHash, a.opts.AuthPassword, a.engineID)
+	var privKey []byte
+	if a.opts.PrivPassword != "" {
+		privKey = localizeKey(newHash, a.opts.PrivPassword, a.engineID)
+	}
+	if request.flags&flagAuth != 0 && !verify(newHash, authKey, data, request.params.authParams) {
+		return a.report(request.msgID, "1.3.6.1.6.3.15.1.1.5.0")
+	}
+	scopedPDU := request.scopedPDU
+	if request.flags&flagPriv != 0 {
+		if scopedPDU, err = decrypt(a.opts.PrivProtocol, privKey, request.params.boots, request.params.time, request.params.privParams, scopedPDU); err != nil {
+			return nil
+		}
+	}
+	if scopedPDU, _, err = decodeExpected(tagSequence, scopedPDU); err != nil {
+		return nil
+	}
+	if _, scopedPDU, err = decodeExpected(tagOctetString, scopedPDU); err != nil {
+		return nil
+	}
+	if _, scopedPDU, err = decodeExpected(tagOctetString, scopedPDU); err != nil {
+		return nil
+	}
+
+	response := v3Message{
+		msgID:     request.msgID,
+		flags:     request.flags &^ flagReportable,
+		params:    usmParams{engineID: a.engineID, boots: 3, time: 1000, username: request.params.username},
+		scopedPDU: encodeSequence(tagSequence, encodeOctetString(a.engineID), encodeOctetString(nil), a.respond(scopedPDU)),
+	}
+	if response.flags&flagPriv != 0 {
+		response.scopedPDU, response.params.privParams, _ = encrypt(a.opts.PrivProtocol, privKey, 3, 1000, response.scopedPDU)
+	}
+	if response.flags&flagAuth != 0 {
+		return sign(newHash, authKey, response)
+	}
+	return response.encode()
+}
+
+func TestGet(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		agent  Options
+		client Options
+		err    string
+	}{
+		{
+			name:   "v2c",
+			agent:  Options{Community: "public"},
+			client: Options{},
+		},
+		{
+			name:   "v2c with the wrong community",
+			agent:  Options{Community: "secret"},
+			client: Options{Community: "public"},
+			err:    "Timed out",
+		},
+		{
+			name:   "v3 without privacy",
+			agent:  Options{Version: "3", AuthProtocol: "md5", AuthPassword: "authpassword"},
+			client: Options{Version: "3", Username: "patrol", AuthProtocol: "md5", AuthPassword: "authpassword"},
+		},
+		{
+			name:   "v3 with AES",
+			agent:  Options{Version: "3", AuthPassword: "authpassword", PrivPassword: "privpassword"},
+			client: Options{Version: "3", Username: "patrol", AuthPassword: "authpassword", PrivPassword: "privpassword"},
+		},
+		{
+			name:   "v3 with DES",
+			agent:  Options{Version: "3", AuthProtocol: "md5", AuthPassword: "authpassword", PrivProtocol: "des", PrivPassword: "privpassword"},
+			client: Options{Version: "3", Username: "patrol", AuthProtocol: "md5", AuthPassword: "authpassword", PrivProtocol: "des", PrivPassword: "privpassword"},
+		},
+		{
+			name:   "v3 with the wrong password",
+			agent:  Options{Version: "3", AuthPassword: "authpassword"},
+			client: Options{Version: "3", Username: "patrol", AuthPassword: "wrongpassword"},
+			err:    "Wrong digest",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.client
+			opts.Host = "127.0.0.1"
+			opts.Port = startAgent(t, test.agent)
+			opts.Timeout = 200 * time.Millisecond
+
+			variables, err := Get(opts, "1.3.6.1.2.1.1.5.0", ".1.3.6.1.2.1.2.2.1.8.1", "1.3.6.1.2.1.2.2.1.10.1", "1.3.6.1.4.1.2021.10.1.3.1")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected error containing '%s', got: %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(variables) != 4 {
+				t.Errorf("Expected 4 variables, got: %#v", variables)
+				return
+			}
+			if variables[0].String() != "core-switch" || variables[0].Type != "OctetString" {
+				t.Errorf("Unexpected sysName: %#v", variables[0])
+			}
+			if n, ok := variables[1].Float(); !ok || n != 1 || variables[1].Type != "Integer" {
+				t.Errorf("Unexpected ifOperStatus: %#v", variables[1])
+			}
+			if n, ok := variables[2].Float(); !ok || n != 4294967295 || variables[2].Type != "Counter32" {
+				t.Errorf("Unexpected ifInOctets: %#v", variables[2])
+			}
+			if n, ok := variables[3].Float(); !ok || n != 0.42 {
+				t.Errorf("Unexpected load average: %#v", variables[3])
+			}
+		})
+	}
+}
+
+func TestGetMissingObject(t *testing.T) {
+	port := startAgent(t, Options{Community: "public"})
+	_, err := Get(Options{Host: "127.0.0.1", Port: port, Timeout: time.Second}, "1.3.6.1.2.1.1.99.0")
+	if err == nil || err.Error() != "No such object: 1.3.6.1.2.1.1.99.0" {
+		t.Errorf("Expected missing object to fail, got: %v", err)
+	}
+}
+
+func TestEncodeOID(t *testing.T) {
+	encoded, err := encodeOID("1.3.6.1.4.1.2021.10.1.3.1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(encoded, []byte{0x06, 0x0b, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x8f, 0x65, 0x0a, 0x01, 0x03, 0x01}) {
+		t.Errorf("Unexpected encoding: %x", encoded)
+	}
+	value, _, err := decodeExpected(tagOID, encoded)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if oid := decodeOID(value); oid != "1.3.6.1.4.1.2021.10.1.3.1" {
+		t.Errorf("Unexpected decoded OID: %s", oid)
+	}
+
+	if _, err := encodeOID("sysName.0"); err == nil {
+		t.Errorf("Expected non-numeric OID to fail")
+	}
+}
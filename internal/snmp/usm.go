@@ -0,0 +1,464 @@
+package snmp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+// SNMP v3 with the user-based security model (RFC 3414), and AES privacy
+// (RFC 3826).
+
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+
+	securityModelUSM = 3
+	maxMessageSize   = 65507
+
+	// Length of the truncated HMACs used by HMAC-MD5-96 and HMAC-SHA-96
+	authParamsLength = 12
+)
+
+// Counters that agents send in reports when they reject a request
+var usmStats = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "Unsupported security level",
+	"1.3.6.1.6.3.15.1.1.2.0": "Not in time window",
+	"1.3.6.1.6.3.15.1.1.3.0": "Unknown user name",
+	"1.3.6.1.6.3.15.1.1.4.0": "Unknown engine ID",
+	"1.3.6.1.6.3.15.1.1.5.0": "Wrong digest (check the auth password)",
+	"1.3.6.1.6.3.15.1.1.6.0": "Decryption error (check the privacy password)",
+}
+
+var errNotInTimeWindow = errors.New("Not in time window")
+
+func authHash(protocol string) (func() hash.Hash, error) {
+	switch protocol {
+	case "", "sha":
+		return sha1.New, nil
+	case "md5":
+		return md5.New, nil
+	default:
+		return nil, fmt.Errorf("Unrecognized auth protocol: '%s'", protocol)
+	}
+}
+
+// localizeKey turns a password into a key that is specific to an engine, as
+// described in RFC 3414 (A.2).
+func localizeKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	chunk := make([]byte, 64)
+	for i := 0; i < 1048576; i += len(chunk) {
+		for j := range chunk {
+			chunk[j] = password[(i+j)%len(password)]
+		}
+		h.Write(chunk)
+	}
+	key := h.Sum(nil)
+
+	h.Reset()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+type usmParams struct {
+	engineID   []byte
+	boots      int64
+	time       int64
+	username   []byte
+	authParams []byte
+	privParams []byte
+}
+
+func (u usmParams) encode() []byte {
+	return encodeSequence(tagSequence,
+		encodeOctetString(u.engineID),
+		encodeInteger(u.boots),
+		encodeInteger(u.time),
+		encodeOctetString(u.username),
+		encodeOctetString(u.authParams),
+		encodeOctetString(u.privParams),
+	)
+}
+
+func decodeUSMParams(data []byte) (u usmParams, err error) {
+	if data, _, err = decodeExpected(tagSequence, data); err != nil {
+		return
+	}
+	if u.engineID, data, err = decodeExpected(tagOctetString, data); err != nil {
+		return
+	}
+	if u.boots, data, err = decodeIntegerElement(data); err != nil {
+		return
+	}
+	if u.time, data, err = decodeIntegerElement(data); err != nil {
+		return
+	}
+	if u.username, data, err = decodeExpected(tagOctetString, data); err != nil {
+		return
+	}
+	if u.authParams, data, err = decodeExpected(tagOctetString, data); err != nil {
+		return
+	}
+	u.privParams, _, err = decodeExpected(tagOctetString, data)
+	return
+}
+
+type v3Message struct {
+	msgID  int64
+	flags  byte
+	params usmParams
+
+	// Encrypted if the privacy flag is set
+	scopedPDU []byte
+}
+
+func (m v3Message) encode() []byte {
+	scopedPDU := m.scopedPDU
+	if m.flags&flagPriv != 0 {
+		scopedPDU = encodeOctetString(scopedPDU)
+	}
+	return encodeSequence(tagSequence,
+		encodeInteger(3),
+		encodeSequence(tagSequence,
+			encodeInteger(m.msgID),
+			encodeInteger(maxMessageSize),
+			encodeOctetString([]byte{m.flags}),
+			encodeInteger(securityModelUSM),
+		),
+		encodeOctetString(m.params.encode()),
+		scopedPDU,
+	)
+}
+
+func decodeV3Message(data []byte) (m v3Message, err error) {
+	if data, _, err = decodeExpected(tagSequence, data); err != nil {
+		return
+	}
+	version, data, err := decodeIntegerElement(data)
+	if err != nil {
+		return
+	}
+	if version != 3 {
+		err = fmt.Errorf("Unexpected SNMP version in response: %d", version)
+		return
+	}
+	header, data, err := decodeExpected(tagSequence, data)
+	if err != nil {
+		return
+	}
+	if m.msgID, header, err = decodeIntegerElement(header); err != nil {
+		return
+	}
+	if _, header, err = decodeIntegerElement(header); err != nil {
+		return
+	}
+	flags, _, err := decodeExpected(tagOctetString, header)
+	if err != nil {
+		return
+	}
+	if len(flags) != 1 {
+		err = fmt.Errorf("Invalid flags in SNMP message")
+		return
+	}
+	m.flags = flags[0]
+
+	params, data, err := decodeExpected(tagOctetString, data)
+	if err != nil {
+		return
+	}
+	if m.params, err = decodeUSMParams(params); err != nil {
+		return
+	}
+	if m.flags&flagPriv != 0 {
+		m.scopedPDU, _, err = decodeExpected(tagOctetString, data)
+	} else {
+		_, _, _, err = decodeTLV(data)
+		m.scopedPDU = data
+	}
+	return
+}
+
+// sign encodes a message with its HMAC. The HMAC is computed over the
+// message with zeroes in place of the HMAC, which has the same length.
+func sign(newHash func() hash.Hash, key []byte, m v3Message) []byte {
+	m.params.authParams = make([]byte, authParamsLength)
+	mac := hmac.New(newHash, key)
+	mac.Write(m.encode())
+	m.params.authParams = mac.Sum(nil)[:authParamsLength]
+	return m.encode()
+}
+
+// verify checks the HMAC of a received message.
+func verify(newHash func() hash.Hash, key []byte, data []byte, authParams []byte) bool {
+	if len(authParams) != authParamsLength {
+		return false
+	}
+	offset := bytes.Index(data, encodeOctetString(authParams))
+	if offset < 0 {
+		return false
+	}
+	offset += 2
+	zeroed := append([]byte(nil), data...)
+	copy(zeroed[offset:offset+authParamsLength], make([]byte, authParamsLength))
+
+	mac := hmac.New(newHash, key)
+	mac.Write(zeroed)
+	return hmac.Equal(mac.Sum(nil)[:authParamsLength], authParams)
+}
+
+// encrypt encrypts a scoped PDU, and returns the salt that the receiver
+// needs to decrypt it.
+func encrypt(protocol string, key []byte, boots, engineTime int64, plaintext []byte) (ciphertext, salt []byte, err error) {
+	salt = make([]byte, 8)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+
+	if protocol == "des" {
+		// The salt is the engine's boots followed by a local integer
+		binary.BigEndian.PutUint32(salt, uint32(boots))
+		block, err := des.NewCipher(key[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = key[8+i] ^ salt[i]
+		}
+		padding := (8 - len(plaintext)%8) % 8
+		ciphertext = append(append([]byte(nil), plaintext...), make([]byte, padding)...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+		return ciphertext, salt, nil
+	}
+
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return
+	}
+	ciphertext = make([]byte, len(plaintext))
+	cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(ciphertext, plaintext)
+	return
+}
+
+func decrypt(protocol string, key []byte, boots, engineTime int64, salt, ciphertext []byte) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("Invalid privacy parameters in SNMP message")
+	}
+
+	if protocol == "des" {
+		if len(ciphertext)%8 != 0 {
+			return nil, fmt.Errorf("Invalid length of encrypted SNMP message")
+		}
+		block, err := des.NewCipher(key[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = key[8+i] ^ salt[i]
+		}
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return plaintext, nil
+	}
+
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
+
+func aesIV(boots, engineTime int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv[0:], uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
+
+// session holds the state of the agent's engine, which is discovered
+// before the first request.
+type session struct {
+	conn         net.Conn
+	opts         Options
+	newHash      func() hash.Hash
+	engineID     []byte
+	boots        int64
+	engineTime   int64
+	discoveredAt time.Time
+	authKey      []byte
+	privKey      []byte
+}
+
+func (s *session) setEngine(params usmParams) {
+	s.engineID = params.engineID
+	s.boots = params.boots
+	s.engineTime = params.time
+	s.discoveredAt = time.Now()
+}
+
+// discover asks the agent for its engine ID, boots and time by sending an
+// unauthenticated request that the agent answers with a report.
+func (s *session) discover() error {
+	msgID := randomInt32()
+	request := v3Message{
+		msgID:     msgID,
+		flags:     flagReportable,
+		scopedPDU: encodeSequence(tagSequence, encodeOctetString(nil), encodeOctetString(nil), encodeSequence(tagGetRequest, encodeInteger(randomInt32()), encodeInteger(0), encodeInteger(0), encodeSequence(tagSequence))),
+	}
+	err := roundTrip(s.conn, s.opts, request.encode(), func(data []byte) (bool, error) {
+		response, err := decodeV3Message(data)
+		if err != nil || response.msgID != msgID {
+			return false, nil
+		}
+		if len(response.params.engineID) == 0 {
+			return true, fmt.Errorf("Agent did not report its engine ID")
+		}
+		s.setEngine(response.params)
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to discover SNMP engine: %s", err)
+	}
+
+	if s.opts.AuthPassword != "" {
+		s.authKey = localizeKey(s.newHash, s.opts.AuthPassword, s.engineID)
+	}
+	if s.opts.PrivPassword != "" {
+		s.privKey = localizeKey(s.newHash, s.opts.PrivPassword, s.engineID)
+	}
+	return nil
+}
+
+func (s *session) get(oids []string) ([]Variable, error) {
+	requestID := randomInt32()
+	encodedPDU, err := encodePDU(tagGetRequest, requestID, oids)
+	if err != nil {
+		return nil, err
+	}
+	scopedPDU := encodeSequence(tagSequence, encodeOctetString(s.engineID), encodeOctetString(nil), encodedPDU)
+
+	msgID := randomInt32()
+	request := v3Message{
+		msgID: msgID,
+		flags: flagReportable,
+		params: usmParams{
+			engineID: s.engineID,
+			boots:    s.boots,
+			time:     s.engineTime + int64(time.Since(s.discoveredAt)/time.Second),
+			username: []byte(s.opts.Username),
+		},
+		scopedPDU: scopedPDU,
+	}
+	if s.privKey != nil {
+		request.flags |= flagPriv
+		request.scopedPDU, request.params.privParams, err = encrypt(s.opts.PrivProtocol, s.privKey, request.params.boots, request.params.time, scopedPDU)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := request.encode()
+	if s.authKey != nil {
+		request.flags |= flagAuth
+		data = sign(s.newHash, s.authKey, request)
+	}
+
+	var variables []Variable
+	err = roundTrip(s.conn, s.opts, data, func(data []byte) (bool, error) {
+		response, err := decodeV3Message(data)
+		if err != nil || response.msgID != msgID {
+			return false, nil
+		}
+
+		if response.flags&flagAuth != 0 {
+			if s.authKey == nil || !verify(s.newHash, s.authKey, data, response.params.authParams) {
+				return true, fmt.Errorf("Response failed authentication")
+			}
+		}
+		scopedPDU := response.scopedPDU
+		if response.flags&flagPriv != 0 {
+			if s.privKey == nil {
+				return true, fmt.Errorf("Response was encrypted unexpectedly")
+			}
+			if scopedPDU, err = decrypt(s.opts.PrivProtocol, s.privKey, response.params.boots, response.params.time, response.params.privParams, scopedPDU); err != nil {
+				return true, err
+			}
+		}
+		if scopedPDU, _, err = decodeExpected(tagSequence, scopedPDU); err != nil {
+			return true, err
+		}
+		if _, scopedPDU, err = decodeExpected(tagOctetString, scopedPDU); err != nil {
+			return true, err
+		}
+		if _, scopedPDU, err = decodeExpected(tagOctetString, scopedPDU); err != nil {
+			return true, err
+		}
+
+		pdu, err := decodePDU(scopedPDU)
+		if err != nil {
+			return true, err
+		}
+		if pdu.tag == tagReport {
+			for _, v := range pdu.variables {
+				if reason, ok := usmStats[strings.TrimPrefix(v.OID, ".")]; ok {
+					if reason == errNotInTimeWindow.Error() {
+						s.setEngine(response.params)
+						return true, errNotInTimeWindow
+					}
+					return true, fmt.Errorf("Agent rejected request: %s", reason)
+				}
+			}
+			return true, fmt.Errorf("Agent rejected request")
+		}
+		if pdu.requestID != requestID {
+			return false, nil
+		}
+		if s.authKey != nil && response.flags&flagAuth == 0 {
+			return true, fmt.Errorf("Response was not authenticated")
+		}
+		variables = pdu.variables
+		return true, nil
+	})
+	return variables, err
+}
+
+func getV3(conn net.Conn, opts Options, oids []string) ([]Variable, error) {
+	newHash, err := authHash(opts.AuthProtocol)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		conn:    conn,
+		opts:    opts,
+		newHash: newHash,
+	}
+	if err := s.discover(); err != nil {
+		return nil, err
+	}
+
+	variables, err := s.get(oids)
+	if err == errNotInTimeWindow {
+		// The agent has sent its current time along with the report
+		variables, err = s.get(oids)
+	}
+	return variables, err
+}
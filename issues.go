@@ -0,0 +1,503 @@
+package patrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+)
+
+// IssueOptions configures the issues that are opened in an issue tracker
+// for checks that stay unhealthy. Exactly one tracker must be set.
+type IssueOptions struct {
+	// Time that a check must be unhealthy before an issue is opened, and
+	// healthy before its issue is closed
+	OpenAfter  time.Duration
+	CloseAfter time.Duration
+
+	// Only open issues for checks with one of these severities. Empty
+	// means all severities.
+	Severities []checker.Severity
+
+	GitHub *GitHubIssueOptions
+	Jira   *JiraIssueOptions
+}
+
+// GitHubIssueOptions opens issues in a GitHub repository.
+type GitHubIssueOptions struct {
+	// Repository to open issues in, i.e. 'myorg/ops'
+	Repo string `yaml:",omitempty"`
+
+	// Personal access token that can write issues to the repository
+	Token string `yaml:",omitempty" json:"-" secret:"true"`
+
+	Labels []string `yaml:",omitempty"`
+
+	// API of GitHub Enterprise Server, i.e.
+	// 'https://github.myorg.com/api/v3'. Defaults to github.com.
+	APIURL string `yaml:"apiURL,omitempty"`
+}
+
+// JiraIssueOptions opens issues in a Jira project.
+type JiraIssueOptions struct {
+	// Base URL of the Jira site, i.e. 'https://myorg.atlassian.net'
+	URL string `yaml:"url,omitempty"`
+
+	// Key of the project to open issues in, and the type of the issues,
+	// which defaults to 'Bug'
+	Project   string `yaml:",omitempty"`
+	IssueType string `yaml:"issueType,omitempty"`
+
+	Labels []string `yaml:",omitempty"`
+
+	// Credentials of Jira Cloud (an email and an API token), or a
+	// personal access token of Jira Server if there is no username
+	Username string `yaml:",omitempty"`
+	Token    string `yaml:",omitempty" json:"-" secret:"true"`
+
+	// Name of the transition that closes issues. By default, the first
+	// transition to a status in the 'Done' category is used.
+	CloseTransition string `yaml:"closeTransition,omitempty"`
+}
+
+// Interval at which checks are compared with their issues, which is
+// replaced by tests
+var issueInterval = 30 * time.Second
+
+// issueRef identifies an issue in a tracker.
+type issueRef struct {
+	// Number of a GitHub issue, or key of a Jira issue
+	ID  string
+	URL string
+}
+
+// issueTracker opens, updates and closes issues.
+type issueTracker interface {
+	// find returns the open issue with the given title, if any
+	find(title string) (issueRef, bool, error)
+	open(title, body string) (issueRef, error)
+	comment(ref issueRef, body string) error
+	close(ref issueRef, body string) error
+}
+
+// issueState tracks the issue of a check, while it is open.
+type issueState struct {
+	Issue issueRef
+
+	// Status of the check in the latest update of the issue, and since
+	// when the check has been healthy
+	Unhealthy    bool
+	HealthySince time.Time
+}
+
+// Validate checks that exactly one tracker is configured, along with the
+// options that it needs.
+func (opts IssueOptions) Validate() error {
+	if (opts.GitHub == nil) == (opts.Jira == nil) {
+		return fmt.Errorf("Exactly one of 'github' and 'jira' must be specified for issues")
+	}
+	if opts.OpenAfter < 0 || opts.CloseAfter < 0 {
+		return fmt.Errorf("Times to open and close issues after cannot be negative")
+	}
+	if gh := opts.GitHub; gh != nil {
+		if parts := strings.Split(gh.Repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("GitHub repo must be formatted as 'owner/name', got: '%s'", gh.Repo)
+		}
+		if gh.Token == "" {
+			return fmt.Errorf("A token must be specified for GitHub issues")
+		}
+		if gh.APIURL != "" {
+			if u, err := url.Parse(gh.APIURL); err != nil || u.Host == "" {
+				return fmt.Errorf("Invalid GitHub apiURL: '%s'", gh.APIURL)
+			}
+		}
+	}
+	if jira := opts.Jira; jira != nil {
+		if u, err := url.Parse(jira.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid Jira url: '%s'", jira.URL)
+		}
+		if jira.Project == "" || jira.Token == "" {
+			return fmt.Errorf("A 'project' and a 'token' must be specified for Jira issues")
+		}
+	}
+	return nil
+}
+
+// newIssueTracker creates the tracker of the given options. Requests to the
+// tracker use the proxy, if any.
+func newIssueTracker(opts IssueOptions, proxy *checker.ProxyOptions) issueTracker {
+	client := &http.Client{Timeout: 1 * time.Minute}
+	if proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = proxy.ProxyFunc()
+		client.Transport = transport
+	}
+	if opts.GitHub != nil {
+		return &githubTracker{GitHubIssueOptions: *opts.GitHub, client: client}
+	}
+	return &jiraTracker{JiraIssueOptions: *opts.Jira, client: client}
+}
+
+// issueTitle is the title of the issue of a check, which identifies the
+// issue when patrol restarts.
+func issueTitle(group, name string) string {
+	return fmt.Sprintf("%s / %s is unhealthy", group, name)
+}
+
+// issueBody describes an ongoing failure of a check.
+func (p *Patrol) issueBody(c *checker.Checker, since time.Time) string {
+	event := p.newEvent("unhealthy", c.Group, c.Name)
+	lines := []string{
+		fmt.Sprintf("%s / %s has been unhealthy since %s.", c.Group, c.Name, since.UTC().Format(time.RFC3339)),
+		"",
+	}
+	if event.Error != "" {
+		lines = append(lines, fmt.Sprintf("Error: %s", event.Error))
+	}
+	if event.Owner != "" {
+		lines = append(lines, fmt.Sprintf("Owner: %s", event.Owner))
+	}
+	if event.RunbookURL != "" {
+		lines = append(lines, fmt.Sprintf("Runbook: %s", event.RunbookURL))
+	}
+	if event.Link != "" {
+		lines = append(lines, fmt.Sprintf("Status page: %s", event.Link))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// syncIssues opens an issue for each check that has been unhealthy for
+// longer than the open delay, comments on the issue when the check
+// recovers or fails again, and closes the issue once the check has been
+// healthy for the close delay. A check that fails again before its issue
+// is closed reuses the issue, and open issues with the same title are
+// reused after a restart, so that failures are not filed twice. Silenced
+// checks are not filed, and status changes of flapping checks are not
+// commented on. Requests that fail are
+// retried on the next sync.
+func (p *Patrol) syncIssues() {
+	now := time.Now()
+	for _, c := range p.checkers {
+		i, unhealthy := p.ongoingIncident(c.Group, c.Name)
+
+		p.issueMux.Lock()
+		state := p.issues[c.Group][c.Name]
+		p.issueMux.Unlock()
+
+		if state == nil {
+			if !unhealthy || c.IsPaused() || now.Sub(i.StartedAt) < p.issueOptions.OpenAfter || !p.issueMatchesSeverity(c.Severity) {
+				continue
+			}
+			if _, ok := p.silenced(c.Group, c.Name); ok {
+				continue
+			}
+			state, err := p.openIssue(c, i.StartedAt)
+			if err != nil {
+				p.logger.Warnf("Failed to open issue for %s/%s: %s", c.Group, c.Name, err)
+				continue
+			}
+			p.setIssueState(c.Group, c.Name, state)
+			continue
+		}
+
+		switch {
+		case unhealthy && !state.Unhealthy && !p.IsFlapping(c.Group, c.Name):
+			event := p.newEvent("unhealthy", c.Group, c.Name)
+			if err := p.issueTracker.comment(state.Issue, fmt.Sprintf("Failing again since %s: %s", i.StartedAt.UTC().Format(time.RFC3339), event.Error)); err != nil {
+				p.logger.Warnf("Failed to update issue %s of %s/%s: %s", state.Issue.ID, c.Group, c.Name, err)
+				continue
+			}
+			p.setIssueState(c.Group, c.Name, &issueState{Issue: state.Issue, Unhealthy: true})
+
+		case !unhealthy && state.Unhealthy && !p.IsFlapping(c.Group, c.Name):
+			since := now
+			if incidents := incidentsFromTransitions(p.History.GetTransitions(c.Group, c.Name)); len(incidents) > 0 {
+				since = incidents[len(incidents)-1].ResolvedAt
+			}
+			body := fmt.Sprintf("Recovered at %s. This issue is closed once the check has been healthy for %s.", since.UTC().Format(time.RFC3339), p.issueOptions.CloseAfter)
+			if err := p.issueTracker.comment(state.Issue, body); err != nil {
+				p.logger.Warnf("Failed to update issue %s of %s/%s: %s", state.Issue.ID, c.Group, c.Name, err)
+				continue
+			}
+			p.setIssueState(c.Group, c.Name, &issueState{Issue: state.Issue, HealthySince: since})
+
+		case !unhealthy && !state.Unhealthy && now.Sub(state.HealthySince) >= p.issueOptions.CloseAfter:
+			body := fmt.Sprintf("Healthy since %s, closing.", state.HealthySince.UTC().Format(time.RFC3339))
+			if err := p.issueTracker.close(state.Issue, body); err != nil {
+				p.logger.Warnf("Failed to close issue %s of %s/%s: %s", state.Issue.ID, c.Group, c.Name, err)
+				continue
+			}
+			p.logger.Infof("Closed issue %s of %s/%s", state.Issue.ID, c.Group, c.Name)
+			p.setIssueState(c.Group, c.Name, nil)
+		}
+	}
+}
+
+// openIssue opens the issue of a check that is unhealthy, or reuses its
+// open issue if there is one.
+func (p *Patrol) openIssue(c *checker.Checker, since time.Time) (*issueState, error) {
+	title := issueTitle(c.Group, c.Name)
+	body := p.issueBody(c, since)
+	issue, found, err := p.issueTracker.find(title)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if err := p.issueTracker.comment(issue, "Failing again.\n\n"+body); err != nil {
+			return nil, err
+		}
+		p.logger.Infof("Reusing issue %s for %s/%s", issue.ID, c.Group, c.Name)
+	} else {
+		if issue, err = p.issueTracker.open(title, body); err != nil {
+			return nil, err
+		}
+		p.logger.Infof("Opened issue %s for %s/%s", issue.ID, c.Group, c.Name)
+	}
+	return &issueState{Issue: issue, Unhealthy: true}, nil
+}
+
+// setIssueState records the issue of a check, or that it has none, and
+// saves it so that the issue is still followed after a restart.
+func (p *Patrol) setIssueState(group, name string, state *issueState) {
+	p.issueMux.Lock()
+	if state == nil {
+		delete(p.issues[group], name)
+	} else {
+		if _, ok := p.issues[group]; !ok {
+			p.issues[group] = make(map[string]*issueState)
+		}
+		p.issues[group][name] = state
+	}
+	p.issueMux.Unlock()
+	p.saveNotificationState(group, name)
+}
+
+func (p *Patrol) issueMatchesSeverity(severity checker.Severity) bool {
+	if len(p.issueOptions.Severities) == 0 {
+		return true
+	}
+	for _, s := range p.issueOptions.Severities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Patrol) scheduleIssues() {
+	for {
+		select {
+		case <-time.After(issueInterval):
+			p.syncIssues()
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// sendTrackerRequest sends a JSON request to an issue tracker, and decodes
+// its JSON response into out (unless it is nil).
+func sendTrackerRequest(client *http.Client, req *http.Request, in, out interface{}) error {
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		req.ContentLength = int64(len(buf))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s returned status %d: %s", req.Method, req.URL.Path, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type githubTracker struct {
+	GitHubIssueOptions
+	client *http.Client
+}
+
+func (gh *githubTracker) request(method, path string, in, out interface{}) error {
+	base := gh.APIURL
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+gh.Token)
+	return sendTrackerRequest(gh.client, req, in, out)
+}
+
+type githubIssue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+}
+
+func (issue githubIssue) ref() issueRef {
+	return issueRef{ID: fmt.Sprintf("%d", issue.Number), URL: issue.HTMLURL}
+}
+
+func (gh *githubTracker) find(title string) (issueRef, bool, error) {
+	query := url.Values{"q": {fmt.Sprintf("repo:%s is:issue is:open in:title %q", gh.Repo, title)}}
+	var result struct {
+		Items []githubIssue `json:"items"`
+	}
+	if err := gh.request(http.MethodGet, "/search/issues?"+query.Encode(), nil, &result); err != nil {
+		return issueRef{}, false, err
+	}
+	for _, issue := range result.Items {
+		if issue.Title == title {
+			return issue.ref(), true, nil
+		}
+	}
+	return issueRef{}, false, nil
+}
+
+func (gh *githubTracker) open(title, body string) (issueRef, error) {
+	var issue githubIssue
+	err := gh.request(http.MethodPost, "/repos/"+gh.Repo+"/issues", map[string]interface{}{
+		"title":  title,
+		"body":   body,
+		"labels": gh.Labels,
+	}, &issue)
+	return issue.ref(), err
+}
+
+func (gh *githubTracker) comment(ref issueRef, body string) error {
+	return gh.request(http.MethodPost, "/repos/"+gh.Repo+"/issues/"+ref.ID+"/comments", map[string]string{"body": body}, nil)
+}
+
+func (gh *githubTracker) close(ref issueRef, body string) error {
+	if err := gh.comment(ref, body); err != nil {
+		return err
+	}
+	return gh.request(http.MethodPatch, "/repos/"+gh.Repo+"/issues/"+ref.ID, map[string]string{"state": "closed"}, nil)
+}
+
+type jiraTracker struct {
+	JiraIssueOptions
+	client *http.Client
+}
+
+func (jira *jiraTracker) request(method, path string, in, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(jira.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if jira.Username != "" {
+		req.SetBasicAuth(jira.Username, jira.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+jira.Token)
+	}
+	return sendTrackerRequest(jira.client, req, in, out)
+}
+
+func (jira *jiraTracker) ref(key string) issueRef {
+	return issueRef{ID: key, URL: strings.TrimSuffix(jira.URL, "/") + "/browse/" + key}
+}
+
+func (jira *jiraTracker) find(title string) (issueRef, bool, error) {
+	// Summaries are matched as text, so the exact title is compared below
+	jql := fmt.Sprintf(`project = %q AND summary ~ %q AND statusCategory != Done`, jira.Project, title)
+	query := url.Values{"jql": {jql}, "fields": {"summary"}}
+	var result struct {
+		Issues []struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Summary string `json:"summary"`
+			} `json:"fields"`
+		} `json:"issues"`
+	}
+	if err := jira.request(http.MethodGet, "/rest/api/2/search?"+query.Encode(), nil, &result); err != nil {
+		return issueRef{}, false, err
+	}
+	for _, issue := range result.Issues {
+		if issue.Fields.Summary == title {
+			return jira.ref(issue.Key), true, nil
+		}
+	}
+	return issueRef{}, false, nil
+}
+
+func (jira *jiraTracker) open(title, body string) (issueRef, error) {
+	issueType := jira.IssueType
+	if issueType == "" {
+		issueType = "Bug"
+	}
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": jira.Project},
+		"issuetype":   map[string]string{"name": issueType},
+		"summary":     title,
+		"description": body,
+	}
+	if len(jira.Labels) > 0 {
+		fields["labels"] = jira.Labels
+	}
+	var issue struct {
+		Key string `json:"key"`
+	}
+	if err := jira.request(http.MethodPost, "/rest/api/2/issue", map[string]interface{}{"fields": fields}, &issue); err != nil {
+		return issueRef{}, err
+	}
+	return jira.ref(issue.Key), nil
+}
+
+func (jira *jiraTracker) comment(ref issueRef, body string) error {
+	return jira.request(http.MethodPost, "/rest/api/2/issue/"+ref.ID+"/comment", map[string]string{"body": body}, nil)
+}
+
+func (jira *jiraTracker) close(ref issueRef, body string) error {
+	var result struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				StatusCategory struct {
+					Key string `json:"key"`
+				} `json:"statusCategory"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	if err := jira.request(http.MethodGet, "/rest/api/2/issue/"+ref.ID+"/transitions", nil, &result); err != nil {
+		return err
+	}
+	transition := ""
+	for _, t := range result.Transitions {
+		if (jira.CloseTransition != "" && strings.EqualFold(t.Name, jira.CloseTransition)) || (jira.CloseTransition == "" && t.To.StatusCategory.Key == "done") {
+			transition = t.ID
+			break
+		}
+	}
+	if transition == "" {
+		return fmt.Errorf("Issue %s has no transition that closes it", ref.ID)
+	}
+
+	if err := jira.comment(ref, body); err != nil {
+		return err
+	}
+	return jira.request(http.MethodPost, "/rest/api/2/issue/"+ref.ID+"/transitions", map[string]interface{}{
+		"transition": map[string]string{"id": transition},
+	}, nil)
+}
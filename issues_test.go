@@ -0,0 +1,182 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestIssues(t *testing.T) {
+	var mux sync.Mutex
+	var requests []string
+	existing := false
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mux.Lock()
+		defer mux.Unlock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+
+		switch req.URL.Path {
+		case "/search/issues":
+			if existing {
+				res.Write([]byte(`{"items": [{"number": 3, "title": "API / Status is unhealthy"}]}`))
+			} else {
+				res.Write([]byte(`{"items": [{"number": 4, "title": "API / Status is unhealthy (old)"}]}`))
+			}
+		case "/repos/myorg/ops/issues":
+			res.Write([]byte(`{"number": 7, "html_url": "https://github.com/myorg/ops/issues/7"}`))
+		case "/rest/api/2/search":
+			if existing {
+				res.Write([]byte(`{"issues": [{"key": "OPS-3", "fields": {"summary": "API / Status is unhealthy"}}]}`))
+			} else {
+				res.Write([]byte(`{"issues": []}`))
+			}
+		case "/rest/api/2/issue":
+			res.Write([]byte(`{"key": "OPS-7"}`))
+		case "/rest/api/2/issue/OPS-7/transitions":
+			if req.Method == http.MethodGet {
+				res.Write([]byte(`{"transitions": [{"id": "11", "name": "In Progress", "to": {"statusCategory": {"key": "indeterminate"}}}, {"id": "31", "name": "Done", "to": {"statusCategory": {"key": "done"}}}]}`))
+			} else if !strings.Contains(string(body), `"id":"31"`) {
+				res.WriteHeader(http.StatusBadRequest)
+			}
+		default:
+			res.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		opts      IssueOptions
+		open      []string
+		comment   string
+		close     []string
+		reuse     []string
+		reusedRef string
+	}{
+		{
+			opts:      IssueOptions{GitHub: &GitHubIssueOptions{Repo: "myorg/ops", Token: "secret", APIURL: server.URL}},
+			open:      []string{"GET /search/issues", "POST /repos/myorg/ops/issues"},
+			comment:   "POST /repos/myorg/ops/issues/7/comments",
+			close:     []string{"POST /repos/myorg/ops/issues/7/comments", "PATCH /repos/myorg/ops/issues/7"},
+			reuse:     []string{"GET /search/issues", "POST /repos/myorg/ops/issues/3/comments"},
+			reusedRef: "3",
+		},
+		{
+			opts:      IssueOptions{Jira: &JiraIssueOptions{URL: server.URL, Project: "OPS", Token: "secret"}},
+			open:      []string{"GET /rest/api/2/search", "POST /rest/api/2/issue"},
+			comment:   "POST /rest/api/2/issue/OPS-7/comment",
+			close:     []string{"GET /rest/api/2/issue/OPS-7/transitions", "POST /rest/api/2/issue/OPS-7/comment", "POST /rest/api/2/issue/OPS-7/transitions"},
+			reuse:     []string{"GET /rest/api/2/search", "POST /rest/api/2/issue/OPS-3/comment"},
+			reusedRef: "OPS-3",
+		},
+	} {
+		if err := test.opts.Validate(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		os.Remove("issues-test.db")
+		historyFile, err := history.New(history.NewOptions{
+			File: "issues-test.db",
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer historyFile.Close(context.Background())
+
+		test.opts.OpenAfter = time.Hour
+		test.opts.CloseAfter = time.Hour
+		p, err := New(CreatePatrolOptions{
+			Checkers: []*checker.Checker{
+				checker.New(&checker.Checker{Group: "API", Name: "Status", Type: "boolean", Cmd: "true", History: historyFile, Interval: time.Minute}),
+			},
+			Issues: &test.opts,
+		}, historyFile)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		mux.Lock()
+		requests = nil
+		existing = false
+		mux.Unlock()
+		now := time.Now()
+		sync := func(status string, ago time.Duration, expected ...string) bool {
+			if status != "" {
+				items := []history.Item{{Group: "API", Name: "Status", Type: "boolean", Status: status, Error: "Connection refused", CreatedAt: now.Add(-ago)}}
+				if err := historyFile.AppendBatch(items)[0]; err != nil {
+					t.Error(err)
+					return false
+				}
+			}
+			p.syncIssues()
+
+			mux.Lock()
+			defer mux.Unlock()
+			if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+				t.Error(fmt.Errorf("Expected requests %q after %s result, got: %q", expected, status, requests))
+				return false
+			}
+			requests = nil
+			return true
+		}
+
+		// Failures are filed once they last long enough, and the issue
+		// follows the check until it has been healthy for long enough
+		if !sync("unhealthy", 50*time.Minute) {
+			return
+		}
+		p.issueOptions.OpenAfter = 30 * time.Minute
+		if !sync("", 0, test.open...) ||
+			!sync("", 0) ||
+			!sync("healthy", 40*time.Minute, test.comment) ||
+			!sync("unhealthy", 30*time.Minute, test.comment) ||
+			!sync("healthy", 20*time.Minute, test.comment) ||
+			!sync("", 0) {
+			return
+		}
+		p.issueOptions.CloseAfter = 20 * time.Minute
+		if !sync("", 0, test.close...) || !sync("", 0) {
+			return
+		}
+
+		// Open issues of the check are reused
+		mux.Lock()
+		existing = true
+		mux.Unlock()
+		p.issueOptions.OpenAfter = 0
+		if !sync("unhealthy", 0, test.reuse...) {
+			return
+		}
+		if state := p.issues["API"]["Status"]; state == nil || state.Issue.ID != test.reusedRef {
+			t.Error(fmt.Errorf("Expected issue %s to be reused, got: %#v", test.reusedRef, state))
+			return
+		}
+	}
+
+	for _, opts := range []IssueOptions{
+		{},
+		{GitHub: &GitHubIssueOptions{Repo: "myorg/ops", Token: "secret"}, Jira: &JiraIssueOptions{URL: server.URL, Project: "OPS", Token: "secret"}},
+		{GitHub: &GitHubIssueOptions{Repo: "ops", Token: "secret"}},
+		{GitHub: &GitHubIssueOptions{Repo: "myorg/ops"}},
+		{Jira: &JiraIssueOptions{URL: "myorg.atlassian.net", Project: "OPS", Token: "secret"}},
+		{Jira: &JiraIssueOptions{URL: server.URL, Token: "secret"}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Error(fmt.Errorf("Expected issue options to be rejected: %#v", opts))
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package patrol
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading    = regexp.MustCompile(`^(#{1,4})\s+(.*)$`)
+	mdListItem   = regexp.MustCompile(`^\s*[-*]\s+(.*)$`)
+	mdNumberItem = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdCode       = regexp.MustCompile("`([^`]+)`")
+	mdBold       = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdItalic     = regexp.MustCompile(`\*([^*]+)\*`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+)
+
+// renderMarkdown converts a small subset of markdown to HTML: headings,
+// paragraphs, lists, fenced code blocks, inline code, emphasis and links.
+// All text is escaped, so the output is safe to embed in a page.
+func renderMarkdown(src string) string {
+	out := &strings.Builder{}
+	var paragraph []string
+	listTag := ""
+	inCode := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p class=\"mb-4\">" + renderInline(strings.Join(paragraph, " ")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if listTag != "" {
+			out.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+	openList := func(tag, class string) {
+		if listTag != tag {
+			closeList()
+			out.WriteString("<" + tag + " class=\"" + class + " ml-6 mb-4\">\n")
+			listTag = tag
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inCode {
+				out.WriteString("</code></pre>\n")
+			} else {
+				flushParagraph()
+				closeList()
+				out.WriteString("<pre class=\"font-mono p-3 mb-4 bg-gray-300 rounded overflow-x-auto\"><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			closeList()
+			// Headings start at h2, since the page has its own title
+			level := len(m[1]) + 1
+			size := []string{"text-2xl", "text-xl", "text-lg", "text-base"}[level-2]
+			fmt.Fprintf(out, "<h%d class=\"font-bold %s mb-2\">%s</h%d>\n", level, size, renderInline(m[2]), level)
+		} else if m := mdListItem.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			openList("ul", "list-disc")
+			out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+		} else if m := mdNumberItem.FindStringSubmatch(line); m != nil {
+			flushParagraph()
+			openList("ol", "list-decimal")
+			out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+		} else if strings.TrimSpace(line) == "" {
+			flushParagraph()
+			closeList()
+		} else {
+			closeList()
+			paragraph = append(paragraph, strings.TrimSpace(line))
+		}
+	}
+
+	if inCode {
+		out.WriteString("</code></pre>\n")
+	}
+	flushParagraph()
+	closeList()
+	return out.String()
+}
+
+// renderInline escapes a line of text and renders its inline formatting.
+func renderInline(text string) string {
+	// Code spans are rendered first and swapped out, so that their contents
+	// are not formatted
+	var codeSpans []string
+	text = mdCode.ReplaceAllStringFunc(html.EscapeString(text), func(span string) string {
+		codeSpans = append(codeSpans, "<code class=\"font-mono bg-gray-300 px-1 rounded\">"+span[1:len(span)-1]+"</code>")
+		return "\x00"
+	})
+
+	text = mdLink.ReplaceAllString(text, `<a class="text-blue-700 underline" href="$2">$1</a>`)
+	text = mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = mdItalic.ReplaceAllString(text, "<em>$1</em>")
+
+	for _, span := range codeSpans {
+		text = strings.Replace(text, "\x00", span, 1)
+	}
+	return text
+}
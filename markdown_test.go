@@ -0,0 +1,25 @@
+package patrol
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		html string
+	}{
+		{"# Title", "<h2 class=\"font-bold text-2xl mb-2\">Title</h2>\n"},
+		{"one\ntwo\n\nthree", "<p class=\"mb-4\">one two</p>\n<p class=\"mb-4\">three</p>\n"},
+		{"- **a**\n- *b*", "<ul class=\"list-disc ml-6 mb-4\">\n<li><strong>a</strong></li>\n<li><em>b</em></li>\n</ul>\n"},
+		{"1. `<a>`", "<ol class=\"list-decimal ml-6 mb-4\">\n<li><code class=\"font-mono bg-gray-300 px-1 rounded\">&lt;a&gt;</code></li>\n</ol>\n"},
+		{"```\n<b>\n```", "<pre class=\"font-mono p-3 mb-4 bg-gray-300 rounded overflow-x-auto\"><code>&lt;b&gt;\n</code></pre>\n"},
+		{"[docs](https://example.com)", "<p class=\"mb-4\"><a class=\"text-blue-700 underline\" href=\"https://example.com\">docs</a></p>\n"},
+		{"[bad](javascript:alert(1))", "<p class=\"mb-4\">[bad](javascript:alert(1))</p>\n"},
+	} {
+		if html := renderMarkdown(test.src); html != test.html {
+			t.Error(fmt.Errorf("Wrong HTML rendered for %q: %q", test.src, html))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package patrol
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Aggregations of the results of a metric check within a step
+const (
+	aggAvg = "avg"
+	aggMin = "min"
+	aggMax = "max"
+)
+
+// Maximum number of points in a metric series
+const maxMetricPoints = 10000
+
+// Default number of points in a metric series, if no step is given
+const defaultMetricPoints = 200
+
+// metricPoint is the aggregated value of the results of a metric check
+// within a step, which starts at Time.
+type metricPoint struct {
+	Time  time.Time
+	Value float64
+
+	// Number of results that the value aggregates
+	Count int
+}
+
+type metricSeries struct {
+	Group  string
+	Check  string
+	Unit   string
+	From   time.Time
+	To     time.Time
+	Step   time.Duration
+	Agg    string
+	Points []metricPoint
+}
+
+// metricBucket accumulates the results within a step.
+type metricBucket struct {
+	sum, min, max float64
+	count         int
+}
+
+// seriesValue returns the value of a result in a series, along with the
+// minimum and maximum of the values that it stands for.
+type seriesValue func(item history.Item) (value, min, max float64)
+
+// metricValue is the value of a result of a metric check. Downsampled
+// results keep the minimum and maximum of the results they replace.
+func metricValue(item history.Item) (float64, float64, float64) {
+	if item.Aggregate != nil {
+		return item.Metric, item.Aggregate.Min, item.Aggregate.Max
+	}
+	return item.Metric, item.Metric, item.Metric
+}
+
+// getMetricSeries aggregates the results of a metric check between the
+// given times into steps, skipping steps without results. Downsampled
+// results count as many results as they replace, and keep their minimum
+// and maximum.
+func (p *Patrol) getMetricSeries(group, check string, from, to time.Time, step time.Duration, agg string) metricSeries {
+	return p.getSeries(group, check, from, to, step, agg, metricValue)
+}
+
+// getSeries aggregates the values of the results of a check between the
+// given times into steps, like getMetricSeries.
+func (p *Patrol) getSeries(group, check string, from, to time.Time, step time.Duration, agg string, valueOf seriesValue) metricSeries {
+	series := metricSeries{
+		Group:  group,
+		Check:  check,
+		From:   from,
+		To:     to,
+		Step:   step,
+		Agg:    agg,
+		Points: []metricPoint{},
+	}
+
+	buckets := make([]metricBucket, int((to.Sub(from)+step-1)/step))
+	// Items are ordered by CreatedAt, so the scan ends with the first item
+	// before the range
+	p.History.EachItem(group, check, func(item history.Item, _ func() history.Item) bool {
+		if item.CreatedAt.Before(from) {
+			return false
+		}
+		if !item.CreatedAt.Before(to) {
+			return true
+		}
+		if series.Unit == "" {
+			series.Unit = item.MetricUnit
+		}
+
+		value, min, max := valueOf(item)
+		count := item.Count
+		if count == 0 {
+			count = 1
+		}
+		if item.Aggregate != nil {
+			count = item.Aggregate.Count
+		}
+		bucket := &buckets[int(item.CreatedAt.Sub(from)/step)]
+		if bucket.count == 0 || min < bucket.min {
+			bucket.min = min
+		}
+		if bucket.count == 0 || max > bucket.max {
+			bucket.max = max
+		}
+		bucket.sum += value * float64(count)
+		bucket.count += count
+		return true
+	})
+
+	for i, bucket := range buckets {
+		if bucket.count == 0 {
+			continue
+		}
+		point := metricPoint{
+			Time:  from.Add(time.Duration(i) * step),
+			Count: bucket.count,
+		}
+		switch agg {
+		case aggMin:
+			point.Value = bucket.min
+		case aggMax:
+			point.Value = bucket.max
+		default:
+			point.Value = bucket.sum / float64(bucket.count)
+		}
+		series.Points = append(series.Points, point)
+	}
+	return series
+}
+
+// serveMetrics returns the results of a metric check as a series that is
+// aggregated on the server, for charts. The check is taken from the path
+// ('/api/v1/metrics/{group}/{check}'), and the series covers 'from' to 'to'
+// (the last 24 hours by default) in steps of 'step', which are aggregated
+// with 'agg' ('avg', 'min' or 'max').
+func (p *Patrol) serveMetrics(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), "/api/v1/metrics/"), "/")
+	if len(parts) != 2 {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("Metrics are served at /api/v1/metrics/{group}/{check}"))
+		return
+	}
+	group, groupErr := url.PathUnescape(parts[0])
+	check, checkErr := url.PathUnescape(parts[1])
+	c := p.getChecker(group, check)
+	if groupErr != nil || checkErr != nil || c == nil || (c.Private && !p.showPrivate(req)) {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s/%s", errCheckerNotFound, group, check))
+		return
+	}
+	if c.Type != "metric" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("%s/%s is not a metric check", group, check))
+		return
+	}
+
+	query := req.URL.Query()
+	to := time.Now()
+	if str := query.Get("to"); str != "" {
+		var err error
+		if to, err = ParseReportTime(str); err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if str := query.Get("from"); str != "" {
+		var err error
+		if from, err = ParseReportTime(str); err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("'from' must be before 'to'"))
+		return
+	}
+
+	step := (to.Sub(from) / defaultMetricPoints).Truncate(time.Second)
+	if str := query.Get("step"); str != "" {
+		var err error
+		if step, err = time.ParseDuration(str); err != nil {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Invalid step: %s", err))
+			return
+		}
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	if to.Sub(from)/step > maxMetricPoints {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Step of %s is too small, a series can have at most %d points", step, maxMetricPoints))
+		return
+	}
+
+	agg := query.Get("agg")
+	if agg == "" {
+		agg = aggAvg
+	}
+	if agg != aggAvg && agg != aggMin && agg != aggMax {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Unrecognized aggregation: '%s' (must be avg, min or max)", agg))
+		return
+	}
+
+	series := p.getMetricSeries(group, check, from, to, step, agg)
+	if series.Unit == "" {
+		series.Unit = c.MetricUnit
+	}
+	writeJSON(res, http.StatusOK, series)
+}
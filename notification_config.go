@@ -2,22 +2,117 @@ package patrol
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/karimsa/patrol/internal/checker"
 	"github.com/karimsa/patrol/internal/logger"
 )
 
 type webhookNotification struct {
 	client http.Client
 
-	URL     *url.URL `yaml:"url"`
+	URL     *url.URL `yaml:"url" secret:"url"`
 	Method  string
-	Headers map[string]string
+	Headers map[string]string `secret:"true"`
 	Body    string
+
+	// Kept so that the webhook can be written back to a config
+	tls *checker.TLSOptions
+}
+
+// notificationEvent describes what a notification is sent for, and fills
+// in the placeholders of webhook bodies.
+type notificationEvent struct {
+	Status      string
+	Group       string
+	Check       string
+	Error       string
+	Annotations map[string]string
+
+	// Who is responsible for the check, and its runbook
+	Owner      string
+	RunbookURL string
+
+	// Link to the check on the status page, or to the failing checks for
+	// grouped failures
+	Link string
+
+	// Link to acknowledge the check's ongoing incident
+	AckLink string
+
+	// Number of failing checks and of their services, which are only set
+	// for grouped failures
+	NumFailing  int
+	NumServices int
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// render replaces the placeholders in a webhook body, i.e. '{{service}}',
+// '{{check.name}}', '{{check.status}}', '{{check.error}}',
+// '{{check.annotations.version}}', '{{check.owner}}', '{{check.runbook_url}}',
+// '{{link}}', '{{ack.link}}', '{{failing.count}}' and '{{failing.services}}'.
+// Unknown placeholders are kept as they are. Values are escaped for JSON
+// strings if the body is JSON.
+func (event notificationEvent) render(body string) string {
+	// Bodies that start with a placeholder are not JSON objects
+	trimmed := strings.TrimSpace(body)
+	isJSON := (strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "{{")) || strings.HasPrefix(trimmed, "[")
+
+	return placeholderPattern.ReplaceAllStringFunc(body, func(placeholder string) string {
+		var value string
+		switch name := placeholderPattern.FindStringSubmatch(placeholder)[1]; {
+		case name == "service":
+			value = event.Group
+		case name == "check.name":
+			value = event.Check
+		case name == "check.status":
+			value = event.Status
+		case name == "check.error":
+			value = event.Error
+		case strings.HasPrefix(name, "check.annotations."):
+			value = event.Annotations[strings.TrimPrefix(name, "check.annotations.")]
+		case name == "check.owner":
+			value = event.Owner
+		case name == "check.runbook_url":
+			value = event.RunbookURL
+		case name == "link":
+			value = event.Link
+		case name == "ack.link":
+			value = event.AckLink
+		case name == "failing.count":
+			if event.NumFailing > 0 {
+				value = strconv.Itoa(event.NumFailing)
+			}
+		case name == "failing.services":
+			if event.NumServices > 0 {
+				value = strconv.Itoa(event.NumServices)
+			}
+		default:
+			return placeholder
+		}
+		if isJSON {
+			buf, _ := json.Marshal(value)
+			value = string(buf[1 : len(buf)-1])
+		}
+		return value
+	})
+}
+
+// transport returns the webhook's HTTP transport, which is created if the
+// webhook still uses the default transport.
+func (wn *webhookNotification) transport() *http.Transport {
+	if wn.client.Transport == nil {
+		wn.client.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return wn.client.Transport.(*http.Transport)
 }
 
 func (wn *webhookNotification) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -26,6 +121,7 @@ func (wn *webhookNotification) UnmarshalYAML(unmarshal func(interface{}) error)
 		Method  string
 		Headers map[string]string
 		Body    string
+		TLS     *checker.TLSOptions `yaml:"tls"`
 	}
 	if err := unmarshal(&raw); err != nil {
 		return err
@@ -47,40 +143,133 @@ func (wn *webhookNotification) UnmarshalYAML(unmarshal func(interface{}) error)
 	if wn.URL.Host == "" {
 		return fmt.Errorf("Hostname is required for URLs in webhooks")
 	}
+	if raw.TLS != nil {
+		config, err := raw.TLS.Config()
+		if err != nil {
+			return err
+		}
+		wn.transport().TLSClientConfig = config
+		wn.tls = raw.TLS
+	}
 	return nil
 }
 
-func (wn *webhookNotification) exec() error {
+func (wn *webhookNotification) MarshalYAML() (interface{}, error) {
+	return struct {
+		URL     string              `yaml:"url"`
+		Method  string              `yaml:"method"`
+		Headers map[string]string   `yaml:"headers,omitempty"`
+		Body    string              `yaml:"body,omitempty"`
+		TLS     *checker.TLSOptions `yaml:"tls,omitempty"`
+	}{wn.URL.String(), wn.Method, wn.Headers, wn.Body, wn.tls}, nil
+}
+
+func (wn *webhookNotification) useProxy(proxy checker.ProxyOptions) {
+	wn.transport().Proxy = proxy.ProxyFunc()
+}
+
+// send renders the request that notifies the webhook of an event and sends
+// it, and returns whether it should be retried if it fails. Requests that
+// are rejected by the webhook are not retried, unless the webhook is
+// overloaded or timed out.
+func (wn *webhookNotification) send(event notificationEvent) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, wn.Method, wn.URL.String(), strings.NewReader(wn.Body))
+	req, err := http.NewRequestWithContext(ctx, wn.Method, wn.URL.String(), strings.NewReader(event.render(wn.Body)))
 	if err != nil {
-		return err
+		return false, err
 	}
 	for key, val := range wn.Headers {
 		req.Header[key] = []string{val}
 	}
 	res, err := wn.client.Do(req)
-	cancel()
 	if err != nil {
-		return err
+		return true, err
 	}
+	res.Body.Close()
 	if res.StatusCode >= 400 {
-		return fmt.Errorf("Webhook returned status: %d", res.StatusCode)
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+		return retry, fmt.Errorf("Webhook returned status: %d", res.StatusCode)
 	}
 
-	return nil
+	return false, nil
+}
+
+func (wn *webhookNotification) exec(event notificationEvent) error {
+	_, err := wn.send(event)
+	return err
 }
 
 type singleNotificationConfig struct {
-	Webhook *webhookNotification
+	// Name that deliveries of the notifier are listed under, which
+	// defaults to the webhook's host
+	Name string `yaml:",omitempty"`
+
+	Webhook *webhookNotification `yaml:",omitempty"`
+
+	// Only send this notification for checks with one of these
+	// severities. Empty means all severities.
+	Severities []checker.Severity `yaml:",omitempty"`
+}
+
+func (sn *singleNotificationConfig) name() string {
+	if sn.Name != "" {
+		return sn.Name
+	}
+	if sn.Webhook != nil && sn.Webhook.URL != nil {
+		return sn.Webhook.URL.Host
+	}
+	return "(empty)"
+}
+
+func (sn *singleNotificationConfig) matchesSeverity(severity checker.Severity) bool {
+	if len(sn.Severities) == 0 {
+		return true
+	}
+	for _, s := range sn.Severities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// useProxy sends all notifications of the given handlers through the proxy.
+func (handlers EventHandlers) useProxy(proxy checker.ProxyOptions) {
+	for _, notifiers := range handlers {
+		for _, sn := range notifiers {
+			if sn != nil && sn.Webhook != nil {
+				sn.Webhook.useProxy(proxy)
+			}
+		}
+	}
+}
+
+// validate checks the options of all handlers that cannot be checked while
+// parsing them.
+func (handlers EventHandlers) validate() error {
+	for _, notifiers := range handlers {
+		for _, sn := range notifiers {
+			if sn == nil {
+				continue
+			}
+			for _, severity := range sn.Severities {
+				if _, err := checker.ParseSeverity(string(severity)); err != nil || severity == "" {
+					return fmt.Errorf("Invalid severity for notification: '%s'", severity)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 type specificNotifier interface {
-	exec() error
+	exec(event notificationEvent) error
 }
 
-func (sn *singleNotificationConfig) Run() {
+// Run sends a notification in the background, without recording its
+// delivery.
+func (sn *singleNotificationConfig) Run(event notificationEvent) {
 	logger := logger.New(logger.LevelInfo, "notifier:")
 	var notifier specificNotifier
 
@@ -92,7 +281,7 @@ func (sn *singleNotificationConfig) Run() {
 		logger.Warnf("Could not send notification using empty notifier")
 	} else {
 		go func() {
-			if err := notifier.exec(); err != nil {
+			if err := notifier.exec(event); err != nil {
 				logger.Warnf("Failed to send notification: %s", err)
 			}
 		}()
@@ -0,0 +1,143 @@
+package patrol
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWebhookProxy(t *testing.T) {
+	requests := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests <- req.URL.String()
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse("http://hooks.example.com/notify")
+	handlers := EventHandlers{
+		"unhealthy": []*singleNotificationConfig{{
+			Webhook: &webhookNotification{Method: "POST", URL: u},
+		}},
+	}
+	handlers.useProxy(checker.ProxyOptions{HTTP: proxy.URL})
+	handlers["unhealthy"][0].Run(notificationEvent{})
+
+	select {
+	case target := <-requests:
+		if target != u.String() {
+			t.Error(fmt.Errorf("Wrong request sent through proxy: %s", target))
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error(fmt.Errorf("Webhook was not sent through the proxy"))
+	}
+}
+
+func TestWebhookTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	caFile := "webhook-test-ca.pem"
+	defer os.Remove(caFile)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, test := range []struct {
+		config string
+		valid  bool
+	}{
+		{fmt.Sprintf("url: %s", server.URL), false},
+		{fmt.Sprintf("url: %s\ntls:\n  ca: %s", server.URL, caFile), true},
+		{fmt.Sprintf("url: %s\ntls:\n  insecureSkipVerify: true", server.URL), true},
+	} {
+		var webhook webhookNotification
+		if err := yaml.Unmarshal([]byte(test.config), &webhook); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := webhook.exec(notificationEvent{}); (err == nil) != test.valid {
+			t.Error(fmt.Errorf("Unexpected result for webhook config %q: %v", test.config, err))
+			return
+		}
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		body     string
+		expected string
+	}{
+		{"Something is down", "Something is down"},
+		{"{{service}}/{{check.name}} is {{check.status}}: {{check.error}} (version {{ check.annotations.version }})", `API/Status is unhealthy: Process "exited" (version 1.4.2)`},
+		{"{{check.annotations.region}} {{unknown}}", " {{unknown}}"},
+		{`{"text": "{{check.name}} failed: {{check.error}}"}`, `{"text": "Status failed: Process \"exited\""}`},
+		{"Paging {{check.owner}}, see {{check.runbook_url}}", "Paging @api-oncall, see https://wiki.myapp.com/runbooks/api"},
+	} {
+		var webhook webhookNotification
+		if err := yaml.Unmarshal([]byte(fmt.Sprintf("url: %s\nmethod: POST\nbody: %q", server.URL, test.body)), &webhook); err != nil {
+			t.Error(err)
+			return
+		}
+		err := webhook.exec(notificationEvent{
+			Status:      "unhealthy",
+			Group:       "API",
+			Check:       "Status",
+			Error:       `Process "exited"`,
+			Annotations: map[string]string{"version": "1.4.2"},
+			Owner:       "@api-oncall",
+			RunbookURL:  "https://wiki.myapp.com/runbooks/api",
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if body := <-bodies; body != test.expected {
+			t.Error(fmt.Errorf("Expected webhook body %q, got: %q", test.expected, body))
+			return
+		}
+	}
+}
+
+func TestSeverityRouting(t *testing.T) {
+	sn := singleNotificationConfig{
+		Severities: []checker.Severity{checker.SeverityCritical, checker.SeverityMajor},
+	}
+	for severity, expected := range map[checker.Severity]bool{
+		checker.SeverityCritical: true,
+		checker.SeverityMajor:    true,
+		checker.SeverityMinor:    false,
+		checker.SeverityInfo:     false,
+	} {
+		if sn.matchesSeverity(severity) != expected {
+			t.Error(fmt.Errorf("Expected match for %s to be %t", severity, expected))
+			return
+		}
+	}
+
+	invalid := EventHandlers{
+		"unhealthy": []*singleNotificationConfig{{Severities: []checker.Severity{"urgent"}}},
+	}
+	if err := invalid.validate(); err == nil {
+		t.Error(fmt.Errorf("Expected unknown severity to be rejected"))
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package patrol
+
+import (
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// saveNotificationState persists the acknowledgement, reminders, flapping
+// state and issue of a check, so that patrol picks up where it left off
+// when it is restarted during an incident. It must not be called while
+// holding any of the locks of that state.
+func (p *Patrol) saveNotificationState(group, name string) {
+	p.notifyStateMux.Lock()
+	defer p.notifyStateMux.Unlock()
+
+	state := history.NotificationState{Group: group, Name: name}
+	p.ackMux.Lock()
+	if ack, ok := p.acks[group][name]; ok {
+		saved := history.Acknowledgement(ack)
+		state.Ack = &saved
+	}
+	if reminder := p.reminders[group][name]; reminder != nil {
+		saved := history.Reminder(*reminder)
+		state.Reminder = &saved
+	}
+	p.ackMux.Unlock()
+
+	state.Flapping = p.IsFlapping(group, name)
+
+	p.issueMux.Lock()
+	if issue := p.issues[group][name]; issue != nil {
+		state.Issue = &history.IssueState{
+			ID:           issue.Issue.ID,
+			URL:          issue.Issue.URL,
+			Unhealthy:    issue.Unhealthy,
+			HealthySince: issue.HealthySince,
+		}
+	}
+	p.issueMux.Unlock()
+
+	if err := p.History.SetNotificationState(state); err != nil {
+		p.logger.Warnf("Failed to save notification state of %s/%s: %s", group, name, err)
+	}
+}
+
+// restoreNotificationStates loads the notification state that was saved
+// for each check before patrol was restarted.
+func (p *Patrol) restoreNotificationStates() {
+	for _, c := range p.checkers {
+		state := p.History.GetNotificationState(c.Group, c.Name)
+		if state.Ack != nil {
+			if _, ok := p.acks[c.Group]; !ok {
+				p.acks[c.Group] = make(map[string]acknowledgement)
+			}
+			p.acks[c.Group][c.Name] = acknowledgement(*state.Ack)
+		}
+		if state.Reminder != nil {
+			if _, ok := p.reminders[c.Group]; !ok {
+				p.reminders[c.Group] = make(map[string]*reminderState)
+			}
+			reminder := reminderState(*state.Reminder)
+			p.reminders[c.Group][c.Name] = &reminder
+		}
+		if state.Flapping {
+			if _, ok := p.flappingChecks[c.Group]; !ok {
+				p.flappingChecks[c.Group] = make(map[string]bool)
+			}
+			p.flappingChecks[c.Group][c.Name] = true
+		}
+		if state.Issue != nil {
+			if _, ok := p.issues[c.Group]; !ok {
+				p.issues[c.Group] = make(map[string]*issueState)
+			}
+			p.issues[c.Group][c.Name] = &issueState{
+				Issue:        issueRef{ID: state.Issue.ID, URL: state.Issue.URL},
+				Unhealthy:    state.Issue.Unhealthy,
+				HealthySince: state.Issue.HealthySince,
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package patrol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var errNotifierNotFound = errors.New("No such notifier")
+
+// configuredNotifier is a notifier along with the event that it handles,
+// and the service that it is limited to (if any).
+type configuredNotifier struct {
+	group    string
+	event    string
+	notifier *singleNotificationConfig
+}
+
+// notifiers lists the configured notifiers, starting with the global ones.
+func (p *Patrol) notifiers() []configuredNotifier {
+	var list []configuredNotifier
+	add := func(group string, handlers EventHandlers) {
+		events := make([]string, 0, len(handlers))
+		for event := range handlers {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		for _, event := range events {
+			for _, n := range handlers[event] {
+				if n != nil {
+					list = append(list, configuredNotifier{group, event, n})
+				}
+			}
+		}
+	}
+
+	add("", p.globalEventHandlers)
+	groups := make([]string, 0, len(p.groupEventHandlers))
+	for group := range p.groupEventHandlers {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		add(group, p.groupEventHandlers[group])
+	}
+	return list
+}
+
+// NotifierTest is the result of sending a test notification through a
+// notifier.
+type NotifierTest struct {
+	Notifier string
+
+	// Event that the notifier handles, and the service that it is limited
+	// to (if any)
+	Event   string
+	Service string `json:",omitempty"`
+
+	Error    string `json:",omitempty"`
+	TestedAt time.Time
+}
+
+// TestNotifiers sends a test notification through each configured notifier
+// with the given name, or through all notifiers if the name is empty, and
+// waits for the results. Test notifications are not retried.
+func (p *Patrol) TestNotifiers(name string) ([]NotifierTest, error) {
+	event := notificationEvent{
+		Status: "test",
+		Group:  p.name,
+		Check:  "Test notification",
+		Error:  "This is a test notification sent by patrol, no action is needed",
+		Link:   p.url,
+	}
+
+	tests := []NotifierTest{}
+	for _, cn := range p.notifiers() {
+		if name != "" && cn.notifier.name() != name {
+			continue
+		}
+		test := NotifierTest{
+			Notifier: cn.notifier.name(),
+			Event:    cn.event,
+			Service:  cn.group,
+		}
+		if cn.notifier.Webhook == nil {
+			test.Error = "Notifier is empty"
+		} else if _, err := cn.notifier.Webhook.send(event); err != nil {
+			test.Error = err.Error()
+		}
+		test.TestedAt = time.Now()
+		tests = append(tests, test)
+	}
+	if len(tests) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("%w: %s", errNotifierNotFound, name)
+		}
+		return nil, fmt.Errorf("No notifiers are configured")
+	}
+
+	// The admin page shows the latest test of each notifier, or its first
+	// failure
+	p.notifierTestMux.Lock()
+	defer p.notifierTestMux.Unlock()
+	tested := make(map[string]bool)
+	for _, test := range tests {
+		if !tested[test.Notifier] || p.notifierTests[test.Notifier].Error == "" {
+			p.notifierTests[test.Notifier] = test
+		}
+		tested[test.Notifier] = true
+	}
+	return tests, nil
+}
+
+// lastNotifierTest returns the latest test of a notifier, if it was tested.
+func (p *Patrol) lastNotifierTest(name string) (NotifierTest, bool) {
+	p.notifierTestMux.Lock()
+	defer p.notifierTestMux.Unlock()
+	test, ok := p.notifierTests[name]
+	return test, ok
+}
+
+// serveTestNotifiers sends a test notification through the notifiers with
+// the given name, or through all notifiers.
+func (p *Patrol) serveTestNotifiers(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	tests, err := p.TestNotifiers(req.FormValue("name"))
+	if errors.Is(err, errNotifierNotFound) {
+		writeJSONError(res, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeJSONError(res, http.StatusBadRequest, err)
+		return
+	}
+
+	if !redirectBack(res, req) {
+		writeJSON(res, http.StatusOK, tests)
+	}
+}
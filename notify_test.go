@@ -0,0 +1,127 @@
+package patrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestTestNotifiers(t *testing.T) {
+	os.Remove("notify-test.db")
+	historyFile, err := history.New(history.NewOptions{File: "notify-test.db"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	bodies := make(chan string, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer slack.Close()
+	pager := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer pager.Close()
+	slackURL, _ := url.Parse(slack.URL)
+	pagerURL, _ := url.Parse(pager.URL)
+
+	p, err := New(CreatePatrolOptions{
+		Name:  "Status",
+		Admin: &PatrolAdminOptions{Username: "admin", Password: "secret"},
+		GlobalEventHandlers: EventHandlers{
+			"unhealthy": {{Name: "slack", Webhook: &webhookNotification{Method: "POST", URL: slackURL, Body: "{{check.status}}: {{check.name}}"}}},
+		},
+		GroupEventHandlers: map[string]EventHandlers{
+			"API": {"unhealthy": {{Name: "pager", Webhook: &webhookNotification{Method: "POST", URL: pagerURL}}}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	test := func(name string) (*http.Response, []NotifierTest, error) {
+		req, err := http.NewRequest("POST", server.URL+"/api/v1/admin/notifiers/test", strings.NewReader(url.Values{"name": {name}}.Encode()))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+		var tests []NotifierTest
+		json.NewDecoder(res.Body).Decode(&tests)
+		return res, tests, nil
+	}
+
+	res, tests, err := test("")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK || len(tests) != 2 {
+		t.Error(fmt.Errorf("Expected 2 tests (status %d), got %#v", res.StatusCode, tests))
+		return
+	}
+	if tests[0].Notifier != "slack" || tests[0].Event != "unhealthy" || tests[0].Service != "" || tests[0].Error != "" {
+		t.Error(fmt.Errorf("Wrong test of slack: %#v", tests[0]))
+		return
+	}
+	if tests[1].Notifier != "pager" || tests[1].Service != "API" || tests[1].Error != "Webhook returned status: 401" {
+		t.Error(fmt.Errorf("Wrong test of pager: %#v", tests[1]))
+		return
+	}
+	if body := <-bodies; body != "test: Test notification" {
+		t.Error(fmt.Errorf("Wrong test notification: %q", body))
+		return
+	}
+
+	// Only the named notifier is tested
+	res, tests, err = test("slack")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK || len(tests) != 1 || len(bodies) != 1 {
+		t.Error(fmt.Errorf("Expected only slack to be tested (status %d), got %#v", res.StatusCode, tests))
+		return
+	}
+	if res, _, err = test("email"); err != nil {
+		t.Error(err)
+		return
+	} else if res.StatusCode != http.StatusNotFound {
+		t.Error(fmt.Errorf("Expected unknown notifier to be rejected, got %d", res.StatusCode))
+		return
+	}
+
+	// Tests are not recorded as deliveries, but are shown by the admin
+	// status
+	notifiers, failures := p.getDeliveryStatus()
+	if len(failures) != 0 || len(notifiers) != 2 {
+		t.Error(fmt.Errorf("Wrong delivery status: %#v, %#v", notifiers, failures))
+		return
+	}
+	for _, status := range notifiers {
+		if status.Sent != 0 || status.LastTest == nil || (status.Notifier == "pager") != (status.LastTest.Error != "") {
+			t.Error(fmt.Errorf("Wrong status of %s: %#v", status.Notifier, status))
+			return
+		}
+	}
+}
@@ -2,12 +2,15 @@ package patrol
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/karimsa/patrol/internal/checker"
 	"github.com/karimsa/patrol/internal/history"
 	"github.com/karimsa/patrol/internal/logger"
@@ -23,6 +26,20 @@ type PatrolHttpsOptions struct {
 	Port uint32
 }
 
+// Credentials that protect patrol's admin interface and API, using
+// HTTP basic authentication.
+type PatrolAdminOptions struct {
+	Username string
+	Password string `json:"-" secret:"true"`
+
+	// Serve the net/http/pprof profiles under '/debug/pprof/'
+	Pprof bool `yaml:",omitempty"`
+
+	// Passwords of additional users by username, who can comment on
+	// incidents but cannot perform other admin actions
+	Responders map[string]string `json:"-" secret:"true"`
+}
+
 // Patrol instance to manage a set of checkers, a history file, and run
 // a web server to serve the web interface. Currently, instances cannot
 // be created directly. You must use: 'New', 'FromConfig', or 'FromConfigFile'.
@@ -32,14 +49,62 @@ type Patrol struct {
 	name                string
 	port                int
 	https               *PatrolHttpsOptions
+	admin               *PatrolAdminOptions
 	checkers            []*checker.Checker
 	server              *http.Server
+	redirectServer      *http.Server
+	shutdown            chan struct{}
 	logger              logger.Logger
 	logLevel            logger.LogLevel
 	groupEventHandlers  map[string]EventHandlers
 	globalEventHandlers EventHandlers
+	flapping            *FlappingOptions
+	flapMux             sync.Mutex
+	flappingChecks      map[string]map[string]bool
+	grouping            *GroupingOptions
+	groupMux            sync.Mutex
+	recentFailures      []time.Time
+	heldFailures        []heldFailure
+	url                 string
+	renotify            time.Duration
+	escalateAfter       time.Duration
+	notifyStateMux      sync.Mutex
+	ackMux              sync.Mutex
+	acks                map[string]map[string]acknowledgement
+	reminders           map[string]map[string]*reminderState
+	notifierTestMux     sync.Mutex
+	notifierTests       map[string]NotifierTest
+	region              string
+	regionLabel         string
+	regionMux           sync.Mutex
+	regionLabels        map[string]string
+	upstream            *PatrolUpstreamOptions
+	proxy               *checker.ProxyOptions
+	reports             *ReportOptions
+	groupStatusRules    map[string]GroupStatusRule
+	staleAfter          int
+	hooks               hooks
+	issueOptions        *IssueOptions
+	issueTracker        issueTracker
+	issueMux            sync.Mutex
+	issues              map[string]map[string]*issueState
+	simulations         map[string]map[string]*checker.SimulationOptions
+	environments        map[string]GroupEnvironment
+	checkUpdates        bool
+	releaseMux          sync.Mutex
+	latestRelease       *Release
+	deliveryMux         sync.Mutex
+	sending             map[string]bool
+	background          sync.WaitGroup
+	stopOnce            sync.Once
+	heldTimer           *time.Timer
 }
 
+var errCheckerNotFound = errors.New("No such checker")
+
+// Time that Close waits for patrol to shut down
+const shutdownTimeout = 1 * time.Minute
+
 // Map that goes from item status values to a list of notification objects
 type EventHandlers map[string][]*singleNotificationConfig
 
@@ -54,6 +119,10 @@ type CreatePatrolOptions struct {
 	// Zero value indicates no HTTPS server.
 	HTTPS *PatrolHttpsOptions
 
+	// Admin credentials used to protect actions such as pausing
+	// checkers. Zero value disables these actions.
+	Admin *PatrolAdminOptions
+
 	// Name is used to render the web interface. It is used
 	// as the page's <title> and the heading at the top of
 	// the page.
@@ -78,21 +147,98 @@ type CreatePatrolOptions struct {
 
 	// Event handlers for all changes
 	GlobalEventHandlers EventHandlers
+
+	// Flap detection options. While a check is flapping, its status
+	// notifications are suppressed and 'flapping' handlers are run
+	// instead. Zero value disables flap detection.
+	Flapping *FlappingOptions
+
+	// Grouping options for failure notifications. During mass outages,
+	// failures are sent as a single notification instead of one per
+	// check. Zero value disables grouping.
+	Grouping *GroupingOptions
+
+	// Public URL of the status page, which notifications link to
+	URL string
+
+	// Maximum number of checks that run at once. When more checks are
+	// due, they run in order of their priority, and low-priority checks
+	// skip their runs. Zero value does not limit checks.
+	Concurrency int
+
+	// Interval at which failure notifications are sent again while a
+	// check is unhealthy, and time after which 'escalated' handlers are
+	// run. Acknowledged failures are neither notified again nor
+	// escalated. Zero values disable these.
+	Renotify      time.Duration
+	EscalateAfter time.Duration
+
+	// Name of the region that this instance runs its checks from. Checks
+	// with a quorum combine their results with those reported by other
+	// regions.
+	Region string
+
+	// Human readable name of the region (i.e. 'Frankfurt'), which is
+	// shown on the status page
+	RegionLabel string
+
+	// Another patrol instance that the results of all checks are sent
+	// to. Zero value disables forwarding.
+	Upstream *PatrolUpstreamOptions
+
+	// Proxy used for notifications and for forwarding results upstream.
+	// Zero value connects directly (or uses the proxy set in the
+	// environment).
+	Proxy *checker.ProxyOptions
+
+	// Monthly reports that are written automatically. Zero value disables
+	// these reports, though they can still be generated on demand.
+	Reports *ReportOptions
+
+	// Issue tracker that issues are opened in for checks that stay
+	// unhealthy. Zero value disables issues.
+	Issues *IssueOptions
+
+	// Patterns of the results that checks record while simulating, by
+	// group and check (see Simulate). Checks without a pattern record
+	// random results.
+	Simulations map[string]map[string]*checker.SimulationOptions
+
+	// Environments that services run in, by group. Services without an
+	// environment are only shown when all environments are.
+	Environments map[string]GroupEnvironment
+
+	// Rules that decide the status of each service from its checks, by
+	// group. Services without a rule are down when any check fails.
+	GroupStatusRules map[string]GroupStatusRule
+
+	// Number of intervals after which the latest result of a check is
+	// stale, i.e. because patrol was not running. Stale results are shown
+	// as unknown until the check runs again. Zero value disables this.
+	StaleAfter int
+
+	// Whether to look up new releases of patrol daily, which the admin
+	// page shows once they are available
+	CheckUpdates bool
 }
 
 func New(options CreatePatrolOptions, historyFile *history.File) (*Patrol, error) {
 	if historyFile == nil {
 		groups := make(map[string]map[string]bool, len(options.Checkers))
+		retention := make(map[string]map[string]history.Retention, len(options.Checkers))
 		for _, checker := range options.Checkers {
 			if _, ok := groups[checker.Group]; !ok {
 				groups[checker.Group] = make(map[string]bool, len(options.Checkers))
+				retention[checker.Group] = make(map[string]history.Retention, len(options.Checkers))
 			}
 			groups[checker.Group][checker.Name] = true
+			retention[checker.Group][checker.Name] = checker.Retention
 		}
 
 		var err error
 		options.History.LogLevel = options.LogLevel
 		options.History.Groups = groups
+		options.History.Retention = retention
 		historyFile, err = history.New(options.History)
 		if err != nil {
 			return nil, err
@@ -103,16 +249,57 @@ func New(options CreatePatrolOptions, historyFile *history.File) (*Patrol, error
 		name:                options.Name,
 		port:                int(options.Port),
 		https:               options.HTTPS,
+		admin:               options.Admin,
 		checkers:            options.Checkers,
 		server:              &http.Server{},
+		redirectServer:      &http.Server{},
+		shutdown:            make(chan struct{}),
 		logLevel:            options.LogLevel,
 		logger:              logger.New(options.LogLevel, ""),
 		groupEventHandlers:  options.GroupEventHandlers,
 		globalEventHandlers: options.GlobalEventHandlers,
+		flapping:            options.Flapping,
+		flappingChecks:      make(map[string]map[string]bool),
+		grouping:            options.Grouping,
+		url:                 strings.TrimSuffix(options.URL, "/"),
+		renotify:            options.Renotify,
+		escalateAfter:       options.EscalateAfter,
+		acks:                make(map[string]map[string]acknowledgement),
+		reminders:           make(map[string]map[string]*reminderState),
+		notifierTests:       make(map[string]NotifierTest),
+		region:              options.Region,
+		regionLabel:         options.RegionLabel,
+		regionLabels:        make(map[string]string),
+		upstream:            options.Upstream,
+		proxy:               options.Proxy,
+		reports:             options.Reports,
+		groupStatusRules:    options.GroupStatusRules,
+		staleAfter:          options.StaleAfter,
+		issueOptions:        options.Issues,
+		issues:              make(map[string]map[string]*issueState),
+		simulations:         options.Simulations,
+		environments:        options.Environments,
+		checkUpdates:        options.CheckUpdates,
 
 		History: historyFile,
 	}
-	p.server.Handler = gziphandler.GzipHandler(p)
+	if p.issueOptions != nil {
+		p.issueTracker = newIssueTracker(*p.issueOptions, p.proxy)
+	}
+	p.restoreNotificationStates()
+	p.server.Handler = p.newHandler()
+	if options.Concurrency > 0 {
+		pool := checker.NewPool(options.Concurrency)
+		for _, c := range p.checkers {
+			c.Pool = pool
+		}
+	}
+	if p.proxy != nil {
+		p.globalEventHandlers.useProxy(*p.proxy)
+		for _, handlers := range p.groupEventHandlers {
+			handlers.useProxy(*p.proxy)
+		}
+	}
 	if p.name == "" {
 		p.name = "Statuspage"
 	}
@@ -150,24 +337,162 @@ func (p *Patrol) SetLogLevel(level logger.LogLevel) {
 func (p *Patrol) OnCheckerStatus(status, group, checker string) {
 	p.logger.Debugf("status changed: %s, %s, %s", status, group, checker)
 
-	if p.globalEventHandlers != nil {
-		if handlers, ok := p.globalEventHandlers[status]; ok && len(handlers) > 0 {
-			p.logger.Debugf("Sending global notification for %s status of %s", status, group)
-			for idx, n := range handlers {
-				n.Run()
-				p.logger.Debugf("Sent global notifcation #%d", idx)
+	// Flapping checks only notify once when they start flapping, and once
+	// more with their current status when they stabilize. Silenced checks
+	// do not notify at all.
+	wasFlapping, flapping := p.updateFlapping(group, checker)
+	if wasFlapping != flapping {
+		p.saveNotificationState(group, checker)
+	}
+	silence, silenced := p.silenced(group, checker)
+	if silenced {
+		p.logger.Infof("Not notifying %s status of %s/%s, which is silenced until %s (%s)", status, group, checker, silence.EndsAt.Format(time.RFC3339), silence.ID)
+	}
+	if flapping {
+		if !wasFlapping {
+			p.logger.Infof("%s/%s is flapping, suppressing notifications", group, checker)
+			if !silenced {
+				p.notify("flapping", group, checker)
 			}
 		}
+		return
 	}
-	if groupHandlers, ok := p.groupEventHandlers[group]; ok {
-		if handlers, ok := groupHandlers[status]; ok && len(handlers) > 0 {
-			p.logger.Debugf("Sending group notification for %s status of %s", status, group)
-			for idx, n := range handlers {
-				n.Run()
-				p.logger.Debugf("Sent group notifcation #%d", idx)
-			}
+	if wasFlapping {
+		p.logger.Infof("%s/%s has stopped flapping", group, checker)
+	}
+	if !silenced {
+		p.notify(status, group, checker)
+	}
+}
+
+// notify runs the handlers of the given event, skipping handlers that are
+// limited to other severities than the check's. Failures may be held, to
+// be sent as a single notification during mass outages.
+func (p *Patrol) notify(status, group, checkName string) {
+	event := p.newEvent(status, group, checkName)
+	handlers := p.handlersFor(status, group, checkName)
+	if status == "unhealthy" {
+		p.failureNotified(group, checkName)
+		if p.holdFailure(event, handlers) {
+			p.logger.Debugf("Holding notification for %s/%s", group, checkName)
+			return
+		}
+	}
+
+	p.logger.Debugf("Sending %d notifications for %s status of %s/%s", len(handlers), status, group, checkName)
+	for _, n := range handlers {
+		p.deliver(n, event)
+	}
+}
+
+// newEvent describes the given event of a check, based on its latest
+// result.
+func (p *Patrol) newEvent(status, group, checkName string) notificationEvent {
+	event := notificationEvent{
+		Status: status,
+		Group:  group,
+		Check:  checkName,
+	}
+	if item, ok := p.History.GetLatestItem(group, checkName); ok {
+		event.Error = item.Error
+		if status == "degraded" {
+			event.Error = item.Anomaly
+		}
+		event.Annotations = item.Annotations
+	}
+	if c := p.getChecker(group, checkName); c != nil {
+		event.Owner = c.Owner
+		event.RunbookURL = c.RunbookURL
+	}
+	if p.url != "" {
+		query := url.Values{"group": {group}, "check": {checkName}}
+		event.Link = p.url + "/check?" + query.Encode()
+
+		// Failures can be acknowledged from the notification
+		if incident, ok := p.ongoingIncident(group, checkName); ok && status != "recovered" && status != "healthy" {
+			query.Set("incident", incident.ID)
+			event.AckLink = p.url + "/ack?" + query.Encode()
+		}
+	}
+	return event
+}
+
+// handlersFor returns the global and group handlers of an event, without
+// those that are limited to other severities than the check's.
+func (p *Patrol) handlersFor(status, group, checkName string) []*singleNotificationConfig {
+	severity := checker.SeverityMajor
+	if c := p.getChecker(group, checkName); c != nil {
+		severity = c.Severity
+	}
+	var handlers []*singleNotificationConfig
+	for _, n := range p.globalEventHandlers[status] {
+		if n.matchesSeverity(severity) {
+			handlers = append(handlers, n)
+		}
+	}
+	for _, n := range p.groupEventHandlers[group][status] {
+		if n.matchesSeverity(severity) {
+			handlers = append(handlers, n)
+		}
+	}
+	return handlers
+}
+
+func (p *Patrol) getChecker(group, name string) *checker.Checker {
+	for _, checker := range p.checkers {
+		if checker.Group == group && checker.Name == name {
+			return checker
 		}
 	}
+	return nil
+}
+
+// SetCheckerPaused pauses or resumes a checker. The paused state is stored
+// in the history file, so that it is kept across restarts.
+func (p *Patrol) SetCheckerPaused(group, name string, paused bool) error {
+	checker := p.getChecker(group, name)
+	if checker == nil {
+		return fmt.Errorf("%w: %s/%s", errCheckerNotFound, group, name)
+	}
+
+	if err := p.History.UpdateCheckState(group, name, func(state *history.CheckState) {
+		state.Paused = paused
+	}); err != nil {
+		return err
+	}
+
+	if paused {
+		checker.Pause()
+	} else {
+		checker.Resume()
+	}
+	return nil
+}
+
+// Simulate makes all checks record synthetic results that follow their
+// simulation patterns, instead of running. External checks are run too.
+// Notifications are still sent, but issues are not opened, results are not
+// forwarded upstream and monthly reports are not written. It must be
+// called before Start.
+func (p *Patrol) Simulate() {
+	for _, c := range p.checkers {
+		opts := p.simulations[c.Group][c.Name]
+		if opts == nil {
+			// The defaults are always valid
+			opts = &checker.SimulationOptions{}
+			opts.Validate()
+		}
+		c.Simulation = opts
+		c.External = false
+		if c.Interval <= 0 {
+			c.Interval = time.Minute
+		}
+	}
+	p.upstream = nil
+	p.reports = nil
+	p.issueOptions = nil
+	p.issueTracker = nil
+	p.logger.Warnf("Simulating results of %d checks", len(p.checkers))
 }
 
 func (p *Patrol) Start() {
@@ -176,53 +501,177 @@ func (p *Patrol) Start() {
 	}
 
 	for _, checker := range p.checkers {
+		if p.History.GetCheckState(checker.Group, checker.Name).Paused {
+			checker.Pause()
+		}
 		checker.Start(p)
 	}
+	if p.upstream != nil {
+		p.goBackground(p.forwardResults)
+	}
+	if p.reports != nil {
+		p.goBackground(p.scheduleReports)
+	}
+	if p.renotify > 0 || p.escalateAfter > 0 {
+		p.goBackground(p.scheduleReminders)
+	}
+	if p.issueTracker != nil {
+		p.goBackground(p.scheduleIssues)
+	}
+	p.goBackground(p.scheduleDeliveryRetries)
+	if p.checkUpdates {
+		p.goBackground(p.scheduleUpdateChecks)
+	}
 
-	go func() {
-		var err error
-		if p.https == nil {
-			p.server.Addr = fmt.Sprintf(":%d", p.port)
-			err = p.server.ListenAndServe()
-		} else {
-			go func() {
-				err := http.ListenAndServe(fmt.Sprintf(":%d", p.port), http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-					http.Redirect(
-						res,
-						req,
-						fmt.Sprintf("https://%s:%d", strings.Split(req.Host, ":")[0], p.https.Port),
-						http.StatusTemporaryRedirect,
-					)
-				}))
-				if err != nil && err != http.ErrServerClosed {
-					panic(err)
-				}
-			}()
-
-			p.server.Addr = fmt.Sprintf(":%d", p.https.Port)
-			err = p.server.ListenAndServeTLS(p.https.Cert, p.https.Key)
-		}
-
-		if err != nil && err != http.ErrServerClosed {
+	// Sockets passed by systemd replace the configured ports: the first
+	// serves the status page, and the second redirects to HTTPS
+	activated, err := systemdListeners()
+	if err != nil {
+		panic(err)
+	}
+	listen := func(idx, port int) net.Listener {
+		if idx < len(activated) {
+			p.logger.Infof("Using socket %s passed by systemd", activated[idx].Addr())
+			return activated[idx]
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
 			panic(err)
 		}
+		return listener
+	}
+
+	if p.https == nil {
+		listener := listen(0, p.port)
+		p.server.Addr = listener.Addr().String()
+		go func() {
+			if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	} else {
+		redirectListener := listen(1, p.port)
+		p.redirectServer.Addr = redirectListener.Addr().String()
+		p.redirectServer.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			http.Redirect(
+				res,
+				req,
+				fmt.Sprintf("https://%s:%d", strings.Split(req.Host, ":")[0], p.https.Port),
+				http.StatusTemporaryRedirect,
+			)
+		})
+		go func() {
+			if err := p.redirectServer.Serve(redirectListener); err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+
+		listener := listen(0, int(p.https.Port))
+		p.server.Addr = listener.Addr().String()
+		go func() {
+			if err := p.server.ServeTLS(listener, p.https.Cert, p.https.Key); err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	if interval := sdWatchdogInterval(); interval > 0 {
+		p.goBackground(func() { p.runWatchdog(interval) })
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		p.logger.Warnf("Failed to notify systemd: %s", err)
+	}
+}
+
+// goBackground runs fn in the background, and Shutdown waits for it to
+// return before closing the history file.
+func (p *Patrol) goBackground(fn func()) {
+	p.background.Add(1)
+	go func() {
+		defer p.background.Done()
+		fn()
 	}()
 }
 
-func (p *Patrol) Stop() {
+// Shutdown stops patrol in an order that does not lose results: every
+// checker and background task is signalled to stop first, then the
+// checkers are waited on and their pending results written, then the HTTP
+// server stops accepting requests (which can also write results), held
+// notifications are sent and in-flight deliveries are waited on, and
+// finally the history file is drained and closed. Every step is run even
+// if an earlier one fails, and all failures are returned together, since
+// they may mean that results were lost. ctx limits the whole shutdown.
+func (p *Patrol) Shutdown(ctx context.Context) error {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		p.logger.Warnf("Failed to notify systemd: %s", err)
+	}
+
+	p.stopOnce.Do(func() {
+		close(p.shutdown)
+	})
 	for _, checker := range p.checkers {
-		checker.Close()
+		checker.Stop()
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
-	defer cancel()
+	var errs []string
+	for _, checker := range p.checkers {
+		if err := checker.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
 	if err := p.server.Shutdown(ctx); err != nil {
-		panic(err)
+		errs = append(errs, fmt.Sprintf("Failed to stop HTTP server: %s", err))
+	}
+	if err := p.redirectServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("Failed to stop HTTP redirect server: %s", err))
+	}
+
+	// Failures that are held for grouping are sent now rather than lost
+	p.groupMux.Lock()
+	held := p.heldTimer != nil && p.heldTimer.Stop()
+	p.heldTimer = nil
+	p.groupMux.Unlock()
+	if held {
+		p.sendHeldFailures()
+		p.background.Done()
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		p.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Sprintf("Timed out waiting for background tasks and deliveries: %s", ctx.Err()))
+	}
+
+	if err := p.History.Close(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to shut down cleanly: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Stop shuts patrol down like Close, without returning failures.
+//
+// Deprecated: use Shutdown or Close, which report results that may have
+// been lost.
+func (p *Patrol) Stop() {
+	if err := p.Close(); err != nil {
+		p.logger.Warnf("%s", err)
 	}
 }
 
-func (p *Patrol) Close() {
+// Close shuts patrol down, waiting up to a minute for checks to finish
+// and for results to be written.
+func (p *Patrol) Close() error {
 	p.logger.Infof("Waiting for graceful shutdown")
-	p.Stop()
-	p.History.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return p.Shutdown(ctx)
 }
@@ -0,0 +1,141 @@
+package patrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Options for forwarding results to another patrol instance, so that the
+// same checks can be run from multiple regions. The upstream instance must
+// have admin credentials configured, which are used to authenticate.
+type PatrolUpstreamOptions struct {
+	URL      string
+	Username string
+	Password string `json:"-" secret:"true"`
+}
+
+type regionResult struct {
+	Region string
+	Label  string `json:",omitempty"`
+	Item   history.Item
+}
+
+// serveResults accepts results of checks that were run by patrol instances
+// in other regions.
+func (p *Patrol) serveResults(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+		return
+	}
+
+	var result regionResult
+	if err := json.NewDecoder(req.Body).Decode(&result); err != nil {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse result: %s", err))
+		return
+	}
+	if result.Region == "" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Results must specify a region"))
+		return
+	}
+
+	checker := p.getChecker(result.Item.Group, result.Item.Name)
+	if checker == nil {
+		writeJSONError(res, http.StatusNotFound, fmt.Errorf("%w: %s/%s", errCheckerNotFound, result.Item.Group, result.Item.Name))
+		return
+	}
+	checker.ReportRegionResult(result.Region, result.Item)
+	if result.Label != "" {
+		p.regionMux.Lock()
+		p.regionLabels[result.Region] = result.Label
+		p.regionMux.Unlock()
+	}
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"region": result.Region,
+		"group":  result.Item.Group,
+		"check":  result.Item.Name,
+	})
+}
+
+// forwardResults sends every result written to the history file to the
+// upstream instance, until patrol is shut down.
+func (p *Patrol) forwardResults() {
+	items, unsubscribe := p.History.Subscribe("")
+	defer unsubscribe()
+
+	client := http.Client{Timeout: 30 * time.Second}
+	if p.proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = p.proxy.ProxyFunc()
+		client.Transport = transport
+	}
+	for {
+		select {
+		case item := <-items:
+			if err := p.forwardResult(&client, item); err != nil {
+				p.logger.Warnf("Failed to forward result of %s/%s: %s", item.Group, item.Name, err)
+			}
+
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// getRegionLabel returns the label of a region, or the region itself if it
+// has no label. Labels of other regions are learned from their results.
+func (p *Patrol) getRegionLabel(region string) string {
+	if region == p.region && p.regionLabel != "" {
+		return p.regionLabel
+	}
+	p.regionMux.Lock()
+	defer p.regionMux.Unlock()
+	if label, ok := p.regionLabels[region]; ok {
+		return label
+	}
+	return region
+}
+
+func (p *Patrol) forwardResult(client *http.Client, item history.Item) error {
+	// Results are forwarded without their output, which can be large and
+	// is not used for consensus
+	item.Output = nil
+	body, err := json.Marshal(regionResult{
+		Region: p.region,
+		Label:  p.regionLabel,
+		Item:   item,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.upstream.URL+"/api/v1/results", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(p.upstream.Username, p.upstream.Password)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		if body.Error == "" {
+			return fmt.Errorf("Upstream returned status %d", res.StatusCode)
+		}
+		return errors.New(body.Error)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package patrol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of patrol, which release builds set with:
+// -ldflags "-X github.com/karimsa/patrol.Version=v1.2.3"
+var Version = "dev"
+
+// ReleasePublicKey is the base64-encoded ed25519 key that the manifests of
+// release binaries are signed with, which release builds set like Version.
+// Builds without a key cannot update themselves.
+var ReleasePublicKey = ""
+
+// Latest release of patrol, as returned by GitHub
+var releasesURL = "https://api.github.com/repos/karimsa/patrol/releases/latest"
+
+// Interval at which new releases are looked up
+const updateInterval = 24 * time.Hour
+
+// Binaries are far smaller than this, so larger downloads are not binaries
+const maxReleaseSize = 256 << 20
+
+var (
+	errNoReleaseBinary = errors.New("No release binary")
+	errBadSignature    = errors.New("Invalid signature")
+	errOlderRelease    = errors.New("Refusing to downgrade")
+)
+
+// Release is a published version of patrol.
+type Release struct {
+	Version     string         `json:"tag_name"`
+	URL         string         `json:"html_url"`
+	PublishedAt time.Time      `json:"published_at"`
+	Assets      []ReleaseAsset `json:"assets"`
+}
+
+// ReleaseAsset is a file attached to a release, i.e. the binary for an
+// OS and architecture or its signature.
+type ReleaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// releaseBinaryName is the name of the binary of a release for an OS and
+// architecture. Each binary has its signed manifest in '{name}.sig'.
+func releaseBinaryName(goos, goarch string) string {
+	name := fmt.Sprintf("patrol-%s-%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// parseVersion parses versions like 'v1.2.3'. Development builds and
+// pre-releases (i.e. 'v1.2.3-rc.1') cannot be parsed.
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// IsNewerVersion returns whether latest is a newer version than current.
+// Versions that cannot be compared, such as development builds, are never
+// older.
+func IsNewerVersion(latest, current string) bool {
+	a, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	b, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// LatestRelease looks up the latest release of patrol.
+func LatestRelease(client *http.Client) (Release, error) {
+	var release Release
+	req, err := http.NewRequest(http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return release, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	res, err := client.Do(req)
+	if err != nil {
+		return release, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return release, fmt.Errorf("Failed to look up latest release (status %d)", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&release); err != nil {
+		return release, fmt.Errorf("Failed to parse latest release: %s", err)
+	}
+	if release.Version == "" {
+		return release, fmt.Errorf("Latest release has no version")
+	}
+	return release, nil
+}
+
+func downloadReleaseAsset(client *http.Client, release Release, name string) ([]byte, error) {
+	for _, asset := range release.Assets {
+		if asset.Name != name {
+			continue
+		}
+		res, err := client.Get(asset.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to download %s (status %d)", name, res.StatusCode)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxReleaseSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxReleaseSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes", name, maxReleaseSize)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: release %s has no %s", errNoReleaseBinary, release.Version, name)
+}
+
+// ReleaseManifest describes a binary of a release. The manifest is signed
+// rather than the binary itself, so that a signed binary cannot be passed
+// off as another version (i.e. to roll back to a vulnerable release) or as
+// the binary of another platform.
+type ReleaseManifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+// SignedManifest is the content of '{name}.sig': the JSON-encoded manifest
+// exactly as it was signed, and its base64-encoded signature.
+type SignedManifest struct {
+	Manifest  string `json:"manifest"`
+	Signature string `json:"signature"`
+}
+
+// verifyRelease checks that the manifest of a binary was signed with the
+// release key, and that it describes the binary, with the given name and
+// version.
+func verifyRelease(binary, signed []byte, publicKey, name, version string) (ReleaseManifest, error) {
+	var manifest ReleaseManifest
+	if publicKey == "" {
+		return manifest, fmt.Errorf("%w: this build of patrol has no release key to verify binaries with", errBadSignature)
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return manifest, fmt.Errorf("%w: the release key of this build is invalid", errBadSignature)
+	}
+	var sm SignedManifest
+	if err := json.Unmarshal(signed, &sm); err != nil {
+		return manifest, fmt.Errorf("%w: failed to parse manifest: %s", errBadSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sm.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), []byte(sm.Manifest), sig) {
+		return manifest, fmt.Errorf("%w: manifest was not signed with the release key", errBadSignature)
+	}
+	if err := json.Unmarshal([]byte(sm.Manifest), &manifest); err != nil {
+		return manifest, fmt.Errorf("%w: failed to parse manifest: %s", errBadSignature, err)
+	}
+
+	if manifest.Name != name {
+		return manifest, fmt.Errorf("%w: manifest is for %s, not %s", errBadSignature, manifest.Name, name)
+	}
+	if manifest.Version != version {
+		return manifest, fmt.Errorf("%w: manifest is for %s, not %s", errBadSignature, manifest.Version, version)
+	}
+	hash := sha256.Sum256(binary)
+	if manifest.SHA256 != hex.EncodeToString(hash[:]) {
+		return manifest, fmt.Errorf("%w: binary does not match its manifest", errBadSignature)
+	}
+	return manifest, nil
+}
+
+// DownloadRelease downloads the binary of a release for the current OS and
+// architecture, and verifies its signed manifest. The release must be newer
+// than this build, unless force is set, in which case it must not be older
+// (i.e. to reinstall the same release, or over a development build).
+func DownloadRelease(client *http.Client, release Release, force bool) ([]byte, error) {
+	name := releaseBinaryName(runtime.GOOS, runtime.GOARCH)
+	binary, err := downloadReleaseAsset(client, release, name)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := downloadReleaseAsset(client, release, name+".sig")
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := verifyRelease(binary, signed, ReleasePublicKey, name, release.Version)
+	if err != nil {
+		return nil, err
+	}
+	if force && IsNewerVersion(Version, manifest.Version) {
+		return nil, fmt.Errorf("%w: release %s is older than %s", errOlderRelease, manifest.Version, Version)
+	} else if !force && !IsNewerVersion(manifest.Version, Version) {
+		return nil, fmt.Errorf("%w: release %s is not newer than %s", errOlderRelease, manifest.Version, Version)
+	}
+	return binary, nil
+}
+
+// ReplaceExecutable replaces the executable at the given path. The new
+// binary is written next to it before it is renamed over the executable,
+// so that a failed update leaves the old one in place. Since Windows does
+// not allow running executables to be replaced, the old one is moved to
+// '{path}.old' first.
+func ReplaceExecutable(path string, binary []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		return os.Rename(tmp.Name(), path)
+	}
+	os.Remove(path + ".old")
+	if err := os.Rename(path, path+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Rename(path+".old", path)
+		return err
+	}
+	return nil
+}
+
+// checkForUpdates looks up the latest release, which the admin page shows
+// when it is newer than this build.
+func (p *Patrol) checkForUpdates() {
+	client := &http.Client{Timeout: 1 * time.Minute}
+	if p.proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = p.proxy.ProxyFunc()
+		client.Transport = transport
+	}
+	release, err := LatestRelease(client)
+	if err != nil {
+		p.logger.Warnf("Failed to check for updates: %s", err)
+		return
+	}
+
+	p.releaseMux.Lock()
+	p.latestRelease = &release
+	p.releaseMux.Unlock()
+	if IsNewerVersion(release.Version, Version) {
+		p.logger.Infof("patrol %s is available (running %s): %s", release.Version, Version, release.URL)
+	}
+}
+
+// getUpdate returns the latest release if it is newer than this build.
+func (p *Patrol) getUpdate() *Release {
+	p.releaseMux.Lock()
+	defer p.releaseMux.Unlock()
+	if p.latestRelease != nil && IsNewerVersion(p.latestRelease.Version, Version) {
+		release := *p.latestRelease
+		return &release
+	}
+	return nil
+}
+
+func (p *Patrol) scheduleUpdateChecks() {
+	p.checkForUpdates()
+	for {
+		select {
+		case <-time.After(updateInterval):
+			p.checkForUpdates()
+		case <-p.shutdown:
+			return
+		}
+	}
+}
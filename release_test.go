@@ -0,0 +1,210 @@
+package patrol
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestIsNewerVersion(t *testing.T) {
+	for _, test := range []struct {
+		latest, current string
+		newer           bool
+	}{
+		{"v1.2.3", "v1.2.2", true},
+		{"v1.10.0", "v1.9.9", true},
+		{"v2.0.0", "v1.99.0", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.2", "v1.2.3", false},
+		{"v1.2.3", "dev", false},
+		{"v1.2.3-rc.1", "v1.2.2", false},
+	} {
+		if newer := IsNewerVersion(test.latest, test.current); newer != test.newer {
+			t.Error(fmt.Errorf("Expected %s to be newer than %s: %t (got %t)", test.latest, test.current, test.newer, newer))
+			return
+		}
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	binary := []byte("#!/bin/sh\necho v1.2.3\n")
+	name := releaseBinaryName(runtime.GOOS, runtime.GOARCH)
+	sign := func(manifest ReleaseManifest) []byte {
+		data, _ := json.Marshal(manifest)
+		signed, _ := json.Marshal(SignedManifest{
+			Manifest:  string(data),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data)),
+		})
+		return signed
+	}
+	hash := sha256.Sum256(binary)
+	signature := sign(ReleaseManifest{Name: name, Version: "v1.2.3", SHA256: hex.EncodeToString(hash[:])})
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/latest":
+			json.NewEncoder(res).Encode(map[string]interface{}{
+				"tag_name": "v1.2.3",
+				"html_url": "https://github.com/karimsa/patrol/releases/tag/v1.2.3",
+				"assets": []map[string]string{
+					{"name": name, "browser_download_url": server.URL + "/binary"},
+					{"name": name + ".sig", "browser_download_url": server.URL + "/signature"},
+				},
+			})
+		case "/binary":
+			res.Write(binary)
+		case "/signature":
+			res.Write(signature)
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defer func(url, key, version string) {
+		releasesURL, ReleasePublicKey, Version = url, key, version
+	}(releasesURL, ReleasePublicKey, Version)
+	releasesURL = server.URL + "/latest"
+	ReleasePublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	Version = "v1.2.2"
+
+	release, err := LatestRelease(server.Client())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if release.Version != "v1.2.3" || len(release.Assets) != 2 {
+		t.Error(fmt.Errorf("Wrong release: %#v", release))
+		return
+	}
+
+	// Binaries are only installed once their manifest is verified
+	downloaded, err := DownloadRelease(server.Client(), release, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(downloaded) != string(binary) {
+		t.Error(fmt.Errorf("Wrong binary downloaded: %s", downloaded))
+		return
+	}
+
+	// Releases that are not newer are only installed when forced, and
+	// never when they are older
+	Version = "v1.2.3"
+	if _, err := DownloadRelease(server.Client(), release, false); !errors.Is(err, errOlderRelease) {
+		t.Error(fmt.Errorf("Expected release to be up to date, got: %v", err))
+		return
+	}
+	if _, err := DownloadRelease(server.Client(), release, true); err != nil {
+		t.Error(fmt.Errorf("Expected forced update to reinstall the release, got: %v", err))
+		return
+	}
+	Version = "v1.3.0"
+	if _, err := DownloadRelease(server.Client(), release, true); !errors.Is(err, errOlderRelease) {
+		t.Error(fmt.Errorf("Expected older release to be refused, got: %v", err))
+		return
+	}
+	Version = "v1.2.2"
+
+	// Signed manifests of other versions or platforms are refused, so an
+	// older binary cannot be served as the latest release
+	for _, manifest := range []ReleaseManifest{
+		{Name: name, Version: "v1.2.1", SHA256: hex.EncodeToString(hash[:])},
+		{Name: "patrol-plan9-mips", Version: "v1.2.3", SHA256: hex.EncodeToString(hash[:])},
+	} {
+		signature = sign(manifest)
+		if _, err := DownloadRelease(server.Client(), release, false); !errors.Is(err, errBadSignature) {
+			t.Error(fmt.Errorf("Expected manifest of %s %s to be rejected, got: %v", manifest.Name, manifest.Version, err))
+			return
+		}
+	}
+	signature = sign(ReleaseManifest{Name: name, Version: "v1.2.3", SHA256: hex.EncodeToString(hash[:])})
+
+	binary = append(binary, []byte("rm -rf /\n")...)
+	if _, err := DownloadRelease(server.Client(), release, false); !errors.Is(err, errBadSignature) {
+		t.Error(fmt.Errorf("Expected tampered binary to be rejected, got: %v", err))
+		return
+	}
+	ReleasePublicKey = ""
+	if _, err := DownloadRelease(server.Client(), release, false); !errors.Is(err, errBadSignature) {
+		t.Error(fmt.Errorf("Expected builds without a release key to refuse updates, got: %v", err))
+		return
+	}
+	release.Assets = release.Assets[1:]
+	if _, err := DownloadRelease(server.Client(), release, false); !errors.Is(err, errNoReleaseBinary) {
+		t.Error(fmt.Errorf("Expected missing binary to be reported, got: %v", err))
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "patrol-self-update")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "patrol")
+	if err := ioutil.WriteFile(path, []byte("old"), 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ReplaceExecutable(path, downloaded); err != nil {
+		t.Error(err)
+		return
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != string(downloaded) {
+		t.Error(fmt.Errorf("Expected executable to be replaced, got: %s (%v)", data, err))
+		return
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error(fmt.Errorf("Expected temporary files to be removed, got %d files", len(files)))
+		return
+	}
+
+	// The admin page shows newer releases
+	os.Remove("release-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "release-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+	p, err := New(CreatePatrolOptions{CheckUpdates: true}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p.checkForUpdates()
+	if status := p.getAdminStatus(); status.Update == nil || status.Update.Version != "v1.2.3" || status.Version != "v1.2.2" {
+		t.Error(fmt.Errorf("Expected v1.2.3 to be available, got: %#v", status.Update))
+		return
+	}
+	Version = "v1.2.3"
+	if status := p.getAdminStatus(); status.Update != nil {
+		t.Error(fmt.Errorf("Expected v1.2.3 to be up to date, got: %#v", status.Update))
+		return
+	}
+}
@@ -0,0 +1,273 @@
+package patrol
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ReportOptions configures the reports that are generated automatically.
+type ReportOptions struct {
+	// Directory that a PDF report of the previous month is written to at
+	// the start of each month
+	Dir string
+}
+
+// checkReport summarizes the availability of a single check over a range
+// of time.
+type checkReport struct {
+	Group string
+	Name  string
+
+	// Percentage of the monitored time in which the check was not unhealthy
+	Uptime float64
+
+	// Time within the range in which the check was being run. Time before the
+	// check's first result is not counted.
+	Monitored time.Duration
+	Downtime  time.Duration
+
+	// Number of incidents that overlap the range
+	Outages int
+
+	// Mean time to recovery of the incidents that were resolved within the
+	// range. Zero if no incidents were resolved.
+	MTTR time.Duration
+}
+
+// ParseReportTime parses the bounds of a report, which are either a date
+// (i.e. '2021-01-31') or an RFC3339 timestamp.
+func ParseReportTime(str string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", str, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time '%s': must be a date (YYYY-MM-DD) or an RFC3339 timestamp", str)
+	}
+	return t, nil
+}
+
+// overlap returns how much of the time between start and end falls within
+// the time between from and to.
+func overlap(start, end, from, to time.Time) time.Duration {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// getReport computes the reports of all checks between the given times.
+// Private checks are only included if asked for.
+func (p *Patrol) getReport(from, to time.Time, includePrivate bool) []checkReport {
+	now := time.Now()
+	if to.After(now) {
+		to = now
+	}
+
+	reports := make([]checkReport, 0, len(p.checkers))
+	for _, checker := range p.checkers {
+		if checker.Private && !includePrivate {
+			continue
+		}
+		report := checkReport{
+			Group:  checker.Group,
+			Name:   checker.Name,
+			Uptime: 100,
+		}
+
+		// The check's first transition is its first result
+		transitions := p.History.GetTransitions(checker.Group, checker.Name)
+		if len(transitions) > 0 {
+			report.Monitored = overlap(transitions[len(transitions)-1].CreatedAt, to, from, to)
+		}
+
+		var numResolved int
+		var totalRecovery time.Duration
+		for _, i := range incidentsFromTransitions(transitions) {
+			end := i.ResolvedAt
+			if i.Ongoing() {
+				end = now
+			}
+			if !i.StartedAt.Before(to) || !end.After(from) {
+				continue
+			}
+
+			report.Outages++
+			report.Downtime += overlap(i.StartedAt, end, from, to)
+			if !i.Ongoing() && !i.ResolvedAt.Before(from) && i.ResolvedAt.Before(to) {
+				numResolved++
+				totalRecovery += i.ResolvedAt.Sub(i.StartedAt)
+			}
+		}
+		if numResolved > 0 {
+			report.MTTR = totalRecovery / time.Duration(numResolved)
+		}
+		if report.Monitored > 0 {
+			report.Uptime = 100 * float64(report.Monitored-report.Downtime) / float64(report.Monitored)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// WriteReport writes the uptime, number of outages and mean time to
+// recovery of each check between the given times, as either 'csv', 'json'
+// or 'pdf'.
+func (p *Patrol) WriteReport(out io.Writer, from, to time.Time, format string) error {
+	return p.writeReport(out, from, to, format, true)
+}
+
+// writeReport writes a report like WriteReport, but only includes private
+// checks if asked for.
+func (p *Patrol) writeReport(out io.Writer, from, to time.Time, format string, includePrivate bool) error {
+	if !from.Before(to) {
+		return fmt.Errorf("The start of a report must be before its end")
+	}
+	reports := p.getReport(from, to, includePrivate)
+
+	switch format {
+	case "json":
+		return json.NewEncoder(out).Encode(reports)
+
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write([]string{"group", "check", "uptime_percent", "monitored_seconds", "downtime_seconds", "outages", "mttr_seconds"})
+		for _, report := range reports {
+			w.Write([]string{
+				report.Group,
+				report.Name,
+				strconv.FormatFloat(report.Uptime, 'f', 3, 64),
+				strconv.FormatFloat(report.Monitored.Seconds(), 'f', 0, 64),
+				strconv.FormatFloat(report.Downtime.Seconds(), 'f', 0, 64),
+				strconv.Itoa(report.Outages),
+				strconv.FormatFloat(report.MTTR.Seconds(), 'f', 0, 64),
+			})
+		}
+		w.Flush()
+		return w.Error()
+
+	case "pdf":
+		return p.writeReportPDF(out, from, to, includePrivate)
+
+	default:
+		return fmt.Errorf("Unrecognized report format: '%s'", format)
+	}
+}
+
+// serveReport generates a report over the given range, which defaults to
+// the last 30 days.
+func (p *Patrol) serveReport(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	to := time.Now()
+	if str := query.Get("to"); str != "" {
+		var err error
+		if to, err = ParseReportTime(str); err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if str := query.Get("from"); str != "" {
+		var err error
+		if from, err = ParseReportTime(str); err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "pdf" {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Unrecognized report format: '%s'", format))
+		return
+	}
+	if !from.Before(to) {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("The start of a report must be before its end"))
+		return
+	}
+
+	switch format {
+	case "csv":
+		res.Header().Set("Content-Type", "text/csv")
+	case "pdf":
+		res.Header().Set("Content-Type", "application/pdf")
+	default:
+		res.Header().Set("Content-Type", "application/json")
+	}
+	if format != "json" {
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"report-%s-%s.%s\"", from.Format("2006-01-02"), to.Format("2006-01-02"), format))
+	}
+	if err := p.writeReport(res, from, to, format, p.showPrivate(req)); err != nil {
+		p.logger.Warnf("Failed to write report: %s", err)
+	}
+}
+
+func monthStart(t time.Time) time.Time {
+	year, month, _ := t.Date()
+	return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+}
+
+// writeMonthlyReport writes the PDF report of the given month to the
+// reports directory, unless it has already been written.
+func (p *Patrol) writeMonthlyReport(month time.Time) error {
+	from := monthStart(month)
+	path := filepath.Join(p.reports.Dir, fmt.Sprintf("report-%s.pdf", from.Format("2006-01")))
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	// Reports are written to a temporary file first, so that a partial
+	// report is never mistaken for a complete one. They are often shared
+	// with customers, so private checks are left out.
+	tmp, err := ioutil.TempFile(p.reports.Dir, ".report-*.pdf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := p.writeReportPDF(tmp, from, from.AddDate(0, 1, 0), false); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	p.logger.Infof("Wrote monthly report: %s", path)
+	p.notify("report", "", "")
+	return nil
+}
+
+// scheduleReports writes the report of the previous month at the start of
+// each month, until patrol is shut down.
+func (p *Patrol) scheduleReports() {
+	for {
+		now := time.Now()
+		if err := p.writeMonthlyReport(monthStart(now).AddDate(0, -1, 0)); err != nil {
+			p.logger.Warnf("Failed to write monthly report: %s", err)
+		}
+
+		select {
+		case <-time.After(time.Until(monthStart(now).AddDate(0, 1, 0))):
+		case <-p.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package patrol
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+	"github.com/karimsa/patrol/internal/pdf"
+	"github.com/wcharczuk/go-chart"
+)
+
+const (
+	pdfMargin     = 40.0
+	pdfLineHeight = 16.0
+)
+
+var (
+	pdfHeaderColor = pdf.Color{R: 0.176, G: 0.216, B: 0.282}
+	pdfStripeColor = pdf.Color{R: 0.929, G: 0.937, B: 0.949}
+	pdfMutedColor  = pdf.Color{R: 0.4, G: 0.4, B: 0.4}
+	pdfRedColor    = pdf.Color{R: 0.608, G: 0.173, B: 0.173}
+	pdfGreenColor  = pdf.Color{R: 0.153, G: 0.404, B: 0.286}
+	pdfWhite       = pdf.Color{R: 1, G: 1, B: 1}
+)
+
+// formatReportDuration formats durations to the minute, since seconds are
+// just noise in a monthly report.
+func formatReportDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d == 0 {
+		return "-"
+	}
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// truncate shortens strings to fit into table columns.
+func truncate(str string, length int) string {
+	runes := []rune(str)
+	if len(runes) <= length {
+		return str
+	}
+	return string(runes[:length-3]) + "..."
+}
+
+// pdfReport lays out a report from top to bottom, starting new pages as
+// they fill up.
+type pdfReport struct {
+	doc  *pdf.Document
+	page *pdf.Page
+	y    float64
+}
+
+func (r *pdfReport) newPage() {
+	r.page = r.doc.AddPage()
+	r.y = pdf.PageHeight - pdfMargin
+}
+
+// reserve makes sure that the given height fits on the current page.
+func (r *pdfReport) reserve(height float64) {
+	if r.y-height < pdfMargin {
+		r.newPage()
+	}
+}
+
+func (r *pdfReport) heading(title string) {
+	r.reserve(3 * pdfLineHeight)
+	r.y -= 2 * pdfLineHeight
+	r.page.Text(pdfMargin, r.y, 14, pdf.Bold, pdf.Black, title)
+	r.y -= pdfLineHeight / 2
+	r.page.Line(pdfMargin, r.y, pdf.PageWidth-pdfMargin, r.y, 0.5, pdfMutedColor)
+}
+
+// row writes a row of a table. Cells are placed at the given x offsets.
+func (r *pdfReport) row(columns []float64, font pdf.Font, stripe bool, cells []string, colors []pdf.Color) {
+	r.reserve(pdfLineHeight)
+	r.y -= pdfLineHeight
+	if stripe {
+		r.page.Rect(pdfMargin, r.y-4, pdf.PageWidth-2*pdfMargin, pdfLineHeight, pdfStripeColor)
+	}
+	for i, cell := range cells {
+		color := pdf.Black
+		if colors != nil {
+			color = colors[i]
+		}
+		r.page.Text(pdfMargin+columns[i], r.y, 9, font, color, cell)
+	}
+}
+
+func (r *pdfReport) paragraph(text string) {
+	r.reserve(pdfLineHeight)
+	r.y -= pdfLineHeight
+	r.page.Text(pdfMargin, r.y, 10, pdf.Regular, pdfMutedColor, text)
+}
+
+func (r *pdfReport) chart(items []history.Item, from, to time.Time) error {
+	xValues := make([]time.Time, len(items))
+	yValues := make([]float64, len(items))
+	for i, item := range items {
+		xValues[i] = item.CreatedAt
+		yValues[i] = item.Metric
+	}
+
+	c := metricChartDefaults
+	c.Width = 1030
+	c.Height = 300
+	c.Series = []chart.Series{
+		chart.TimeSeries{
+			XValues: xValues,
+			YValues: yValues,
+			Style:   seriesStyle,
+		},
+	}
+	c.XAxis.Range = &chart.ContinuousRange{
+		Min: float64(from.UnixNano()),
+		Max: float64(to.UnixNano()),
+	}
+
+	// go-chart cannot draw constant functions
+	min, max := yValues[0], yValues[0]
+	for _, y := range yValues {
+		if y < min {
+			min = y
+		}
+		if y > max {
+			max = y
+		}
+	}
+	if min == max {
+		c.YAxis.Range = &chart.ContinuousRange{
+			Min: min - 1,
+			Max: max + 1,
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := c.Render(chart.PNG, &buffer); err != nil {
+		return fmt.Errorf("Failed to render graph: %s", err)
+	}
+	img, err := png.Decode(&buffer)
+	if err != nil {
+		return err
+	}
+
+	width := pdf.PageWidth - 2*pdfMargin
+	height := width * float64(c.Height) / float64(c.Width)
+	r.reserve(height + pdfLineHeight/2)
+	r.y -= height + pdfLineHeight/2
+	return r.page.Image(img, pdfMargin, r.y, width, height)
+}
+
+// writeReportPDF writes the report between the given times as a PDF, with
+// a table of the uptime of each check, a list of the incidents within the
+// range and a chart of each metric check.
+func (p *Patrol) writeReportPDF(out io.Writer, from, to time.Time, includePrivate bool) error {
+	r := &pdfReport{
+		doc: pdf.New(fmt.Sprintf("%s reliability report", p.name)),
+	}
+	r.newPage()
+
+	// Header
+	r.page.Rect(0, pdf.PageHeight-110, pdf.PageWidth, 110, pdfHeaderColor)
+	r.page.Text(pdfMargin, pdf.PageHeight-55, 22, pdf.Bold, pdfWhite, p.name)
+	r.page.Text(pdfMargin, pdf.PageHeight-80, 12, pdf.Regular, pdfWhite, fmt.Sprintf(
+		"Reliability report: %s to %s",
+		from.Format("Jan 2, 2006 15:04"),
+		to.Format("Jan 2, 2006 15:04"),
+	))
+	r.page.Text(pdfMargin, pdf.PageHeight-96, 9, pdf.Regular, pdfWhite, "Generated "+time.Now().Format(time.RFC1123))
+	r.y = pdf.PageHeight - 110
+
+	// Uptime table
+	reports := p.getReport(from, to, includePrivate)
+	r.heading("Uptime")
+	columns := []float64{0, 270, 340, 400, 460}
+	r.row(columns, pdf.Bold, false, []string{"Check", "Uptime", "Outages", "Downtime", "MTTR"}, nil)
+	for i, report := range reports {
+		uptime := "no data"
+		uptimeColor := pdfMutedColor
+		if report.Monitored > 0 {
+			uptime = fmt.Sprintf("%.3f%%", report.Uptime)
+			uptimeColor = pdfGreenColor
+			if report.Downtime > 0 {
+				uptimeColor = pdfRedColor
+			}
+		}
+		r.row(columns, pdf.Regular, i%2 == 0, []string{
+			truncate(report.Group+" / "+report.Name, 55),
+			uptime,
+			fmt.Sprintf("%d", report.Outages),
+			formatReportDuration(report.Downtime),
+			formatReportDuration(report.MTTR),
+		}, []pdf.Color{pdf.Black, uptimeColor, pdf.Black, pdf.Black, pdf.Black})
+	}
+
+	// Incidents, oldest first
+	r.heading("Incidents")
+	var incidents []incident
+	for _, i := range p.getIncidents(includePrivate) {
+		if i.StartedAt.Before(to) && (i.Ongoing() || i.ResolvedAt.After(from)) {
+			incidents = append(incidents, i)
+		}
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].StartedAt.Before(incidents[j].StartedAt)
+	})
+	if len(incidents) == 0 {
+		r.paragraph("No incidents occurred.")
+	} else {
+		columns = []float64{0, 270, 400}
+		r.row(columns, pdf.Bold, false, []string{"Check", "Started", "Duration"}, nil)
+		for idx, i := range incidents {
+			duration := "ongoing"
+			if !i.Ongoing() {
+				duration = formatReportDuration(i.ResolvedAt.Sub(i.StartedAt))
+			}
+			if i.HasPostmortem {
+				duration += " (postmortem)"
+			}
+			r.row(columns, pdf.Regular, idx%2 == 0, []string{
+				truncate(i.Group+" / "+i.Name, 55),
+				i.StartedAt.Format("Jan 2, 2006 15:04"),
+				duration,
+			}, nil)
+		}
+	}
+
+	// Metric charts
+	headingWritten := false
+	for _, checker := range p.checkers {
+		if checker.Type != "metric" {
+			continue
+		}
+		var items []history.Item
+		p.History.EachItem(checker.Group, checker.Name, func(item history.Item, _ func() history.Item) bool {
+			if !item.CreatedAt.Before(from) && item.CreatedAt.Before(to) {
+				items = append(items, item)
+			}
+			return !item.CreatedAt.Before(from)
+		})
+		if len(items) == 0 {
+			continue
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		})
+
+		if !headingWritten {
+			r.heading("Metrics")
+			headingWritten = true
+		}
+		title := checker.Group + " / " + checker.Name
+		if checker.MetricUnit != "" {
+			title += " (" + checker.MetricUnit + ")"
+		}
+		r.reserve(pdfLineHeight + 100)
+		r.y -= pdfLineHeight * 1.5
+		r.page.Text(pdfMargin, r.y, 10, pdf.Bold, pdf.Black, title)
+		if err := r.chart(items, from, to); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.doc.WriteTo(out)
+	return err
+}
@@ -0,0 +1,167 @@
+package patrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestReport(t *testing.T) {
+	os.Remove("report-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "report-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	p, err := New(CreatePatrolOptions{
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "bar",
+				Cmd:      "true",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Two hour-long outages in a ten hour range, and one outage that started
+	// before the range
+	from := time.Now().Add(-10 * time.Hour).Truncate(time.Hour)
+	var items []history.Item
+	for _, result := range []struct {
+		hours  int
+		status string
+	}{
+		{-2, "healthy"},
+		{-1, "unhealthy"},
+		{1, "healthy"},
+		{4, "unhealthy"},
+		{5, "healthy"},
+		{7, "unhealthy"},
+		{8, "healthy"},
+	} {
+		items = append(items, history.Item{
+			Group:     "foo",
+			Name:      "bar",
+			Type:      "boolean",
+			Dedupe:    history.DedupeEveryRun,
+			Status:    result.status,
+			CreatedAt: from.Add(time.Duration(result.hours) * time.Hour),
+		})
+	}
+	for _, err := range historyFile.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	reports := p.getReport(from, from.Add(10*time.Hour), true)
+	if len(reports) != 1 {
+		t.Error(fmt.Errorf("Expected 1 report, got %d", len(reports)))
+		return
+	}
+	report := reports[0]
+	if report.Outages != 3 || report.Downtime != 3*time.Hour || report.Uptime != 70 || report.MTTR != 4*time.Hour/3 {
+		t.Error(fmt.Errorf("Wrong report generated: %#v", report))
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := p.WriteReport(&buffer, from, from.Add(10*time.Hour), "csv"); err != nil {
+		t.Error(err)
+		return
+	}
+	rows, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(rows) != 2 || rows[1][2] != "70.000" || rows[1][5] != "3" || rows[1][6] != "4800" {
+		t.Error(fmt.Errorf("Wrong CSV report generated: %#v", rows))
+		return
+	}
+}
+
+func TestMonthlyReport(t *testing.T) {
+	os.Remove("report-monthly-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "report-monthly-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	dir := t.TempDir()
+	p, err := New(CreatePatrolOptions{
+		Name: "Acme",
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{
+				Group:    "foo",
+				Name:     "latency",
+				Type:     "metric",
+				Cmd:      "echo 1",
+				History:  historyFile,
+				Interval: 1 * time.Minute,
+			}),
+		},
+		Reports: &ReportOptions{Dir: dir},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	month := monthStart(time.Now()).AddDate(0, -1, 0)
+	var items []history.Item
+	for i := 0; i < 10; i++ {
+		items = append(items, history.Item{
+			Group:     "foo",
+			Name:      "latency",
+			Type:      "metric",
+			Status:    "healthy",
+			Metric:    float64(i * i),
+			CreatedAt: month.Add(time.Duration(i) * 24 * time.Hour),
+		})
+	}
+	for _, err := range historyFile.AppendBatch(items) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if err := p.writeMonthlyReport(month); err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "report-"+month.Format("2006-01")+".pdf"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || !bytes.Contains(data, []byte("(Acme) Tj")) || !bytes.Contains(data, []byte("/Im1 Do")) {
+		t.Error(fmt.Errorf("Report is missing its title or chart"))
+		return
+	}
+}
@@ -0,0 +1,93 @@
+// sign-release signs the manifests of the binaries of a release, which
+// 'patrol self-update' verifies before installing them. The ed25519 private
+// key is read from PATROL_RELEASE_KEY (base64-encoded), and each binary
+// gets its signed manifest (its name, the release's version and its
+// SHA-256) in '{binary}.sig'.
+//
+//	go run ./scripts/sign-release -generate                      # print a new private key
+//	go run ./scripts/sign-release -public                        # print the public key
+//	go run ./scripts/sign-release -version v1.2.3 dist/patrol-*  # sign binaries
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/karimsa/patrol"
+)
+
+func main() {
+	generate := flag.Bool("generate", false, "Print a new private key")
+	public := flag.Bool("public", false, "Print the public key of PATROL_RELEASE_KEY, which release builds embed")
+	version := flag.String("version", "", "Version of the release that the binaries belong to (i.e. v1.2.3)")
+	flag.Parse()
+
+	if err := run(*generate, *public, *version, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(generate, public bool, version string, files []string) error {
+	if generate {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("PATROL_RELEASE_KEY"))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("PATROL_RELEASE_KEY must be a base64-encoded ed25519 private key")
+	}
+	privateKey := ed25519.PrivateKey(key)
+	if public {
+		fmt.Println(base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+		return nil
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("No binaries to sign")
+	}
+	if !patrol.IsNewerVersion(version, "v0.0.0") {
+		return fmt.Errorf("A release version is required (i.e. -version v1.2.3)")
+	}
+	for _, file := range files {
+		binary, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(binary)
+		manifest, err := json.Marshal(patrol.ReleaseManifest{
+			Name:    filepath.Base(file),
+			Version: version,
+			SHA256:  hex.EncodeToString(hash[:]),
+		})
+		if err != nil {
+			return err
+		}
+		signed, err := json.Marshal(patrol.SignedManifest{
+			Manifest:  string(manifest),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifest)),
+		})
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file+".sig", append(signed, '\n'), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Signed %s\n", file)
+	}
+	return nil
+}
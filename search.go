@@ -0,0 +1,195 @@
+package patrol
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karimsa/patrol/internal/history"
+)
+
+// Limits on the number of results returned by a search
+const (
+	defaultSearchResults = 50
+	maxSearchResults     = 500
+)
+
+// Maximum length of the line that is returned with each search result
+const maxExcerptLength = 200
+
+// searchResult is a result of a check whose error or output matched a
+// search.
+type searchResult struct {
+	Group     string
+	Name      string
+	ID        string
+	Status    string
+	CreatedAt time.Time
+
+	// First line of the error or output that contains a term of the search
+	Excerpt string
+}
+
+// searchQuery finds results whose error or output contains every term,
+// ignoring case. Empty fields do not restrict the search.
+type searchQuery struct {
+	Terms    []string
+	Group    string
+	Name     string
+	From, To time.Time
+}
+
+// parseSearchTerms splits a search into lowercase terms. Terms are
+// separated by spaces, unless they are quoted (i.e. '"connection refused"').
+func parseSearchTerms(str string) []string {
+	var terms []string
+	for i, part := range strings.Split(str, `"`) {
+		// Every other part is quoted
+		if i%2 == 1 {
+			if part = strings.TrimSpace(part); part != "" {
+				terms = append(terms, strings.ToLower(part))
+			}
+			continue
+		}
+		for _, term := range strings.Fields(part) {
+			terms = append(terms, strings.ToLower(term))
+		}
+	}
+	return terms
+}
+
+// excerpt returns the first line of the text that contains one of the
+// terms, or false if the text does not contain all of the terms.
+func excerpt(text []byte, terms []string) (string, bool) {
+	lower := bytes.ToLower(text)
+	if len(lower) != len(text) {
+		// Some characters change length when lowercased, so the positions
+		// only line up with the lowercased text
+		text = lower
+	}
+	first := -1
+	for _, term := range terms {
+		idx := bytes.Index(lower, []byte(term))
+		if idx < 0 {
+			return "", false
+		}
+		if first < 0 || idx < first {
+			first = idx
+		}
+	}
+
+	start := bytes.LastIndexByte(text[:first], '\n') + 1
+	end := bytes.IndexByte(text[first:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += first
+	}
+	line := strings.TrimSpace(string(text[start:end]))
+	if len(line) > maxExcerptLength {
+		line = line[:maxExcerptLength] + "..."
+	}
+	return line, true
+}
+
+// matchItem returns the excerpt of an item that matches a search, or false
+// if it does not match. The error and the output are searched together, so
+// that terms can be split between them.
+func matchItem(item history.Item, terms []string) (string, bool) {
+	text := make([]byte, 0, len(item.Error)+1+len(item.Output))
+	text = append(text, item.Error...)
+	text = append(text, '\n')
+	text = append(text, item.Output...)
+	return excerpt(text, terms)
+}
+
+// search looks through the retained results of all checks, and returns
+// those that match the query with the most recent first.
+func (p *Patrol) search(query searchQuery, limit int, includePrivate bool) []searchResult {
+	results := []searchResult{}
+	if len(query.Terms) == 0 {
+		return results
+	}
+
+	for _, c := range p.checkers {
+		if (query.Group != "" && c.Group != query.Group) ||
+			(query.Name != "" && c.Name != query.Name) ||
+			(c.Private && !includePrivate) {
+			continue
+		}
+
+		// Outputs are only read back for the results in the time range,
+		// which ends with the first result before it
+		p.History.EachItem(c.Group, c.Name, func(item history.Item, load func() history.Item) bool {
+			if !query.From.IsZero() && item.CreatedAt.Before(query.From) {
+				return false
+			}
+			if !query.To.IsZero() && !item.CreatedAt.Before(query.To) {
+				return true
+			}
+			if line, ok := matchItem(load(), query.Terms); ok {
+				results = append(results, searchResult{
+					Group:     item.Group,
+					Name:      item.Name,
+					ID:        item.ID,
+					Status:    item.Status,
+					CreatedAt: item.CreatedAt,
+					Excerpt:   line,
+				})
+			}
+			return true
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// serveSearch finds results whose error or output contains the terms in
+// 'q', optionally limited to a check and to a time range.
+func (p *Patrol) serveSearch(res http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := searchQuery{
+		Terms: parseSearchTerms(params.Get("q")),
+		Group: params.Get("group"),
+		Name:  params.Get("check"),
+	}
+	if len(query.Terms) == 0 {
+		writeJSONError(res, http.StatusBadRequest, fmt.Errorf("A search query must be specified in 'q'"))
+		return
+	}
+	for key, bound := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if str := params.Get(key); str != "" {
+			t, err := ParseReportTime(str)
+			if err != nil {
+				writeJSONError(res, http.StatusBadRequest, err)
+				return
+			}
+			*bound = t
+		}
+	}
+
+	limit := defaultSearchResults
+	if str := params.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Invalid limit: %s", str))
+			return
+		}
+		limit = n
+	}
+	if limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+
+	writeJSON(res, http.StatusOK, p.search(query, limit, p.showPrivate(req)))
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/wcharczuk/go-chart"
 	"github.com/wcharczuk/go-chart/drawing"
 
+	"github.com/karimsa/patrol/internal/checker"
 	"github.com/karimsa/patrol/internal/history"
 	"github.com/karimsa/patrol/internal/logger"
 )
@@ -92,7 +94,12 @@ var (
 				}
 				return r
 			},
-			"since": prettytime.Format,
+			// Annotations that are URLs are shown as links
+			"isLink": func(s string) bool {
+				return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+			},
+			"since":    prettytime.Format,
+			"markdown": renderMarkdown,
 			"fmtNum": func(n float64) string {
 				parts := strings.Split(fmt.Sprintf("%.2f", n), ".")
 				for i := len(parts[0]) - 3; i > 0; i -= 3 {
@@ -116,11 +123,17 @@ var (
 					xValues[i] = item.CreatedAt
 					yValues[i] = item.Metric
 
-					if res.Min > item.Metric {
-						res.Min = item.Metric
+					// Aggregates of downsampled results keep the extremes
+					// of the results, while their metric is the average
+					min, max := item.Metric, item.Metric
+					if item.Aggregate != nil {
+						min, max = item.Aggregate.Min, item.Aggregate.Max
+					}
+					if res.Min > min {
+						res.Min = min
 					}
-					if res.Max < item.Metric {
-						res.Max = item.Metric
+					if res.Max < max {
+						res.Max = max
 					}
 					res.Avg += item.Metric
 				}
@@ -166,6 +179,11 @@ var (
 	)
 )
 
+type forecastView struct {
+	At        time.Time
+	Threshold float64
+}
+
 func init() {
 	template.Must(pageView.New("styles.css").Parse(stylesCSS))
 }
@@ -187,34 +205,235 @@ func (p *Patrol) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		Groups          map[string]map[string][]history.Item
 		NumServicesDown int
 		NumServices     int
+		NumPending      int
 		LatestCreatedAt time.Time
 		GroupFilter     string
 		StatusFilter    string
 		Debug           bool
+		AdminEnabled    bool
+		Paused          map[string]map[string]bool
+		Private         map[string]map[string]bool
+		Stale           map[string]map[string]bool
+		Flapping        map[string]map[string]bool
+		Forecasts       map[string]map[string]*forecastView
+
+		// Checks of the status pages of third-party providers, and for
+		// each failing check, those of them that it depends on that are
+		// failing too, which may have caused its failure
+		Dependencies      map[string]map[string]bool
+		DependencyOutages map[string]map[string][]string
+
+		// Acknowledgements of the ongoing incidents of failing checks
+		Acknowledged map[string]map[string]*acknowledgement
+
+		// Severity of each check, and the checks of each group ordered
+		// from the most to the least severe
+		Severities map[string]map[string]checker.Severity
+		CheckOrder map[string][]string
+
+		// Owners and runbooks of the checks that have them
+		Owners   map[string]map[string]string
+		Runbooks map[string]map[string]string
+
+		// Environments that services run in, the one that is shown, and
+		// the environment of each group that has one
+		Environments      []string
+		EnvironmentFilter string
+		GroupEnvironments map[string]string
+
+		Overall overallStatus
 	}{
-		Name:            p.name,
-		Groups:          p.History.GetData(),
-		NumServicesDown: 0,
-		NumServices:     0,
-		LatestCreatedAt: time.Unix(0, 0),
-		GroupFilter:     query.Get("group"),
-		StatusFilter:    query.Get("status"),
-		Debug:           p.logLevel == logger.LevelDebug,
+		Name:              p.name,
+		Groups:            p.History.GetData(),
+		NumServicesDown:   0,
+		NumServices:       0,
+		LatestCreatedAt:   time.Unix(0, 0),
+		GroupFilter:       query.Get("group"),
+		StatusFilter:      query.Get("status"),
+		Debug:             p.logLevel == logger.LevelDebug,
+		AdminEnabled:      p.admin != nil,
+		Paused:            make(map[string]map[string]bool),
+		Private:           make(map[string]map[string]bool),
+		Stale:             make(map[string]map[string]bool),
+		Flapping:          make(map[string]map[string]bool),
+		Forecasts:         make(map[string]map[string]*forecastView),
+		Dependencies:      make(map[string]map[string]bool),
+		DependencyOutages: make(map[string]map[string][]string),
+		Acknowledged:      make(map[string]map[string]*acknowledgement),
+		Severities:        make(map[string]map[string]checker.Severity),
+		CheckOrder:        make(map[string][]string),
+		Owners:            make(map[string]map[string]string),
+		Runbooks:          make(map[string]map[string]string),
+
+		Environments:      p.getEnvironments(),
+		EnvironmentFilter: query.Get("env"),
+		GroupEnvironments: make(map[string]string, len(p.environments)),
+	}
+	for group, env := range p.environments {
+		data.GroupEnvironments[group] = env.Name
+	}
+
+	// Only the services of the chosen environment are shown
+	if data.EnvironmentFilter != "" {
+		for group := range data.Groups {
+			if data.GroupEnvironments[group] != data.EnvironmentFilter {
+				delete(data.Groups, group)
+			}
+		}
+	}
+
+	// Private checks are only shown to the admin and responders, and are
+	// marked as private for them
+	showPrivate := p.showPrivate(req)
+	for _, c := range p.checkers {
+		if data.EnvironmentFilter != "" && data.GroupEnvironments[c.Group] != data.EnvironmentFilter {
+			continue
+		}
+		if c.Private {
+			if !showPrivate {
+				if group, ok := data.Groups[c.Group]; ok {
+					delete(group, c.Name)
+					if len(group) == 0 {
+						delete(data.Groups, c.Group)
+					}
+				}
+				continue
+			}
+			if _, ok := data.Private[c.Group]; !ok {
+				data.Private[c.Group] = make(map[string]bool)
+			}
+			data.Private[c.Group][c.Name] = true
+		}
+
+		// Checks that have not reported a result yet are shown as pending
+		if _, ok := data.Groups[c.Group]; !ok {
+			data.Groups[c.Group] = make(map[string][]history.Item)
+		}
+		if len(data.Groups[c.Group][c.Name]) == 0 {
+			data.Groups[c.Group][c.Name] = nil
+			data.NumPending++
+		}
+
+		if _, ok := data.Severities[c.Group]; !ok {
+			data.Severities[c.Group] = make(map[string]checker.Severity)
+		}
+		data.Severities[c.Group][c.Name] = c.Severity
+
+		// Owners and runbooks are internal, like private checks
+		if c.Owner != "" && showPrivate {
+			if _, ok := data.Owners[c.Group]; !ok {
+				data.Owners[c.Group] = make(map[string]string)
+			}
+			data.Owners[c.Group][c.Name] = c.Owner
+		}
+		if c.RunbookURL != "" && showPrivate {
+			if _, ok := data.Runbooks[c.Group]; !ok {
+				data.Runbooks[c.Group] = make(map[string]string)
+			}
+			data.Runbooks[c.Group][c.Name] = c.RunbookURL
+		}
+
+		if c.StatusPage != nil {
+			if _, ok := data.Dependencies[c.Group]; !ok {
+				data.Dependencies[c.Group] = make(map[string]bool)
+			}
+			data.Dependencies[c.Group][c.Name] = true
+		}
+		if c.IsPaused() {
+			if _, ok := data.Paused[c.Group]; !ok {
+				data.Paused[c.Group] = make(map[string]bool)
+			}
+			data.Paused[c.Group][c.Name] = true
+		}
+		if p.IsFlapping(c.Group, c.Name) {
+			if _, ok := data.Flapping[c.Group]; !ok {
+				data.Flapping[c.Group] = make(map[string]bool)
+			}
+			data.Flapping[c.Group][c.Name] = true
+		}
+		if forecastAt := c.GetState().ForecastAt; !forecastAt.IsZero() {
+			if _, ok := data.Forecasts[c.Group]; !ok {
+				data.Forecasts[c.Group] = make(map[string]*forecastView)
+			}
+			data.Forecasts[c.Group][c.Name] = &forecastView{
+				At:        forecastAt,
+				Threshold: c.Forecast.Threshold,
+			}
+		}
 	}
 
-	for _, group := range data.Groups {
-		for _, items := range group {
+	latest := make(map[string]map[string]history.Item, len(data.Groups))
+	for groupName, group := range data.Groups {
+		severities := data.Severities[groupName]
+		severity := func(checkName string) checker.Severity {
+			if s, ok := severities[checkName]; ok {
+				return s
+			}
+			return checker.SeverityMajor
+		}
+
+		order := make([]string, 0, len(group))
+		for checkName, items := range group {
+			order = append(order, checkName)
 			if len(items) > 0 {
-				if items[0].Status == "unhealthy" {
-					data.NumServicesDown++
+				if p.isStale(items[0]) {
+					if _, ok := data.Stale[groupName]; !ok {
+						data.Stale[groupName] = make(map[string]bool)
+					}
+					data.Stale[groupName][checkName] = true
+				} else if items[0].Status == "unhealthy" {
+					// Outages of providers are not outages of the services
+					if !data.Dependencies[groupName][checkName] {
+						data.NumServicesDown++
+					}
+					if incident, ok := p.ongoingIncident(groupName, checkName); ok {
+						if ack, ok := p.acknowledged(groupName, checkName, incident.ID); ok {
+							if !showPrivate {
+								ack.By = ""
+							}
+							if _, ok := data.Acknowledged[groupName]; !ok {
+								data.Acknowledged[groupName] = make(map[string]*acknowledgement)
+							}
+							data.Acknowledged[groupName][checkName] = &ack
+						}
+					}
+				}
+				if _, ok := latest[groupName]; !ok {
+					latest[groupName] = make(map[string]history.Item, len(group))
 				}
-				if data.LatestCreatedAt.Before(items[0].CreatedAt) {
-					data.LatestCreatedAt = items[0].CreatedAt
+				latest[groupName][checkName] = items[0]
+				if data.LatestCreatedAt.Before(items[0].SeenAt()) {
+					data.LatestCreatedAt = items[0].SeenAt()
 				}
 				data.NumServices++
 			}
 		}
+
+		sort.Slice(order, func(i, j int) bool {
+			a, b := severity(order[i]).Rank(), severity(order[j]).Rank()
+			if a != b {
+				return a < b
+			}
+			return order[i] < order[j]
+		})
+		data.CheckOrder[groupName] = order
+	}
+	for _, c := range p.checkers {
+		if item, ok := latest[c.Group][c.Name]; !ok || item.Status != "unhealthy" || data.Stale[c.Group][c.Name] {
+			continue
+		}
+		for _, dependency := range c.DependsOn {
+			parts := strings.SplitN(dependency, "/", 2)
+			if item, ok := latest[parts[0]][parts[1]]; !ok || item.Status != "unhealthy" || data.Stale[parts[0]][parts[1]] {
+				continue
+			}
+			if _, ok := data.DependencyOutages[c.Group]; !ok {
+				data.DependencyOutages[c.Group] = make(map[string][]string)
+			}
+			data.DependencyOutages[c.Group][c.Name] = append(data.DependencyOutages[c.Group][c.Name], parts[0]+" / "+parts[1])
+		}
 	}
+	data.Overall = p.getOverallStatus(latest, showPrivate)
 
 	if err := pageView.Execute(res, data); err != nil {
 		p.logger.Warnf("Failed to execute template: %s", err)
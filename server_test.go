@@ -1,10 +1,13 @@
 package patrol
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -64,5 +67,344 @@ func TestServer(t *testing.T) {
 		return
 	}
 
-	p.Close()
+	if err := p.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Once shut down, the history file is closed
+	if err := historyFile.Close(context.Background()); err != nil {
+		t.Error(fmt.Errorf("Expected history file to be closed by shutdown, got: %s", err))
+		return
+	}
+}
+
+func TestSeverityRollup(t *testing.T) {
+	os.Remove("server-severity-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "server-severity-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, severity := range []checker.Severity{checker.SeverityCritical, checker.SeverityMinor, checker.SeverityInfo} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "foo",
+			Name:     string(severity),
+			Severity: severity,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{Checkers: checkers}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	for _, test := range []struct {
+		failing string
+		summary string
+	}{
+		{"info", "All systems operational (1 informational checks failing)"},
+		{"minor", "Partial outage: 2 Systems are down"},
+		{"critical", "Major outage: 3 Systems are down"},
+	} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   test.failing,
+			Type:   "boolean",
+			Status: "unhealthy",
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !strings.Contains(string(body), test.summary) {
+			t.Error(fmt.Errorf("Expected summary '%s' once %s check failed", test.summary, test.failing))
+			return
+		}
+	}
+}
+
+func TestGroupStatusRules(t *testing.T) {
+	for _, test := range []struct {
+		rule    GroupStatusRule
+		failing map[string]bool
+		down    bool
+	}{
+		{GroupStatusRule{}, map[string]bool{"a": false, "b": true}, true},
+		{GroupStatusRule{Weights: map[string]float64{"b": 0}}, map[string]bool{"a": false, "b": true}, false},
+		{GroupStatusRule{Rule: groupRuleAny}, map[string]bool{"a": false, "b": true}, false},
+		{GroupStatusRule{Rule: groupRuleAny}, map[string]bool{"a": true, "b": true}, true},
+		{GroupStatusRule{Rule: groupRuleQuorum, Quorum: 2.0 / 3.0}, map[string]bool{"a": false, "b": false, "c": true}, false},
+		{GroupStatusRule{Rule: groupRuleQuorum, Quorum: 2.0 / 3.0}, map[string]bool{"a": false, "b": true, "c": true}, true},
+		{GroupStatusRule{Rule: groupRuleWeighted, Threshold: 2}, map[string]bool{"a": true, "b": false, "c": false}, false},
+		{GroupStatusRule{Rule: groupRuleWeighted, Threshold: 2, Weights: map[string]float64{"a": 2}}, map[string]bool{"a": true, "b": false}, true},
+		{GroupStatusRule{Rule: groupRuleWeighted, Threshold: 2}, map[string]bool{"a": true, "b": true, "c": false}, true},
+	} {
+		if down := test.rule.isDown(test.failing); down != test.down {
+			t.Error(fmt.Errorf("Expected %#v to return %t for %v", test.rule, test.down, test.failing))
+			return
+		}
+	}
+}
+
+func TestOptionalChecks(t *testing.T) {
+	os.Remove("server-optional-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "server-optional-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, name := range []string{"api", "canary"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "foo",
+			Name:     name,
+			Severity: checker.SeverityCritical,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{
+		Checkers: checkers,
+		GroupStatusRules: map[string]GroupStatusRule{
+			"foo": {Weights: map[string]float64{"canary": 0}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	if _, err := historyFile.Append(history.Item{
+		Group:  "foo",
+		Name:   "api",
+		Type:   "boolean",
+		Status: "healthy",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, test := range []struct {
+		name   string
+		status string
+		health int
+	}{
+		{"canary", statusOperational, http.StatusOK},
+		{"api", statusMajorOutage, http.StatusServiceUnavailable},
+	} {
+		if _, err := historyFile.Append(history.Item{
+			Group:  "foo",
+			Name:   test.name,
+			Type:   "boolean",
+			Status: "unhealthy",
+		}); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if status := p.getOverallStatus(historyFile.GetLatestItems(), true); status.Groups["foo"] != test.status {
+			t.Error(fmt.Errorf("Expected foo to be %s once %s failed, got: %#v", test.status, test.name, status))
+			return
+		}
+		res, err := http.Get(server.URL + "/healthz/foo")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != test.health {
+			t.Error(fmt.Errorf("Expected /healthz/foo to return %d once %s failed, got %d", test.health, test.name, res.StatusCode))
+			return
+		}
+	}
+}
+
+func TestPendingChecks(t *testing.T) {
+	os.Remove("server-pending-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "server-pending-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, name := range []string{"Homepage", "New check"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "Web",
+			Name:     name,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{Checkers: checkers}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	getPage := func() (string, error) {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	body, err := getPage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(body, "Waiting for the first results (2 checks pending)") {
+		t.Error(fmt.Errorf("Expected page to wait for the first results: %s", body))
+		return
+	}
+
+	if _, err := historyFile.Append(history.Item{
+		Group:  "Web",
+		Name:   "Homepage",
+		Type:   "boolean",
+		Status: "healthy",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	body, err = getPage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(body, "All systems operational") || !strings.Contains(body, "New check") || strings.Count(body, ">Pending</span>") != 1 {
+		t.Error(fmt.Errorf("Expected new check to be shown as pending: %s", body))
+		return
+	}
+	if status := p.getOverallStatus(historyFile.GetLatestItems(), false); status.NumChecks != 1 || status.NumChecksPending != 1 {
+		t.Error(fmt.Errorf("Wrong number of pending checks: %#v", status))
+		return
+	}
+}
+
+func TestStaleResults(t *testing.T) {
+	os.Remove("server-stale-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "server-stale-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var checkers []*checker.Checker
+	for _, name := range []string{"Homepage", "Login"} {
+		checkers = append(checkers, checker.New(&checker.Checker{
+			Group:    "Web",
+			Name:     name,
+			Cmd:      "true",
+			History:  historyFile,
+			Interval: 1 * time.Minute,
+		}))
+	}
+	p, err := New(CreatePatrolOptions{
+		Checkers:   checkers,
+		StaleAfter: 3,
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+
+	// Both results were recorded before patrol was stopped for a while
+	for _, name := range []string{"Homepage", "Login"} {
+		if errs := historyFile.AppendBatch([]history.Item{{
+			Group:     "Web",
+			Name:      name,
+			Type:      "boolean",
+			Status:    "unhealthy",
+			CreatedAt: time.Now().Add(-10 * time.Minute),
+		}}); errs[0] != nil {
+			t.Error(errs[0])
+			return
+		}
+	}
+	if _, err := historyFile.Append(history.Item{
+		Group:  "Web",
+		Name:   "Homepage",
+		Type:   "boolean",
+		Status: "healthy",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	status := p.getOverallStatus(historyFile.GetLatestItems(), true)
+	if status.Status != statusOperational || status.NumChecks != 1 || status.NumChecksStale != 1 || status.NumChecksDown != 0 {
+		t.Error(fmt.Errorf("Expected stale result to be left out of the status: %#v", status))
+		return
+	}
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(body), "1 checks have no recent results") || !strings.Contains(string(body), ">Unknown</span>") {
+		t.Error(fmt.Errorf("Expected stale result to be shown as unknown: %s", body))
+		return
+	}
+
+	res, err = http.Get(server.URL + "/healthz/Web")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Error(fmt.Errorf("Expected stale failure to be ignored by /healthz, got %d", res.StatusCode))
+		return
+	}
 }
@@ -0,0 +1,251 @@
+package patrol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+var (
+	errSilenceNotFound = errors.New("No such silence")
+	errInvalidSilence  = errors.New("Invalid silence")
+)
+
+// SilenceRequest asks for the notifications of the checks that match its
+// patterns to be muted for a while, i.e. with 'patrol silence create'.
+type SilenceRequest struct {
+	Group string   `json:"group,omitempty"`
+	Check string   `json:"check,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	// Start of the silence, which defaults to now, and how long it lasts
+	// (i.e. '2h')
+	StartsAt time.Time `json:"startsAt,omitempty"`
+	Duration string    `json:"duration"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+// SilenceStatus is a silence along with the checks that it matches.
+type SilenceStatus struct {
+	history.Silence
+	Active bool
+	Checks []string
+}
+
+// newSilenceID returns a short random ID, which is easy to type when
+// deleting the silence.
+func newSilenceID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// checkTags returns the tags of a check, along with 'region:{region}' of
+// the region that it is run from.
+func checkTags(c *checker.Checker) []string {
+	tags := c.Tags
+	if c.Region != "" {
+		tags = append(append([]string{}, tags...), "region:"+c.Region)
+	}
+	return tags
+}
+
+// silenceMatches returns whether a silence applies to a check, regardless
+// of whether it is active.
+func silenceMatches(s history.Silence, c *checker.Checker) bool {
+	if ok, _ := path.Match(s.Group, c.Group); s.Group != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(s.Check, c.Name); s.Check != "" && !ok {
+		return false
+	}
+	tags := checkTags(c)
+	for _, pattern := range s.Tags {
+		matched := false
+		for _, tag := range tags {
+			if ok, _ := path.Match(pattern, tag); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func silenceActive(s history.Silence, now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// silenced returns the active silence that mutes a check, if any.
+func (p *Patrol) silenced(group, name string) (history.Silence, bool) {
+	c := p.getChecker(group, name)
+	if c == nil {
+		return history.Silence{}, false
+	}
+	now := time.Now()
+	for _, s := range p.History.GetSilences() {
+		if silenceActive(s, now) && silenceMatches(s, c) {
+			return s, true
+		}
+	}
+	return history.Silence{}, false
+}
+
+func (p *Patrol) silenceStatus(s history.Silence, now time.Time) SilenceStatus {
+	status := SilenceStatus{Silence: s, Active: silenceActive(s, now), Checks: []string{}}
+	for _, c := range p.checkers {
+		if silenceMatches(s, c) {
+			status.Checks = append(status.Checks, c.Group+"/"+c.Name)
+		}
+	}
+	return status
+}
+
+// listSilences returns the silences that have not ended yet, in the order
+// that they start.
+func (p *Patrol) listSilences() []SilenceStatus {
+	now := time.Now()
+	list := []SilenceStatus{}
+	for _, s := range p.History.GetSilences() {
+		if now.Before(s.EndsAt) {
+			list = append(list, p.silenceStatus(s, now))
+		}
+	}
+	return list
+}
+
+// createSilence persists a new silence. Silences must match at least one
+// check, so that mistyped patterns are not silently ignored.
+func (p *Patrol) createSilence(req SilenceRequest, user string) (SilenceStatus, error) {
+	if req.Group == "" && req.Check == "" && len(req.Tags) == 0 {
+		return SilenceStatus{}, fmt.Errorf("%w: a group, check or tag must be given", errInvalidSilence)
+	}
+	for _, pattern := range append([]string{req.Group, req.Check}, req.Tags...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return SilenceStatus{}, fmt.Errorf("%w: bad pattern '%s'", errInvalidSilence, pattern)
+		}
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		return SilenceStatus{}, fmt.Errorf("%w: duration must be positive, i.e. '2h' (got '%s')", errInvalidSilence, req.Duration)
+	}
+
+	now := time.Now()
+	s := history.Silence{
+		ID:        newSilenceID(),
+		Group:     req.Group,
+		Check:     req.Check,
+		Tags:      req.Tags,
+		Reason:    req.Reason,
+		CreatedBy: user,
+		StartsAt:  req.StartsAt,
+		CreatedAt: now,
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	s.EndsAt = s.StartsAt.Add(duration)
+	if !now.Before(s.EndsAt) {
+		return SilenceStatus{}, fmt.Errorf("%w: it would have already ended", errInvalidSilence)
+	}
+
+	status := p.silenceStatus(s, now)
+	if len(status.Checks) == 0 {
+		return SilenceStatus{}, fmt.Errorf("%w: it does not match any check", errInvalidSilence)
+	}
+	if err := p.History.SetSilence(s); err != nil {
+		return SilenceStatus{}, err
+	}
+	p.logger.Infof("%s silenced %d checks until %s (%s): %s", user, len(status.Checks), s.EndsAt.Format(time.RFC3339), s.ID, s.Reason)
+	return status, nil
+}
+
+// deleteSilence ends a silence early, or cancels it before it starts.
+func (p *Patrol) deleteSilence(id string) error {
+	for _, s := range p.History.GetSilences() {
+		if s.ID == id {
+			s.Deleted = true
+			return p.History.SetSilence(s)
+		}
+	}
+	return fmt.Errorf("%w: %s", errSilenceNotFound, id)
+}
+
+// serveSilences lists silences (GET), creates a silence from a
+// SilenceRequest (POST), and deletes the silence with the given 'id'
+// (DELETE).
+func (p *Patrol) serveSilences(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(res, http.StatusOK, p.listSilences())
+
+	case http.MethodPost:
+		var silenceReq SilenceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1<<20)).Decode(&silenceReq); err != nil {
+			writeJSONError(res, http.StatusBadRequest, fmt.Errorf("Failed to parse silence: %s", err))
+			return
+		}
+
+		// Only authenticated requests reach this handler
+		user, _, _ := req.BasicAuth()
+		status, err := p.createSilence(silenceReq, user)
+		if errors.Is(err, errInvalidSilence) {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			writeJSONError(res, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, status)
+
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		if err := p.deleteSilence(id); errors.Is(err, errSilenceNotFound) {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeJSONError(res, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]string{"id": id})
+
+	default:
+		writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", req.Method))
+	}
+}
+
+// CreateSilence creates a silence in a running patrol instance,
+// authenticating with its admin credentials.
+func CreateSilence(upstream PatrolUpstreamOptions, req SilenceRequest) (SilenceStatus, error) {
+	var status SilenceStatus
+	err := callAPI(upstream, http.MethodPost, "/api/v1/silences", req, &status, "create silence")
+	return status, err
+}
+
+// ListSilences lists the silences of a running patrol instance that have
+// not ended yet.
+func ListSilences(upstream PatrolUpstreamOptions) ([]SilenceStatus, error) {
+	var list []SilenceStatus
+	err := callAPI(upstream, http.MethodGet, "/api/v1/silences", nil, &list, "list silences")
+	return list, err
+}
+
+// DeleteSilence deletes a silence of a running patrol instance.
+func DeleteSilence(upstream PatrolUpstreamOptions, id string) error {
+	return callAPI(upstream, http.MethodDelete, "/api/v1/silences?id="+url.QueryEscape(id), nil, nil, "delete silence")
+}
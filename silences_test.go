@@ -0,0 +1,142 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+func TestSilences(t *testing.T) {
+	os.Remove("silences-test.db")
+	historyFile, err := history.New(history.NewOptions{
+		File: "silences-test.db",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer historyFile.Close(context.Background())
+
+	var numNotifications int32
+	notifyServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&numNotifications, 1)
+	}))
+	defer notifyServer.Close()
+	notifyURL, _ := url.Parse(notifyServer.URL)
+
+	p, err := New(CreatePatrolOptions{
+		Admin: &PatrolAdminOptions{Username: "admin", Password: "secret"},
+		Checkers: []*checker.Checker{
+			checker.New(&checker.Checker{Group: "API", Name: "eu-west", Cmd: "true", Tags: []string{"region:eu", "tier:web"}, History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "API", Name: "us-east", Cmd: "true", Tags: []string{"region:us", "tier:web"}, History: historyFile, Interval: time.Minute}),
+			checker.New(&checker.Checker{Group: "DB", Name: "primary", Cmd: "true", Region: "eu", History: historyFile, Interval: time.Minute}),
+		},
+		GlobalEventHandlers: EventHandlers{
+			"unhealthy": {{
+				Webhook: &webhookNotification{Method: "POST", URL: notifyURL},
+			}},
+		},
+	}, historyFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := httptest.NewServer(p.server.Handler)
+	defer server.Close()
+	upstream := PatrolUpstreamOptions{URL: server.URL, Username: "admin", Password: "secret"}
+
+	// Tags match the tags of checks and the region that they run from
+	silence, err := CreateSilence(upstream, SilenceRequest{Tags: []string{"region:eu"}, Duration: "2h", Reason: "DC maintenance"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !silence.Active || silence.CreatedBy != "admin" || strings.Join(silence.Checks, ",") != "API/eu-west,DB/primary" {
+		t.Error(fmt.Errorf("Wrong silence: %#v", silence))
+		return
+	}
+	scheduled, err := CreateSilence(upstream, SilenceRequest{Group: "API", Check: "*-east", Tags: []string{"tier:*"}, StartsAt: time.Now().Add(time.Hour), Duration: "30m"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if scheduled.Active || strings.Join(scheduled.Checks, ",") != "API/us-east" {
+		t.Error(fmt.Errorf("Wrong scheduled silence: %#v", scheduled))
+		return
+	}
+
+	for _, req := range []SilenceRequest{
+		{Duration: "2h"},
+		{Group: "API", Duration: "forever"},
+		{Group: "API", Duration: "-1h"},
+		{Group: "API", StartsAt: time.Now().Add(-2 * time.Hour), Duration: "1h"},
+		{Group: "[", Duration: "1h"},
+		{Tags: []string{"region:ap"}, Duration: "1h"},
+	} {
+		if _, err := CreateSilence(upstream, req); err == nil || !strings.Contains(err.Error(), "status 400") {
+			t.Error(fmt.Errorf("Expected silence to be rejected: %#v (got %v)", req, err))
+			return
+		}
+	}
+	if _, err := CreateSilence(PatrolUpstreamOptions{URL: server.URL}, SilenceRequest{Group: "API", Duration: "1h"}); err == nil {
+		t.Error(fmt.Errorf("Expected silences to require admin credentials"))
+		return
+	}
+
+	list, err := ListSilences(upstream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(list) != 2 || list[0].ID != silence.ID || list[1].ID != scheduled.ID {
+		t.Error(fmt.Errorf("Expected both silences to be listed, got: %#v", list))
+		return
+	}
+
+	// Only checks that are silenced right now skip their notifications
+	for _, name := range []string{"eu-west", "us-east"} {
+		if _, err := historyFile.Append(history.Item{Group: "API", Name: name, Type: "boolean", Status: "unhealthy"}); err != nil {
+			t.Error(err)
+			return
+		}
+		p.OnCheckerStatus("unhealthy", "API", name)
+	}
+	<-time.After(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&numNotifications); n != 1 {
+		t.Error(fmt.Errorf("Expected 1 notification, got %d", n))
+		return
+	}
+
+	// Deleted silences stop muting checks
+	if err := DeleteSilence(upstream, silence.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := DeleteSilence(upstream, silence.ID); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Error(fmt.Errorf("Expected deleted silence to be missing, got: %v", err))
+		return
+	}
+	if _, ok := p.silenced("API", "eu-west"); ok {
+		t.Error(fmt.Errorf("Expected API/eu-west to no longer be silenced"))
+		return
+	}
+	list, err = ListSilences(upstream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(list) != 1 || list[0].ID != scheduled.ID {
+		t.Error(fmt.Errorf("Expected only the scheduled silence to be listed, got: %#v", list))
+		return
+	}
+}
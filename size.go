@@ -0,0 +1,71 @@
+package patrol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// size is a number of bytes, written with an optional unit (i.e. '512MB').
+// Units are powers of 1024.
+type size int64
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+func (s *size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	parsed, err := parseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = size(parsed)
+	return nil
+}
+
+// MarshalYAML writes the size with the largest unit that it is a multiple
+// of.
+func (s size) MarshalYAML() (interface{}, error) {
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if s > 0 && int64(s)%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/unit.bytes, unit.suffix), nil
+		}
+	}
+	return fmt.Sprintf("%dB", int64(s)), nil
+}
+
+func parseSize(str string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(str))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: '%s'", str)
+	}
+	return int64(n * float64(multiplier)), nil
+}
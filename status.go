@@ -0,0 +1,215 @@
+package patrol
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/karimsa/patrol/internal/checker"
+	"github.com/karimsa/patrol/internal/history"
+)
+
+const (
+	statusOperational   = "operational"
+	statusPartialOutage = "partial_outage"
+	statusMajorOutage   = "major_outage"
+)
+
+var statusRanks = map[string]int{
+	statusOperational:   0,
+	statusPartialOutage: 1,
+	statusMajorOutage:   2,
+}
+
+// overallStatus summarizes the health of every service, and of all
+// services together, based on the severity of their failing checks.
+type overallStatus struct {
+	Status        string
+	Groups        map[string]string
+	NumChecks     int
+	NumChecksDown int
+	UpdatedAt     time.Time
+
+	// Number of checks that have not reported a result yet, and of checks
+	// whose latest result is stale, which are not included in NumChecks
+	NumChecksPending int
+	NumChecksStale   int
+}
+
+// outageStatus returns the status of a service that has a failing check
+// of the given severity.
+func outageStatus(severity checker.Severity) string {
+	switch severity {
+	case checker.SeverityCritical:
+		return statusMajorOutage
+	case checker.SeverityInfo:
+		return statusOperational
+	default:
+		return statusPartialOutage
+	}
+}
+
+// Rules for computing the status of a service from its checks
+const (
+	groupRuleAll      = "all"
+	groupRuleAny      = "any"
+	groupRuleQuorum   = "quorum"
+	groupRuleWeighted = "weighted"
+)
+
+// GroupStatusRule decides whether a service is down, based on which of its
+// checks are failing. The zero value is the 'all' rule, so a service is
+// down as soon as any of its checks fails.
+type GroupStatusRule struct {
+	// One of 'all', 'any' (down once every check fails), 'quorum' (down
+	// once fewer than Quorum of the checks pass) or 'weighted' (down once
+	// the weights of the failing checks add up to Threshold)
+	Rule string
+
+	// Fraction of checks that must pass, for the 'quorum' rule
+	Quorum float64
+
+	// Total weight of failing checks at which the service is down, for
+	// the 'weighted' rule
+	Threshold float64
+
+	// Weights of checks by name, which default to 1. Checks with a weight
+	// of 0 are optional, and never cause the service to be down.
+	Weights map[string]float64
+}
+
+func (rule GroupStatusRule) weight(name string) float64 {
+	if weight, ok := rule.Weights[name]; ok {
+		return weight
+	}
+	return 1
+}
+
+// isDown returns whether a service is down, given whether each of its
+// checks (by name) is failing. Checks that have not run yet should not be
+// included.
+func (rule GroupStatusRule) isDown(failing map[string]bool) bool {
+	var total, down float64
+	for name, isFailing := range failing {
+		weight := rule.weight(name)
+		total += weight
+		if isFailing {
+			down += weight
+		}
+	}
+	if down == 0 {
+		return false
+	}
+
+	switch rule.Rule {
+	case groupRuleAny:
+		return down == total
+	case groupRuleQuorum:
+		// Allows for rounding errors, so that 2 of 3 checks meet a quorum
+		// of 2/3
+		return total-down < rule.Quorum*total-1e-9
+	case groupRuleWeighted:
+		return down >= rule.Threshold
+	default:
+		return true
+	}
+}
+
+func (p *Patrol) groupIsDown(group string, failing map[string]bool) bool {
+	return p.groupStatusRules[group].isDown(failing)
+}
+
+// isStale returns whether the latest result of a check is too old to be
+// trusted, since the check should have run again several times since.
+// Checks that are paused or currently running are never stale.
+func (p *Patrol) isStale(item history.Item) bool {
+	if p.staleAfter <= 0 {
+		return false
+	}
+	c := p.getChecker(item.Group, item.Name)
+	if c == nil || c.Interval <= 0 || c.IsPaused() || c.GetState().Running {
+		return false
+	}
+	return time.Since(item.SeenAt()) > time.Duration(p.staleAfter)*c.Interval
+}
+
+func (p *Patrol) checkSeverity(group, name string) checker.Severity {
+	if c := p.getChecker(group, name); c != nil {
+		return c.Severity
+	}
+	return checker.SeverityMajor
+}
+
+// isDependency returns whether a check reads the status page of a
+// third-party provider.
+func (p *Patrol) isDependency(group, name string) bool {
+	c := p.getChecker(group, name)
+	return c != nil && c.StatusPage != nil
+}
+
+// getOverallStatus rolls the latest item of each check up into the status
+// of each service, and then into the status of all services. A service that
+// is down according to its status rule has the status of its most severe
+// failing check, and is operational otherwise. Private checks are only
+// included if asked for, and statuspage checks never are.
+func (p *Patrol) getOverallStatus(latest map[string]map[string]history.Item, includePrivate bool) overallStatus {
+	status := overallStatus{
+		Status: statusOperational,
+		Groups: make(map[string]string, len(latest)),
+	}
+	for _, c := range p.checkers {
+		if _, ok := latest[c.Group][c.Name]; !ok && (includePrivate || !c.Private) && c.StatusPage == nil {
+			status.NumChecksPending++
+		}
+	}
+	for groupName, group := range latest {
+		groupStatus := statusOperational
+		failing := make(map[string]bool, len(group))
+		for checkName, item := range group {
+			if !includePrivate && p.isPrivate(groupName, checkName) {
+				continue
+			}
+			// Outages of providers are shown next to the checks that
+			// depend on them, but are not outages of the services
+			if p.isDependency(groupName, checkName) {
+				continue
+			}
+			if p.isStale(item) {
+				status.NumChecksStale++
+				continue
+			}
+			status.NumChecks++
+			if status.UpdatedAt.Before(item.CreatedAt) {
+				status.UpdatedAt = item.CreatedAt
+			}
+			failing[checkName] = item.Status == "unhealthy"
+			if !failing[checkName] {
+				continue
+			}
+
+			status.NumChecksDown++
+			if p.groupStatusRules[groupName].weight(checkName) == 0 {
+				continue
+			}
+			if s := outageStatus(p.checkSeverity(groupName, checkName)); statusRanks[s] > statusRanks[groupStatus] {
+				groupStatus = s
+			}
+		}
+		if len(failing) == 0 {
+			continue
+		}
+		if !p.groupIsDown(groupName, failing) {
+			groupStatus = statusOperational
+		}
+
+		status.Groups[groupName] = groupStatus
+		if statusRanks[groupStatus] > statusRanks[status.Status] {
+			status.Status = groupStatus
+		}
+	}
+	return status
+}
+
+// serveStatus returns the overall status of all services.
+func (p *Patrol) serveStatus(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, p.getOverallStatus(p.History.GetLatestItems(), p.showPrivate(req)))
+}
@@ -0,0 +1,108 @@
+package patrol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// First file descriptor that systemd passes to socket activated services
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets that systemd passed to patrol, if it
+// was started by a socket unit. The variables that describe the sockets are
+// removed from the environment, so that check commands do not see them.
+func systemdListeners() ([]net.Listener, error) {
+	return activatedListeners(sdListenFDsStart)
+}
+
+func activatedListeners(firstFD int) ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	numFDs, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFDs < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS from systemd: '%s'", os.Getenv("LISTEN_FDS"))
+	}
+
+	listeners := make([]net.Listener, 0, numFDs)
+	for fd := firstFD; fd < firstFD+numFDs; fd++ {
+		// The listener uses a duplicate of the descriptor, which is not
+		// inherited by check commands
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Socket %d passed by systemd is not a listening socket: %s", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change (i.e. 'READY=1') to systemd, if patrol was
+// started by a service with 'Type=notify' or a watchdog. It does nothing
+// otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often systemd expects to be notified that
+// patrol is alive, or zero if the service has no watchdog.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog notifies systemd's watchdog at half of its timeout, until the
+// server is shut down. Notifications are skipped while the history file is
+// stuck, so that systemd restarts patrol.
+func (p *Patrol) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !p.History.IsResponsive(interval / 4) {
+				p.logger.Warnf("History file is not responding, skipping watchdog notification")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				p.logger.Warnf("Failed to notify systemd watchdog: %s", err)
+			}
+		case <-p.shutdown:
+			return
+		}
+	}
+}
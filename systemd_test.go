@@ -0,0 +1,115 @@
+package patrol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrol-systemd")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Error(fmt.Errorf("Expected READY=1, got: %s", buf[:n]))
+		return
+	}
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if interval := sdWatchdogInterval(); interval != 30*time.Second {
+		t.Error(fmt.Errorf("Expected watchdog interval of 30s, got: %s", interval))
+		return
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Error(fmt.Errorf("Expected watchdog of another process to be ignored, got: %s", interval))
+		return
+	}
+}
+
+func TestActivatedListeners(t *testing.T) {
+	// Not started by systemd
+	if listeners, err := activatedListeners(sdListenFDsStart); err != nil || len(listeners) != 0 {
+		t.Error(fmt.Errorf("Expected no listeners, got: %v (%v)", listeners, err))
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file, err := listener.(*net.TCPListener).File()
+	listener.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := activatedListeners(int(file.Fd()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(listeners) != 1 {
+		t.Error(fmt.Errorf("Expected a single listener, got: %v", listeners))
+		return
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Error(fmt.Errorf("Expected socket activation variables to be removed from the environment"))
+		return
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("activated"))
+	})}
+	go server.Serve(listeners[0])
+	defer server.Close()
+
+	res, err := http.Get("http://" + listeners[0].Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "activated" {
+		t.Error(fmt.Errorf("Unexpected response from activated socket: %s", body))
+		return
+	}
+}
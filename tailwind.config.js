@@ -3,6 +3,6 @@ module.exports = {
     mode: 'layers',
     enabled: process.env.NODE_ENV === 'production',
     preserveHtmlElements: false,
-    content: ['./index.html'],
+    content: ['./index.html', './markdown.go'],
   },
 }